@@ -1,6 +1,16 @@
 package cache
 
-import "time"
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by Get if there is no value under the key
+var ErrNotFound = errors.New("cache: key not found")
 
 // Cache is the basic interface for cache implementations
 type Cache interface {
@@ -10,4 +20,67 @@ type Cache interface {
 	DeleteMask(mask string) error
 	DeleteMulti(keys ...interface{}) error
 	Exists(key string) (bool, error)
+
+	// Increment atomically adds delta to the counter stored under the key and
+	// returns its new value. expires applies only when the counter is created.
+	// Counters can be read only using Increment.
+	Increment(key string, delta int64, expires time.Duration) (int64, error)
+}
+
+// encode serializes a value in the format shared by all implementations
+func encode(value interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(value); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// decode deserializes data created by encode into the pointer
+func decode(data []byte, pointer interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(pointer)
+}
+
+// compileMask converts a redis glob-style pattern, eg. "tokens:*", into a regexp
+func compileMask(mask string) (*regexp.Regexp, error) {
+	var pattern bytes.Buffer
+	pattern.WriteString("^")
+
+	for i := 0; i < len(mask); i++ {
+		switch c := mask[i]; c {
+		case '*':
+			pattern.WriteString(".*")
+		case '?':
+			pattern.WriteString(".")
+		case '[':
+			end := strings.IndexByte(mask[i:], ']')
+			if end == -1 {
+				pattern.WriteString(`\[`)
+				continue
+			}
+
+			class := mask[i+1 : i+end]
+			if strings.HasPrefix(class, "^") {
+				class = "^" + regexp.QuoteMeta(class[1:])
+			} else {
+				class = regexp.QuoteMeta(class)
+			}
+			// Ranges like a-z have to stay intact
+			class = strings.Replace(class, `\-`, "-", -1)
+
+			pattern.WriteString("[" + class + "]")
+			i += end
+		case '\\':
+			if i+1 < len(mask) {
+				i++
+			}
+			pattern.WriteString(regexp.QuoteMeta(string(mask[i])))
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	pattern.WriteString("$")
+	return regexp.Compile(pattern.String())
 }
@@ -0,0 +1,250 @@
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MemoryCache is an in-process implementation of Cache. It keeps at most
+// MaxEntries values and evicts the least recently used ones first.
+type MemoryCache struct {
+	sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	max     int
+}
+
+// MemoryCacheOpts is used to pass options to NewMemoryCache
+type MemoryCacheOpts struct {
+	MaxEntries int
+}
+
+type memoryEntry struct {
+	key     string
+	data    []byte
+	expires time.Time
+}
+
+// expired checks whether the entry's TTL has passed
+func (m *memoryEntry) expired(now time.Time) bool {
+	return !m.expires.IsZero() && now.After(m.expires)
+}
+
+// NewMemoryCache creates a new, empty in-memory cache
+func NewMemoryCache(options *MemoryCacheOpts) *MemoryCache {
+	// Default values
+	if options.MaxEntries == 0 {
+		options.MaxEntries = 10000
+	}
+
+	return &MemoryCache{
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+		max:     options.MaxEntries,
+	}
+}
+
+// Get decodes the value stored under the key into the passed pointer
+func (m *MemoryCache) Get(key string, pointer interface{}) error {
+	data, err := m.getBytes(key)
+	if err != nil {
+		return err
+	}
+
+	return decode(data, pointer)
+}
+
+func (m *MemoryCache) getBytes(key string) ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	element, ok := m.entries[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	entry := element.Value.(*memoryEntry)
+	if entry.expired(time.Now()) {
+		m.remove(element)
+		return nil, ErrNotFound
+	}
+
+	m.order.MoveToFront(element)
+	return entry.data, nil
+}
+
+// Set encodes the value and stores it. Zero expires means that it's kept
+// until it's evicted.
+func (m *MemoryCache) Set(key string, value interface{}, expires time.Duration) error {
+	data, err := encode(value)
+	if err != nil {
+		return err
+	}
+
+	m.setBytes(key, data, expires)
+	return nil
+}
+
+func (m *MemoryCache) setBytes(key string, data []byte, expires time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.set(key, data, expires)
+}
+
+// set has to be called with the lock held
+func (m *MemoryCache) set(key string, data []byte, expires time.Duration) {
+	entry := &memoryEntry{
+		key:  key,
+		data: data,
+	}
+	if expires != 0 {
+		entry.expires = time.Now().Add(expires)
+	}
+
+	if element, ok := m.entries[key]; ok {
+		element.Value = entry
+		m.order.MoveToFront(element)
+		return
+	}
+
+	m.entries[key] = m.order.PushFront(entry)
+
+	// Evict the least recently used entries
+	for m.order.Len() > m.max {
+		m.remove(m.order.Back())
+	}
+}
+
+// Delete removes the value stored under the key
+func (m *MemoryCache) Delete(key string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if element, ok := m.entries[key]; ok {
+		m.remove(element)
+	}
+
+	return nil
+}
+
+// DeleteMask removes all keys matching a redis glob-style pattern
+func (m *MemoryCache) DeleteMask(mask string) error {
+	re, err := compileMask(mask)
+	if err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	for key, element := range m.entries {
+		if re.MatchString(key) {
+			m.remove(element)
+		}
+	}
+
+	return nil
+}
+
+// DeleteMulti removes multiple keys
+func (m *MemoryCache) DeleteMulti(keys ...interface{}) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, key := range keys {
+		if element, ok := m.entries[fmt.Sprint(key)]; ok {
+			m.remove(element)
+		}
+	}
+
+	return nil
+}
+
+// Exists performs a check whether a key exists
+func (m *MemoryCache) Exists(key string) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	element, ok := m.entries[key]
+	if !ok {
+		return false, nil
+	}
+
+	if element.Value.(*memoryEntry).expired(time.Now()) {
+		m.remove(element)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// Increment adds delta to the counter stored under the key while holding the
+// lock, so concurrent increments aren't lost
+func (m *MemoryCache) Increment(key string, delta int64, expires time.Duration) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	value := delta
+	if element, ok := m.entries[key]; ok {
+		entry := element.Value.(*memoryEntry)
+		if entry.expired(time.Now()) {
+			m.remove(element)
+		} else {
+			var current int64
+			if err := decode(entry.data, &current); err != nil {
+				return 0, err
+			}
+			value += current
+
+			data, err := encode(value)
+			if err != nil {
+				return 0, err
+			}
+
+			// The expiration is kept
+			element.Value = &memoryEntry{
+				key:     key,
+				data:    data,
+				expires: entry.expires,
+			}
+			m.order.MoveToFront(element)
+
+			return value, nil
+		}
+	}
+
+	data, err := encode(value)
+	if err != nil {
+		return 0, err
+	}
+
+	m.set(key, data, expires)
+	return value, nil
+}
+
+// Clear removes all entries
+func (m *MemoryCache) Clear() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.entries = map[string]*list.Element{}
+	m.order.Init()
+}
+
+// Len returns the count of stored entries, including expired ones that
+// weren't accessed yet
+func (m *MemoryCache) Len() int {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.order.Len()
+}
+
+// remove has to be called with the lock held
+func (m *MemoryCache) remove(element *list.Element) {
+	m.order.Remove(element)
+	delete(m.entries, element.Value.(*memoryEntry).key)
+}
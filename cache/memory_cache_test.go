@@ -0,0 +1,235 @@
+package cache_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lavab/api/cache"
+)
+
+func TestMemoryCacheGetSet(t *testing.T) {
+	c := cache.NewMemoryCache(&cache.MemoryCacheOpts{})
+
+	var value string
+	if err := c.Get("missing", &value); err != cache.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	if err := c.Set("key", "value", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Get("key", &value); err != nil {
+		t.Fatal(err)
+	}
+	if value != "value" {
+		t.Fatalf("invalid value %q", value)
+	}
+
+	// Overwriting doesn't create another entry
+	if err := c.Set("key", "other", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get("key", &value); err != nil || value != "other" {
+		t.Fatalf("invalid value %q: %v", value, err)
+	}
+	if c.Len() != 1 {
+		t.Fatalf("invalid length %d", c.Len())
+	}
+}
+
+func TestMemoryCacheExpiry(t *testing.T) {
+	c := cache.NewMemoryCache(&cache.MemoryCacheOpts{})
+
+	if err := c.Set("short", 1, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set("long", 2, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set("forever", 3, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if exists, _ := c.Exists("short"); !exists {
+		t.Fatal("value expired too early")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	var value int
+	if err := c.Get("short", &value); err != cache.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if exists, _ := c.Exists("short"); exists {
+		t.Fatal("expired value exists")
+	}
+
+	for _, key := range []string{"long", "forever"} {
+		if err := c.Get(key, &value); err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+	}
+
+	// Expired entries are removed once they're accessed
+	if c.Len() != 2 {
+		t.Fatalf("invalid length %d", c.Len())
+	}
+}
+
+func TestMemoryCacheEviction(t *testing.T) {
+	c := cache.NewMemoryCache(&cache.MemoryCacheOpts{
+		MaxEntries: 2,
+	})
+
+	c.Set("a", 1, 0)
+	c.Set("b", 2, 0)
+
+	// Reading a makes b the least recently used entry
+	var value int
+	if err := c.Get("a", &value); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Set("c", 3, 0)
+
+	if c.Len() != 2 {
+		t.Fatalf("invalid length %d", c.Len())
+	}
+	if err := c.Get("b", &value); err != cache.ErrNotFound {
+		t.Fatalf("expected b to be evicted, got %v", err)
+	}
+	for _, key := range []string{"a", "c"} {
+		if exists, _ := c.Exists(key); !exists {
+			t.Fatalf("%s was evicted", key)
+		}
+	}
+
+	// Overwriting counts as a use too
+	c.Set("a", 4, 0)
+	c.Set("d", 5, 0)
+
+	if exists, _ := c.Exists("c"); exists {
+		t.Fatal("expected c to be evicted")
+	}
+	if err := c.Get("a", &value); err != nil || value != 4 {
+		t.Fatalf("invalid value %d: %v", value, err)
+	}
+}
+
+func TestMemoryCacheDelete(t *testing.T) {
+	c := cache.NewMemoryCache(&cache.MemoryCacheOpts{})
+
+	keys := []string{
+		"labels:1",
+		"labels:owner:a",
+		"labels:counts:a",
+		"labels:counts:b",
+		"tokens:1",
+		"tokens:2",
+		"tokens:10",
+	}
+	for _, key := range keys {
+		c.Set(key, true, 0)
+	}
+
+	cases := []struct {
+		mask    string
+		deleted []string
+	}{
+		{"labels:counts:*", []string{"labels:counts:a", "labels:counts:b"}},
+		{"tokens:?", []string{"tokens:1", "tokens:2"}},
+		{"labels:[0-9]", []string{"labels:1"}},
+		{"*", []string{"labels:owner:a", "tokens:10"}},
+	}
+
+	for _, test := range cases {
+		before := c.Len()
+
+		if err := c.DeleteMask(test.mask); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, key := range test.deleted {
+			if exists, _ := c.Exists(key); exists {
+				t.Fatalf("%s: %s wasn't deleted", test.mask, key)
+			}
+		}
+		if c.Len() != before-len(test.deleted) {
+			t.Fatalf("%s: deleted %d keys, expected %d", test.mask, before-c.Len(), len(test.deleted))
+		}
+	}
+
+	c.Set("a", 1, 0)
+	c.Set("b", 2, 0)
+	c.Set("c", 3, 0)
+
+	if err := c.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteMulti("b", "missing"); err != nil {
+		t.Fatal(err)
+	}
+	if c.Len() != 1 {
+		t.Fatalf("invalid length %d", c.Len())
+	}
+}
+
+// testIncrement checks that concurrent increments aren't lost and that the
+// expiration is set only when a counter is created
+func testIncrement(t *testing.T, c cache.Cache, prefix string) {
+	var (
+		count = 50
+		wg    sync.WaitGroup
+		lock  sync.Mutex
+		seen  = map[int64]bool{}
+	)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			value, err := c.Increment(prefix+"counter", 1, time.Hour)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			lock.Lock()
+			seen[value] = true
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if len(seen) != count || !seen[1] || !seen[int64(count)] {
+		t.Fatalf("concurrent increments returned %v", seen)
+	}
+
+	if value, err := c.Increment(prefix+"counter", -10, time.Hour); err != nil || value != int64(count-10) {
+		t.Fatalf("invalid value %d after a decrement: %v", value, err)
+	}
+
+	// Later increments don't extend the expiration
+	if value, err := c.Increment(prefix+"short", 1, 100*time.Millisecond); err != nil || value != 1 {
+		t.Fatalf("invalid value %d: %v", value, err)
+	}
+	if value, err := c.Increment(prefix+"short", 1, time.Hour); err != nil || value != 2 {
+		t.Fatalf("invalid value %d: %v", value, err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	if value, err := c.Increment(prefix+"short", 1, time.Hour); err != nil || value != 1 {
+		t.Fatalf("counter wasn't reset after expiring: %d (%v)", value, err)
+	}
+
+	if err := c.DeleteMulti(prefix+"counter", prefix+"short"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryCacheIncrement(t *testing.T) {
+	testIncrement(t, cache.NewMemoryCache(&cache.MemoryCacheOpts{}), "")
+}
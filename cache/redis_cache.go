@@ -1,21 +1,23 @@
 package cache
 
 import (
-	"bytes"
-	"encoding/gob"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
 
-// Scripts!
-var (
-	scriptDeleteMask = redis.NewScript(0, `
-		for _, k in ipairs( redis.call( 'keys', ARGV[1] ) ) do
-			redis.call( 'del', k )
-		end
-	`)
-)
+// scanCount is the COUNT hint passed to SCAN by DeleteMask
+const scanCount = 1000
+
+// incrementScript sets the expiration of counters created by INCRBY in the same
+// step, so that a counter can't be left without one
+var incrementScript = redis.NewScript(1, `
+local value = redis.call("INCRBY", KEYS[1], ARGV[1])
+if tonumber(ARGV[2]) > 0 and redis.call("PTTL", KEYS[1]) == -1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return value
+`)
 
 // RedisCache is an implementation of Cache that uses Redis as a backend
 type RedisCache struct {
@@ -88,43 +90,54 @@ func NewRedisCache(options *RedisCacheOpts) (*RedisCache, error) {
 
 // Get retrieves data from the database and then decodes it into the passed pointer.
 func (r *RedisCache) Get(key string, pointer interface{}) error {
+	data, err := r.getBytes(key)
+	if err != nil {
+		return err
+	}
+
+	return decode(data, pointer)
+}
+
+func (r *RedisCache) getBytes(key string) ([]byte, error) {
 	conn := r.pool.Get()
 	defer conn.Close()
 
 	// Perform the get
 	data, err := redis.Bytes(conn.Do("GET", key))
-	if err != nil {
-		return err
+	if err == redis.ErrNil {
+		return nil, ErrNotFound
 	}
 
-	// Initialize a new decoder
-	dec := gob.NewDecoder(bytes.NewReader(data))
-
-	// Decode it into pointer
-	return dec.Decode(pointer)
+	return data, err
 }
 
 // Set encodes passed value and sends it to redis
 func (r *RedisCache) Set(key string, value interface{}, expires time.Duration) error {
-	conn := r.pool.Get()
-	defer conn.Close()
-
-	// Initialize a new encoder
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-
-	// Encode the value
-	if err := enc.Encode(value); err != nil {
+	data, err := encode(value)
+	if err != nil {
 		return err
 	}
 
+	return r.setBytes(key, data, expires)
+}
+
+func (r *RedisCache) setBytes(key string, data []byte, expires time.Duration) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
 	// Save it into redis
 	if expires == 0 {
-		_, err := conn.Do("SET", key, buffer.Bytes())
+		_, err := conn.Do("SET", key, data)
 		return err
 	}
 
-	_, err := conn.Do("SETEX", key, expires.Seconds(), buffer.Bytes())
+	// SETEX accepts only whole seconds
+	seconds := int(expires.Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	_, err := conn.Do("SETEX", key, seconds, data)
 	return err
 }
 
@@ -136,12 +149,39 @@ func (r *RedisCache) Delete(key string) error {
 	return err
 }
 
-// DeleteMask removes data using KEYS masks
+// DeleteMask removes keys matching the mask. It iterates over the keyspace
+// using SCAN, so unlike KEYS it doesn't block the server.
 func (r *RedisCache) DeleteMask(mask string) error {
 	conn := r.pool.Get()
 	defer conn.Close()
-	_, err := scriptDeleteMask.Do(conn, mask)
-	return err
+
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", mask, "COUNT", scanCount))
+		if err != nil {
+			return err
+		}
+
+		if cursor, err = redis.Int(values[0], nil); err != nil {
+			return err
+		}
+
+		keys, err := redis.Values(values[1], nil)
+		if err != nil {
+			return err
+		}
+
+		if len(keys) > 0 {
+			if _, err := conn.Do("DEL", keys...); err != nil {
+				return err
+			}
+		}
+
+		// SCAN is done once it returns a zero cursor
+		if cursor == 0 {
+			return nil
+		}
+	}
 }
 
 // DeleteMulti removes multiple keys
@@ -158,3 +198,47 @@ func (r *RedisCache) Exists(key string) (bool, error) {
 	defer conn.Close()
 	return redis.Bool(conn.Do("EXISTS", key))
 }
+
+// Increment atomically adds delta to the counter using INCRBY
+func (r *RedisCache) Increment(key string, delta int64, expires time.Duration) (int64, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	// PEXPIRE accepts only whole milliseconds
+	milliseconds := int64(expires / time.Millisecond)
+	if expires > 0 && milliseconds < 1 {
+		milliseconds = 1
+	}
+
+	return redis.Int64(incrementScript.Do(conn, key, delta, milliseconds))
+}
+
+// publish sends a message to a pub/sub channel
+func (r *RedisCache) publish(channel string, message []byte) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PUBLISH", channel, message)
+	return err
+}
+
+// subscribe passes messages sent to the channel to handler until the
+// connection fails or is closed. ready is called once subscribed.
+func (r *RedisCache) subscribe(conn redis.Conn, channel string, ready func(), handler func(message []byte)) error {
+	psc := redis.PubSubConn{Conn: conn}
+	if err := psc.Subscribe(channel); err != nil {
+		return err
+	}
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Subscription:
+			if v.Kind == "subscribe" && ready != nil {
+				ready()
+			}
+		case redis.Message:
+			handler(v.Data)
+		case error:
+			return v
+		}
+	}
+}
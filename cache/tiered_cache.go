@@ -0,0 +1,256 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/garyburd/redigo/redis"
+)
+
+// TieredCache is an implementation of Cache that keeps hot values in memory
+// in front of Redis. Writes on one node evict the key from the memory tiers of
+// other nodes using Redis pub/sub.
+type TieredCache struct {
+	local   *MemoryCache
+	remote  *RedisCache
+	ttl     time.Duration
+	node    string
+	channel string
+
+	lock   sync.Mutex
+	conn   redis.Conn
+	closed bool
+
+	// OnError is called when the invalidation listener loses its connection,
+	// if it's set
+	OnError func(err error)
+}
+
+// TieredCacheOpts is used to pass options to NewTieredCache
+type TieredCacheOpts struct {
+	// MaxEntries is the size of the memory tier
+	MaxEntries int
+
+	// LocalTTL caps the time a value is kept in memory, it's also the maximal
+	// staleness of values that expired in Redis
+	LocalTTL time.Duration
+
+	// Channel is the name of the invalidation channel, "cache:invalidate" by default
+	Channel string
+}
+
+// tieredInvalidation is the format of messages sent on the invalidation channel
+type tieredInvalidation struct {
+	Node string   `json:"node"`
+	Keys []string `json:"keys,omitempty"`
+	Mask string   `json:"mask,omitempty"`
+}
+
+// NewTieredCache creates a new cache with a memory tier in front of remote
+// and starts listening for invalidations
+func NewTieredCache(remote *RedisCache, options *TieredCacheOpts) *TieredCache {
+	// Default values
+	if options.LocalTTL == 0 {
+		options.LocalTTL = time.Minute
+	}
+	if options.Channel == "" {
+		options.Channel = "cache:invalidate"
+	}
+
+	t := &TieredCache{
+		local: NewMemoryCache(&MemoryCacheOpts{
+			MaxEntries: options.MaxEntries,
+		}),
+		remote:  remote,
+		ttl:     options.LocalTTL,
+		node:    uniuri.New(),
+		channel: options.Channel,
+	}
+
+	go t.listen()
+
+	return t
+}
+
+// Get tries the memory tier and then Redis
+func (t *TieredCache) Get(key string, pointer interface{}) error {
+	data, err := t.local.getBytes(key)
+	if err == nil {
+		return decode(data, pointer)
+	}
+
+	data, err = t.remote.getBytes(key)
+	if err != nil {
+		return err
+	}
+
+	t.local.setBytes(key, data, t.ttl)
+
+	return decode(data, pointer)
+}
+
+// Set stores the value in both tiers and evicts it from other nodes
+func (t *TieredCache) Set(key string, value interface{}, expires time.Duration) error {
+	data, err := encode(value)
+	if err != nil {
+		return err
+	}
+
+	if err := t.remote.setBytes(key, data, expires); err != nil {
+		return err
+	}
+
+	local := t.ttl
+	if expires != 0 && expires < local {
+		local = expires
+	}
+	t.local.setBytes(key, data, local)
+
+	return t.invalidate(&tieredInvalidation{
+		Keys: []string{key},
+	})
+}
+
+// Delete removes the key from both tiers on all nodes
+func (t *TieredCache) Delete(key string) error {
+	if err := t.remote.Delete(key); err != nil {
+		return err
+	}
+
+	t.local.Delete(key)
+
+	return t.invalidate(&tieredInvalidation{
+		Keys: []string{key},
+	})
+}
+
+// DeleteMask removes keys matching the mask from both tiers on all nodes
+func (t *TieredCache) DeleteMask(mask string) error {
+	if err := t.remote.DeleteMask(mask); err != nil {
+		return err
+	}
+
+	if err := t.local.DeleteMask(mask); err != nil {
+		return err
+	}
+
+	return t.invalidate(&tieredInvalidation{
+		Mask: mask,
+	})
+}
+
+// DeleteMulti removes multiple keys from both tiers on all nodes
+func (t *TieredCache) DeleteMulti(keys ...interface{}) error {
+	if err := t.remote.DeleteMulti(keys...); err != nil {
+		return err
+	}
+
+	t.local.DeleteMulti(keys...)
+
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		names[i] = fmt.Sprint(key)
+	}
+
+	return t.invalidate(&tieredInvalidation{
+		Keys: names,
+	})
+}
+
+// Exists performs a check whether a key exists in any of the tiers
+func (t *TieredCache) Exists(key string) (bool, error) {
+	if exists, _ := t.local.Exists(key); exists {
+		return true, nil
+	}
+
+	return t.remote.Exists(key)
+}
+
+// Increment passes the counter to Redis. Counters aren't kept in the memory
+// tier, as all nodes have to see the same value.
+func (t *TieredCache) Increment(key string, delta int64, expires time.Duration) (int64, error) {
+	return t.remote.Increment(key, delta, expires)
+}
+
+// Close stops listening for invalidations. The cache remains usable, but the
+// memory tier might serve values modified by other nodes until LocalTTL passes.
+func (t *TieredCache) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.closed = true
+	if t.conn != nil {
+		t.conn.Close()
+	}
+}
+
+// invalidate notifies other nodes about a write
+func (t *TieredCache) invalidate(message *tieredInvalidation) error {
+	message.Node = t.node
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	return t.remote.publish(t.channel, data)
+}
+
+// listen applies invalidations sent by other nodes, reconnecting on failures
+func (t *TieredCache) listen() {
+	for {
+		// The connection isn't pooled, as closing a pooled pub/sub connection
+		// waits for replies consumed by the listener
+		conn, err := t.remote.pool.Dial()
+		if err != nil {
+			if t.OnError != nil {
+				t.OnError(err)
+			}
+
+			time.Sleep(time.Second)
+			continue
+		}
+
+		t.lock.Lock()
+		if t.closed {
+			t.lock.Unlock()
+			conn.Close()
+			return
+		}
+		t.conn = conn
+		t.lock.Unlock()
+
+		// Invalidations might have been missed while the listener was
+		// disconnected, so the memory tier is emptied on every subscription
+		err = t.remote.subscribe(conn, t.channel, t.local.Clear, t.handle)
+		conn.Close()
+
+		t.lock.Lock()
+		closed := t.closed
+		t.lock.Unlock()
+
+		if err != nil && !closed && t.OnError != nil {
+			t.OnError(err)
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+func (t *TieredCache) handle(data []byte) {
+	var message tieredInvalidation
+	if err := json.Unmarshal(data, &message); err != nil || message.Node == t.node {
+		return
+	}
+
+	for _, key := range message.Keys {
+		t.local.Delete(key)
+	}
+
+	if message.Mask != "" {
+		t.local.DeleteMask(message.Mask)
+	}
+}
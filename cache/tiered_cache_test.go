@@ -0,0 +1,125 @@
+package cache_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dchest/uniuri"
+
+	"github.com/lavab/api/cache"
+)
+
+// newTiered creates a tiered cache of a separate API instance
+func newTiered(t *testing.T, channel string) *cache.TieredCache {
+	address := os.Getenv("REDIS_ADDRESS")
+	if address == "" {
+		address = "127.0.0.1:6379"
+	}
+
+	remote, err := cache.NewRedisCache(&cache.RedisCacheOpts{
+		Address: address,
+	})
+	if err != nil {
+		t.Skipf("redis is not available at %s: %v", address, err)
+	}
+
+	return cache.NewTieredCache(remote, &cache.TieredCacheOpts{
+		LocalTTL: time.Hour,
+		Channel:  channel,
+	})
+}
+
+// eventually retries check until it succeeds or the invalidation times out
+func eventually(t *testing.T, message string, check func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTieredCacheInvalidation(t *testing.T) {
+	var (
+		channel = "cache_test:" + uniuri.New()
+		prefix  = "cache_test:" + uniuri.New() + ":"
+		first   = newTiered(t, channel)
+		second  = newTiered(t, channel)
+	)
+	defer first.Close()
+	defer second.Close()
+
+	// Wait for both listeners to subscribe
+	time.Sleep(500 * time.Millisecond)
+
+	get := func(c *cache.TieredCache, key string) string {
+		var value string
+		if err := c.Get(key, &value); err != nil {
+			return ""
+		}
+
+		return value
+	}
+
+	// Both nodes keep the value in their memory tiers
+	key := prefix + "key"
+	if err := first.Set(key, "old", 0); err != nil {
+		t.Fatal(err)
+	}
+	if value := get(second, key); value != "old" {
+		t.Fatalf("invalid value %q", value)
+	}
+
+	// A write on one node evicts the value from the other one
+	if err := first.Set(key, "new", 0); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "Set wasn't propagated", func() bool {
+		return get(second, key) == "new"
+	})
+
+	if err := second.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "Delete wasn't propagated", func() bool {
+		return get(first, key) == ""
+	})
+
+	// Masks and multiple keys are invalidated too
+	keys := []string{prefix + "labels:a", prefix + "labels:b", prefix + "tokens:a"}
+	for _, key := range keys {
+		if err := first.Set(key, "value", 0); err != nil {
+			t.Fatal(err)
+		}
+		if value := get(second, key); value != "value" {
+			t.Fatalf("invalid value %q", value)
+		}
+	}
+
+	if err := first.DeleteMask(prefix + "labels:*"); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "DeleteMask wasn't propagated", func() bool {
+		return get(second, keys[0]) == "" && get(second, keys[1]) == ""
+	})
+	if value := get(second, keys[2]); value != "value" {
+		t.Fatal("DeleteMask removed a key not matching the mask")
+	}
+
+	if err := first.DeleteMulti(keys[2]); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "DeleteMulti wasn't propagated", func() bool {
+		return get(second, keys[2]) == ""
+	})
+}
+
+func TestTieredCacheIncrement(t *testing.T) {
+	c := newTiered(t, "cache_test:"+uniuri.New())
+	defer c.Close()
+
+	testIncrement(t, c, "cache_test:"+uniuri.New()+":")
+}
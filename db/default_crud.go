@@ -50,6 +50,22 @@ func (d *Default) Insert(data interface{}) error {
 	return nil
 }
 
+// insertUnique inserts a document into the table unless its ID is taken. It
+// returns false if the document already exists.
+func insertUnique(t RethinkTable, data interface{}) (bool, error) {
+	result, err := t.GetTable().Insert(data).RunWrite(t.GetSession())
+	if err != nil {
+		// A document can only be rejected by the insert if its ID is taken
+		if result.Errors > 0 {
+			return false, nil
+		}
+
+		return false, NewDatabaseError(t, err, "")
+	}
+
+	return true, nil
+}
+
 // Update performs an update on an existing resource according to passed data
 func (d *Default) Update(data interface{}) error {
 	err := d.GetTable().Update(data).Exec(d.session)
@@ -90,6 +106,16 @@ func (d *Default) DeleteID(id string) error {
 	return nil
 }
 
+// DeleteByIndex deletes all resources whose index is matching and returns the count of removed rows
+func (d *Default) DeleteByIndex(index string, values ...interface{}) (int, error) {
+	result, err := d.GetTable().GetAllByIndex(index, values...).Delete().RunWrite(d.session)
+	if err != nil {
+		return 0, NewDatabaseError(d, err, "")
+	}
+
+	return result.Deleted, nil
+}
+
 // Find searches for a resource in the database and then returns a cursor
 func (d *Default) Find(id string) (*gorethink.Cursor, error) {
 	cursor, err := d.GetTable().Get(id).Run(d.session)
@@ -2,6 +2,8 @@ package db
 
 import (
 	"fmt"
+
+	"github.com/dancannon/gorethink"
 )
 
 // DatabaseError is the wrapper for RethinkDB errors that allows passing more data with the message
@@ -29,3 +31,12 @@ func NewDatabaseError(t RethinkTable, err error, message string) *DatabaseError
 		message: message,
 	}
 }
+
+// IsNotFound checks whether the error was caused by a missing document
+func IsNotFound(err error) bool {
+	if wrapped, ok := err.(*DatabaseError); ok {
+		err = wrapped.err
+	}
+
+	return err == gorethink.ErrEmptyResult
+}
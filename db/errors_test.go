@@ -0,0 +1,29 @@
+package db
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dancannon/gorethink"
+)
+
+func TestIsNotFound(t *testing.T) {
+	table := NewCRUDTable(nil, "test", "addresses")
+
+	cases := []struct {
+		err      error
+		notFound bool
+	}{
+		{gorethink.ErrEmptyResult, true},
+		{NewDatabaseError(table, gorethink.ErrEmptyResult, ""), true},
+		{NewDatabaseError(table, errors.New("connection closed"), ""), false},
+		{errors.New("connection closed"), false},
+		{nil, false},
+	}
+
+	for _, test := range cases {
+		if IsNotFound(test.err) != test.notFound {
+			t.Fatalf("%v: not found %v, expected %v", test.err, !test.notFound, test.notFound)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/dancannon/gorethink"
+
+	"github.com/lavab/api/models"
+)
+
+// ErrInvalidCursor is returned by DecodeCursor if the cursor is malformed
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+// pageFields maps the fields that can be used for cursor pagination to the
+// suffixes of their compound indexes, eg. ownerDateCreated is [owner, date_created, id]
+var pageFields = map[string]string{
+	"date_created":  "DateCreated",
+	"date_modified": "DateModified",
+}
+
+// Cursor points at the last item of a page. It is passed to the clients as an
+// opaque string.
+type Cursor struct {
+	Field string    `json:"f"`
+	Desc  bool      `json:"o"`
+	Date  time.Time `json:"d"`
+	ID    string    `json:"i"`
+}
+
+// Encode serializes the cursor into an URL-safe string
+func (c *Cursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.URLEncoding.EncodeToString(data)
+}
+
+// DecodeCursor parses a cursor returned by Cursor.Encode
+func DecodeCursor(input string) (*Cursor, error) {
+	data, err := base64.URLEncoding.DecodeString(input)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var cursor Cursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	if _, ok := pageFields[cursor.Field]; !ok || cursor.ID == "" {
+		return nil, ErrInvalidCursor
+	}
+
+	return &cursor, nil
+}
+
+// PageOpts describes a single page of a cursor-paginated list
+type PageOpts struct {
+	// Field is either date_created or date_modified
+	Field string
+	Desc  bool
+
+	// Cursor is nil on the first page
+	Cursor *Cursor
+	Limit  int
+}
+
+// IsPageField checks whether a field can be used for cursor pagination
+func IsPageField(field string) bool {
+	_, ok := pageFields[field]
+	return ok
+}
+
+// between selects rows of the page from a compound index starting with prefix,
+// eg. "owner" for the ownerDateCreated index, and sorts them. One extra row
+// is fetched to find out whether there is a next page.
+func (p *PageOpts) between(table gorethink.Term, prefix string, value interface{}) gorethink.Term {
+	index := prefix + pageFields[p.Field]
+
+	var (
+		lower   = []interface{}{value, gorethink.MinVal}
+		upper   = []interface{}{value, gorethink.MaxVal}
+		options = gorethink.BetweenOpts{
+			Index: index,
+		}
+	)
+
+	// Bounds exclude the last item of the previous page
+	if p.Cursor != nil {
+		if p.Desc {
+			upper = []interface{}{value, p.Cursor.Date, p.Cursor.ID}
+		} else {
+			lower = []interface{}{value, p.Cursor.Date, p.Cursor.ID}
+			options.LeftBound = "open"
+		}
+	}
+
+	var order interface{} = gorethink.Asc(index)
+	if p.Desc {
+		order = gorethink.Desc(index)
+	}
+
+	return table.Between(lower, upper, options).OrderBy(gorethink.OrderByOpts{
+		Index: order,
+	})
+}
+
+// next trims the extra row fetched by between and returns the cursor of the
+// next page, if there is one
+func (p *PageOpts) next(count int, last func(i int) *models.Resource) (int, *Cursor) {
+	if count <= p.Limit {
+		return count, nil
+	}
+
+	resource := last(p.Limit - 1)
+
+	cursor := &Cursor{
+		Field: p.Field,
+		Desc:  p.Desc,
+		ID:    resource.ID,
+	}
+
+	if p.Field == "date_modified" {
+		cursor.Date = resource.DateModified
+	} else {
+		cursor.Date = resource.DateCreated
+	}
+
+	return p.Limit, cursor
+}
+
+// orderBy appends sort conditions parsed from the sort GET parameter to the term
+func orderBy(term gorethink.Term, sort []string) gorethink.Term {
+	if len(sort) == 0 {
+		return term
+	}
+
+	var conds []interface{}
+	for _, cond := range sort {
+		if cond[0] == '-' {
+			conds = append(conds, gorethink.Desc(cond[1:]))
+		} else if cond[0] == '+' || cond[0] == ' ' {
+			conds = append(conds, gorethink.Asc(cond[1:]))
+		} else {
+			conds = append(conds, gorethink.Asc(cond))
+		}
+	}
+
+	return term.OrderBy(conds...)
+}
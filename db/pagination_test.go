@@ -0,0 +1,102 @@
+package db
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/lavab/api/models"
+)
+
+func TestCursor(t *testing.T) {
+	cursor := &Cursor{
+		Field: "date_modified",
+		Desc:  true,
+		Date:  time.Date(2015, 6, 1, 12, 30, 0, 0, time.UTC),
+		ID:    "item",
+	}
+
+	decoded, err := DecodeCursor(cursor.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Field != cursor.Field || decoded.Desc != cursor.Desc || !decoded.Date.Equal(cursor.Date) || decoded.ID != cursor.ID {
+		t.Fatalf("invalid cursor %+v", decoded)
+	}
+
+	encode := func(input string) string {
+		return base64.URLEncoding.EncodeToString([]byte(input))
+	}
+
+	for _, input := range []string{
+		"",
+		"not base64!",
+		encode("not json"),
+		encode(`{"f":"date_created"}`),
+		encode(`{"f":"name","i":"item"}`),
+		encode(`{"i":"item"}`),
+		encode(`{"f":"date_created","i":"item","d":"yesterday"}`),
+		(&Cursor{Field: "date_created"}).Encode(),
+	} {
+		if _, err := DecodeCursor(input); err != ErrInvalidCursor {
+			t.Fatalf("%q: invalid cursor was accepted", input)
+		}
+	}
+}
+
+func TestIsPageField(t *testing.T) {
+	for field, valid := range map[string]bool{
+		"date_created":  true,
+		"date_modified": true,
+		"name":          false,
+		"-date_created": false,
+		"":              false,
+	} {
+		if IsPageField(field) != valid {
+			t.Fatalf("%q: page field %v, expected %v", field, !valid, valid)
+		}
+	}
+}
+
+func TestPageOptsNext(t *testing.T) {
+	created := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	resources := make([]*models.Resource, 4)
+	for i := range resources {
+		resources[i] = &models.Resource{
+			ID:           string('a' + rune(i)),
+			DateCreated:  created.AddDate(0, 0, i),
+			DateModified: created.AddDate(0, 1, i),
+		}
+	}
+	last := func(i int) *models.Resource {
+		return resources[i]
+	}
+
+	// The extra row is missing, so it's the last page
+	page := &PageOpts{Field: "date_created", Limit: 4}
+	if count, next := page.next(4, last); count != 4 || next != nil {
+		t.Fatalf("last page: %d items, cursor %+v", count, next)
+	}
+	if count, next := page.next(0, last); count != 0 || next != nil {
+		t.Fatalf("empty page: %d items, cursor %+v", count, next)
+	}
+
+	page = &PageOpts{Field: "date_created", Limit: 3}
+	count, next := page.next(4, last)
+	if count != 3 || next == nil {
+		t.Fatalf("page with a next one: %d items, cursor %+v", count, next)
+	}
+	if next.Field != "date_created" || next.Desc || next.ID != "c" || !next.Date.Equal(resources[2].DateCreated) {
+		t.Fatalf("invalid cursor %+v", next)
+	}
+
+	page = &PageOpts{Field: "date_modified", Desc: true, Limit: 2}
+	count, next = page.next(3, last)
+	if count != 2 || next == nil {
+		t.Fatalf("page with a next one: %d items, cursor %+v", count, next)
+	}
+	if next.Field != "date_modified" || !next.Desc || next.ID != "b" || !next.Date.Equal(resources[1].DateModified) {
+		t.Fatalf("invalid cursor %+v", next)
+	}
+}
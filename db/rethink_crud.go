@@ -46,6 +46,7 @@ type RethinkUpdater interface {
 type RethinkDeleter interface {
 	Delete(pred interface{}) error
 	DeleteID(id string) error
+	DeleteByIndex(index string, values ...interface{}) (int, error)
 }
 
 // RethinkCRUD is the interface that every table should implement
@@ -0,0 +1,245 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/dancannon/gorethink"
+)
+
+// SearchTerm is a single criterion of a search query, eg. `from:bob@lavaboom.com`
+// or `-label:Spam`.
+type SearchTerm struct {
+	Key     string
+	Value   string
+	Negated bool
+
+	// After and Before bound the date range of "date" terms. Zero values mean
+	// that the range is open on that side.
+	After  time.Time
+	Before time.Time
+}
+
+// SearchQuery is a list of terms that all have to match
+type SearchQuery []*SearchTerm
+
+// searchDateLayout is the format of dates in date ranges
+const searchDateLayout = "2006-01-02"
+
+// ParseSearchQuery parses a query like `from:bob@lavaboom.com has:attachment
+// after:2015-01-01 -label:Spam`. Values containing spaces can be quoted.
+// Supported keys:
+//   - from, to, cc, bcc - exact address, as stored in the email
+//   - kind              - raw, manifest or pgpmime
+//   - status            - status of the email, eg. received or processed
+//   - has               - only "attachment" is supported
+//   - after, before     - date range on date_created, after is inclusive, before is not
+//   - date              - a single day or a range, eg. 2015-01-01..2015-02-01
+//   - label             - label name, has to be resolved into an ID before searching
+//   - secure            - all, some or none
+//
+// Every term can be negated by prefixing it with a "-".
+func ParseSearchQuery(raw string) (SearchQuery, error) {
+	tokens, err := tokenizeSearchQuery(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty search query")
+	}
+
+	query := SearchQuery{}
+	for _, token := range tokens {
+		term := &SearchTerm{}
+
+		if strings.HasPrefix(token, "-") {
+			term.Negated = true
+			token = token[1:]
+		}
+
+		parts := strings.SplitN(token, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid search term %q", token)
+		}
+
+		term.Key = strings.ToLower(parts[0])
+		term.Value = parts[1]
+
+		switch term.Key {
+		case "from", "to", "cc", "bcc", "status", "label":
+		case "kind":
+			if term.Value != "raw" && term.Value != "manifest" && term.Value != "pgpmime" {
+				return nil, fmt.Errorf("invalid kind %q", term.Value)
+			}
+		case "secure":
+			if term.Value != "all" && term.Value != "some" && term.Value != "none" {
+				return nil, fmt.Errorf("invalid secure value %q", term.Value)
+			}
+		case "has":
+			if term.Value != "attachment" {
+				return nil, fmt.Errorf("unsupported has value %q", term.Value)
+			}
+		case "after", "before", "date":
+			if err := term.parseDateRange(); err != nil {
+				return nil, err
+			}
+			term.Key = "date"
+		default:
+			return nil, fmt.Errorf("unsupported search key %q", term.Key)
+		}
+
+		query = append(query, term)
+	}
+
+	return query, nil
+}
+
+// tokenizeSearchQuery splits the query on whitespace, keeping quoted values together
+func tokenizeSearchQuery(raw string) ([]string, error) {
+	var (
+		tokens  []string
+		current []rune
+		quoted  bool
+	)
+
+	for _, r := range raw {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case unicode.IsSpace(r) && !quoted:
+			if len(current) > 0 {
+				tokens = append(tokens, string(current))
+				current = nil
+			}
+		default:
+			current = append(current, r)
+		}
+	}
+
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote in the search query")
+	}
+
+	if len(current) > 0 {
+		tokens = append(tokens, string(current))
+	}
+
+	return tokens, nil
+}
+
+func (s *SearchTerm) parseDateRange() error {
+	parse := func(value string) (time.Time, error) {
+		date, err := time.Parse(searchDateLayout, value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid date %q", value)
+		}
+		return date, nil
+	}
+
+	var err error
+	switch s.Key {
+	case "after":
+		s.After, err = parse(s.Value)
+	case "before":
+		s.Before, err = parse(s.Value)
+	case "date":
+		if bounds := strings.SplitN(s.Value, "..", 2); len(bounds) == 2 {
+			if bounds[0] == "" && bounds[1] == "" {
+				return fmt.Errorf("invalid date range %q", s.Value)
+			}
+
+			if bounds[0] != "" {
+				if s.After, err = parse(bounds[0]); err != nil {
+					return err
+				}
+			}
+
+			if bounds[1] != "" {
+				s.Before, err = parse(bounds[1])
+			}
+		} else {
+			// A single day
+			s.After, err = parse(s.Value)
+			s.Before = s.After.AddDate(0, 0, 1)
+		}
+	}
+
+	return err
+}
+
+// Has checks whether the query contains a term with the specified key
+func (s SearchQuery) Has(key string) bool {
+	for _, term := range s {
+		if term.Key == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isThreadKey checks whether a term matches thread's properties instead of email's
+func isThreadKey(key string) bool {
+	return key == "label" || key == "secure"
+}
+
+// index returns the first term that can be looked up using a secondary index
+func (s SearchQuery) index() *SearchTerm {
+	for _, term := range s {
+		if term.Negated {
+			continue
+		}
+
+		switch term.Key {
+		case "from", "to", "cc", "bcc":
+			return term
+		}
+	}
+
+	return nil
+}
+
+// emailCondition returns a term that checks whether an email matches the term
+func (s *SearchTerm) emailCondition(row gorethink.Term, threads gorethink.Term) gorethink.Term {
+	var cond gorethink.Term
+
+	switch s.Key {
+	case "from", "kind", "status":
+		cond = row.Field(s.Key).Eq(s.Value)
+	case "to", "cc", "bcc":
+		cond = row.Field(s.Key).Default([]interface{}{}).Contains(s.Value)
+	case "has":
+		cond = row.Field("files").Default([]interface{}{}).IsEmpty().Not()
+	case "date":
+		cond = gorethink.Expr(true)
+		if !s.After.IsZero() {
+			cond = cond.And(row.Field("date_created").Ge(s.After))
+		}
+		if !s.Before.IsZero() {
+			cond = cond.And(row.Field("date_created").Lt(s.Before))
+		}
+	default:
+		cond = s.threadCondition(threads.Get(row.Field("thread")).Default(map[string]interface{}{}))
+	}
+
+	if s.Negated {
+		cond = cond.Not()
+	}
+
+	return cond
+}
+
+// threadCondition returns a term that checks whether a thread matches the term
+func (s *SearchTerm) threadCondition(row gorethink.Term) gorethink.Term {
+	switch s.Key {
+	case "label":
+		return row.Field("labels").Default([]interface{}{}).Contains(s.Value)
+	case "secure":
+		return row.Field("secure").Default("").Eq(s.Value)
+	}
+
+	return gorethink.Expr(true)
+}
@@ -0,0 +1,184 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func searchDate(value string) time.Time {
+	result, err := time.Parse(searchDateLayout, value)
+	if err != nil {
+		panic(err)
+	}
+
+	return result
+}
+
+func TestTokenizeSearchQuery(t *testing.T) {
+	cases := []struct {
+		raw    string
+		tokens []string
+		valid  bool
+	}{
+		{"", nil, true},
+		{"  \t\n ", nil, true},
+		{"from:bob@lavaboom.com", []string{"from:bob@lavaboom.com"}, true},
+		{"  has:attachment\t-label:Spam \n", []string{"has:attachment", "-label:Spam"}, true},
+		{`label:"Work stuff" kind:raw`, []string{"label:Work stuff", "kind:raw"}, true},
+		{`"label:Work stuff"`, []string{"label:Work stuff"}, true},
+		{`-label:"a  b"c`, []string{"-label:a  bc"}, true},
+		{`label:""`, []string{"label:"}, true},
+		{`label:"Work stuff`, nil, false},
+		{`"`, nil, false},
+	}
+
+	for _, test := range cases {
+		tokens, err := tokenizeSearchQuery(test.raw)
+		if !test.valid {
+			if err == nil {
+				t.Fatalf("%q: invalid query was accepted", test.raw)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%q: %v", test.raw, err)
+		}
+		if !reflect.DeepEqual(tokens, test.tokens) {
+			t.Fatalf("%q: tokens %q, expected %q", test.raw, tokens, test.tokens)
+		}
+	}
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	cases := []struct {
+		raw   string
+		query SearchQuery
+	}{
+		{
+			"from:bob@lavaboom.com -to:alice@lavaboom.com",
+			SearchQuery{
+				{Key: "from", Value: "bob@lavaboom.com"},
+				{Key: "to", Value: "alice@lavaboom.com", Negated: true},
+			},
+		},
+		{
+			`FROM:bob@lavaboom.com label:"Work stuff" -has:attachment`,
+			SearchQuery{
+				{Key: "from", Value: "bob@lavaboom.com"},
+				{Key: "label", Value: "Work stuff"},
+				{Key: "has", Value: "attachment", Negated: true},
+			},
+		},
+		{
+			"kind:pgpmime secure:some status:received cc:a@b.c bcc:d@e.f",
+			SearchQuery{
+				{Key: "kind", Value: "pgpmime"},
+				{Key: "secure", Value: "some"},
+				{Key: "status", Value: "received"},
+				{Key: "cc", Value: "a@b.c"},
+				{Key: "bcc", Value: "d@e.f"},
+			},
+		},
+		{
+			"after:2015-01-01 -before:2015-02-01",
+			SearchQuery{
+				{Key: "date", Value: "2015-01-01", After: searchDate("2015-01-01")},
+				{Key: "date", Value: "2015-02-01", Before: searchDate("2015-02-01"), Negated: true},
+			},
+		},
+		{
+			"date:2015-01-31",
+			SearchQuery{
+				{Key: "date", Value: "2015-01-31", After: searchDate("2015-01-31"), Before: searchDate("2015-02-01")},
+			},
+		},
+		{
+			"date:2015-01-01..2015-02-01 date:..2015-03-01 date:2015-04-01..",
+			SearchQuery{
+				{Key: "date", Value: "2015-01-01..2015-02-01", After: searchDate("2015-01-01"), Before: searchDate("2015-02-01")},
+				{Key: "date", Value: "..2015-03-01", Before: searchDate("2015-03-01")},
+				{Key: "date", Value: "2015-04-01..", After: searchDate("2015-04-01")},
+			},
+		},
+		{
+			// Only the first colon separates the key
+			"label:a:b",
+			SearchQuery{
+				{Key: "label", Value: "a:b"},
+			},
+		},
+	}
+
+	for _, test := range cases {
+		query, err := ParseSearchQuery(test.raw)
+		if err != nil {
+			t.Fatalf("%q: %v", test.raw, err)
+		}
+
+		if len(query) != len(test.query) {
+			t.Fatalf("%q: %d terms, expected %d", test.raw, len(query), len(test.query))
+		}
+		for i, term := range query {
+			if !reflect.DeepEqual(term, test.query[i]) {
+				t.Fatalf("%q: term %d is %+v, expected %+v", test.raw, i, term, test.query[i])
+			}
+		}
+	}
+}
+
+func TestParseSearchQueryInvalid(t *testing.T) {
+	for _, raw := range []string{
+		"",
+		"   ",
+		"bob",
+		"-",
+		"from:",
+		"-from:",
+		":bob",
+		`label:"Work`,
+		"subject:hello",
+		"body:hello",
+		"kind:smime",
+		"kind:RAW",
+		"secure:most",
+		"has:label",
+		"after:yesterday",
+		"before:2015-13-01",
+		"date:2015-1-1",
+		"date:..",
+		"date:2015-01-01..later",
+		"date:sooner..2015-01-01",
+		"from:bob@lavaboom.com date:2015-02-30",
+	} {
+		if query, err := ParseSearchQuery(raw); err == nil {
+			t.Fatalf("%q: invalid query was parsed into %+v", raw, query)
+		}
+	}
+}
+
+func TestSearchQueryHas(t *testing.T) {
+	query, err := ParseSearchQuery("-label:Spam after:2015-01-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !query.Has("label") || !query.Has("date") || query.Has("after") || query.Has("from") {
+		t.Fatalf("invalid keys of %+v", query)
+	}
+
+	// Negated terms can't use an index
+	if term := query.index(); term != nil {
+		t.Fatalf("negated term %+v was used as an index", term)
+	}
+
+	query, err = ParseSearchQuery("-from:bob@lavaboom.com label:Work to:alice@lavaboom.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if term := query.index(); term == nil || term.Key != "to" {
+		t.Fatalf("invalid index term %+v", term)
+	}
+}
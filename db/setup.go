@@ -36,6 +36,13 @@ func Setup(opts r.ConnectOpts) error {
 		r.DB(d).Table("addresses").IndexCreate("owner").Exec(ss)
 		r.DB(d).Table("addresses").IndexCreate("date_created").Exec(ss)
 		r.DB(d).Table("addresses").IndexCreate("date_modified").Exec(ss)
+		r.DB(d).Table("addresses").IndexCreate("domain").Exec(ss)
+
+		r.DB(d).TableCreate("audit").Exec(ss)
+		r.DB(d).Table("audit").IndexCreate("account").Exec(ss)
+		r.DB(d).Table("audit").IndexCreate("actor").Exec(ss)
+		r.DB(d).Table("audit").IndexCreate("type").Exec(ss)
+		r.DB(d).Table("audit").IndexCreate("date_created").Exec(ss)
 
 		r.DB(d).TableCreate("contacts").Exec(ss)
 		r.DB(d).Table("contacts").IndexCreate("owner").Exec(ss)
@@ -43,6 +50,14 @@ func Setup(opts r.ConnectOpts) error {
 		r.DB(d).Table("contacts").IndexCreate("date_created").Exec(ss)
 		r.DB(d).Table("contacts").IndexCreate("date_modified").Exec(ss)
 
+		r.DB(d).TableCreate("domains").Exec(ss)
+		r.DB(d).Table("domains").IndexCreate("owner").Exec(ss)
+		r.DB(d).Table("domains").IndexCreate("name").Exec(ss)
+		r.DB(d).Table("domains").IndexCreate("date_created").Exec(ss)
+
+		r.DB(d).TableCreate("domain_claims").Exec(ss)
+		r.DB(d).Table("domain_claims").IndexCreate("owner").Exec(ss)
+
 		r.DB(d).TableCreate("emails").Exec(ss)
 		r.DB(d).Table("emails").IndexCreate("owner").Exec(ss)
 		r.DB(d).Table("emails").IndexCreate("date_created").Exec(ss)
@@ -69,6 +84,7 @@ func Setup(opts r.ConnectOpts) error {
 
 		r.DB(d).TableCreate("files").Exec(ss)
 		r.DB(d).Table("files").IndexCreate("owner").Exec(ss)
+		r.DB(d).Table("files").IndexCreate("blob").Exec(ss)
 		r.DB(d).Table("files").IndexCreate("name").Exec(ss)
 		r.DB(d).Table("files").IndexCreate("date_created").Exec(ss)
 		r.DB(d).Table("files").IndexCreate("date_modified").Exec(ss)
@@ -78,6 +94,7 @@ func Setup(opts r.ConnectOpts) error {
 		r.DB(d).Table("keys").IndexCreate("date_created").Exec(ss)
 		r.DB(d).Table("keys").IndexCreate("date_modified").Exec(ss)
 		r.DB(d).Table("keys").IndexCreate("key_id").Exec(ss)
+		r.DB(d).Table("keys").IndexCreate("key_id_short").Exec(ss)
 
 		r.DB(d).TableCreate("labels").Exec(ss)
 		r.DB(d).Table("labels").IndexCreate("name").Exec(ss)
@@ -91,6 +108,11 @@ func Setup(opts r.ConnectOpts) error {
 			}
 		}).Exec(ss)
 
+		r.DB(d).TableCreate("reservations").Exec(ss)
+		r.DB(d).Table("reservations").IndexCreate("name").Exec(ss)
+		r.DB(d).Table("reservations").IndexCreate("email").Exec(ss)
+		r.DB(d).Table("reservations").IndexCreate("expiry_date").Exec(ss)
+
 		r.DB(d).TableCreate("threads").Exec(ss)
 		r.DB(d).Table("threads").IndexCreate("name").Exec(ss)
 		r.DB(d).Table("threads").IndexCreate("owner").Exec(ss)
@@ -115,6 +137,17 @@ func Setup(opts r.ConnectOpts) error {
 		r.DB(d).Table("tokens").IndexCreate("date_modified").Exec(ss)
 		r.DB(d).Table("tokens").IndexCreate("type").Exec(ss)
 		r.DB(d).Table("tokens").IndexCreate("expiry_date").Exec(ss)
+		r.DB(d).Table("tokens").IndexCreate("family").Exec(ss)
+
+		r.DB(d).TableCreate("uploads").Exec(ss)
+		r.DB(d).Table("uploads").IndexCreate("owner").Exec(ss)
+		r.DB(d).Table("uploads").IndexCreate("date_created").Exec(ss)
+		r.DB(d).Table("uploads").IndexCreate("expiry_date").Exec(ss)
+
+		r.DB(d).TableCreate("votes").Exec(ss)
+		r.DB(d).Table("votes").IndexCreateFunc("voters", func(row r.Term) interface{} {
+			return row.Field("for").Add(row.Field("against"))
+		}, r.IndexCreateOpts{Multi: true}).Exec(ss)
 
 		r.DB(d).TableCreate("webhooks").Exec(ss)
 		r.DB(d).Table("webhooks").IndexCreate("target").Exec(ss)
@@ -125,7 +158,43 @@ func Setup(opts r.ConnectOpts) error {
 				row.Field("type"),
 			}
 		}).Exec(ss)
+
+		// Compound indexes used by cursor pagination
+		for _, index := range pageIndexes {
+			createPageIndexes(ss, d, index[0], index[1])
+		}
+
+		r.DB(d).Table("emails").IndexCreateFunc("threadAndDate", func(row r.Term) interface{} {
+			return []interface{}{
+				row.Field("thread"),
+				row.Field("date_created"),
+			}
+		}).Exec(ss)
 	}
 
 	return ss.Close()
 }
+
+// pageIndexes lists tables and prefixes of their cursor pagination indexes
+var pageIndexes = [][2]string{
+	{"contacts", "owner"},
+	{"emails", "owner"},
+	{"emails", "thread"},
+	{"files", "owner"},
+	{"threads", "owner"},
+}
+
+// createPageIndexes creates [prefix, date_created, id] and [prefix, date_modified, id]
+// indexes named eg. ownerDateCreated
+func createPageIndexes(ss *r.Session, db string, table string, prefix string) {
+	for field, suffix := range pageFields {
+		field := field
+		r.DB(db).Table(table).IndexCreateFunc(prefix+suffix, func(row r.Term) interface{} {
+			return []interface{}{
+				row.Field(prefix),
+				row.Field(field),
+				row.Field("id"),
+			}
+		}).Exec(ss)
+	}
+}
@@ -2,6 +2,10 @@ package db
 
 import (
 	"errors"
+	"regexp"
+	"time"
+
+	"github.com/dancannon/gorethink"
 
 	"github.com/lavab/api/models"
 )
@@ -35,6 +39,98 @@ func (users *AccountsTable) FindAccountByName(name string) (*models.Account, err
 	return &result, nil
 }
 
+// GetByStatus returns all accounts with specified status
+func (a *AccountsTable) GetByStatus(status string) ([]*models.Account, error) {
+	var result []*models.Account
+
+	if err := a.FindByIndexFetch(&result, "status", status); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// List returns accounts matching the query, status and type. The query is
+// matched against names and alternative email addresses.
+func (a *AccountsTable) List(
+	query string,
+	status string,
+	kind string,
+	sort []string,
+	offset int,
+	limit int,
+) ([]*models.Account, error) {
+	term := orderBy(a.GetTable().Filter(a.listFilter(query, status, kind)), sort)
+
+	// Slice the result in 3 cases
+	if offset != 0 && limit == 0 {
+		term = term.Skip(offset)
+	}
+
+	if offset == 0 && limit != 0 {
+		term = term.Limit(limit)
+	}
+
+	if offset != 0 && limit != 0 {
+		term = term.Slice(offset, offset+limit)
+	}
+
+	cursor, err := term.Run(a.GetSession())
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var result []*models.Account
+	if err := cursor.All(&result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// CountList counts all accounts matched by List
+func (a *AccountsTable) CountList(query string, status string, kind string) (int, error) {
+	cursor, err := a.GetTable().Filter(a.listFilter(query, status, kind)).Count().Run(a.GetSession())
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+
+	var result int
+	if err := cursor.One(&result); err != nil {
+		return 0, err
+	}
+
+	return result, nil
+}
+
+// listFilter matches accounts listed by List
+func (a *AccountsTable) listFilter(query string, status string, kind string) func(row gorethink.Term) gorethink.Term {
+	return func(row gorethink.Term) gorethink.Term {
+		cond := gorethink.Expr(true)
+
+		if query != "" {
+			pattern := "(?i)" + regexp.QuoteMeta(query)
+			cond = cond.And(
+				row.Field("name").Match(pattern).Ne(nil).Or(
+					row.Field("alt_email").Default("").Match(pattern).Ne(nil),
+				),
+			)
+		}
+
+		if status != "" {
+			cond = cond.And(row.Field("status").Eq(status))
+		}
+
+		if kind != "" {
+			cond = cond.And(row.Field("type").Eq(kind))
+		}
+
+		return cond
+	}
+}
+
 func (a *AccountsTable) GetTokenOwner(token *models.Token) (*models.Account, error) {
 	user, err := a.GetAccount(token.Owner)
 	if err != nil {
@@ -71,3 +167,28 @@ func (a *AccountsTable) IsEmailUsed(email string) (bool, error) {
 
 	return true, nil
 }
+
+// UpdateFactorValue replaces account's 2FA data only if it still equals old,
+// so that a single code can't be used by two concurrent requests. Returns
+// false if the data was modified in the meantime.
+func (a *AccountsTable) UpdateFactorValue(id string, old []string, value []string) (bool, error) {
+	if old == nil {
+		old = []string{}
+	}
+
+	result, err := a.GetTable().Get(id).Update(func(row gorethink.Term) interface{} {
+		return gorethink.Branch(
+			row.Field("factor_value").Default([]interface{}{}).Eq(old),
+			map[string]interface{}{
+				"factor_value":  value,
+				"date_modified": time.Now(),
+			},
+			map[string]interface{}{},
+		)
+	}).RunWrite(a.GetSession())
+	if err != nil {
+		return false, err
+	}
+
+	return result.Replaced == 1, nil
+}
@@ -1,6 +1,8 @@
 package db
 
 import (
+	"github.com/dancannon/gorethink"
+
 	"github.com/lavab/api/models"
 )
 
@@ -17,7 +19,7 @@ func (a *AddressesTable) GetAddress(id string) (*models.Address, error) {
 }
 
 func (a *AddressesTable) GetOwnedBy(id string) ([]*models.Address, error) {
-	cursor, err := a.GetTable().GetAllByIndex("owner", id).Run(a.GetSession())
+	cursor, err := a.GetTable().GetAllByIndex("owner", id).OrderBy(gorethink.Asc("date_created")).Run(a.GetSession())
 	if err != nil {
 		return nil, err
 	}
@@ -29,6 +31,36 @@ func (a *AddressesTable) GetOwnedBy(id string) ([]*models.Address, error) {
 	return result, nil
 }
 
-func (a *AddressesTable) DeleteOwnedBy(id string) error {
-	return a.GetTable().GetAllByIndex("owner", id).Delete().Exec(a.GetSession())
+// Create inserts the address unless it's already used. It returns false if it
+// is, so only one of concurrent requests can create the address.
+func (a *AddressesTable) Create(address *models.Address) (bool, error) {
+	return insertUnique(a, address)
+}
+
+// CountOwnedBy counts all addresses owned by id
+func (a *AddressesTable) CountOwnedBy(id string) (int, error) {
+	return a.FindByAndCount("owner", id)
+}
+
+// SetDefault makes the address the default sending identity of its owner
+func (a *AddressesTable) SetDefault(owner string, id string) error {
+	err := a.GetTable().GetAllByIndex("owner", owner).Update(func(row gorethink.Term) interface{} {
+		return map[string]interface{}{
+			"default": row.Field("id").Eq(id),
+		}
+	}).Exec(a.GetSession())
+	if err != nil {
+		return NewDatabaseError(a, err, "")
+	}
+
+	return nil
+}
+
+// DeleteByDomain removes all addresses created under a custom domain
+func (a *AddressesTable) DeleteByDomain(domain string) (int, error) {
+	return a.DeleteByIndex("domain", domain)
+}
+
+func (a *AddressesTable) DeleteOwnedBy(id string) (int, error) {
+	return a.DeleteByIndex("owner", id)
 }
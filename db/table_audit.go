@@ -0,0 +1,108 @@
+package db
+
+import (
+	"time"
+
+	"github.com/dancannon/gorethink"
+
+	"github.com/lavab/api/models"
+)
+
+// AuditTable implements the CRUD interface for the audit log. Events are only
+// ever inserted and pruned after the retention period.
+type AuditTable struct {
+	RethinkCRUD
+}
+
+// AuditQuery narrows down events returned by List. Empty fields match all
+// events.
+type AuditQuery struct {
+	Account string
+	Actor   string
+	Type    string
+	Since   time.Time
+	Until   time.Time
+}
+
+// List returns events matching the query, newest first
+func (a *AuditTable) List(query *AuditQuery, offset int, limit int) ([]*models.AuditEvent, error) {
+	term := a.listTerm(query).OrderBy(gorethink.Desc("date_created"))
+
+	// Slice the result
+	if offset != 0 || limit != 0 {
+		term = term.Slice(offset, offset+limit)
+	}
+
+	cursor, err := term.Run(a.GetSession())
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var result []*models.AuditEvent
+	if err := cursor.All(&result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// CountList counts all events matched by List
+func (a *AuditTable) CountList(query *AuditQuery) (int, error) {
+	cursor, err := a.listTerm(query).Count().Run(a.GetSession())
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+
+	var result int
+	if err := cursor.One(&result); err != nil {
+		return 0, err
+	}
+
+	return result, nil
+}
+
+// listTerm selects events matching the query
+func (a *AuditTable) listTerm(query *AuditQuery) gorethink.Term {
+	term := a.GetTable()
+	if query.Account != "" {
+		term = term.GetAllByIndex("account", query.Account)
+	}
+
+	return term.Filter(func(row gorethink.Term) gorethink.Term {
+		cond := gorethink.Expr(true)
+
+		if query.Actor != "" {
+			cond = cond.And(row.Field("actor").Eq(query.Actor))
+		}
+
+		if query.Type != "" {
+			cond = cond.And(row.Field("type").Eq(query.Type))
+		}
+
+		if !query.Since.IsZero() {
+			cond = cond.And(row.Field("date_created").Ge(query.Since))
+		}
+
+		if !query.Until.IsZero() {
+			cond = cond.And(row.Field("date_created").Lt(query.Until))
+		}
+
+		return cond
+	})
+}
+
+// DeleteBefore removes events older than date
+func (a *AuditTable) DeleteBefore(date time.Time) (int, error) {
+	result, err := a.GetTable().Between(
+		gorethink.MinVal,
+		date,
+		gorethink.BetweenOpts{Index: "date_created"},
+	).Delete().RunWrite(a.GetSession())
+	if err != nil {
+		return 0, NewDatabaseError(a, err, "")
+	}
+
+	return result.Deleted, nil
+}
@@ -1,6 +1,8 @@
 package db
 
 import (
+	"github.com/dancannon/gorethink"
+
 	"github.com/lavab/api/models"
 )
 
@@ -35,8 +37,52 @@ func (c *ContactsTable) GetOwnedBy(id string) ([]*models.Contact, error) {
 }
 
 // DeleteOwnedBy deletes all contacts owned by id
-func (c *ContactsTable) DeleteOwnedBy(id string) error {
-	return c.Delete(map[string]interface{}{
-		"owner": id,
+func (c *ContactsTable) DeleteOwnedBy(id string) (int, error) {
+	return c.DeleteByIndex("owner", id)
+}
+
+// CountOwnedBy counts all contacts owned by id
+func (c *ContactsTable) CountOwnedBy(id string) (int, error) {
+	return c.FindByAndCount("owner", id)
+}
+
+// List returns owner's contacts, sorted and sliced using an offset
+func (c *ContactsTable) List(owner string, sort []string, offset int, limit int) ([]*models.Contact, error) {
+	term := orderBy(c.GetTable().GetAllByIndex("owner", owner), sort)
+
+	// Slice the result
+	if offset != 0 || limit != 0 {
+		term = term.Slice(offset, offset+limit)
+	}
+
+	return c.fetch(term)
+}
+
+// ListPage returns a page of owner's contacts, using a cursor instead of an offset
+func (c *ContactsTable) ListPage(owner string, opts *PageOpts) ([]*models.Contact, *Cursor, error) {
+	resp, err := c.fetch(opts.between(c.GetTable(), "owner", owner).Limit(opts.Limit + 1))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	count, next := opts.next(len(resp), func(i int) *models.Resource {
+		return &resp[i].Resource
 	})
+
+	return resp[:count], next, nil
+}
+
+func (c *ContactsTable) fetch(term gorethink.Term) ([]*models.Contact, error) {
+	cursor, err := term.Run(c.GetSession())
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var resp []*models.Contact
+	if err := cursor.All(&resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
 }
@@ -0,0 +1,113 @@
+package db
+
+import (
+	"time"
+
+	"github.com/dancannon/gorethink"
+
+	"github.com/lavab/api/models"
+)
+
+// DomainsTable implements the CRUD interface for custom domains
+type DomainsTable struct {
+	RethinkCRUD
+
+	// Claims contains names of verified domains as primary keys, so that a
+	// name can't be verified twice
+	Claims RethinkCRUD
+}
+
+// domainClaim reserves a domain name for the verified domain
+type domainClaim struct {
+	Name   string `gorethink:"id"`
+	Domain string `gorethink:"domain"`
+	Owner  string `gorethink:"owner"`
+}
+
+// GetDomain returns the domain with the specified ID
+func (d *DomainsTable) GetDomain(id string) (*models.Domain, error) {
+	var result models.Domain
+
+	if err := d.FindFetchOne(id, &result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// GetOwnedBy returns all domains owned by id
+func (d *DomainsTable) GetOwnedBy(id string) ([]*models.Domain, error) {
+	var result []*models.Domain
+
+	if err := d.FindByIndexFetch(&result, "owner", id); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// GetVerified returns the verified domain with the specified name
+func (d *DomainsTable) GetVerified(name string) (*models.Domain, error) {
+	var result []*models.Domain
+
+	if err := d.FindByIndexFetch(&result, "name", name); err != nil {
+		return nil, err
+	}
+
+	for _, domain := range result {
+		if domain.Status == "verified" {
+			return domain, nil
+		}
+	}
+
+	return nil, NewDatabaseError(d, gorethink.ErrEmptyResult, "")
+}
+
+// Verify marks the domain as verified once it claims its name. Inserting a
+// claim fails if the name is already claimed, so only one of concurrent
+// verifications succeeds. It returns false if another domain holds the name.
+func (d *DomainsTable) Verify(domain *models.Domain) (bool, error) {
+	if _, err := d.Claims.GetTable().Insert(&domainClaim{
+		Name:   domain.Name,
+		Domain: domain.ID,
+		Owner:  domain.Owner,
+	}).RunWrite(d.Claims.GetSession()); err != nil {
+		// Either the name is taken or the claim is a leftover of this domain
+		var claim domainClaim
+		if err := d.Claims.FindFetchOne(domain.Name, &claim); err != nil {
+			return false, err
+		}
+
+		if claim.Domain != domain.ID {
+			return false, nil
+		}
+	}
+
+	domain.Status = "verified"
+	domain.DateVerified = time.Now().UTC()
+	domain.DateModified = domain.DateVerified
+
+	return true, d.UpdateID(domain.ID, domain)
+}
+
+// DeleteDomain removes the domain and releases its name if it was verified
+func (d *DomainsTable) DeleteDomain(domain *models.Domain) error {
+	if domain.Status == "verified" {
+		if _, err := d.Claims.GetTable().Get(domain.Name).Filter(map[string]interface{}{
+			"domain": domain.ID,
+		}).Delete().RunWrite(d.Claims.GetSession()); err != nil {
+			return err
+		}
+	}
+
+	return d.DeleteID(domain.ID)
+}
+
+// DeleteOwnedBy removes all domains owned by id and releases their names
+func (d *DomainsTable) DeleteOwnedBy(id string) (int, error) {
+	if _, err := d.Claims.DeleteByIndex("owner", id); err != nil {
+		return 0, err
+	}
+
+	return d.DeleteByIndex("owner", id)
+}
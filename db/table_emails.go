@@ -37,10 +37,8 @@ func (e *EmailsTable) GetOwnedBy(id string) ([]*models.Email, error) {
 }
 
 // DeleteOwnedBy deletes all emails owned by id
-func (e *EmailsTable) DeleteOwnedBy(id string) error {
-	return e.Delete(map[string]interface{}{
-		"owner": id,
-	})
+func (e *EmailsTable) DeleteOwnedBy(id string) (int, error) {
+	return e.DeleteByIndex("owner", id)
 }
 
 func (e *EmailsTable) CountOwnedBy(id string) (int, error) {
@@ -55,33 +53,10 @@ func (e *EmailsTable) List(
 	thread string,
 ) ([]*models.Email, error) {
 
-	filter := map[string]interface{}{}
-
-	if owner != "" {
-		filter["owner"] = owner
-	}
-
-	if thread != "" {
-		filter["thread"] = thread
-	}
-
-	term := e.GetTable().Filter(filter).Filter(gorethink.Not(gorethink.Row.Field("status").Eq(gorethink.Expr("queued"))))
+	term := e.GetTable().Filter(e.listFilter(owner, thread))
 
 	// If sort array has contents, parse them and add to the term
-	if sort != nil && len(sort) > 0 {
-		var conds []interface{}
-		for _, cond := range sort {
-			if cond[0] == '-' {
-				conds = append(conds, gorethink.Desc(cond[1:]))
-			} else if cond[0] == '+' || cond[0] == ' ' {
-				conds = append(conds, gorethink.Asc(cond[1:]))
-			} else {
-				conds = append(conds, gorethink.Asc(cond))
-			}
-		}
-
-		term = term.OrderBy(conds...)
-	}
+	term = orderBy(term, sort)
 
 	// Slice the result in 3 cases
 	if offset != 0 && limit == 0 {
@@ -113,6 +88,72 @@ func (e *EmailsTable) List(
 	return resp, nil
 }
 
+// ListPage returns a page of emails listed by List, using a cursor instead of an offset
+func (e *EmailsTable) ListPage(owner string, thread string, opts *PageOpts) ([]*models.Email, *Cursor, error) {
+	term := opts.between(e.GetTable(), "owner", owner)
+	if thread != "" {
+		term = opts.between(e.GetTable(), "thread", thread)
+	}
+
+	// Run the query
+	cursor, err := term.Filter(e.listFilter(owner, thread)).Limit(opts.Limit + 1).Run(e.GetSession())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cursor.Close()
+
+	// Fetch the cursor
+	var resp []*models.Email
+	err = cursor.All(&resp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	count, next := opts.next(len(resp), func(i int) *models.Resource {
+		return &resp[i].Resource
+	})
+
+	return resp[:count], next, nil
+}
+
+// CountList counts all emails matched by List
+func (e *EmailsTable) CountList(owner string, thread string) (int, error) {
+	term := e.GetTable().GetAllByIndex("owner", owner)
+	if thread != "" {
+		term = e.GetTable().GetAllByIndex("thread", thread)
+	}
+
+	cursor, err := term.Filter(e.listFilter(owner, thread)).Count().Run(e.GetSession())
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+
+	var result int
+	if err := cursor.One(&result); err != nil {
+		return 0, err
+	}
+
+	return result, nil
+}
+
+// listFilter matches emails of an owner in a thread, hiding the queued ones
+func (e *EmailsTable) listFilter(owner string, thread string) func(row gorethink.Term) gorethink.Term {
+	return func(row gorethink.Term) gorethink.Term {
+		cond := row.Field("status").Ne("queued")
+
+		if owner != "" {
+			cond = cond.And(row.Field("owner").Eq(owner))
+		}
+
+		if thread != "" {
+			cond = cond.And(row.Field("thread").Eq(thread))
+		}
+
+		return cond
+	}
+}
+
 func (e *EmailsTable) GetByThread(thread string) ([]*models.Email, error) {
 	var result []*models.Email
 
@@ -150,3 +191,82 @@ func (e *EmailsTable) GetThreadManifest(thread string) (string, error) {
 
 	return manifest, nil
 }
+
+// Search returns owner's emails matching the query. Label terms have to
+// contain label IDs.
+func (e *EmailsTable) Search(
+	owner string,
+	query SearchQuery,
+	sort []string,
+	offset int,
+	limit int,
+) ([]*models.Email, error) {
+	term := orderBy(e.searchTerm(owner, query), sort)
+
+	// Slice the result
+	if offset != 0 || limit != 0 {
+		term = term.Slice(offset, offset+limit)
+	}
+
+	// Run the query
+	cursor, err := term.Run(e.GetSession())
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	// Fetch the cursor
+	var resp []*models.Email
+	err = cursor.All(&resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// SearchThreads returns IDs of owner's threads that contain an email matching
+// the query
+func (e *EmailsTable) SearchThreads(owner string, query SearchQuery) ([]string, error) {
+	cursor, err := e.searchTerm(owner, query).Field("thread").Distinct().Run(e.GetSession())
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var resp []string
+	err = cursor.All(&resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// searchTerm looks up the emails using one of the address indexes if possible
+// and filters them using the rest of the query
+func (e *EmailsTable) searchTerm(owner string, query SearchQuery) gorethink.Term {
+	var term gorethink.Term
+	if index := query.index(); index != nil {
+		term = e.GetTable().GetAllByIndex(index.Key, index.Value)
+	} else {
+		term = e.GetTable().GetAllByIndex("owner", owner)
+	}
+
+	threads := gorethink.DB(e.GetDBName()).Table("threads")
+
+	return term.Filter(func(row gorethink.Term) gorethink.Term {
+		cond := row.Field("owner").Eq(owner)
+
+		// Queued emails are hidden, unless explicitly requested
+		if !query.Has("status") {
+			cond = cond.And(row.Field("status").Ne("queued"))
+		}
+
+		for _, term := range query {
+			cond = cond.And(term.emailCondition(row, threads))
+		}
+
+		return cond
+	})
+}
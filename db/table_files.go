@@ -1,7 +1,15 @@
 package db
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
 	"github.com/lavab/api/models"
+	"github.com/lavab/api/storage"
 
 	"github.com/dancannon/gorethink"
 )
@@ -9,25 +17,33 @@ import (
 type FilesTable struct {
 	RethinkCRUD
 	Emails *EmailsTable
+	Blobs  storage.BlobStore
 }
 
+// GetFile returns file's metadata, without the payload
 func (f *FilesTable) GetFile(id string) (*models.File, error) {
-	var result models.File
-
-	if err := f.FindFetchOne(id, &result); err != nil {
+	cursor, err := f.GetTable().Get(id).Without("data").Run(f.GetSession())
+	if err != nil {
 		return nil, err
 	}
+	defer cursor.Close()
+
+	var result models.File
+	if err := cursor.One(&result); err != nil {
+		return nil, NewDatabaseError(f, err, "")
+	}
 
 	return &result, nil
 }
 
+// GetFiles returns metadata of files with specified IDs
 func (f *FilesTable) GetFiles(ids ...string) ([]*models.File, error) {
 	iids := make([]interface{}, len(ids))
 	for i, v := range ids {
 		iids[i] = v
 	}
 
-	query, err := f.GetTable().GetAll(iids...).Run(f.GetSession())
+	query, err := f.GetTable().GetAll(iids...).Without("data").Run(f.GetSession())
 	if err != nil {
 		return nil, err
 	}
@@ -40,23 +56,441 @@ func (f *FilesTable) GetFiles(ids ...string) ([]*models.File, error) {
 	return result, nil
 }
 
+// GetOwnedBy returns metadata of all files owned by id
 func (f *FilesTable) GetOwnedBy(id string) ([]*models.File, error) {
+	query, err := f.GetTable().GetAllByIndex("owner", id).Without("data").Run(f.GetSession())
+	if err != nil {
+		return nil, err
+	}
+
 	var result []*models.File
+	if err := query.All(&result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// List returns metadata of owner's files, optionally narrowed down to the ones
+// with specified IDs and name, sorted and sliced using an offset
+func (f *FilesTable) List(
+	owner string,
+	ids []string,
+	name string,
+	sort []string,
+	offset int,
+	limit int,
+) ([]*models.File, error) {
+	term := orderBy(f.GetTable().GetAllByIndex("owner", owner).Filter(f.listFilter(ids, name)), sort)
+
+	// Slice the result
+	if offset != 0 || limit != 0 {
+		term = term.Slice(offset, offset+limit)
+	}
+
+	return f.fetch(term)
+}
+
+// ListPage returns a page of files listed by List, using a cursor instead of an offset
+func (f *FilesTable) ListPage(owner string, ids []string, name string, opts *PageOpts) ([]*models.File, *Cursor, error) {
+	resp, err := f.fetch(opts.between(f.GetTable(), "owner", owner).Filter(f.listFilter(ids, name)).Limit(opts.Limit + 1))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	count, next := opts.next(len(resp), func(i int) *models.Resource {
+		return &resp[i].Resource
+	})
+
+	return resp[:count], next, nil
+}
+
+// CountList counts all files matched by List
+func (f *FilesTable) CountList(owner string, ids []string, name string) (int, error) {
+	cursor, err := f.GetTable().GetAllByIndex("owner", owner).Filter(f.listFilter(ids, name)).Count().Run(f.GetSession())
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+
+	var result int
+	if err := cursor.One(&result); err != nil {
+		return 0, err
+	}
+
+	return result, nil
+}
+
+// listFilter matches files with one of the IDs and the name. nil IDs and an
+// empty name match all files.
+func (f *FilesTable) listFilter(ids []string, name string) func(row gorethink.Term) gorethink.Term {
+	return func(row gorethink.Term) gorethink.Term {
+		cond := gorethink.Expr(true)
 
-	err := f.WhereAndFetch(map[string]interface{}{
-		"owner": id,
-	}, &result)
+		if ids != nil {
+			cond = cond.And(gorethink.Expr(ids).Contains(row.Field("id")))
+		}
+
+		if name != "" {
+			cond = cond.And(row.Field("name").Eq(name))
+		}
+
+		return cond
+	}
+}
+
+// fetch runs a query and returns the files without their payloads
+func (f *FilesTable) fetch(term gorethink.Term) ([]*models.File, error) {
+	cursor, err := term.Without("data").Run(f.GetSession())
 	if err != nil {
 		return nil, err
 	}
+	defer cursor.Close()
+
+	var resp []*models.File
+	if err := cursor.All(&resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// OpenPayload opens the payload of a file for reading
+func (f *FilesTable) OpenPayload(file *models.File) (io.ReadCloser, error) {
+	// Files that weren't migrated yet might still have it inline
+	if file.Blob == "" {
+		cursor, err := f.GetTable().Get(file.ID).Field("data").Run(f.GetSession())
+		if err != nil {
+			return nil, err
+		}
+		defer cursor.Close()
+
+		var data string
+		if err := cursor.One(&data); err != nil {
+			return nil, NewDatabaseError(f, err, "")
+		}
+
+		return ioutil.NopCloser(strings.NewReader(data)), nil
+	}
+
+	return f.Blobs.Get(file.Blob)
+}
+
+// StorePayload puts the payload into the blob store under its content address
+// and fills in file's Hash, Size and Blob. open is called twice - once to hash
+// the payload and once to store it, unless an identical blob already exists.
+func (f *FilesTable) StorePayload(file *models.File, open func() (io.ReadCloser, error)) error {
+	// Hash the payload
+	payload, err := open()
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, payload)
+	payload.Close()
+	if err != nil {
+		return err
+	}
+
+	// Blobs are addressed per owner, so that an account can't probe for other accounts' payloads
+	file.Hash = hex.EncodeToString(hash.Sum(nil))
+	file.Size = size
+	file.Blob = "files/" + file.Owner + "/" + file.Hash
+	file.Data = ""
+
+	exists, err := f.Blobs.Exists(file.Blob)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	payload, err = open()
+	if err != nil {
+		return err
+	}
+	defer payload.Close()
+
+	_, err = f.Blobs.Put(file.Blob, payload)
+	return err
+}
+
+// ReleasePayload removes a blob if no file references it anymore
+func (f *FilesTable) ReleasePayload(blob string) error {
+	if blob == "" {
+		return nil
+	}
+
+	cursor, err := f.GetTable().GetAllByIndex("blob", blob).Count().Run(f.GetSession())
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	var count int
+	if err := cursor.One(&count); err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return nil
+	}
+
+	return f.Blobs.Delete(blob)
+}
+
+// DeleteID removes the file and its payload, unless another file shares it
+func (f *FilesTable) DeleteID(id string) error {
+	file, err := f.GetFile(id)
+	if err != nil {
+		return err
+	}
+
+	if err := f.RethinkCRUD.DeleteID(id); err != nil {
+		return err
+	}
+
+	return f.ReleasePayload(file.Blob)
+}
+
+// SizeOwnedBy sums sizes of files owned by id
+func (f *FilesTable) SizeOwnedBy(id string) (int64, error) {
+	cursor, err := f.GetTable().GetAllByIndex("owner", id).Sum("size").Run(f.GetSession())
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+
+	var result int64
+	if err := cursor.One(&result); err != nil {
+		return 0, err
+	}
 
 	return result, nil
 }
 
-func (f *FilesTable) DeleteOwnedBy(id string) error {
-	return f.Delete(map[string]interface{}{
-		"owner": id,
-	})
+// DeleteOwnedBy removes all files owned by id together with their payloads
+func (f *FilesTable) DeleteOwnedBy(id string) (int, error) {
+	cursor, err := f.GetTable().GetAllByIndex("owner", id).Field("blob").Default("").Distinct().Run(f.GetSession())
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+
+	var blobs []string
+	if err := cursor.All(&blobs); err != nil {
+		return 0, err
+	}
+
+	// Payloads go first, so that a retry can find them. Blobs are addressed per
+	// owner, so none of them are shared with other accounts.
+	for _, blob := range blobs {
+		if blob != "" {
+			if err := f.Blobs.Delete(blob); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return f.DeleteByIndex("owner", id)
+}
+
+// MigratePayloads moves payloads of files created before content addressing
+// (inline in the data field or in per-file blobs) to content-addressed blobs.
+// Inline payloads are removed once they're in the blob store, except for
+// attachments of queued emails - the mailer still reads them from the table.
+func (f *FilesTable) MigratePayloads() (int, error) {
+	cursor, err := f.GetTable().Filter(func(row gorethink.Term) gorethink.Term {
+		return row.Field("hash").Default("").Eq("")
+	}).Without("data").Run(f.GetSession())
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+
+	var files []*models.File
+	if err := cursor.All(&files); err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, file := range files {
+		// An inline payload takes precedence over the old blob
+		oldBlob := file.Blob
+		source := file.Blob
+		inline, err := f.hasInlineData(file.ID)
+		if err != nil {
+			return migrated, err
+		}
+		if inline {
+			source = ""
+		}
+
+		if err := f.StorePayload(file, func() (io.ReadCloser, error) {
+			return f.OpenPayload(&models.File{
+				Resource: models.Resource{ID: file.ID},
+				Blob:     source,
+			})
+		}); err != nil {
+			return migrated, fmt.Errorf("unable to migrate file %s: %v", file.ID, err)
+		}
+
+		if err := f.UpdateID(file.ID, map[string]interface{}{
+			"hash": file.Hash,
+			"size": file.Size,
+			"blob": file.Blob,
+		}); err != nil {
+			return migrated, err
+		}
+
+		if oldBlob != "" && oldBlob != file.Blob {
+			if err := f.Blobs.Delete(oldBlob); err != nil {
+				return migrated, err
+			}
+		}
+
+		if inline {
+			if err := f.releaseInlinePayload(file); err != nil {
+				return migrated, err
+			}
+		}
+
+		migrated++
+	}
+
+	// Copies made for emails which were sent while the API was down
+	cursor, err = f.GetTable().Filter(func(row gorethink.Term) gorethink.Term {
+		return row.Field("hash").Default("").Ne("").And(row.Field("data").Default("").Ne(""))
+	}).Without("data").Run(f.GetSession())
+	if err != nil {
+		return migrated, err
+	}
+	defer cursor.Close()
+
+	var inlined []*models.File
+	if err := cursor.All(&inlined); err != nil {
+		return migrated, err
+	}
+
+	for _, file := range inlined {
+		if err := f.releaseInlinePayload(file); err != nil {
+			return migrated, err
+		}
+	}
+
+	return migrated, nil
+}
+
+// hasInlineData checks whether the file's payload is stored in the data field
+func (f *FilesTable) hasInlineData(id string) (bool, error) {
+	cursor, err := f.GetTable().Get(id).Field("data").Default("").Ne("").Run(f.GetSession())
+	if err != nil {
+		return false, err
+	}
+	defer cursor.Close()
+
+	var inline bool
+	if err := cursor.One(&inline); err != nil {
+		return false, err
+	}
+
+	return inline, nil
+}
+
+// InlinePayloads copies payloads of the files from the blob store into their
+// data fields. The mailer loads attachments from the files table, so it has to
+// be called before an email is queued for sending. The copies are removed by
+// ReleaseInlinePayloads once the email is sent.
+func (f *FilesTable) InlinePayloads(ids ...string) error {
+	for _, id := range ids {
+		inline, err := f.hasInlineData(id)
+		if err != nil {
+			return err
+		}
+		if inline {
+			continue
+		}
+
+		file, err := f.GetFile(id)
+		if err != nil {
+			return err
+		}
+
+		payload, err := f.OpenPayload(file)
+		if err != nil {
+			return err
+		}
+
+		data, err := ioutil.ReadAll(payload)
+		payload.Close()
+		if err != nil {
+			return err
+		}
+
+		if err := f.UpdateID(id, map[string]interface{}{
+			"data": string(data),
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReleaseInlinePayloads removes inline copies of payloads of the files, unless
+// they are attached to another queued email. Files without a content-addressed
+// blob are left alone, as the copy is their only payload.
+func (f *FilesTable) ReleaseInlinePayloads(ids ...string) error {
+	for _, id := range ids {
+		file, err := f.GetFile(id)
+		if err != nil {
+			// Attachments might have been deleted in the meantime
+			if IsNotFound(err) {
+				continue
+			}
+
+			return err
+		}
+
+		if err := f.releaseInlinePayload(file); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// releaseInlinePayload removes the data field of a file stored in the blob
+// store if no queued email references it
+func (f *FilesTable) releaseInlinePayload(file *models.File) error {
+	if file.Hash == "" || file.Blob == "" {
+		return nil
+	}
+
+	cursor, err := f.Emails.GetTable().GetAllByIndex("owner", file.Owner).Filter(func(row gorethink.Term) gorethink.Term {
+		return row.Field("status").Eq("queued").And(row.Field("files").Default([]string{}).Contains(file.ID))
+	}).Count().Run(f.Emails.GetSession())
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	var queued int
+	if err := cursor.One(&queued); err != nil {
+		return err
+	}
+
+	if queued > 0 {
+		return nil
+	}
+
+	// Files without the data field are left unchanged
+	_, err = f.GetTable().Get(file.ID).Replace(func(row gorethink.Term) gorethink.Term {
+		return row.Without("data")
+	}).RunWrite(f.GetSession())
+	return err
 }
 
 func (f *FilesTable) GetEmailFiles(id string) ([]*models.File, error) {
@@ -108,7 +542,7 @@ func (f *FilesTable) GetInEmail(owner string, email string, name string) ([]*mod
 			gorethink.Expr(e.Files).Contains(row.Field("id")),
 			row.Field("name").Eq(gorethink.Expr(name)),
 		)
-	}).Run(f.GetSession())
+	}).Without("data").Run(f.GetSession())
 	if err != nil {
 		return nil, err
 	}
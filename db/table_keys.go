@@ -1,17 +1,51 @@
 package db
 
 import (
+	"github.com/dancannon/gorethink"
+
 	"github.com/lavab/api/models"
 )
 
 type KeysTable struct {
 	RethinkCRUD
+	Votes *VotesTable
+}
+
+// withReliability derives the reliability of keys from the votes stored for
+// them, so that concurrent votes can't leave a stale score in the key
+func (k *KeysTable) withReliability(term gorethink.Term) gorethink.Term {
+	return term.Merge(func(key gorethink.Term) interface{} {
+		return map[string]interface{}{
+			"reliability": k.Votes.GetTable().Get(key.Field("id")).Do(func(votes gorethink.Term) interface{} {
+				return gorethink.Branch(
+					votes.Eq(nil),
+					0,
+					votes.Field("for").Count().Sub(votes.Field("against").Count()),
+				)
+			}),
+		}
+	})
+}
+
+// fetch runs a query returning keys and fills results with them
+func (k *KeysTable) fetch(term gorethink.Term, results *[]*models.Key) error {
+	cursor, err := k.withReliability(term).Run(k.GetSession())
+	if err != nil {
+		return NewDatabaseError(k, err, "")
+	}
+	defer cursor.Close()
+
+	if err := cursor.All(results); err != nil {
+		return NewDatabaseError(k, err, "")
+	}
+
+	return nil
 }
 
 func (k *KeysTable) FindByOwner(id string) ([]*models.Key, error) {
 	var results []*models.Key
 
-	if err := k.FindByAndFetch("owner", id, &results); err != nil {
+	if err := k.fetch(k.GetTable().GetAllByIndex("owner", id), &results); err != nil {
 		return nil, err
 	}
 
@@ -19,11 +53,43 @@ func (k *KeysTable) FindByOwner(id string) ([]*models.Key, error) {
 }
 
 func (k *KeysTable) FindByFingerprint(fp string) (*models.Key, error) {
-	var result models.Key
+	var results []*models.Key
+
+	// GetAll doesn't return null for missing keys, unlike Get
+	if err := k.fetch(k.GetTable().GetAll(fp), &results); err != nil {
+		return nil, err
+	}
+
+	if len(results) == 0 {
+		return nil, NewDatabaseError(k, gorethink.ErrEmptyResult, "")
+	}
 
-	if err := k.FindFetchOne(fp, &result); err != nil {
+	return results[0], nil
+}
+
+// FindByKeyID returns keys with the specified 16-character key ID
+func (k *KeysTable) FindByKeyID(id string) ([]*models.Key, error) {
+	var results []*models.Key
+
+	if err := k.fetch(k.GetTable().GetAllByIndex("key_id", id), &results); err != nil {
 		return nil, err
 	}
 
-	return &result, nil
+	return results, nil
+}
+
+// FindByKeyIDShort returns keys with the specified 8-character key ID
+func (k *KeysTable) FindByKeyIDShort(id string) ([]*models.Key, error) {
+	var results []*models.Key
+
+	if err := k.fetch(k.GetTable().GetAllByIndex("key_id_short", id), &results); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// DeleteOwnedBy deletes all keys owned by id
+func (k *KeysTable) DeleteOwnedBy(id string) (int, error) {
+	return k.DeleteByIndex("owner", id)
 }
@@ -1,44 +1,99 @@
 package db
 
 import (
+	"errors"
 	"time"
 
-	//"github.com/dancannon/gorethink"
+	"github.com/dancannon/gorethink"
 
-	//"github.com/lavab/api/cache"
+	"github.com/lavab/api/cache"
 	"github.com/lavab/api/models"
 )
 
+// ErrMisconfiguredAccount is returned if an account lacks builtin labels
+var ErrMisconfiguredAccount = errors.New("Misconfigured account")
+
+// LabelsTable implements the CRUD interface for labels. Labels are cached by
+// ID, as lists of owner's labels and as lists with thread counts.
 type LabelsTable struct {
 	RethinkCRUD
-	Emails *EmailsTable
-	//Cache   cache.Cache
+	Emails  *EmailsTable
+	Threads *ThreadsTable
+	Cache   cache.Cache
 	Expires time.Duration
 }
 
+// labelCounts is the cached form of owner's labels with thread counts
+type labelCounts struct {
+	Labels []*models.Label
+}
+
+func (l *LabelsTable) idKey(id string) string {
+	return l.GetTableName() + ":" + id
+}
+
+func (l *LabelsTable) ownerKey(owner string) string {
+	return l.GetTableName() + ":owner:" + owner
+}
+
+func (l *LabelsTable) countsKey(owner string) string {
+	return l.GetTableName() + ":counts:" + owner
+}
+
+// Insert monkey-patches the DefaultCRUD method and introduces caching
 func (l *LabelsTable) Insert(data interface{}) error {
 	if err := l.RethinkCRUD.Insert(data); err != nil {
 		return err
 	}
 
+	var labels []*models.Label
+	switch v := data.(type) {
+	case *models.Label:
+		labels = []*models.Label{v}
+	case []*models.Label:
+		labels = v
+	default:
+		return nil
+	}
+
+	for _, label := range labels {
+		if err := l.Cache.Set(l.idKey(label.ID), label, l.Expires); err != nil {
+			return err
+		}
+
+		if err := l.invalidateOwner(label.Owner); err != nil {
+			return err
+		}
+	}
+
 	return nil
+}
+
+// Create inserts the label unless its ID is taken. It returns false if it is,
+// eg. when the label of a tag was created by another delivery.
+func (l *LabelsTable) Create(label *models.Label) (bool, error) {
+	created, err := insertUnique(l, label)
+	if err != nil || !created {
+		return false, err
+	}
 
-	//label, ok := data.(*models.Token)
-	//if !ok {
-	//	return nil
-	//}
+	if err := l.Cache.Set(l.idKey(label.ID), label, l.Expires); err != nil {
+		return false, err
+	}
 
-	//return l.Cache.Set(l.RethinkCRUD.GetTableName()+":"+label.ID, label, l.Expires)
+	return true, l.invalidateOwner(label.Owner)
 }
 
-// Update clears all updated keys
+// Update clears cached keys of the updated labels and their owners
 func (l *LabelsTable) Update(data interface{}) error {
-	if err := l.RethinkCRUD.Update(data); err != nil {
-		return err
+	result, err := l.GetTable().Update(data, gorethink.UpdateOpts{
+		ReturnChanges: true,
+	}).RunWrite(l.GetSession())
+	if err != nil {
+		return NewDatabaseError(l, err, "")
 	}
 
-	return nil
-	//return l.Cache.DeleteMask(l.RethinkCRUD.GetTableName() + ":*")
+	return l.deleteCached(result)
 }
 
 // UpdateID updates the specified label and updates cache
@@ -47,68 +102,136 @@ func (l *LabelsTable) UpdateID(id string, data interface{}) error {
 		return err
 	}
 
-	return nil
+	// Bypass the cache, it contains the old version
+	var label models.Label
+	if err := l.RethinkCRUD.FindFetchOne(id, &label); err != nil {
+		return err
+	}
 
-	//label, err := l.GetLabel(id)
-	//if err != nil {
-	//	return err
-	//}
+	if err := l.Cache.Set(l.idKey(id), &label, l.Expires); err != nil {
+		return err
+	}
 
-	//return l.Cache.Set(l.RethinkCRUD.GetTableName()+":"+id, label, l.Expires)
+	return l.invalidateOwner(label.Owner)
 }
 
 // Delete removes from db and cache using filter
 func (l *LabelsTable) Delete(cond interface{}) error {
-	/*result, err := l.GetTable().Filter(cond).Delete(gorethink.DeleteOpts{
+	result, err := l.GetTable().Filter(cond).Delete(gorethink.DeleteOpts{
 		ReturnChanges: true,
-	}).RunWrite(l.GetSession())*/
-	_, err := l.GetTable().Filter(cond).Delete().RunWrite(l.GetSession())
+	}).RunWrite(l.GetSession())
 	if err != nil {
 		return err
 	}
 
-	return nil
-
-	/*var ids []interface{}
-	for _, change := range result.Changes {
-		ids = append(ids, l.RethinkCRUD.GetTableName()+":"+change.OldValue.(map[string]interface{})["id"].(string))
-	}
-
-	return l.Cache.DeleteMulti(ids...)*/
+	return l.deleteCached(result)
 }
 
 // DeleteID removes from db and cache using id query
 func (l *LabelsTable) DeleteID(id string) error {
-	/*label, err := l.GetLabel(id)
+	result, err := l.GetTable().Get(id).Delete(gorethink.DeleteOpts{
+		ReturnChanges: true,
+	}).RunWrite(l.GetSession())
 	if err != nil {
 		return err
-	}*/
+	}
 
-	if err := l.RethinkCRUD.DeleteID(l.RethinkCRUD.GetTableName() + ":" + id); err != nil {
-		return err
+	return l.deleteCached(result)
+}
+
+// DeleteByIndex removes from db and cache using an index query
+func (l *LabelsTable) DeleteByIndex(index string, values ...interface{}) (int, error) {
+	result, err := l.GetTable().GetAllByIndex(index, values...).Delete(gorethink.DeleteOpts{
+		ReturnChanges: true,
+	}).RunWrite(l.GetSession())
+	if err != nil {
+		return 0, err
 	}
 
-	/*l.Cache.Delete(l.RethinkCRUD.GetTableName() + ":" + id)
-	l.Cache.Delete(l.RethinkCRUD.GetTableName() + ":owner:" + label.Owner)*/
+	return result.Deleted, l.deleteCached(result)
+}
 
-	return nil
+// DeleteOwnedBy deletes all labels owned by id
+func (l *LabelsTable) DeleteOwnedBy(id string) (int, error) {
+	return l.DeleteByIndex("owner", id)
+}
+
+// DeleteCustomOwnedBy deletes all labels owned by id that aren't builtin
+func (l *LabelsTable) DeleteCustomOwnedBy(id string) (int, error) {
+	result, err := l.GetTable().GetAllByIndex("owner", id).Filter(map[string]interface{}{
+		"builtin": false,
+	}).Delete(gorethink.DeleteOpts{
+		ReturnChanges: true,
+	}).RunWrite(l.GetSession())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.Deleted, l.deleteCached(result)
 }
 
+// deleteCached removes labels changed by a write query from the cache
+func (l *LabelsTable) deleteCached(result gorethink.WriteResponse) error {
+	var (
+		keys   []interface{}
+		owners = map[string]struct{}{}
+	)
+	for _, change := range result.Changes {
+		// Updates might move labels between owners, so both versions count
+		for _, value := range []interface{}{change.OldValue, change.NewValue} {
+			label, ok := value.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			if id, ok := label["id"].(string); ok {
+				keys = append(keys, l.idKey(id))
+			}
+			if owner, ok := label["owner"].(string); ok {
+				owners[owner] = struct{}{}
+			}
+		}
+	}
+
+	for owner := range owners {
+		keys = append(keys, l.ownerKey(owner), l.countsKey(owner))
+	}
+
+	// DEL without any keys is an invalid redis command
+	if len(keys) == 0 {
+		return nil
+	}
+
+	return l.Cache.DeleteMulti(keys...)
+}
+
+// invalidateOwner removes owner's cached label lists
+func (l *LabelsTable) invalidateOwner(owner string) error {
+	return l.Cache.DeleteMulti(l.ownerKey(owner), l.countsKey(owner))
+}
+
+// InvalidateCounts removes owner's cached thread counts. It has to be called
+// whenever threads of the owner are created, deleted or change their labels
+// or read state.
+func (l *LabelsTable) InvalidateCounts(owner string) error {
+	return l.Cache.Delete(l.countsKey(owner))
+}
+
+// GetLabel returns a label with the specified ID
 func (l *LabelsTable) GetLabel(id string) (*models.Label, error) {
 	var result models.Label
 
-	/*if err := l.Cache.Get(l.RethinkCRUD.GetTableName()+":"+id, &result); err == nil {
+	if err := l.Cache.Get(l.idKey(id), &result); err == nil {
 		return &result, nil
-	}*/
+	}
 
 	if err := l.FindFetchOne(id, &result); err != nil {
 		return nil, err
 	}
 
-	/*err := l.Cache.Set(l.RethinkCRUD.GetTableName()+":"+id, result, l.Expires)
-	if err != nil {
+	if err := l.Cache.Set(l.idKey(id), &result, l.Expires); err != nil {
 		return nil, err
-	}*/
+	}
 
 	return &result, nil
 }
@@ -117,39 +240,101 @@ func (l *LabelsTable) GetLabel(id string) (*models.Label, error) {
 func (l *LabelsTable) GetOwnedBy(id string) ([]*models.Label, error) {
 	var result []*models.Label
 
-	/*if err := l.Cache.Get(l.RethinkCRUD.GetTableName()+":owner:"+id, &result); err == nil {
+	if err := l.Cache.Get(l.ownerKey(id), &result); err == nil {
 		return result, nil
-	}*/
+	}
 
-	err := l.WhereAndFetch(map[string]interface{}{
-		"owner": id,
-	}, &result)
-	if err != nil {
+	if err := l.FindByIndexFetch(&result, "owner", id); err != nil {
 		return nil, err
 	}
 
-	/*err = l.Cache.Set(l.RethinkCRUD.GetTableName()+":owner:"+id, result, l.Expires)
-	if err != nil {
+	if err := l.Cache.Set(l.ownerKey(id), result, l.Expires); err != nil {
 		return nil, err
-	}*/
+	}
 
 	return result, nil
 }
 
+// GetLabelByNameAndOwner returns owner's label with the specified name
 func (l *LabelsTable) GetLabelByNameAndOwner(owner string, name string) (*models.Label, error) {
-	var result models.Label
+	labels, err := l.GetOwnedBy(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, label := range labels {
+		if label.Name == name {
+			return label, nil
+		}
+	}
+
+	return nil, NewDatabaseError(l, gorethink.ErrEmptyResult, "")
+}
 
-	if err := l.WhereAndFetchOne(map[string]interface{}{
-		"name":  name,
-		"owner": owner,
-	}, &result); err != nil {
+// GetBuiltin returns owner's builtin label with the specified name, eg. "Sent"
+func (l *LabelsTable) GetBuiltin(owner string, name string) (*models.Label, error) {
+	labels, err := l.GetOwnedBy(owner)
+	if err != nil {
 		return nil, err
 	}
 
-	/*err := l.Cache.Set(l.RethinkCRUD.GetTableName()+":"+id, result, l.Expires)
+	for _, label := range labels {
+		if label.Builtin && label.Name == name {
+			return label, nil
+		}
+	}
+
+	return nil, NewDatabaseError(l, gorethink.ErrEmptyResult, "")
+}
+
+// GetOwnedByWithCounts returns all labels owned by id with thread counts.
+// Threads labeled as Spam, Trash or Sent don't count as unread in other labels.
+func (l *LabelsTable) GetOwnedByWithCounts(id string) ([]*models.Label, error) {
+	var result labelCounts
+
+	if err := l.Cache.Get(l.countsKey(id), &result); err == nil {
+		return result.Labels, nil
+	}
+
+	labels, err := l.GetOwnedBy(id)
 	if err != nil {
 		return nil, err
-	}*/
+	}
 
-	return &result, nil
+	var excluded []interface{}
+	for _, label := range labels {
+		if label.Builtin && (label.Name == "Spam" || label.Name == "Trash" || label.Name == "Sent") {
+			excluded = append(excluded, label.ID)
+		}
+	}
+
+	if len(excluded) != 3 {
+		return nil, ErrMisconfiguredAccount
+	}
+
+	threads := l.Threads.GetTable()
+	cursor, err := l.GetTable().GetAllByIndex("owner", id).Map(func(label gorethink.Term) gorethink.Term {
+		return label.Merge(map[string]interface{}{
+			"total_threads_count": threads.GetAllByIndex("labels", label.Field("id")).Count(),
+			"unread_threads_count": threads.GetAllByIndex("labels", label.Field("id")).Filter(func(thread gorethink.Term) gorethink.Term {
+				return thread.Field("is_read").Not().And(
+					gorethink.Expr(excluded).SetIntersection(thread.Field("labels")).IsEmpty(),
+				)
+			}).Count(),
+		})
+	}).Run(l.GetSession())
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	if err := cursor.All(&result.Labels); err != nil {
+		return nil, err
+	}
+
+	if err := l.Cache.Set(l.countsKey(id), &result, l.Expires); err != nil {
+		return nil, err
+	}
+
+	return result.Labels, nil
 }
@@ -0,0 +1,126 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dancannon/gorethink"
+
+	"github.com/lavab/api/cache"
+)
+
+// newCachedLabels creates a labels table with a memory cache holding labels
+// of owners "a" and "b"
+func newCachedLabels(t *testing.T) (*LabelsTable, *cache.MemoryCache) {
+	memory := cache.NewMemoryCache(&cache.MemoryCacheOpts{})
+	labels := &LabelsTable{
+		RethinkCRUD: NewCRUDTable(nil, "test", "labels"),
+		Cache:       memory,
+		Expires:     time.Hour,
+	}
+
+	for _, owner := range []string{"a", "b"} {
+		for _, key := range []string{
+			labels.idKey(owner + "-label"),
+			labels.ownerKey(owner),
+			labels.countsKey(owner),
+		} {
+			if err := memory.Set(key, true, labels.Expires); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	return labels, memory
+}
+
+func expectCached(t *testing.T, memory *cache.MemoryCache, keys map[string]bool) {
+	for key, cached := range keys {
+		if exists, _ := memory.Exists(key); exists != cached {
+			t.Fatalf("key %s cached: %v, expected %v", key, exists, cached)
+		}
+	}
+}
+
+func TestLabelsInvalidateCounts(t *testing.T) {
+	labels, memory := newCachedLabels(t)
+
+	if err := labels.InvalidateCounts("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only owner's counts are stale
+	expectCached(t, memory, map[string]bool{
+		"labels:a-label":  true,
+		"labels:owner:a":  true,
+		"labels:counts:a": false,
+		"labels:b-label":  true,
+		"labels:owner:b":  true,
+		"labels:counts:b": true,
+	})
+}
+
+func TestLabelsDeleteCached(t *testing.T) {
+	labels, memory := newCachedLabels(t)
+
+	if err := labels.deleteCached(gorethink.WriteResponse{
+		Changes: []gorethink.ChangeResponse{
+			{
+				OldValue: map[string]interface{}{
+					"id":    "a-label",
+					"owner": "a",
+				},
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectCached(t, memory, map[string]bool{
+		"labels:a-label":  false,
+		"labels:owner:a":  false,
+		"labels:counts:a": false,
+		"labels:b-label":  true,
+		"labels:owner:b":  true,
+		"labels:counts:b": true,
+	})
+
+	// Writes without changes don't touch the cache
+	if err := labels.deleteCached(gorethink.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if memory.Len() != 3 {
+		t.Fatalf("invalid cache length %d", memory.Len())
+	}
+}
+
+func TestLabelsUpdateCached(t *testing.T) {
+	labels, memory := newCachedLabels(t)
+
+	// An update moving a label to another owner invalidates both owners
+	if err := labels.deleteCached(gorethink.WriteResponse{
+		Changes: []gorethink.ChangeResponse{
+			{
+				OldValue: map[string]interface{}{
+					"id":    "a-label",
+					"owner": "a",
+				},
+				NewValue: map[string]interface{}{
+					"id":    "a-label",
+					"owner": "b",
+				},
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectCached(t, memory, map[string]bool{
+		"labels:a-label":  false,
+		"labels:owner:a":  false,
+		"labels:counts:a": false,
+		"labels:b-label":  true,
+		"labels:owner:b":  false,
+		"labels:counts:b": false,
+	})
+}
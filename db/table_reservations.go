@@ -1,21 +1,33 @@
 package db
 
+import (
+	"time"
+
+	"github.com/dancannon/gorethink"
+
+	"github.com/lavab/api/models"
+)
+
 // ReservationsTable is a CRUD interface for accessing the "reservation" table
 type ReservationsTable struct {
 	RethinkCRUD
 }
 
+// IsUsernameUsed checks whether the username has a reservation that hasn't
+// expired yet
 func (r *ReservationsTable) IsUsernameUsed(name string) (bool, error) {
-	count, err := r.FindByAndCount("name", name)
+	reservations, err := r.GetByName(name)
 	if err != nil {
 		return false, err
 	}
 
-	if count == 0 {
-		return false, nil
+	for _, reservation := range reservations {
+		if !reservation.Expired() {
+			return true, nil
+		}
 	}
 
-	return true, nil
+	return false, nil
 }
 
 func (r *ReservationsTable) IsEmailUsed(email string) (bool, error) {
@@ -30,3 +42,50 @@ func (r *ReservationsTable) IsEmailUsed(email string) (bool, error) {
 
 	return true, nil
 }
+
+// GetByName returns reservations of a username
+func (r *ReservationsTable) GetByName(name string) ([]*models.Reservation, error) {
+	var result []*models.Reservation
+
+	if err := r.FindByIndexFetch(&result, "name", name); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// List returns all reservations sorted by name
+func (r *ReservationsTable) List() ([]*models.Reservation, error) {
+	cursor, err := r.GetTable().OrderBy(gorethink.Asc("name")).Run(r.GetSession())
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var result []*models.Reservation
+	if err := cursor.All(&result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// DeleteExpired removes reservations that have expired. Reservations without
+// an expiry date are kept.
+func (r *ReservationsTable) DeleteExpired() (int, error) {
+	result, err := r.GetTable().Between(
+		time.Unix(0, 0),
+		time.Now(),
+		gorethink.BetweenOpts{Index: "expiry_date"},
+	).Delete().RunWrite(r.GetSession())
+	if err != nil {
+		return 0, NewDatabaseError(r, err, "")
+	}
+
+	return result.Deleted, nil
+}
+
+// DeleteByName releases a username
+func (r *ReservationsTable) DeleteByName(name string) (int, error) {
+	return r.DeleteByIndex("name", name)
+}
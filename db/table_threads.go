@@ -10,6 +10,60 @@ import (
 
 type ThreadsTable struct {
 	RethinkCRUD
+	Emails *EmailsTable
+	Labels *LabelsTable
+}
+
+// Insert creates threads and invalidates label counts of their owners
+func (t *ThreadsTable) Insert(data interface{}) error {
+	if err := t.RethinkCRUD.Insert(data); err != nil {
+		return err
+	}
+
+	switch v := data.(type) {
+	case *models.Thread:
+		return t.Labels.InvalidateCounts(v.Owner)
+	case []*models.Thread:
+		for _, thread := range v {
+			if err := t.Labels.InvalidateCounts(thread.Owner); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// UpdateID updates the thread and invalidates label counts of its owner
+func (t *ThreadsTable) UpdateID(id string, data interface{}) error {
+	if err := t.RethinkCRUD.UpdateID(id, data); err != nil {
+		return err
+	}
+
+	if thread, ok := data.(*models.Thread); ok && thread.Owner != "" {
+		return t.Labels.InvalidateCounts(thread.Owner)
+	}
+
+	thread, err := t.GetThread(id)
+	if err != nil {
+		return err
+	}
+
+	return t.Labels.InvalidateCounts(thread.Owner)
+}
+
+// DeleteID removes the thread and invalidates label counts of its owner
+func (t *ThreadsTable) DeleteID(id string) error {
+	thread, err := t.GetThread(id)
+	if err != nil {
+		return err
+	}
+
+	if err := t.RethinkCRUD.DeleteID(id); err != nil {
+		return err
+	}
+
+	return t.Labels.InvalidateCounts(thread.Owner)
 }
 
 func (t *ThreadsTable) GetThread(id string) (*models.Thread, error) {
@@ -35,10 +89,13 @@ func (t *ThreadsTable) GetOwnedBy(id string) ([]*models.Thread, error) {
 	return result, nil
 }
 
-func (t *ThreadsTable) DeleteOwnedBy(id string) error {
-	return t.Delete(map[string]interface{}{
-		"owner": id,
-	})
+func (t *ThreadsTable) DeleteOwnedBy(id string) (int, error) {
+	deleted, err := t.DeleteByIndex("owner", id)
+	if err != nil {
+		return 0, err
+	}
+
+	return deleted, t.Labels.InvalidateCounts(id)
 }
 
 func (t *ThreadsTable) CountOwnedBy(id string) (int, error) {
@@ -60,88 +117,177 @@ func (t *ThreadsTable) List(
 	}
 
 	// If sort array has contents, parse them and add to the term
-	if sort != nil && len(sort) > 0 {
-		var conds []interface{}
-		for _, cond := range sort {
-			if cond[0] == '-' {
-				conds = append(conds, gorethink.Desc(cond[1:]))
-			} else if cond[0] == '+' || cond[0] == ' ' {
-				conds = append(conds, gorethink.Asc(cond[1:]))
+	term = orderBy(term, sort)
+
+	// Filter by labels
+	if len(labels) > 0 {
+		term = term.Filter(t.labelsFilter(labels))
+	}
+
+	// Slice the result
+	if offset != 0 || limit != 0 {
+		term = term.Slice(offset, offset+limit)
+	}
+
+	// Add manifests
+	term = t.withManifests(term)
+
+	// Run the query
+	cursor, err := term.Run(t.GetSession())
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	// Fetch the cursor
+	var resp []*models.Thread
+	err = cursor.All(&resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// ListPage returns a page of threads listed by List, using a cursor instead of an offset
+func (t *ThreadsTable) ListPage(owner string, labels []string, opts *PageOpts) ([]*models.Thread, *Cursor, error) {
+	term := opts.between(t.GetTable(), "owner", owner)
+
+	if len(labels) > 0 {
+		term = term.Filter(t.labelsFilter(labels))
+	}
+
+	// Add manifests
+	term = t.withManifests(term.Limit(opts.Limit + 1))
+
+	// Run the query
+	cursor, err := term.Run(t.GetSession())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cursor.Close()
+
+	// Fetch the cursor
+	var resp []*models.Thread
+	err = cursor.All(&resp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	count, next := opts.next(len(resp), func(i int) *models.Resource {
+		return &resp[i].Resource
+	})
+
+	return resp[:count], next, nil
+}
+
+// CountList counts all threads matched by List
+func (t *ThreadsTable) CountList(owner string, labels []string) (int, error) {
+	term := t.GetTable().GetAllByIndex("owner", owner)
+
+	if len(labels) > 0 {
+		term = term.Filter(t.labelsFilter(labels))
+	}
+
+	cursor, err := term.Count().Run(t.GetSession())
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+
+	var result int
+	if err := cursor.One(&result); err != nil {
+		return 0, err
+	}
+
+	return result, nil
+}
+
+// labelsFilter matches threads that have all of the labels, except for the
+// ones prefixed with a "-", which must not be assigned to them
+func (t *ThreadsTable) labelsFilter(labels []string) func(row gorethink.Term) gorethink.Term {
+	return func(row gorethink.Term) gorethink.Term {
+		cond := gorethink.Expr(true)
+
+		for _, label := range labels {
+			if label == "" {
+				continue
+			}
+
+			if label[0] == '-' {
+				cond = cond.And(row.Field("labels").Contains(label[1:]).Not())
 			} else {
-				conds = append(conds, gorethink.Asc(cond))
+				cond = cond.And(row.Field("labels").Contains(label))
 			}
 		}
 
-		term = term.OrderBy(conds...)
+		return cond
 	}
+}
 
-	// Parse labels
-	hasLabels := []string{}
-	excLabels := []string{}
-	for _, label := range labels {
-		if label[0] == '-' {
-			excLabels = append(excLabels, label[1:])
+// Search returns owner's threads matching the query. Email terms match threads
+// containing at least one matching email. Label terms have to contain label IDs.
+func (t *ThreadsTable) Search(
+	owner string,
+	query SearchQuery,
+	sort []string,
+	offset int,
+	limit int,
+) ([]*models.Thread, error) {
+	// Split the query
+	var emailQuery, threadQuery SearchQuery
+	for _, term := range query {
+		if isThreadKey(term.Key) {
+			threadQuery = append(threadQuery, term)
 		} else {
-			hasLabels = append(hasLabels, label)
+			emailQuery = append(emailQuery, term)
 		}
 	}
 
-	// Transform that into a term
-	if len(hasLabels) > 0 || len(excLabels) > 0 {
-		var hasTerm gorethink.Term
-		if len(hasLabels) == 1 {
-			hasTerm = gorethink.Row.Field("labels").Contains(hasLabels[0])
-		} else if len(hasLabels) > 0 {
-			for i, label := range hasLabels {
-				if i == 0 {
-					hasTerm = gorethink.Row.Field("labels").Contains(label)
-				} else {
-					hasTerm = hasTerm.And(gorethink.Row.Field("labels").Contains(label))
-				}
-			}
+	term := t.GetTable().GetAllByIndex("owner", owner)
+
+	// Narrow the threads down using the emails first
+	if len(emailQuery) > 0 {
+		ids, err := t.Emails.SearchThreads(owner, emailQuery)
+		if err != nil {
+			return nil, err
 		}
 
-		var excTerm gorethink.Term
-		if len(excLabels) == 1 {
-			excTerm = gorethink.Not(gorethink.Row.Field("labels").Contains(excLabels[0]))
-		} else {
-			for i, label := range excLabels {
-				if i == 0 {
-					excTerm = gorethink.Not(gorethink.Row.Field("labels").Contains(label))
-				} else {
-					excTerm = excTerm.And(gorethink.Not(gorethink.Row.Field("labels").Contains(label)))
-				}
-			}
+		if len(ids) == 0 {
+			return []*models.Thread{}, nil
 		}
 
-		// Append them into the term
-		if len(hasLabels) > 0 && len(excLabels) > 0 {
-			term = term.Filter(hasTerm.And(excTerm))
-		} else if len(hasLabels) > 0 && len(excLabels) == 0 {
-			term = term.Filter(hasTerm)
-		} else if len(hasLabels) == 0 && len(excLabels) > 0 {
-			term = term.Filter(excTerm)
+		iids := make([]interface{}, len(ids))
+		for i, v := range ids {
+			iids[i] = v
 		}
+
+		term = t.GetTable().GetAll(iids...)
 	}
 
+	term = term.Filter(func(row gorethink.Term) gorethink.Term {
+		cond := row.Field("owner").Eq(owner)
+
+		for _, term := range threadQuery {
+			if term.Negated {
+				cond = cond.And(term.threadCondition(row).Not())
+			} else {
+				cond = cond.And(term.threadCondition(row))
+			}
+		}
+
+		return cond
+	})
+
+	term = orderBy(term, sort)
+
 	// Slice the result
 	if offset != 0 || limit != 0 {
 		term = term.Slice(offset, offset+limit)
 	}
 
 	// Add manifests
-	term = term.Map(func(thread gorethink.Term) gorethink.Term {
-		return thread.Merge(gorethink.DB(t.GetDBName()).Table("emails").Between([]interface{}{
-			thread.Field("id"),
-			time.Date(1990, time.January, 1, 23, 0, 0, 0, time.UTC),
-		}, []interface{}{
-			thread.Field("id"),
-			time.Date(2090, time.January, 1, 23, 0, 0, 0, time.UTC),
-		}, gorethink.BetweenOpts{
-			Index: "threadAndDate",
-		}).OrderBy(gorethink.OrderByOpts{Index: "threadAndDate"}).
-			Nth(0).Pluck("manifest"))
-	})
+	term = t.withManifests(term)
 
 	// Run the query
 	cursor, err := term.Run(t.GetSession())
@@ -160,6 +306,22 @@ func (t *ThreadsTable) List(
 	return resp, nil
 }
 
+// withManifests merges the manifest of the first email into every thread
+func (t *ThreadsTable) withManifests(term gorethink.Term) gorethink.Term {
+	return term.Map(func(thread gorethink.Term) gorethink.Term {
+		return thread.Merge(gorethink.DB(t.GetDBName()).Table("emails").Between([]interface{}{
+			thread.Field("id"),
+			time.Date(1990, time.January, 1, 23, 0, 0, 0, time.UTC),
+		}, []interface{}{
+			thread.Field("id"),
+			time.Date(2090, time.January, 1, 23, 0, 0, 0, time.UTC),
+		}, gorethink.BetweenOpts{
+			Index: "threadAndDate",
+		}).OrderBy(gorethink.OrderByOpts{Index: "threadAndDate"}).
+			Nth(0).Pluck("manifest"))
+	})
+}
+
 func (t *ThreadsTable) GetByLabel(label string) ([]*models.Thread, error) {
 	var result []*models.Thread
 
@@ -45,6 +45,11 @@ func (t *TokensTable) UpdateID(id string, data interface{}) error {
 		return err
 	}
 
+	// Otherwise GetToken would return the cached version
+	if err := t.Cache.Delete(t.RethinkCRUD.GetTableName() + ":" + id); err != nil {
+		return err
+	}
+
 	token, err := t.GetToken(id)
 	if err != nil {
 		return err
@@ -62,11 +67,33 @@ func (t *TokensTable) Delete(cond interface{}) error {
 		return err
 	}
 
+	return t.deleteCached(result)
+}
+
+// DeleteByIndex removes from db and cache using an index query
+func (t *TokensTable) DeleteByIndex(index string, values ...interface{}) (int, error) {
+	result, err := t.GetTable().GetAllByIndex(index, values...).Delete(gorethink.DeleteOpts{
+		ReturnChanges: true,
+	}).RunWrite(t.GetSession())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.Deleted, t.deleteCached(result)
+}
+
+// deleteCached removes tokens deleted by a write query from the cache
+func (t *TokensTable) deleteCached(result gorethink.WriteResponse) error {
 	var ids []interface{}
 	for _, change := range result.Changes {
 		ids = append(ids, t.RethinkCRUD.GetTableName()+":"+change.OldValue.(map[string]interface{})["id"].(string))
 	}
 
+	// DEL without any keys is an invalid redis command
+	if len(ids) == 0 {
+		return nil
+	}
+
 	return t.Cache.DeleteMulti(ids...)
 }
 
@@ -104,9 +131,118 @@ func (t *TokensTable) GetToken(id string) (*models.Token, error) {
 	return &result, nil
 }
 
-// DeleteOwnedBy deletes all tokens owned by id
-func (t *TokensTable) DeleteOwnedBy(id string) error {
-	return t.Delete(map[string]interface{}{
+// GetOwnedBy returns all tokens of the type owned by id
+func (t *TokensTable) GetOwnedBy(id string, kind string) ([]*models.Token, error) {
+	var result []*models.Token
+
+	err := t.WhereAndFetch(map[string]interface{}{
 		"owner": id,
-	})
+		"type":  kind,
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Touch records the last use of the token. Writes are limited to one per
+// interval, tracked in the cache.
+func (t *TokensTable) Touch(token *models.Token, ip string, userAgent string, interval time.Duration) error {
+	key := t.RethinkCRUD.GetTableName() + ":used:" + token.ID
+	if exists, err := t.Cache.Exists(key); err != nil || exists {
+		return err
+	}
+
+	if err := t.Cache.Set(key, true, interval); err != nil {
+		return err
+	}
+
+	token.DateUsed = time.Now()
+	token.IP = ip
+	token.UserAgent = userAgent
+
+	if err := t.RethinkCRUD.UpdateID(token.ID, map[string]interface{}{
+		"date_used":  token.DateUsed,
+		"ip":         token.IP,
+		"user_agent": token.UserAgent,
+	}); err != nil {
+		return err
+	}
+
+	return t.Cache.Set(t.RethinkCRUD.GetTableName()+":"+token.ID, token, t.Expires)
+}
+
+// GetFamily returns all tokens of the family
+func (t *TokensTable) GetFamily(family string) ([]*models.Token, error) {
+	var result []*models.Token
+
+	err := t.WhereAndFetch(map[string]interface{}{
+		"family": family,
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Consume marks a single-use token of the type as used, the same way as
+// Token.Invalidate does. It returns false if the token has already been used,
+// so only one of concurrent requests can succeed.
+func (t *TokensTable) Consume(id string, kind string) (bool, error) {
+	return t.setType(id, kind, "."+kind)
+}
+
+// Restore reverts Consume, so that the token can be used again. It returns
+// false if the token wasn't consumed.
+func (t *TokensTable) Restore(id string, kind string) (bool, error) {
+	return t.setType(id, "."+kind, kind)
+}
+
+// setType atomically changes the type of the token if it's from
+func (t *TokensTable) setType(id string, from string, to string) (bool, error) {
+	result, err := t.GetTable().Get(id).Update(func(row gorethink.Term) interface{} {
+		return gorethink.Branch(
+			row.Field("type").Eq(from),
+			map[string]interface{}{
+				"type":          to,
+				"date_modified": time.Now(),
+			},
+			map[string]interface{}{},
+		)
+	}).RunWrite(t.GetSession())
+	if err != nil {
+		return false, err
+	}
+
+	if err := t.Cache.Delete(t.RethinkCRUD.GetTableName() + ":" + id); err != nil {
+		return false, err
+	}
+
+	return result.Replaced == 1, nil
+}
+
+// DeleteFamily deletes all tokens of the family
+func (t *TokensTable) DeleteFamily(family string) (int, error) {
+	return t.DeleteByIndex("family", family)
+}
+
+// DeleteSessions deletes auth, refresh and API tokens owned by id
+func (t *TokensTable) DeleteSessions(id string) (int, error) {
+	result, err := t.GetTable().GetAllByIndex("owner", id).Filter(func(row gorethink.Term) interface{} {
+		return gorethink.Expr([]interface{}{"auth", "refresh", "api"}).Contains(row.Field("type"))
+	}).Delete(gorethink.DeleteOpts{
+		ReturnChanges: true,
+	}).RunWrite(t.GetSession())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.Deleted, t.deleteCached(result)
+}
+
+// DeleteOwnedBy deletes all tokens owned by id
+func (t *TokensTable) DeleteOwnedBy(id string) (int, error) {
+	return t.DeleteByIndex("owner", id)
 }
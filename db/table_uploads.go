@@ -0,0 +1,101 @@
+package db
+
+import (
+	"time"
+
+	"github.com/dancannon/gorethink"
+
+	"github.com/lavab/api/models"
+	"github.com/lavab/api/storage"
+)
+
+// UploadsTable implements the CRUD interface for chunked uploads
+type UploadsTable struct {
+	RethinkCRUD
+	Blobs storage.BlobStore
+}
+
+// GetUpload returns an upload with specified ID
+func (u *UploadsTable) GetUpload(id string) (*models.Upload, error) {
+	var result models.Upload
+
+	if err := u.FindFetchOne(id, &result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// AddChunk atomically marks the n-th chunk of an upload as received
+func (u *UploadsTable) AddChunk(id string, n int) error {
+	return u.UpdateID(id, map[string]interface{}{
+		"chunks":        gorethink.Row.Field("chunks").SetInsert(n),
+		"date_modified": time.Now(),
+	})
+}
+
+// DeleteID removes the upload together with its chunks
+func (u *UploadsTable) DeleteID(id string) error {
+	upload, err := u.GetUpload(id)
+	if err != nil {
+		return err
+	}
+
+	if err := u.Blobs.Delete(upload.ChunkKeys()...); err != nil {
+		return err
+	}
+
+	return u.RethinkCRUD.DeleteID(id)
+}
+
+// DeleteExpired removes uploads that weren't finalized before their expiry
+// date together with all their declared chunks.
+func (u *UploadsTable) DeleteExpired() (int, error) {
+	cursor, err := u.GetTable().Between(
+		time.Unix(0, 0),
+		time.Now(),
+		gorethink.BetweenOpts{Index: "expiry_date"},
+	).Run(u.GetSession())
+	if err != nil {
+		return 0, NewDatabaseError(u, err, "")
+	}
+	defer cursor.Close()
+
+	var uploads []*models.Upload
+	if err := cursor.All(&uploads); err != nil {
+		return 0, NewDatabaseError(u, err, "")
+	}
+
+	deleted := 0
+	for _, upload := range uploads {
+		// Chunks go first, so that the next run can find them
+		if err := u.Blobs.Delete(upload.ChunkKeys()...); err != nil {
+			return deleted, err
+		}
+
+		if err := u.RethinkCRUD.DeleteID(upload.ID); err != nil {
+			return deleted, err
+		}
+
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// DeleteOwnedBy removes all uploads owned by id together with their chunks
+func (u *UploadsTable) DeleteOwnedBy(id string) (int, error) {
+	var uploads []*models.Upload
+	if err := u.FindByIndexFetch(&uploads, "owner", id); err != nil {
+		return 0, err
+	}
+
+	// Chunks go first, so that a retry can find them
+	for _, upload := range uploads {
+		if err := u.Blobs.Delete(upload.ChunkKeys()...); err != nil {
+			return 0, err
+		}
+	}
+
+	return u.DeleteByIndex("owner", id)
+}
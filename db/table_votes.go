@@ -0,0 +1,90 @@
+package db
+
+import (
+	"github.com/dancannon/gorethink"
+
+	"github.com/lavab/api/models"
+)
+
+// VotesTable implements the CRUD interface for key votes
+type VotesTable struct {
+	RethinkCRUD
+}
+
+// GetKeyVotes returns votes cast on the key with specified fingerprint
+func (v *VotesTable) GetKeyVotes(id string) (*models.KeyVotes, error) {
+	var result models.KeyVotes
+
+	if err := v.FindFetchOne(id, &result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// Vote atomically replaces account's vote on a key. Positive values vote for
+// the key, negative against it and zero removes the account's vote.
+func (v *VotesTable) Vote(id string, account string, vote int) (*models.KeyVotes, error) {
+	err := v.GetTable().Get(id).Replace(func(row gorethink.Term) gorethink.Term {
+		doc := row.Default(map[string]interface{}{
+			"id":      id,
+			"for":     []string{},
+			"against": []string{},
+		})
+
+		// Remove the previous vote
+		forList := doc.Field("for").SetDifference([]string{account})
+		againstList := doc.Field("against").SetDifference([]string{account})
+
+		// And then append the new one
+		if vote > 0 {
+			forList = forList.SetInsert(account)
+		} else if vote < 0 {
+			againstList = againstList.SetInsert(account)
+		}
+
+		return doc.Merge(map[string]interface{}{
+			"for":     forList,
+			"against": againstList,
+		})
+	}).Exec(v.GetSession())
+	if err != nil {
+		return nil, NewDatabaseError(v, err, "")
+	}
+
+	return v.GetKeyVotes(id)
+}
+
+// DeleteCastBy removes votes the account has cast on any key
+func (v *VotesTable) DeleteCastBy(account string) (int, error) {
+	result, err := v.GetTable().GetAllByIndex("voters", account).Update(func(row gorethink.Term) interface{} {
+		return map[string]interface{}{
+			"for":     row.Field("for").SetDifference([]string{account}),
+			"against": row.Field("against").SetDifference([]string{account}),
+		}
+	}).RunWrite(v.GetSession())
+	if err != nil {
+		return 0, NewDatabaseError(v, err, "")
+	}
+
+	return result.Replaced, nil
+}
+
+// DeleteKeyVotes removes votes cast on keys with specified fingerprints
+func (v *VotesTable) DeleteKeyVotes(ids ...string) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	iids := make([]interface{}, len(ids))
+	for i, id := range ids {
+		iids[i] = id
+	}
+
+	result, err := v.GetTable().GetAll(iids...).Delete().RunWrite(v.GetSession())
+	if err != nil {
+		return 0, NewDatabaseError(v, err, "")
+	}
+
+	return result.Deleted, nil
+}
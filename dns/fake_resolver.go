@@ -0,0 +1,44 @@
+package dns
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// ErrNoRecords is returned by FakeResolver for names without records
+var ErrNoRecords = errors.New("dns: no such records")
+
+// FakeResolver is an in-memory Resolver for tests and development
+type FakeResolver struct {
+	sync.RWMutex
+	txt map[string][]string
+}
+
+// NewFakeResolver creates a new FakeResolver without any records
+func NewFakeResolver() *FakeResolver {
+	return &FakeResolver{
+		txt: map[string][]string{},
+	}
+}
+
+// SetTXT replaces TXT records of name
+func (f *FakeResolver) SetTXT(name string, records ...string) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.txt[strings.ToLower(name)] = records
+}
+
+// LookupTXT returns TXT records of name
+func (f *FakeResolver) LookupTXT(name string) ([]string, error) {
+	f.RLock()
+	defer f.RUnlock()
+
+	records, ok := f.txt[strings.ToLower(name)]
+	if !ok {
+		return nil, ErrNoRecords
+	}
+
+	return records, nil
+}
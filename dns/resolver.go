@@ -0,0 +1,24 @@
+package dns
+
+import (
+	"net"
+)
+
+// Resolver is the basic interface for DNS lookups used by the API. It's
+// pluggable, so that domain verification works without the network.
+type Resolver interface {
+	LookupTXT(name string) ([]string, error)
+}
+
+// NetResolver resolves records using the system's resolver
+type NetResolver struct{}
+
+// NewNetResolver creates a new NetResolver
+func NewNetResolver() *NetResolver {
+	return &NetResolver{}
+}
+
+// LookupTXT returns TXT records of name
+func (n *NetResolver) LookupTXT(name string) ([]string, error) {
+	return net.LookupTXT(name)
+}
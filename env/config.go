@@ -7,12 +7,29 @@ type Flags struct {
 	LogFormatterType string
 	ForceColors      bool
 	EmailDomain      string
+	TrustedProxies   string
 
 	SessionDuration int
+	RefreshDuration int
+	InviteQuota     int
+	AddressLimit    int
+	AuditRetention  int
+
+	BlobStore     string
+	BlobPath      string
+	S3Endpoint    string
+	S3Region      string
+	S3Bucket      string
+	S3AccessKey   string
+	S3SecretKey   string
+	MaxChunkSize  int64
+	MaxUploadSize int64
 
 	RedisAddress  string
 	RedisDatabase int
 	RedisPassword string
+	CacheSize     int
+	CacheTTL      int
 
 	RethinkDBAddress  string
 	RethinkDBKey      string
@@ -24,6 +41,9 @@ type Flags struct {
 	YubiCloudID  string
 	YubiCloudKey string
 
+	WebAuthnRPID   string
+	WebAuthnOrigin string
+
 	SlackURL      string
 	SlackLevels   string
 	SlackChannel  string
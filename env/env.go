@@ -1,6 +1,8 @@
 package env
 
 import (
+	"net"
+
 	"github.com/Sirupsen/logrus"
 	"github.com/bitly/go-nsq"
 	"github.com/dancannon/gorethink"
@@ -9,7 +11,10 @@ import (
 
 	"github.com/lavab/api/cache"
 	"github.com/lavab/api/db"
+	"github.com/lavab/api/dns"
+	"github.com/lavab/api/events"
 	"github.com/lavab/api/factor"
+	"github.com/lavab/api/storage"
 )
 
 var (
@@ -21,6 +26,8 @@ var (
 	Rethink *gorethink.Session
 	// Cache is the global instance of the cache interface
 	Cache cache.Cache
+	// Blobs is the global instance of the blob store interface
+	Blobs storage.BlobStore
 	// Accounts is the global instance of AccountsTable
 	Accounts *db.AccountsTable
 	// Addresses is the global instance of Addresses table
@@ -33,6 +40,8 @@ var (
 	Contacts *db.ContactsTable
 	// Reservations is the global instance of ReservationsTable
 	Reservations *db.ReservationsTable
+	// Domains is the global instance of DomainsTable
+	Domains *db.DomainsTable
 	// Emails is the global instance of EmailsTable
 	Emails *db.EmailsTable
 	// Labels is the global instance of LabelsTable
@@ -41,6 +50,18 @@ var (
 	Files *db.FilesTable
 	// Threads is the global instance of ThreadsTable
 	Threads *db.ThreadsTable
+	// Audit is the global instance of AuditTable
+	Audit *db.AuditTable
+	// Votes is the global instance of VotesTable
+	Votes *db.VotesTable
+	// Uploads is the global instance of UploadsTable
+	Uploads *db.UploadsTable
+	// Events is the bus used to notify subscribed sessions about changes
+	Events *events.Bus
+	// Resolver is used to verify custom domains
+	Resolver dns.Resolver
+	// TrustedProxies contains networks of load balancers allowed to set X-Forwarded-For
+	TrustedProxies []*net.IPNet
 	// Factors contains all currently registered factors
 	Factors map[string]factor.Factor
 	// Producer is the nsq producer used to send messages to other components of the system
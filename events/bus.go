@@ -0,0 +1,243 @@
+package events
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// Session is a connection of a client that receives events, eg. a sockjs.Session
+type Session interface {
+	ID() string
+	Send(message string) error
+}
+
+// Event is a notification about a change of an account's data. Type is made
+// of the resource and the action, eg. "thread.update".
+type Event struct {
+	Type string      `json:"type"`
+	ID   string      `json:"id"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// ErrorHandler is called when a message can't be delivered to a session
+type ErrorHandler func(session Session, err error)
+
+// Transport passes messages between API instances, so that they reach
+// sessions connected to other nodes
+type Transport interface {
+	// Join and Leave register the node as holding sessions of the owner
+	Join(owner string) error
+	Leave(owner string) error
+
+	// Subscribed checks whether any node holds owner's sessions
+	Subscribed(owner string) (bool, error)
+
+	// Publish sends an encoded message to all nodes holding owner's sessions
+	Publish(owner string, message string) error
+
+	// Listen starts passing messages sent to this node to deliver. owners
+	// returns the owners of local sessions, so that they can be registered
+	// again after a reconnection.
+	Listen(deliver func(owner string, message string), owners func() []string)
+}
+
+// Bus delivers messages to the sessions subscribed to their owners
+type Bus struct {
+	sync.RWMutex
+	sessions  map[string][]Session
+	transport Transport
+
+	// membership serializes calls to Join and Leave, joined lists the owners
+	// this node is registered for
+	membership sync.Mutex
+	joined     map[string]bool
+
+	// OnError is called on send failures, if it's set
+	OnError ErrorHandler
+}
+
+// NewBus creates a new, empty event bus
+func NewBus() *Bus {
+	return &Bus{
+		sessions: map[string][]Session{},
+		joined:   map[string]bool{},
+	}
+}
+
+// SetTransport makes the bus deliver messages across API instances
+func (b *Bus) SetTransport(transport Transport) {
+	b.Lock()
+	b.transport = transport
+	b.Unlock()
+
+	transport.Listen(b.deliver, b.owners)
+}
+
+// Subscribe starts sending owner's messages to the session
+func (b *Bus) Subscribe(owner string, session Session) {
+	b.Lock()
+	for _, s := range b.sessions[owner] {
+		if s == session {
+			b.Unlock()
+			return
+		}
+	}
+
+	b.sessions[owner] = append(b.sessions[owner], session)
+	first := len(b.sessions[owner]) == 1
+	b.Unlock()
+
+	// First session of the owner on this node
+	if first {
+		b.register(owner)
+	}
+}
+
+// Unsubscribe stops sending owner's messages to the session
+func (b *Bus) Unsubscribe(owner string, session Session) {
+	b.Lock()
+	sessions := b.sessions[owner]
+	for i, s := range sessions {
+		if s == session {
+			sessions[i] = sessions[len(sessions)-1]
+			sessions[len(sessions)-1] = nil
+			sessions = sessions[:len(sessions)-1]
+			break
+		}
+	}
+
+	if len(sessions) > 0 {
+		b.sessions[owner] = sessions
+		b.Unlock()
+		return
+	}
+
+	_, last := b.sessions[owner]
+	delete(b.sessions, owner)
+	b.Unlock()
+
+	// Last session of the owner on this node
+	if last {
+		b.register(owner)
+	}
+}
+
+// register joins or leaves owner's messages on the transport, depending on
+// whether the node holds any of owner's sessions. It's called without holding
+// the bus lock, so that deliveries don't wait for the transport. Sessions might
+// come and go in the meantime, so the state is checked again under the lock.
+func (b *Bus) register(owner string) {
+	b.membership.Lock()
+	defer b.membership.Unlock()
+
+	b.RLock()
+	local := len(b.sessions[owner]) > 0
+	transport := b.transport
+	b.RUnlock()
+
+	if transport == nil || local == b.joined[owner] {
+		return
+	}
+
+	if local {
+		if err := transport.Join(owner); err != nil {
+			b.error(nil, err)
+			return
+		}
+
+		b.joined[owner] = true
+		return
+	}
+
+	if err := transport.Leave(owner); err != nil {
+		b.error(nil, err)
+		return
+	}
+
+	delete(b.joined, owner)
+}
+
+// Subscribed checks whether any session, on any node, is subscribed to owner's messages
+func (b *Bus) Subscribed(owner string) bool {
+	b.RLock()
+	local := len(b.sessions[owner]) > 0
+	transport := b.transport
+	b.RUnlock()
+
+	if local || transport == nil {
+		return local
+	}
+
+	subscribed, err := transport.Subscribed(owner)
+	if err != nil {
+		b.error(nil, err)
+		return false
+	}
+
+	return subscribed
+}
+
+// Publish sends an event to all sessions subscribed to the owner
+func (b *Bus) Publish(owner string, event *Event) {
+	b.Send(owner, event)
+}
+
+// Send marshals the message and sends it to all sessions subscribed to the owner
+func (b *Bus) Send(owner string, message interface{}) {
+	// Don't bother marshalling if nobody listens
+	if !b.Subscribed(owner) {
+		return
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		b.error(nil, err)
+		return
+	}
+
+	b.RLock()
+	transport := b.transport
+	b.RUnlock()
+
+	if transport == nil {
+		b.deliver(owner, string(data))
+		return
+	}
+
+	if err := transport.Publish(owner, string(data)); err != nil {
+		b.error(nil, err)
+	}
+}
+
+// deliver writes an encoded message to the owner's sessions
+func (b *Bus) deliver(owner string, message string) {
+	b.RLock()
+	sessions := make([]Session, len(b.sessions[owner]))
+	copy(sessions, b.sessions[owner])
+	b.RUnlock()
+
+	for _, session := range sessions {
+		if err := session.Send(message); err != nil {
+			b.error(session, err)
+		}
+	}
+}
+
+// owners returns owners of the sessions connected to this node
+func (b *Bus) owners() []string {
+	b.RLock()
+	defer b.RUnlock()
+
+	owners := make([]string, 0, len(b.sessions))
+	for owner := range b.sessions {
+		owners = append(owners, owner)
+	}
+
+	return owners
+}
+
+func (b *Bus) error(session Session, err error) {
+	if b.OnError != nil {
+		b.OnError(session, err)
+	}
+}
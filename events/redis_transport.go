@@ -0,0 +1,295 @@
+package events
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/garyburd/redigo/redis"
+)
+
+// RedisTransport is an implementation of Transport that uses Redis pub/sub.
+// Every node listens on its own channel and a set per owner lists the nodes
+// holding owner's sessions, so messages are only sent where they're needed.
+type RedisTransport struct {
+	pool   *redis.Pool
+	node   string
+	prefix string
+
+	deliver func(owner string, message string)
+
+	lock   sync.Mutex
+	conn   redis.Conn
+	closed bool
+
+	// OnError is called when the listener loses its connection, if it's set
+	OnError func(err error)
+}
+
+// RedisTransportOpts is used to pass options to NewRedisTransport
+type RedisTransportOpts struct {
+	Address  string
+	Database int
+	Password string
+
+	// Node is the ID of this API instance, random by default
+	Node string
+
+	// Prefix is prepended to all keys and channels, "events:" by default
+	Prefix string
+}
+
+// redisEnvelope is the format of messages sent between nodes
+type redisEnvelope struct {
+	Owner   string `json:"owner"`
+	Message string `json:"message"`
+}
+
+// NewRedisTransport creates a new transport with a redis backend
+func NewRedisTransport(options *RedisTransportOpts) (*RedisTransport, error) {
+	// Default values
+	if options.Node == "" {
+		options.Node = uniuri.New()
+	}
+	if options.Prefix == "" {
+		options.Prefix = "events:"
+	}
+
+	// Create a new redis pool
+	pool := &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			c, err := redis.Dial("tcp", options.Address)
+			if err != nil {
+				return nil, err
+			}
+
+			if options.Password != "" {
+				if _, err := c.Do("AUTH", options.Password); err != nil {
+					c.Close()
+					return nil, err
+				}
+			}
+
+			if options.Database != 0 {
+				if _, err := c.Do("SELECT", options.Database); err != nil {
+					c.Close()
+					return nil, err
+				}
+			}
+
+			return c, err
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+
+	// Test the pool
+	conn := pool.Get()
+	defer conn.Close()
+	if err := pool.TestOnBorrow(conn, time.Now()); err != nil {
+		return nil, err
+	}
+
+	return &RedisTransport{
+		pool:   pool,
+		node:   options.Node,
+		prefix: options.Prefix,
+	}, nil
+}
+
+// Node returns the ID of this node
+func (r *RedisTransport) Node() string {
+	return r.node
+}
+
+// Join adds this node to the set of nodes holding owner's sessions
+func (r *RedisTransport) Join(owner string) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SADD", r.ownerKey(owner), r.node)
+	return err
+}
+
+// Leave removes this node from the set of nodes holding owner's sessions
+func (r *RedisTransport) Leave(owner string) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SREM", r.ownerKey(owner), r.node)
+	return err
+}
+
+// Subscribed checks whether any node holds owner's sessions
+func (r *RedisTransport) Subscribed(owner string) (bool, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	count, err := redis.Int(conn.Do("SCARD", r.ownerKey(owner)))
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// Publish sends the message to the channels of nodes holding owner's sessions
+func (r *RedisTransport) Publish(owner string, message string) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	nodes, err := redis.Strings(conn.Do("SMEMBERS", r.ownerKey(owner)))
+	if err != nil {
+		return err
+	}
+
+	var payload []byte
+	for _, node := range nodes {
+		// Local sessions don't need a round trip
+		if node == r.node {
+			if r.deliver != nil {
+				r.deliver(owner, message)
+			}
+			continue
+		}
+
+		if payload == nil {
+			payload, err = json.Marshal(&redisEnvelope{
+				Owner:   owner,
+				Message: message,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		receivers, err := redis.Int(conn.Do("PUBLISH", r.nodeChannel(node), payload))
+		if err != nil {
+			return err
+		}
+
+		// Nobody listens on that channel, so the node is gone. It registers
+		// again on reconnection if it was only a network issue.
+		if receivers == 0 {
+			if _, err := conn.Do("SREM", r.ownerKey(owner), node); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Listen subscribes to this node's channel in a new goroutine. The connection
+// is reestablished until Close is called.
+func (r *RedisTransport) Listen(deliver func(owner string, message string), owners func() []string) {
+	r.deliver = deliver
+
+	go func() {
+		for {
+			r.lock.Lock()
+			if r.closed {
+				r.lock.Unlock()
+				return
+			}
+			r.lock.Unlock()
+
+			// The connection isn't pooled, as closing a pooled pub/sub
+			// connection waits for replies consumed by the listener
+			conn, err := r.pool.Dial()
+			if err != nil {
+				if r.OnError != nil {
+					r.OnError(err)
+				}
+
+				time.Sleep(time.Second)
+				continue
+			}
+
+			r.lock.Lock()
+			if r.closed {
+				r.lock.Unlock()
+				conn.Close()
+				return
+			}
+			r.conn = conn
+			r.lock.Unlock()
+
+			if err := r.listen(conn, owners); err != nil && r.OnError != nil {
+				r.lock.Lock()
+				closed := r.closed
+				r.lock.Unlock()
+
+				if !closed {
+					r.OnError(err)
+				}
+			}
+			conn.Close()
+
+			time.Sleep(time.Second)
+		}
+	}()
+}
+
+// listen handles a single pub/sub connection until it fails
+func (r *RedisTransport) listen(conn redis.Conn, owners func() []string) error {
+	psc := redis.PubSubConn{Conn: conn}
+	if err := psc.Subscribe(r.nodeChannel(r.node)); err != nil {
+		return err
+	}
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Subscription:
+			// Register local sessions again, they might have been removed
+			// by other nodes while we were disconnected
+			if v.Kind == "subscribe" {
+				for _, owner := range owners() {
+					if err := r.Join(owner); err != nil {
+						return err
+					}
+				}
+			}
+		case redis.Message:
+			var envelope redisEnvelope
+			if err := json.Unmarshal(v.Data, &envelope); err != nil {
+				continue
+			}
+
+			r.deliver(envelope.Owner, envelope.Message)
+		case error:
+			return v
+		}
+	}
+}
+
+// Close stops listening and removes this node from the owners' sets
+func (r *RedisTransport) Close(owners []string) error {
+	r.lock.Lock()
+	r.closed = true
+	if r.conn != nil {
+		r.conn.Close()
+	}
+	r.lock.Unlock()
+
+	for _, owner := range owners {
+		if err := r.Leave(owner); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *RedisTransport) ownerKey(owner string) string {
+	return r.prefix + "owner:" + owner
+}
+
+func (r *RedisTransport) nodeChannel(node string) string {
+	return r.prefix + "node:" + node
+}
@@ -0,0 +1,114 @@
+package events_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dchest/uniuri"
+
+	"github.com/lavab/api/events"
+)
+
+type testSession struct {
+	id       string
+	messages chan string
+}
+
+func (t *testSession) ID() string {
+	return t.id
+}
+
+func (t *testSession) Send(message string) error {
+	t.messages <- message
+	return nil
+}
+
+// newInstance creates a bus connected to redis, just like a separate API instance
+func newInstance(t *testing.T, prefix string) (*events.Bus, *events.RedisTransport) {
+	address := os.Getenv("REDIS_ADDRESS")
+	if address == "" {
+		address = "127.0.0.1:6379"
+	}
+
+	transport, err := events.NewRedisTransport(&events.RedisTransportOpts{
+		Address: address,
+		Prefix:  prefix,
+	})
+	if err != nil {
+		t.Skipf("redis is not available at %s: %v", address, err)
+	}
+
+	bus := events.NewBus()
+	bus.SetTransport(transport)
+
+	return bus, transport
+}
+
+func TestRedisTransport(t *testing.T) {
+	prefix := "events_test:" + uniuri.New() + ":"
+
+	first, firstTransport := newInstance(t, prefix)
+	defer firstTransport.Close(nil)
+	second, secondTransport := newInstance(t, prefix)
+	defer secondTransport.Close(nil)
+
+	// Wait for both listeners to subscribe
+	time.Sleep(500 * time.Millisecond)
+
+	owner := uniuri.New()
+	session := &testSession{
+		id:       uniuri.New(),
+		messages: make(chan string, 10),
+	}
+
+	if second.Subscribed(owner) {
+		t.Fatal("owner is subscribed before any session connected")
+	}
+
+	first.Subscribe(owner, session)
+
+	if !second.Subscribed(owner) {
+		t.Fatal("subscription on the first instance is not visible on the second")
+	}
+
+	// An event published on the second instance reaches the first one
+	second.Publish(owner, &events.Event{
+		Type: "thread.update",
+		ID:   "thread-id",
+	})
+
+	select {
+	case message := <-session.messages:
+		expected := `{"type":"thread.update","id":"thread-id"}`
+		if message != expected {
+			t.Fatalf("unexpected message %s, expected %s", message, expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not delivered across instances")
+	}
+
+	// Local delivery works too and doesn't produce duplicates
+	first.Publish(owner, &events.Event{
+		Type: "thread.delete",
+		ID:   "thread-id",
+	})
+
+	select {
+	case <-session.messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not delivered locally")
+	}
+
+	select {
+	case message := <-session.messages:
+		t.Fatalf("unexpected duplicate message %s", message)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	first.Unsubscribe(owner, session)
+
+	if second.Subscribed(owner) {
+		t.Fatal("owner is still subscribed after the session left")
+	}
+}
@@ -1,38 +1,236 @@
 package factor
 
 import (
-	"github.com/gokyle/hotp"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/rsc/qr"
 )
 
+// authenticatorIssuer is displayed next to the account name in the apps
+const authenticatorIssuer = "Lavaboom"
+
+// Authenticator is an implementation of Factor for RFC 6238 TOTP apps, eg.
+// Google Authenticator. Its data is laid out as follows:
+//   - data[0]  - base32-encoded secret
+//   - data[1]  - last accepted time step, used to reject replays
+//   - data[2:] - SHA256 hashes of unused recovery codes
 type Authenticator struct {
 	length int
+
+	// Period is the length of a time step
+	Period time.Duration
+
+	// Window is the count of steps accepted before and after the current one
+	Window int
+
+	// now is replaceable for testing
+	now func() time.Time
 }
 
+// NewAuthenticator creates a new TOTP factor that uses codes of the passed length
 func NewAuthenticator(length int) *Authenticator {
 	return &Authenticator{
 		length: length,
+		Period: 30 * time.Second,
+		Window: 1,
+		now:    time.Now,
 	}
 }
 
+// Type returns factor's type
 func (a *Authenticator) Type() string {
 	return "authenticator"
 }
 
+// Request does nothing in this driver, codes are generated by the app
 func (a *Authenticator) Request(data string) (string, error) {
-	otp, err := hotp.GenerateHOTP(a.length, false)
+	return "", nil
+}
+
+// Verify checks if the code or a recovery code is valid
+func (a *Authenticator) Verify(data []string, input string) (bool, error) {
+	ok, _, err := a.VerifyUpdate(data, input)
+	return ok, err
+}
+
+// VerifyUpdate checks the code and returns data with the time step of the
+// code or without the used recovery code
+func (a *Authenticator) VerifyUpdate(data []string, input string) (bool, []string, error) {
+	if len(data) < 2 {
+		return false, nil, fmt.Errorf("invalid authenticator data")
+	}
+
+	input = normalizeCode(input)
+
+	// Recovery codes are longer than the TOTP codes
+	if len(input) != a.length {
+		hash := hashRecoveryCode(input)
+		for i, stored := range data[2:] {
+			if hmac.Equal([]byte(hash), []byte(stored)) {
+				updated := append([]string{}, data[:2+i]...)
+				return true, append(updated, data[3+i:]...), nil
+			}
+		}
+
+		return false, nil, nil
+	}
+
+	last, err := strconv.ParseInt(data[1], 10, 64)
 	if err != nil {
+		return false, nil, err
+	}
+
+	step, ok, err := a.Check(data[0], input, last)
+	if err != nil || !ok {
+		return false, nil, err
+	}
+
+	updated := append([]string{}, data...)
+	updated[1] = strconv.FormatInt(step, 10)
+	return true, updated, nil
+}
+
+// Check verifies a code against the secret and returns the time step it
+// matched. Steps earlier than or equal to last are rejected.
+func (a *Authenticator) Check(secret string, input string, last int64) (int64, bool, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return 0, false, err
+	}
+
+	current := a.now().Unix() / int64(a.Period/time.Second)
+	for step := current - int64(a.Window); step <= current+int64(a.Window); step++ {
+		if step <= last {
+			continue
+		}
+
+		if hmac.Equal([]byte(a.code(key, step)), []byte(input)) {
+			return step, true, nil
+		}
+	}
+
+	return 0, false, nil
+}
+
+// code computes the HOTP value of the step as described in RFC 4226
+func (a *Authenticator) code(key []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for i := 0; i < a.length; i++ {
+		modulo *= 10
+	}
+
+	return fmt.Sprintf("%0*d", a.length, value%modulo)
+}
+
+// NewSecret generates a random 160-bit secret
+func (a *Authenticator) NewSecret() (string, error) {
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
 		return "", err
 	}
 
-	return otp.URL(data), nil
+	return strings.TrimRight(base32.StdEncoding.EncodeToString(key), "="), nil
 }
 
-func (a *Authenticator) Verify(data []string, input string) (bool, error) {
-	// obviously broken
-	hotp, err := hotp.Unmarshal([]byte(data[0]))
+// URI returns an otpauth URI that can be imported into the apps
+func (a *Authenticator) URI(secret string, account string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", authenticatorIssuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", strconv.Itoa(a.length))
+	values.Set("period", strconv.Itoa(int(a.Period/time.Second)))
+
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + authenticatorIssuer + ":" + account,
+		RawQuery: values.Encode(),
+	}
+
+	return uri.String()
+}
+
+// QR encodes the URI as a PNG QR code
+func (a *Authenticator) QR(secret string, account string) ([]byte, error) {
+	code, err := qr.Encode(a.URI(secret, account), qr.Q)
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+
+	return code.PNG(), nil
+}
+
+// Data creates factor data for a confirmed secret. step is the time step of
+// the confirmation code, so that it can't be used again.
+func (a *Authenticator) Data(secret string, step int64, hashes []string) []string {
+	return append([]string{secret, strconv.FormatInt(step, 10)}, hashes...)
+}
+
+// WithRecoveryCodes replaces recovery codes in the data
+func (a *Authenticator) WithRecoveryCodes(data []string, hashes []string) []string {
+	return append(append([]string{}, data[:2]...), hashes...)
+}
+
+// NewRecoveryCodes generates count single-use codes and their hashes. Only
+// the hashes should be stored.
+func NewRecoveryCodes(count int) ([]string, []string, error) {
+	var (
+		codes  = make([]string, count)
+		hashes = make([]string, count)
+		buffer = make([]byte, 10)
+	)
+
+	for i := 0; i < count; i++ {
+		if _, err := rand.Read(buffer); err != nil {
+			return nil, nil, err
+		}
+
+		// 80 bits of entropy in 16 characters
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(buffer))
+		codes[i] = code[:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:]
+		hashes[i] = hashRecoveryCode(normalizeCode(codes[i]))
+	}
+
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
+
+// normalizeCode removes separators that users might type in
+func normalizeCode(input string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(input))
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.TrimRight(secret, "="))
+	if padding := len(secret) % 8; padding != 0 {
+		secret += strings.Repeat("=", 8-padding)
 	}
 
-	return hotp.Check(input), nil
+	return base32.StdEncoding.DecodeString(secret)
 }
@@ -0,0 +1,162 @@
+package factor
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the base32 form of the SHA1 key of RFC 6238 Appendix B,
+// "12345678901234567890"
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// newTestAuthenticator returns an authenticator with a stopped clock
+func newTestAuthenticator(length int, now int64) *Authenticator {
+	a := NewAuthenticator(length)
+	a.now = func() time.Time {
+		return time.Unix(now, 0)
+	}
+
+	return a
+}
+
+func TestAuthenticatorRFC6238(t *testing.T) {
+	vectors := []struct {
+		time int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, vector := range vectors {
+		a := newTestAuthenticator(8, vector.time)
+
+		step, ok, err := a.Check(rfc6238Secret, vector.code, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("code %s wasn't accepted at %d", vector.code, vector.time)
+		}
+		if step != vector.time/30 {
+			t.Fatalf("code %s matched step %d, expected %d", vector.code, step, vector.time/30)
+		}
+	}
+}
+
+func TestAuthenticatorWindow(t *testing.T) {
+	// 94287082 is the code of step 1
+	cases := []struct {
+		time     int64
+		accepted bool
+	}{
+		{-30, false},
+		{0, true},
+		{59, true},
+		{89, true},
+		{90, false},
+	}
+
+	for _, test := range cases {
+		a := newTestAuthenticator(8, test.time)
+
+		_, ok, err := a.Check(rfc6238Secret, "94287082", -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != test.accepted {
+			t.Fatalf("code accepted at %d: %v, expected %v", test.time, ok, test.accepted)
+		}
+	}
+
+	// Without a window only the current step is accepted
+	a := newTestAuthenticator(8, 89)
+	a.Window = 0
+	if _, ok, _ := a.Check(rfc6238Secret, "94287082", -1); ok {
+		t.Fatal("code of the previous step was accepted without a window")
+	}
+}
+
+func TestAuthenticatorReplay(t *testing.T) {
+	a := newTestAuthenticator(8, 59)
+	data := a.Data(rfc6238Secret, 0, nil)
+
+	ok, updated, err := a.VerifyUpdate(data, "9428-7082")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("valid code was rejected")
+	}
+	if updated[1] != "1" {
+		t.Fatalf("last step wasn't updated: %s", updated[1])
+	}
+
+	// The same code can't be used twice
+	if ok, _, _ := a.VerifyUpdate(updated, "94287082"); ok {
+		t.Fatal("code was accepted twice")
+	}
+
+	// Neither can codes of earlier steps, even if they're in the window
+	if _, ok, _ := a.Check(rfc6238Secret, a.code([]byte("12345678901234567890"), 0), 1); ok {
+		t.Fatal("code of an earlier step was accepted")
+	}
+
+	// Codes of later steps are fine
+	a.now = func() time.Time {
+		return time.Unix(1111111109, 0)
+	}
+	if ok, updated, _ = a.VerifyUpdate(updated, "07081804"); !ok {
+		t.Fatal("code of a later step was rejected")
+	}
+	if updated[1] != strconv.FormatInt(1111111109/30, 10) {
+		t.Fatalf("last step wasn't updated: %s", updated[1])
+	}
+}
+
+func TestAuthenticatorRecoveryCodes(t *testing.T) {
+	codes, hashes, err := NewRecoveryCodes(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTestAuthenticator(6, 59)
+	data := a.Data(rfc6238Secret, 0, hashes)
+
+	ok, updated, err := a.VerifyUpdate(data, codes[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("recovery code was rejected")
+	}
+
+	// Only the used code is removed
+	if len(updated) != 4 || updated[2] != hashes[0] || updated[3] != hashes[2] {
+		t.Fatalf("invalid data after using a recovery code: %v", updated)
+	}
+	if len(data) != 5 {
+		t.Fatal("original data was modified")
+	}
+
+	if ok, _, _ := a.VerifyUpdate(updated, codes[1]); ok {
+		t.Fatal("recovery code was accepted twice")
+	}
+
+	// Codes are accepted with any separators and case
+	if ok, _, _ := a.VerifyUpdate(updated, "  "+codes[0]); !ok {
+		t.Fatal("recovery code with spaces was rejected")
+	}
+	if ok, _, _ := a.VerifyUpdate(updated, normalizeCode(codes[2])); !ok {
+		t.Fatal("recovery code without separators was rejected")
+	}
+
+	if ok, _, _ := a.VerifyUpdate(updated, "aaaa-bbbb-cccc-dddd"); ok {
+		t.Fatal("invalid recovery code was accepted")
+	}
+}
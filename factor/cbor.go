@@ -0,0 +1,135 @@
+package factor
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// errInvalidCBOR is returned when WebAuthn data can't be decoded
+var errInvalidCBOR = errors.New("invalid CBOR data")
+
+// cborMaxDepth limits nesting of decoded structures
+const cborMaxDepth = 16
+
+// decodeCBOR decodes the first CBOR (RFC 7049) item of data and returns the
+// remaining bytes. It supports the subset used by WebAuthn: integers, byte
+// and text strings, arrays, maps, booleans and null. Maps are
+// decoded into map[interface{}]interface{} with int64 or string keys.
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (interface{}, []byte, error) {
+	if len(data) == 0 || depth > cborMaxDepth {
+		return nil, nil, errInvalidCBOR
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	// Simple values use the additional information differently. Floats
+	// don't appear in WebAuthn structures and are rejected.
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		}
+
+		return nil, nil, errInvalidCBOR
+	}
+
+	// Read the argument
+	var argument uint64
+	switch {
+	case info < 24:
+		argument = uint64(info)
+	case info == 24 && len(data) >= 1:
+		argument, data = uint64(data[0]), data[1:]
+	case info == 25 && len(data) >= 2:
+		argument, data = uint64(binary.BigEndian.Uint16(data)), data[2:]
+	case info == 26 && len(data) >= 4:
+		argument, data = uint64(binary.BigEndian.Uint32(data)), data[4:]
+	case info == 27 && len(data) >= 8:
+		argument, data = binary.BigEndian.Uint64(data), data[8:]
+	default:
+		// Indefinite lengths aren't used by authenticators
+		return nil, nil, errInvalidCBOR
+	}
+
+	switch major {
+	case 0:
+		if argument > math.MaxInt64 {
+			return nil, nil, errInvalidCBOR
+		}
+		return int64(argument), data, nil
+	case 1:
+		if argument > math.MaxInt64 {
+			return nil, nil, errInvalidCBOR
+		}
+		return -1 - int64(argument), data, nil
+	case 2, 3:
+		if argument > uint64(len(data)) {
+			return nil, nil, errInvalidCBOR
+		}
+		value := append([]byte{}, data[:argument]...)
+		if major == 3 {
+			return string(value), data[argument:], nil
+		}
+		return value, data[argument:], nil
+	case 4:
+		// Every item takes at least a byte
+		if argument > uint64(len(data)) {
+			return nil, nil, errInvalidCBOR
+		}
+		array := make([]interface{}, 0, argument)
+		for i := uint64(0); i < argument; i++ {
+			var (
+				item interface{}
+				err  error
+			)
+			item, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			array = append(array, item)
+		}
+		return array, data, nil
+	case 5:
+		if argument > uint64(len(data)) {
+			return nil, nil, errInvalidCBOR
+		}
+		object := make(map[interface{}]interface{}, argument)
+		for i := uint64(0); i < argument; i++ {
+			var (
+				key, value interface{}
+				err        error
+			)
+			key, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errInvalidCBOR
+			}
+			value, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			object[key] = value
+		}
+		return object, data, nil
+	case 6:
+		// Tags are ignored
+		return decodeCBORItem(data, depth+1)
+	}
+
+	return nil, nil, errInvalidCBOR
+}
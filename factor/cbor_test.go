@@ -0,0 +1,159 @@
+package factor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// cborHead encodes the initial byte and the argument of an item
+func cborHead(major byte, argument uint64) []byte {
+	switch {
+	case argument < 24:
+		return []byte{major<<5 | byte(argument)}
+	case argument <= 0xff:
+		return []byte{major<<5 | 24, byte(argument)}
+	case argument <= 0xffff:
+		head := []byte{major<<5 | 25, 0, 0}
+		binary.BigEndian.PutUint16(head[1:], uint16(argument))
+		return head
+	}
+
+	head := []byte{major<<5 | 26, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(head[1:], uint32(argument))
+	return head
+}
+
+func cborInt(value int64) []byte {
+	if value < 0 {
+		return cborHead(1, uint64(-1-value))
+	}
+
+	return cborHead(0, uint64(value))
+}
+
+func cborBytes(value []byte) []byte {
+	return append(cborHead(2, uint64(len(value))), value...)
+}
+
+func cborText(value string) []byte {
+	return append(cborHead(3, uint64(len(value))), value...)
+}
+
+// cborMap encodes a map out of alternating keys and values
+func cborMap(items ...[]byte) []byte {
+	return append(cborHead(5, uint64(len(items)/2)), bytes.Join(items, nil)...)
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"1903e8", int64(1000)},
+		{"1a000f4240", int64(1000000)},
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"20", int64(-1)},
+		{"3903e7", int64(-1000)},
+		{"40", []byte{}},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"6449455446", "IETF"},
+		{"80", []interface{}{}},
+		{"8301820203820405", []interface{}{int64(1), []interface{}{int64(2), int64(3)}, []interface{}{int64(4), int64(5)}}},
+		{"a201020304", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[interface{}]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"c11a514b67b0", int64(1363896240)},
+	}
+
+	for _, test := range cases {
+		input, _ := hex.DecodeString(test.input)
+
+		value, rest, err := decodeCBOR(input)
+		if err != nil {
+			t.Fatalf("%s: %v", test.input, err)
+		}
+		if len(rest) != 0 {
+			t.Fatalf("%s: %d bytes left", test.input, len(rest))
+		}
+		if !reflect.DeepEqual(value, test.expected) {
+			t.Fatalf("%s: decoded %#v, expected %#v", test.input, value, test.expected)
+		}
+	}
+}
+
+func TestDecodeCBORInvalid(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+	}{
+		{"empty", ""},
+		{"truncated argument", "19ff"},
+		{"truncated byte string", "4401"},
+		{"truncated text string", "6449"},
+		{"truncated array", "830102"},
+		{"map without a value", "a101"},
+		{"invalid map key", "a1f601"},
+		{"array map key", "a18001"},
+		{"float", "f93c00"},
+		{"undefined simple value", "f0"},
+		{"indefinite length", "5f"},
+		{"reserved additional information", "1c"},
+		{"integer overflow", "1bffffffffffffffff"},
+		{"negative integer overflow", "3bffffffffffffffff"},
+		{"huge array", "9bffffffffffffffff"},
+		{"huge byte string", "5a7fffffff"},
+		{"huge map", "ba7fffffff"},
+		{"dangling tag", "c1"},
+	}
+
+	for _, test := range cases {
+		input, _ := hex.DecodeString(test.input)
+
+		if _, _, err := decodeCBOR(input); err != errInvalidCBOR {
+			t.Fatalf("%s: expected errInvalidCBOR, got %v", test.name, err)
+		}
+	}
+}
+
+func TestDecodeCBORRest(t *testing.T) {
+	// Only the first item is decoded, callers have to check the rest
+	value, rest, err := decodeCBOR([]byte{0x01, 0x02, 0x03})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != int64(1) || !bytes.Equal(rest, []byte{0x02, 0x03}) {
+		t.Fatalf("decoded %v, rest %x", value, rest)
+	}
+}
+
+func TestDecodeCBORDepth(t *testing.T) {
+	nest := func(head []byte, depth int) []byte {
+		data := cborInt(1)
+		for i := 0; i < depth; i++ {
+			data = append(append([]byte{}, head...), data...)
+		}
+		return data
+	}
+
+	for _, head := range [][]byte{
+		cborHead(4, 1),               // single-item arrays
+		append(cborHead(5, 1), 0x00), // maps with one key
+		cborHead(6, 1),               // tags
+	} {
+		if _, _, err := decodeCBOR(nest(head, cborMaxDepth)); err != nil {
+			t.Fatalf("%x: nesting up to the limit was rejected: %v", head, err)
+		}
+
+		if _, _, err := decodeCBOR(nest(head, cborMaxDepth+1)); err != errInvalidCBOR {
+			t.Fatalf("%x: nesting over the limit was accepted: %v", head, err)
+		}
+	}
+}
@@ -5,3 +5,18 @@ type Factor interface {
 	Request(data string) (string, error)
 	Verify(data []string, input string) (bool, error)
 }
+
+// StatefulFactor is implemented by factors that modify their data on every
+// successful verification, eg. to reject replayed codes. The verification
+// counts only once the updated data is stored.
+type StatefulFactor interface {
+	Factor
+	VerifyUpdate(data []string, input string) (bool, []string, error)
+}
+
+// DataRequester is implemented by factors whose challenges depend on the
+// factor's data, eg. on the list of registered authenticators
+type DataRequester interface {
+	Factor
+	RequestData(id string, data []string) (string, error)
+}
@@ -0,0 +1,645 @@
+package factor
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/agl/ed25519"
+
+	"github.com/lavab/api/cache"
+)
+
+// COSE algorithm identifiers supported by the WebAuthn factor
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+)
+
+// ed25519PKIXPrefix is the DER encoding of an Ed25519 SubjectPublicKeyInfo
+// without the key itself. crypto/x509 doesn't support Ed25519 keys.
+var ed25519PKIXPrefix = []byte{
+	0x30, 0x2a, 0x30, 0x05, 0x06, 0x03, 0x2b, 0x65, 0x70, 0x03, 0x21, 0x00,
+}
+
+// Flags of the authenticator data
+const (
+	webAuthnUserPresent   = 0x01
+	webAuthnAttestedData  = 0x40
+	webAuthnExtensionData = 0x80
+)
+
+var (
+	// ErrInvalidCredential is returned when a WebAuthn response fails the verification
+	ErrInvalidCredential = errors.New("Invalid WebAuthn credential")
+
+	// ErrCredentialExists is returned when an authenticator is registered twice
+	ErrCredentialExists = errors.New("Authenticator is already registered")
+)
+
+// WebAuthn is an implementation of Factor for FIDO2/U2F security keys using
+// the WebAuthn API. Every element of its data is a JSON-encoded WebAuthnCredential,
+// so an account can have several authenticators registered.
+type WebAuthn struct {
+	rpID   string
+	rpName string
+	origin string
+	cache  cache.Cache
+	ttl    time.Duration
+}
+
+// WebAuthnOpts is used to pass options to NewWebAuthn
+type WebAuthnOpts struct {
+	// RPID is the domain the credentials are scoped to, eg. lavaboom.com
+	RPID   string
+	RPName string
+
+	// Origin is the origin of the web client, eg. https://mail.lavaboom.com
+	Origin string
+
+	// Cache stores the issued challenges until they're used
+	Cache        cache.Cache
+	ChallengeTTL time.Duration
+}
+
+// WebAuthnCredential is a registered authenticator
+type WebAuthnCredential struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	PublicKey   string    `json:"public_key"`
+	Algorithm   int64     `json:"algorithm"`
+	Counter     uint32    `json:"counter"`
+	DateCreated time.Time `json:"date_created"`
+	DateUsed    time.Time `json:"date_used,omitempty"`
+}
+
+// webAuthnResponse is the JSON form of a PublicKeyCredential, with binary
+// fields encoded using base64url
+type webAuthnResponse struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+	} `json:"response"`
+}
+
+type webAuthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type webAuthnDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// NewWebAuthn creates a new WebAuthn factor
+func NewWebAuthn(options *WebAuthnOpts) *WebAuthn {
+	// Default values
+	if options.RPName == "" {
+		options.RPName = "Lavaboom"
+	}
+	if options.ChallengeTTL == 0 {
+		options.ChallengeTTL = 5 * time.Minute
+	}
+
+	return &WebAuthn{
+		rpID:   options.RPID,
+		rpName: options.RPName,
+		origin: options.Origin,
+		cache:  options.Cache,
+		ttl:    options.ChallengeTTL,
+	}
+}
+
+// Type returns factor's type
+func (w *WebAuthn) Type() string {
+	return "webauthn"
+}
+
+// Request returns assertion options without a list of allowed credentials,
+// which works only with discoverable credentials. Use RequestData if the
+// account's data is available.
+func (w *WebAuthn) Request(id string) (string, error) {
+	return w.RequestData(id, nil)
+}
+
+// RequestData returns JSON-encoded PublicKeyCredentialRequestOptions for the
+// registered authenticators
+func (w *WebAuthn) RequestData(id string, data []string) (string, error) {
+	challenge, err := w.newChallenge()
+	if err != nil {
+		return "", err
+	}
+
+	if err := w.cache.Set(w.challengeKey(challenge), id, w.ttl); err != nil {
+		return "", err
+	}
+
+	credentials, err := w.Credentials(data)
+	if err != nil {
+		return "", err
+	}
+
+	options, err := json.Marshal(map[string]interface{}{
+		"challenge":        challenge,
+		"rpId":             w.rpID,
+		"timeout":          int(w.ttl / time.Millisecond),
+		"allowCredentials": descriptors(credentials),
+		"userVerification": "discouraged",
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return string(options), nil
+}
+
+// Verify checks if the input is a valid assertion
+func (w *WebAuthn) Verify(data []string, input string) (bool, error) {
+	ok, _, err := w.VerifyUpdate(data, input)
+	return ok, err
+}
+
+// VerifyUpdate checks the assertion and returns data with the updated sign
+// counter of the used authenticator
+func (w *WebAuthn) VerifyUpdate(data []string, input string) (bool, []string, error) {
+	credentials, err := w.Credentials(data)
+	if err != nil {
+		return false, nil, err
+	}
+
+	var response webAuthnResponse
+	if err := json.Unmarshal([]byte(input), &response); err != nil {
+		return false, nil, nil
+	}
+
+	// Find the used authenticator
+	index := -1
+	for i, credential := range credentials {
+		if trimBase64(credential.ID) == trimBase64(response.ID) {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		return false, nil, nil
+	}
+	credential := credentials[index]
+
+	clientDataJSON, err := decodeBase64URL(response.Response.ClientDataJSON)
+	if err != nil {
+		return false, nil, nil
+	}
+
+	clientData, err := w.checkClientData(clientDataJSON, "webauthn.get")
+	if err != nil {
+		return false, nil, nil
+	}
+
+	// Challenges can be used only once
+	if exists, err := w.cache.Exists(w.challengeKey(clientData.Challenge)); err != nil {
+		return false, nil, err
+	} else if !exists {
+		return false, nil, nil
+	}
+	if err := w.cache.Delete(w.challengeKey(clientData.Challenge)); err != nil {
+		return false, nil, err
+	}
+
+	authData, err := decodeBase64URL(response.Response.AuthenticatorData)
+	if err != nil {
+		return false, nil, nil
+	}
+
+	counter, _, err := w.parseAuthData(authData)
+	if err != nil {
+		return false, nil, nil
+	}
+
+	signature, err := decodeBase64URL(response.Response.Signature)
+	if err != nil {
+		return false, nil, nil
+	}
+
+	hash := sha256.Sum256(clientDataJSON)
+	if !credential.verify(append(authData, hash[:]...), signature) {
+		return false, nil, nil
+	}
+
+	// A counter that didn't increase means that the authenticator was cloned.
+	// Authenticators that don't implement counters always return 0.
+	if (counter != 0 || credential.Counter != 0) && counter <= credential.Counter {
+		return false, nil, nil
+	}
+
+	credential.Counter = counter
+	credential.DateUsed = time.Now()
+
+	updated := append([]string{}, data...)
+	if updated[index], err = credential.Encode(); err != nil {
+		return false, nil, err
+	}
+
+	return true, updated, nil
+}
+
+// BeginRegistration returns JSON-encoded PublicKeyCredentialCreationOptions
+// for a new authenticator of the account
+func (w *WebAuthn) BeginRegistration(id string, name string, data []string) (string, error) {
+	challenge, err := w.newChallenge()
+	if err != nil {
+		return "", err
+	}
+
+	if err := w.cache.Set(w.registrationKey(id), challenge, w.ttl); err != nil {
+		return "", err
+	}
+
+	credentials, err := w.Credentials(data)
+	if err != nil {
+		return "", err
+	}
+
+	options, err := json.Marshal(map[string]interface{}{
+		"challenge": challenge,
+		"rp": map[string]interface{}{
+			"id":   w.rpID,
+			"name": w.rpName,
+		},
+		"user": map[string]interface{}{
+			"id":          encodeBase64URL([]byte(id)),
+			"name":        name,
+			"displayName": name,
+		},
+		"pubKeyCredParams": []map[string]interface{}{
+			{"type": "public-key", "alg": coseES256},
+			{"type": "public-key", "alg": coseEdDSA},
+			{"type": "public-key", "alg": coseRS256},
+		},
+		"timeout":            int(w.ttl / time.Millisecond),
+		"excludeCredentials": descriptors(credentials),
+		"attestation":        "none",
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return string(options), nil
+}
+
+// FinishRegistration verifies the attestation response created using the
+// options returned by BeginRegistration. Attestation statements aren't
+// verified, so any authenticator model is accepted.
+func (w *WebAuthn) FinishRegistration(id string, name string, data []string, input string) (*WebAuthnCredential, error) {
+	var challenge string
+	if err := w.cache.Get(w.registrationKey(id), &challenge); err != nil {
+		return nil, ErrInvalidCredential
+	}
+
+	var response webAuthnResponse
+	if err := json.Unmarshal([]byte(input), &response); err != nil {
+		return nil, ErrInvalidCredential
+	}
+
+	clientDataJSON, err := decodeBase64URL(response.Response.ClientDataJSON)
+	if err != nil {
+		return nil, ErrInvalidCredential
+	}
+
+	clientData, err := w.checkClientData(clientDataJSON, "webauthn.create")
+	if err != nil || trimBase64(clientData.Challenge) != trimBase64(challenge) {
+		return nil, ErrInvalidCredential
+	}
+
+	rawAttestation, err := decodeBase64URL(response.Response.AttestationObject)
+	if err != nil {
+		return nil, ErrInvalidCredential
+	}
+
+	attestation, rest, err := decodeCBOR(rawAttestation)
+	if err != nil || len(rest) != 0 {
+		return nil, ErrInvalidCredential
+	}
+
+	object, ok := attestation.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrInvalidCredential
+	}
+
+	authData, ok := object["authData"].([]byte)
+	if !ok {
+		return nil, ErrInvalidCredential
+	}
+
+	counter, credential, err := w.parseAuthData(authData)
+	if err != nil || credential == nil {
+		return nil, ErrInvalidCredential
+	}
+
+	credentials, err := w.Credentials(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, existing := range credentials {
+		if existing.ID == credential.ID {
+			return nil, ErrCredentialExists
+		}
+	}
+
+	if err := w.cache.Delete(w.registrationKey(id)); err != nil {
+		return nil, err
+	}
+
+	credential.Name = name
+	credential.Counter = counter
+	credential.DateCreated = time.Now()
+
+	return credential, nil
+}
+
+// Credentials decodes factor's data
+func (w *WebAuthn) Credentials(data []string) ([]*WebAuthnCredential, error) {
+	credentials := make([]*WebAuthnCredential, len(data))
+	for i, item := range data {
+		if err := json.Unmarshal([]byte(item), &credentials[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return credentials, nil
+}
+
+// Encode serializes the credential into an element of factor's data
+func (c *WebAuthnCredential) Encode() (string, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// verify checks the signature using credential's public key
+func (c *WebAuthnCredential) verify(message []byte, signature []byte) bool {
+	der, err := base64.StdEncoding.DecodeString(c.PublicKey)
+	if err != nil {
+		return false
+	}
+
+	if c.Algorithm == coseEdDSA {
+		if len(der) != len(ed25519PKIXPrefix)+ed25519.PublicKeySize ||
+			!bytes.HasPrefix(der, ed25519PKIXPrefix) ||
+			len(signature) != ed25519.SignatureSize {
+			return false
+		}
+
+		var (
+			key [ed25519.PublicKeySize]byte
+			sig [ed25519.SignatureSize]byte
+		)
+		copy(key[:], der[len(ed25519PKIXPrefix):])
+		copy(sig[:], signature)
+
+		return ed25519.Verify(&key, message, &sig)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return false
+	}
+
+	hash := sha256.Sum256(message)
+
+	switch c.Algorithm {
+	case coseES256:
+		if key, ok := key.(*ecdsa.PublicKey); ok {
+			var sig struct {
+				R, S *big.Int
+			}
+			if rest, err := asn1.Unmarshal(signature, &sig); err != nil || len(rest) != 0 {
+				return false
+			}
+			if sig.R.Sign() <= 0 || sig.S.Sign() <= 0 {
+				return false
+			}
+
+			return ecdsa.Verify(key, hash[:], sig.R, sig.S)
+		}
+	case coseRS256:
+		if key, ok := key.(*rsa.PublicKey); ok {
+			return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) == nil
+		}
+	}
+
+	return false
+}
+
+// checkClientData parses client data and checks its type and origin
+func (w *WebAuthn) checkClientData(input []byte, kind string) (*webAuthnClientData, error) {
+	var clientData webAuthnClientData
+	if err := json.Unmarshal(input, &clientData); err != nil {
+		return nil, err
+	}
+
+	if clientData.Type != kind || clientData.Origin != w.origin || clientData.Challenge == "" {
+		return nil, ErrInvalidCredential
+	}
+
+	return &clientData, nil
+}
+
+// parseAuthData checks the authenticator data and returns its sign counter
+// and the attested credential, if it's present. Extensions are ignored.
+func (w *WebAuthn) parseAuthData(data []byte) (uint32, *WebAuthnCredential, error) {
+	if len(data) < 37 {
+		return 0, nil, ErrInvalidCredential
+	}
+
+	rpIDHash := sha256.Sum256([]byte(w.rpID))
+	if !bytes.Equal(data[:32], rpIDHash[:]) {
+		return 0, nil, ErrInvalidCredential
+	}
+
+	flags := data[32]
+	if flags&webAuthnUserPresent == 0 {
+		return 0, nil, ErrInvalidCredential
+	}
+
+	counter := binary.BigEndian.Uint32(data[33:37])
+	data = data[37:]
+
+	var credential *WebAuthnCredential
+	if flags&webAuthnAttestedData != 0 {
+		// AAGUID and the length of the credential ID
+		if len(data) < 18 {
+			return 0, nil, ErrInvalidCredential
+		}
+
+		length := int(binary.BigEndian.Uint16(data[16:18]))
+		data = data[18:]
+		if len(data) < length {
+			return 0, nil, ErrInvalidCredential
+		}
+
+		credential = &WebAuthnCredential{
+			ID: encodeBase64URL(data[:length]),
+		}
+
+		var (
+			coseKey interface{}
+			err     error
+		)
+		coseKey, data, err = decodeCBOR(data[length:])
+		if err != nil {
+			return 0, nil, ErrInvalidCredential
+		}
+
+		key, ok := coseKey.(map[interface{}]interface{})
+		if !ok {
+			return 0, nil, ErrInvalidCredential
+		}
+
+		credential.Algorithm, credential.PublicKey, err = parseCOSEKey(key)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if flags&webAuthnExtensionData != 0 {
+		extensions, rest, err := decodeCBOR(data)
+		if err != nil {
+			return 0, nil, ErrInvalidCredential
+		}
+		if _, ok := extensions.(map[interface{}]interface{}); !ok {
+			return 0, nil, ErrInvalidCredential
+		}
+		data = rest
+	}
+
+	// Nothing else can follow
+	if len(data) != 0 {
+		return 0, nil, ErrInvalidCredential
+	}
+
+	return counter, credential, nil
+}
+
+// parseCOSEKey converts a COSE_Key into a base64-encoded PKIX public key
+func parseCOSEKey(key map[interface{}]interface{}) (int64, string, error) {
+	algorithm, _ := key[int64(3)].(int64)
+
+	var public interface{}
+	switch algorithm {
+	case coseES256:
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if curve, _ := key[int64(-1)].(int64); curve != 1 || len(x) != 32 || len(y) != 32 {
+			return 0, "", ErrInvalidCredential
+		}
+
+		ecKey := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !ecKey.Curve.IsOnCurve(ecKey.X, ecKey.Y) {
+			return 0, "", ErrInvalidCredential
+		}
+		public = ecKey
+	case coseRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return 0, "", ErrInvalidCredential
+		}
+
+		public = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	case coseEdDSA:
+		x, _ := key[int64(-2)].([]byte)
+		if curve, _ := key[int64(-1)].(int64); curve != 6 || len(x) != ed25519.PublicKeySize {
+			return 0, "", ErrInvalidCredential
+		}
+
+		der := append(append([]byte{}, ed25519PKIXPrefix...), x...)
+		return algorithm, base64.StdEncoding.EncodeToString(der), nil
+	default:
+		return 0, "", ErrInvalidCredential
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return 0, "", ErrInvalidCredential
+	}
+
+	return algorithm, base64.StdEncoding.EncodeToString(der), nil
+}
+
+func (w *WebAuthn) newChallenge() (string, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return "", err
+	}
+
+	return encodeBase64URL(challenge), nil
+}
+
+func (w *WebAuthn) challengeKey(challenge string) string {
+	return "webauthn:challenge:" + trimBase64(challenge)
+}
+
+func (w *WebAuthn) registrationKey(id string) string {
+	return "webauthn:registration:" + id
+}
+
+func descriptors(credentials []*WebAuthnCredential) []*webAuthnDescriptor {
+	result := make([]*webAuthnDescriptor, len(credentials))
+	for i, credential := range credentials {
+		result[i] = &webAuthnDescriptor{
+			Type: "public-key",
+			ID:   credential.ID,
+		}
+	}
+
+	return result
+}
+
+// encodeBase64URL encodes data using unpadded base64url, as WebAuthn does
+func encodeBase64URL(data []byte) string {
+	return trimBase64(base64.URLEncoding.EncodeToString(data))
+}
+
+// decodeBase64URL accepts both padded and unpadded base64url
+func decodeBase64URL(input string) ([]byte, error) {
+	input = trimBase64(input)
+	if padding := len(input) % 4; padding != 0 {
+		input += strings.Repeat("=", 4-padding)
+	}
+
+	return base64.URLEncoding.DecodeString(input)
+}
+
+func trimBase64(input string) string {
+	return strings.TrimRight(input, "=")
+}
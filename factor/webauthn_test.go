@@ -0,0 +1,445 @@
+package factor
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/agl/ed25519"
+
+	"github.com/lavab/api/cache"
+)
+
+// An ES256 assertion of an authenticator with counter 5, signed using openssl
+const (
+	fixtureRPID           = "lavaboom.com"
+	fixtureOrigin         = "https://mail.lavaboom.com"
+	fixtureCredentialID   = "ZGVmZ2hpamtsbW5vcHFycw"
+	fixtureX              = "b934753208d5a990ecfcc94ba5c165e4381711a8597cd1ec4c3beb0027b0e20c"
+	fixtureY              = "54b368acf771cea52e11ef63375c1040a2a0036fabdde7c067107e0d37b91784"
+	fixtureChallenge      = "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8"
+	fixtureAuthData       = "6oFLQgb77RFGNqV7lMPa3qS_WF2G5fLn0w4lC-34s8IBAAAABQ"
+	fixtureClientDataJSON = "eyJ0eXBlIjoid2ViYXV0aG4uZ2V0IiwiY2hhbGxlbmdlIjoiQUFFQ0F3UUZCZ2NJQ1FvTERBME9EeEFSRWhNVUZSWVhHQmthR3h3ZEhoOCIsIm9yaWdpbiI6Imh0dHBzOi8vbWFpbC5sYXZhYm9vbS5jb20iLCJjcm9zc09yaWdpbiI6ZmFsc2V9"
+	fixtureSignature      = "MEYCIQCPCC_q1GtsNuoqCZZ-NlqSLksfloQ51lCo8gGNOq-fLAIhANc1IME1GAb-QHImu5y1ThoNao2qtRdAiwjF4zZ9pv1f"
+)
+
+func newTestWebAuthn(rpID string, origin string) *WebAuthn {
+	return NewWebAuthn(&WebAuthnOpts{
+		RPID:   rpID,
+		Origin: origin,
+		Cache:  cache.NewMemoryCache(&cache.MemoryCacheOpts{}),
+	})
+}
+
+// fixtureCOSEKey returns the COSE_Key of the fixture's authenticator
+func fixtureCOSEKey() []byte {
+	x, _ := hex.DecodeString(fixtureX)
+	y, _ := hex.DecodeString(fixtureY)
+
+	return cborMap(
+		cborInt(1), cborInt(2),
+		cborInt(3), cborInt(coseES256),
+		cborInt(-1), cborInt(1),
+		cborInt(-2), cborBytes(x),
+		cborInt(-3), cborBytes(y),
+	)
+}
+
+// fixtureData returns factor's data with the fixture's authenticator
+func fixtureData(t *testing.T, counter uint32) []string {
+	key, _, err := decodeCBOR(fixtureCOSEKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	algorithm, public, err := parseCOSEKey(key.(map[interface{}]interface{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credential, err := (&WebAuthnCredential{
+		ID:        fixtureCredentialID,
+		PublicKey: public,
+		Algorithm: algorithm,
+		Counter:   counter,
+	}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []string{credential}
+}
+
+// fixtureAssertion encodes the fixture, optionally modified
+func fixtureAssertion(t *testing.T, modify func(response *webAuthnResponse)) string {
+	var response webAuthnResponse
+	response.ID = fixtureCredentialID
+	response.Type = "public-key"
+	response.Response.ClientDataJSON = fixtureClientDataJSON
+	response.Response.AuthenticatorData = fixtureAuthData
+	response.Response.Signature = fixtureSignature
+
+	if modify != nil {
+		modify(&response)
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+// issueChallenge stores the fixture's challenge, as RequestData would
+func issueChallenge(t *testing.T, w *WebAuthn) {
+	if err := w.cache.Set(w.challengeKey(fixtureChallenge), "account", w.ttl); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// modifyBase64 decodes a base64url field, modifies and encodes it again
+func modifyBase64(field *string, modify func(data []byte) []byte) {
+	data, _ := decodeBase64URL(*field)
+	*field = encodeBase64URL(modify(data))
+}
+
+func TestWebAuthnAssertion(t *testing.T) {
+	w := newTestWebAuthn(fixtureRPID, fixtureOrigin)
+	issueChallenge(t, w)
+
+	data := fixtureData(t, 2)
+	ok, updated, err := w.VerifyUpdate(data, fixtureAssertion(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("valid assertion was rejected")
+	}
+
+	credentials, err := w.Credentials(updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credentials[0].Counter != 5 || credentials[0].DateUsed.IsZero() {
+		t.Fatalf("credential wasn't updated: %+v", credentials[0])
+	}
+
+	// The challenge can be used only once
+	if ok, _, _ := w.VerifyUpdate(data, fixtureAssertion(t, nil)); ok {
+		t.Fatal("reused challenge was accepted")
+	}
+}
+
+func TestWebAuthnAssertionRejected(t *testing.T) {
+	cases := []struct {
+		name    string
+		rpID    string
+		origin  string
+		counter uint32
+		modify  func(response *webAuthnResponse)
+	}{
+		{
+			name: "wrong rpIdHash",
+			rpID: "example.com",
+		},
+		{
+			name:   "wrong origin",
+			origin: "https://mail.example.com",
+		},
+		{
+			name:    "same counter",
+			counter: 5,
+		},
+		{
+			name:    "counter going backwards",
+			counter: 10,
+		},
+		{
+			name: "unknown credential",
+			modify: func(response *webAuthnResponse) {
+				response.ID = "AAAA"
+			},
+		},
+		{
+			name: "tampered signature",
+			modify: func(response *webAuthnResponse) {
+				modifyBase64(&response.Response.Signature, func(data []byte) []byte {
+					data[len(data)-1] ^= 0x01
+					return data
+				})
+			},
+		},
+		{
+			name: "signature with trailing data",
+			modify: func(response *webAuthnResponse) {
+				modifyBase64(&response.Response.Signature, func(data []byte) []byte {
+					return append(data, 0x00)
+				})
+			},
+		},
+		{
+			name: "tampered counter",
+			modify: func(response *webAuthnResponse) {
+				modifyBase64(&response.Response.AuthenticatorData, func(data []byte) []byte {
+					data[36]++
+					return data
+				})
+			},
+		},
+		{
+			name: "over-long authenticator data",
+			modify: func(response *webAuthnResponse) {
+				modifyBase64(&response.Response.AuthenticatorData, func(data []byte) []byte {
+					return append(data, 0x00)
+				})
+			},
+		},
+		{
+			name: "wrong client data type",
+			modify: func(response *webAuthnResponse) {
+				modifyBase64(&response.Response.ClientDataJSON, func(data []byte) []byte {
+					return bytes.Replace(data, []byte("webauthn.get"), []byte("webauthn.create"), 1)
+				})
+			},
+		},
+	}
+
+	for _, test := range cases {
+		if test.rpID == "" {
+			test.rpID = fixtureRPID
+		}
+		if test.origin == "" {
+			test.origin = fixtureOrigin
+		}
+
+		w := newTestWebAuthn(test.rpID, test.origin)
+		issueChallenge(t, w)
+
+		ok, _, err := w.VerifyUpdate(fixtureData(t, test.counter), fixtureAssertion(t, test.modify))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if ok {
+			t.Fatalf("%s: assertion was accepted", test.name)
+		}
+	}
+}
+
+// authData builds authenticator data of the fixture's relying party
+func authData(flags byte, counter uint32, rest ...[]byte) []byte {
+	hash := sha256.Sum256([]byte(fixtureRPID))
+	data := append(hash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], counter)
+
+	return append(data, bytes.Join(rest, nil)...)
+}
+
+// attestedData builds attested credential data with the credential ID and key
+func attestedData(id []byte, key []byte) []byte {
+	data := make([]byte, 18)
+	binary.BigEndian.PutUint16(data[16:], uint16(len(id)))
+
+	return append(append(data, id...), key...)
+}
+
+func TestWebAuthnParseAuthData(t *testing.T) {
+	w := newTestWebAuthn(fixtureRPID, fixtureOrigin)
+	id, _ := decodeBase64URL(fixtureCredentialID)
+	wrongRP := sha256.Sum256([]byte("example.com"))
+
+	cases := []struct {
+		name       string
+		data       []byte
+		valid      bool
+		counter    uint32
+		credential bool
+	}{
+		{"assertion", authData(0x01, 7), true, 7, false},
+		{"attestation", authData(0x41, 0, attestedData(id, fixtureCOSEKey())), true, 0, true},
+		{"extensions", authData(0x81, 3, cborMap(cborText("appid"), []byte{0xf5})), true, 3, false},
+		{"attestation with extensions", authData(0xc1, 1, attestedData(id, fixtureCOSEKey()), cborMap()), true, 1, true},
+		{"truncated", authData(0x01, 7)[:36], false, 0, false},
+		{"wrong rpIdHash", append(wrongRP[:], authData(0x01, 7)[32:]...), false, 0, false},
+		{"user not present", authData(0x00, 7), false, 0, false},
+		{"trailing data", authData(0x01, 7, []byte{0x00}), false, 0, false},
+		{"extensions that aren't a map", authData(0x81, 3, cborInt(1)), false, 0, false},
+		{"truncated extensions", authData(0x81, 3, cborMap(cborText("appid"))), false, 0, false},
+		{"trailing data after the key", authData(0x41, 0, attestedData(id, fixtureCOSEKey()), []byte{0x00}), false, 0, false},
+		{"truncated AAGUID", authData(0x41, 0, make([]byte, 17)), false, 0, false},
+		{"truncated credential ID", authData(0x41, 0, attestedData(id, nil)[:20]), false, 0, false},
+		{"missing key", authData(0x41, 0, attestedData(id, nil)), false, 0, false},
+		{"key that isn't a map", authData(0x41, 0, attestedData(id, cborBytes([]byte{1}))), false, 0, false},
+		{"malformed key", authData(0x41, 0, attestedData(id, cborMap(cborInt(3), cborInt(coseES256)))), false, 0, false},
+	}
+
+	for _, test := range cases {
+		counter, credential, err := w.parseAuthData(test.data)
+		if !test.valid {
+			if err == nil {
+				t.Fatalf("%s: invalid data was accepted", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if counter != test.counter {
+			t.Fatalf("%s: invalid counter %d", test.name, counter)
+		}
+		if (credential != nil) != test.credential {
+			t.Fatalf("%s: credential parsed: %v, expected %v", test.name, credential != nil, test.credential)
+		}
+		if credential != nil && (credential.ID != fixtureCredentialID || credential.Algorithm != coseES256) {
+			t.Fatalf("%s: invalid credential %+v", test.name, credential)
+		}
+	}
+}
+
+func TestParseCOSEKey(t *testing.T) {
+	x, _ := hex.DecodeString(fixtureX)
+	y, _ := hex.DecodeString(fixtureY)
+	offCurve := append([]byte{}, y...)
+	offCurve[31] ^= 0x01
+
+	cases := []struct {
+		name  string
+		key   []byte
+		valid bool
+	}{
+		{"ES256", fixtureCOSEKey(), true},
+		{"RS256", cborMap(cborInt(3), cborInt(coseRS256), cborInt(-1), cborBytes(bytes.Repeat([]byte{0xff}, 256)), cborInt(-2), cborBytes([]byte{1, 0, 1})), true},
+		{"EdDSA", cborMap(cborInt(3), cborInt(coseEdDSA), cborInt(-1), cborInt(6), cborInt(-2), cborBytes(make([]byte, 32))), true},
+		{"missing algorithm", cborMap(cborInt(-1), cborInt(1), cborInt(-2), cborBytes(x), cborInt(-3), cborBytes(y)), false},
+		{"unsupported algorithm", cborMap(cborInt(3), cborInt(-35), cborInt(-1), cborInt(2), cborInt(-2), cborBytes(x), cborInt(-3), cborBytes(y)), false},
+		{"algorithm as a string", cborMap(cborInt(3), cborText("ES256"), cborInt(-1), cborInt(1), cborInt(-2), cborBytes(x), cborInt(-3), cborBytes(y)), false},
+		{"ES256 on another curve", cborMap(cborInt(3), cborInt(coseES256), cborInt(-1), cborInt(2), cborInt(-2), cborBytes(x), cborInt(-3), cborBytes(y)), false},
+		{"ES256 without y", cborMap(cborInt(3), cborInt(coseES256), cborInt(-1), cborInt(1), cborInt(-2), cborBytes(x)), false},
+		{"ES256 with a short x", cborMap(cborInt(3), cborInt(coseES256), cborInt(-1), cborInt(1), cborInt(-2), cborBytes(x[1:]), cborInt(-3), cborBytes(y)), false},
+		{"ES256 off the curve", cborMap(cborInt(3), cborInt(coseES256), cborInt(-1), cborInt(1), cborInt(-2), cborBytes(x), cborInt(-3), cborBytes(offCurve)), false},
+		{"RS256 without a modulus", cborMap(cborInt(3), cborInt(coseRS256), cborInt(-2), cborBytes([]byte{1, 0, 1})), false},
+		{"RS256 with a long exponent", cborMap(cborInt(3), cborInt(coseRS256), cborInt(-1), cborBytes([]byte{0xff}), cborInt(-2), cborBytes(make([]byte, 5))), false},
+		{"EdDSA on another curve", cborMap(cborInt(3), cborInt(coseEdDSA), cborInt(-1), cborInt(7), cborInt(-2), cborBytes(make([]byte, 32))), false},
+		{"EdDSA with a short key", cborMap(cborInt(3), cborInt(coseEdDSA), cborInt(-1), cborInt(6), cborInt(-2), cborBytes(make([]byte, 31))), false},
+	}
+
+	for _, test := range cases {
+		key, _, err := decodeCBOR(test.key)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		_, public, err := parseCOSEKey(key.(map[interface{}]interface{}))
+		if test.valid && (err != nil || public == "") {
+			t.Fatalf("%s: valid key was rejected: %v", test.name, err)
+		}
+		if !test.valid && err != ErrInvalidCredential {
+			t.Fatalf("%s: invalid key was accepted", test.name)
+		}
+	}
+}
+
+func TestWebAuthnEdDSA(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, _, err := decodeCBOR(cborMap(
+		cborInt(1), cborInt(1),
+		cborInt(3), cborInt(coseEdDSA),
+		cborInt(-1), cborInt(6),
+		cborInt(-2), cborBytes(public[:]),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credential := &WebAuthnCredential{}
+	credential.Algorithm, credential.PublicKey, err = parseCOSEKey(key.(map[interface{}]interface{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := []byte("message")
+	signature := ed25519.Sign(private, message)
+
+	if !credential.verify(message, signature[:]) {
+		t.Fatal("valid signature was rejected")
+	}
+	if credential.verify([]byte("other message"), signature[:]) {
+		t.Fatal("signature of another message was accepted")
+	}
+	if credential.verify(message, signature[1:]) {
+		t.Fatal("truncated signature was accepted")
+	}
+}
+
+func TestWebAuthnRegistration(t *testing.T) {
+	w := newTestWebAuthn(fixtureRPID, fixtureOrigin)
+	id, _ := decodeBase64URL(fixtureCredentialID)
+
+	// register completes the ceremony with the fixture's authenticator
+	register := func(data []string, trailing []byte) (*WebAuthnCredential, error) {
+		raw, err := w.BeginRegistration("account", "name", data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var options struct {
+			Challenge string `json:"challenge"`
+		}
+		if err := json.Unmarshal([]byte(raw), &options); err != nil {
+			t.Fatal(err)
+		}
+
+		clientData, _ := json.Marshal(map[string]interface{}{
+			"type":      "webauthn.create",
+			"challenge": options.Challenge,
+			"origin":    fixtureOrigin,
+		})
+
+		attestation := cborMap(
+			cborText("fmt"), cborText("none"),
+			cborText("attStmt"), cborMap(),
+			cborText("authData"), cborBytes(authData(0x41, 0, attestedData(id, fixtureCOSEKey()))),
+		)
+
+		var response webAuthnResponse
+		response.ID = fixtureCredentialID
+		response.Type = "public-key"
+		response.Response.ClientDataJSON = encodeBase64URL(clientData)
+		response.Response.AttestationObject = encodeBase64URL(append(attestation, trailing...))
+
+		input, _ := json.Marshal(response)
+		return w.FinishRegistration("account", "name", data, string(input))
+	}
+
+	if _, err := register(nil, []byte{0x00}); err != ErrInvalidCredential {
+		t.Fatalf("attestation with trailing data was accepted: %v", err)
+	}
+
+	credential, err := register(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, _ := w.Credentials(fixtureData(t, 0))
+	if credential.ID != fixtureCredentialID || credential.PublicKey != expected[0].PublicKey || credential.Name != "name" {
+		t.Fatalf("invalid credential %+v", credential)
+	}
+
+	encoded, err := credential.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := register([]string{encoded}, nil); err != ErrCredentialExists {
+		t.Fatalf("expected ErrCredentialExists, got %v", err)
+	}
+}
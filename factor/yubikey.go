@@ -0,0 +1,270 @@
+package factor
+
+import (
+	"crypto/aes"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// modhexAlphabet maps modhex characters to hex digits
+const modhexAlphabet = "cbdefghijklnrtuv"
+
+const (
+	// yubiKeyCRCResidue is the CRC16 of a valid decrypted token
+	yubiKeyCRCResidue = 0xf0b8
+
+	// yubiKeyCounterMask strips the flag of tokens triggered by caps lock
+	yubiKeyCounterMask = 0x7fff
+)
+
+var (
+	// ErrInvalidOTP is returned when a YubiKey OTP can't be decrypted or is malformed
+	ErrInvalidOTP = errors.New("Invalid YubiKey OTP")
+
+	// ErrYubiKeyExists is returned when a YubiKey is registered twice
+	ErrYubiKeyExists = errors.New("YubiKey is already registered")
+)
+
+// YubiKey is an implementation of Factor that validates Yubico OTPs locally,
+// without YubiCloud. Every element of its data is a JSON-encoded YubiKeyCredential
+// containing key's AES secret and the last seen counters.
+type YubiKey struct{}
+
+// YubiKeyCredential is a registered YubiKey
+type YubiKeyCredential struct {
+	PublicID    string    `json:"public_id"`
+	PrivateID   string    `json:"private_id,omitempty"`
+	AESKey      string    `json:"aes_key,omitempty"`
+	Name        string    `json:"name"`
+	Counter     int       `json:"counter"`
+	Session     int       `json:"session"`
+	DateCreated time.Time `json:"date_created"`
+	DateUsed    time.Time `json:"date_used,omitempty"`
+}
+
+// yubiKeyToken is a decrypted OTP
+type yubiKeyToken struct {
+	PrivateID []byte
+	Counter   int
+	Session   int
+}
+
+// NewYubiKey creates a new local YubiKey OTP factor
+func NewYubiKey() *YubiKey {
+	return &YubiKey{}
+}
+
+// Type returns factor's type
+func (y *YubiKey) Type() string {
+	return "yubikey"
+}
+
+// Request does nothing in this driver
+func (y *YubiKey) Request(data string) (string, error) {
+	return "", nil
+}
+
+// Verify checks if the OTP is valid
+func (y *YubiKey) Verify(data []string, input string) (bool, error) {
+	ok, _, err := y.VerifyUpdate(data, input)
+	return ok, err
+}
+
+// VerifyUpdate decrypts the OTP using the key matching its public ID and
+// returns data with the updated counters of that key. OTPs with counters
+// lower than or equal to the stored ones are replays.
+func (y *YubiKey) VerifyUpdate(data []string, input string) (bool, []string, error) {
+	credentials, err := y.Credentials(data)
+	if err != nil {
+		return false, nil, err
+	}
+
+	input = strings.ToLower(strings.TrimSpace(input))
+	if len(input) != 44 {
+		return false, nil, nil
+	}
+
+	index := -1
+	for i, credential := range credentials {
+		if credential.PublicID == input[:12] {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		return false, nil, nil
+	}
+	credential := credentials[index]
+
+	token, err := credential.decrypt(input)
+	if err != nil {
+		return false, nil, nil
+	}
+
+	if !credential.after(token) {
+		return false, nil, nil
+	}
+
+	credential.Counter = token.Counter
+	credential.Session = token.Session
+	credential.DateUsed = time.Now()
+
+	updated := append([]string{}, data...)
+	if updated[index], err = credential.Encode(); err != nil {
+		return false, nil, err
+	}
+
+	return true, updated, nil
+}
+
+// Register checks the OTP using the passed secrets and returns a new credential.
+// privateID and aesKey are hex-encoded, as displayed by the personalization tool.
+func (y *YubiKey) Register(name string, privateID string, aesKey string, otp string, data []string) (*YubiKeyCredential, error) {
+	credentials, err := y.Credentials(data)
+	if err != nil {
+		return nil, err
+	}
+
+	otp = strings.ToLower(strings.TrimSpace(otp))
+	if len(otp) != 44 {
+		return nil, ErrInvalidOTP
+	}
+
+	credential := &YubiKeyCredential{
+		PublicID:    otp[:12],
+		PrivateID:   strings.ToLower(privateID),
+		AESKey:      strings.ToLower(aesKey),
+		Name:        name,
+		DateCreated: time.Now(),
+	}
+
+	for _, existing := range credentials {
+		if existing.PublicID == credential.PublicID {
+			return nil, ErrYubiKeyExists
+		}
+	}
+
+	token, err := credential.decrypt(otp)
+	if err != nil {
+		return nil, err
+	}
+
+	credential.Counter = token.Counter
+	credential.Session = token.Session
+
+	return credential, nil
+}
+
+// Credentials decodes factor's data
+func (y *YubiKey) Credentials(data []string) ([]*YubiKeyCredential, error) {
+	credentials := make([]*YubiKeyCredential, len(data))
+	for i, item := range data {
+		if err := json.Unmarshal([]byte(item), &credentials[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return credentials, nil
+}
+
+// Encode serializes the credential into an element of factor's data
+func (c *YubiKeyCredential) Encode() (string, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// decrypt decodes the ciphertext part of the OTP and checks its checksum and
+// private ID
+func (c *YubiKeyCredential) decrypt(otp string) (*yubiKeyToken, error) {
+	key, err := hex.DecodeString(c.AESKey)
+	if err != nil || len(key) != aes.BlockSize {
+		return nil, ErrInvalidOTP
+	}
+
+	privateID, err := hex.DecodeString(c.PrivateID)
+	if err != nil || len(privateID) != 6 {
+		return nil, ErrInvalidOTP
+	}
+
+	ciphertext, err := decodeModhex(otp[12:])
+	if err != nil || len(ciphertext) != aes.BlockSize {
+		return nil, ErrInvalidOTP
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ErrInvalidOTP
+	}
+
+	// A single block, so ECB is what the key uses
+	plaintext := make([]byte, aes.BlockSize)
+	block.Decrypt(plaintext, ciphertext)
+
+	if yubiKeyCRC(plaintext) != yubiKeyCRCResidue {
+		return nil, ErrInvalidOTP
+	}
+
+	if subtle.ConstantTimeCompare(plaintext[:6], privateID) != 1 {
+		return nil, ErrInvalidOTP
+	}
+
+	return &yubiKeyToken{
+		PrivateID: plaintext[:6],
+		Counter:   int(binary.LittleEndian.Uint16(plaintext[6:8]) & yubiKeyCounterMask),
+		Session:   int(plaintext[11]),
+	}, nil
+}
+
+// after checks whether the token was generated after the last accepted one
+func (c *YubiKeyCredential) after(token *yubiKeyToken) bool {
+	if token.Counter != c.Counter {
+		return token.Counter > c.Counter
+	}
+
+	return token.Session > c.Session
+}
+
+// yubiKeyCRC computes the ISO13239 CRC16 used by YubiKeys
+func yubiKeyCRC(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			lsb := crc & 1
+			crc >>= 1
+			if lsb != 0 {
+				crc ^= 0x8408
+			}
+		}
+	}
+
+	return crc
+}
+
+func decodeModhex(input string) ([]byte, error) {
+	if len(input)%2 != 0 {
+		return nil, ErrInvalidOTP
+	}
+
+	result := make([]byte, len(input)/2)
+	for i := 0; i < len(input); i += 2 {
+		high := strings.IndexByte(modhexAlphabet, input[i])
+		low := strings.IndexByte(modhexAlphabet, input[i+1])
+		if high == -1 || low == -1 {
+			return nil, ErrInvalidOTP
+		}
+
+		result[i/2] = byte(high<<4 | low)
+	}
+
+	return result, nil
+}
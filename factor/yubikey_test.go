@@ -0,0 +1,218 @@
+package factor
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+// The token of yubico-c's README, prefixed with a 12 characters long public ID
+const (
+	yubicoAESKey    = "ecde18dbe76fbd0c33330f1c354871db"
+	yubicoPrivateID = "8792ebfe26cc"
+	yubicoPublicID  = "cccccccccccb"
+	yubicoOTP       = yubicoPublicID + "hknhfjbrjnlnldnhcujvddbikngjrtgh"
+)
+
+// yubiKeyOTP generates an OTP of the yubico-c key, as the YubiKey would
+func yubiKeyOTP(t *testing.T, counter int, session int) string {
+	key, _ := hex.DecodeString(yubicoAESKey)
+	privateID, _ := hex.DecodeString(yubicoPrivateID)
+
+	plaintext := make([]byte, aes.BlockSize)
+	copy(plaintext, privateID)
+	binary.LittleEndian.PutUint16(plaintext[6:], uint16(counter))
+	plaintext[11] = byte(session)
+	binary.LittleEndian.PutUint16(plaintext[14:], ^yubiKeyCRC(plaintext[:14]))
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext := make([]byte, aes.BlockSize)
+	block.Encrypt(ciphertext, plaintext)
+
+	otp := []byte(yubicoPublicID)
+	for _, b := range ciphertext {
+		otp = append(otp, modhexAlphabet[b>>4], modhexAlphabet[b&0x0f])
+	}
+
+	return string(otp)
+}
+
+func TestDecodeModhex(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected string
+		valid    bool
+	}{
+		{"", "", true},
+		{"cbdefghijklnrtuv", "0123456789abcdef", true},
+		{"vvcc", "ff00", true},
+		{"hknhfjbrjnlnldnhcujvddbikngjrtgh", "69b6481c8baba2b60e8f22179b58cd56", true},
+		{"cbd", "", false},
+		{"cbda", "", false},
+		{"CBDE", "", false},
+		{"cb0e", "", false},
+	}
+
+	for _, test := range cases {
+		output, err := decodeModhex(test.input)
+		if !test.valid {
+			if err != ErrInvalidOTP {
+				t.Fatalf("%q: invalid modhex was accepted", test.input)
+			}
+			continue
+		}
+
+		expected, _ := hex.DecodeString(test.expected)
+		if err != nil || !bytes.Equal(output, expected) {
+			t.Fatalf("%q: decoded %x (%v), expected %s", test.input, output, err, test.expected)
+		}
+	}
+}
+
+func TestYubiKeyCRC(t *testing.T) {
+	// CRC-16/X-25 of "123456789" is 0x906e, complemented on output
+	if crc := yubiKeyCRC([]byte("123456789")); crc != ^uint16(0x906e) {
+		t.Fatalf("invalid CRC %04x", crc)
+	}
+
+	// A token with its CRC appended leaves the residue
+	plaintext, _ := hex.DecodeString("8792ebfe26cc130030c20011c89f23c8")
+	if crc := yubiKeyCRC(plaintext); crc != yubiKeyCRCResidue {
+		t.Fatalf("invalid residue %04x", crc)
+	}
+
+	for i := range plaintext {
+		corrupted := append([]byte{}, plaintext...)
+		corrupted[i] ^= 0x01
+
+		if yubiKeyCRC(corrupted) == yubiKeyCRCResidue {
+			t.Fatalf("corrupted byte %d wasn't detected", i)
+		}
+	}
+}
+
+func TestYubiKeyDecrypt(t *testing.T) {
+	credential := &YubiKeyCredential{
+		PublicID:  yubicoPublicID,
+		PrivateID: yubicoPrivateID,
+		AESKey:    yubicoAESKey,
+	}
+
+	token, err := credential.decrypt(yubicoOTP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(token.PrivateID) != yubicoPrivateID || token.Counter != 0x13 || token.Session != 0x11 {
+		t.Fatalf("invalid token %+v", token)
+	}
+
+	// The caps lock flag isn't a part of the counter
+	if token, err := credential.decrypt(yubiKeyOTP(t, 0x8013, 1)); err != nil || token.Counter != 0x13 {
+		t.Fatalf("invalid token %+v (%v)", token, err)
+	}
+
+	cases := []struct {
+		name       string
+		credential YubiKeyCredential
+		otp        string
+	}{
+		{"wrong private ID", YubiKeyCredential{PrivateID: "000000000000", AESKey: yubicoAESKey}, yubicoOTP},
+		{"wrong AES key", YubiKeyCredential{PrivateID: yubicoPrivateID, AESKey: "00000000000000000000000000000000"}, yubicoOTP},
+		{"short AES key", YubiKeyCredential{PrivateID: yubicoPrivateID, AESKey: yubicoAESKey[2:]}, yubicoOTP},
+		{"tampered ciphertext", *credential, yubicoOTP[:43] + "c"},
+		{"invalid modhex", *credential, yubicoOTP[:43] + "a"},
+	}
+
+	for _, test := range cases {
+		if _, err := test.credential.decrypt(test.otp); err != ErrInvalidOTP {
+			t.Fatalf("%s: OTP was accepted", test.name)
+		}
+	}
+}
+
+func TestYubiKeyAfter(t *testing.T) {
+	credential := &YubiKeyCredential{
+		Counter: 19,
+		Session: 17,
+	}
+
+	cases := []struct {
+		counter int
+		session int
+		after   bool
+	}{
+		{19, 17, false},
+		{19, 16, false},
+		{18, 200, false},
+		{19, 18, true},
+		{20, 0, true},
+	}
+
+	for _, test := range cases {
+		if credential.after(&yubiKeyToken{Counter: test.counter, Session: test.session}) != test.after {
+			t.Fatalf("token %d/%d after 19/17: %v", test.counter, test.session, !test.after)
+		}
+	}
+}
+
+func TestYubiKeyReplay(t *testing.T) {
+	y := NewYubiKey()
+
+	credential, err := y.Register("key", yubicoPrivateID, yubicoAESKey, yubicoOTP, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credential.PublicID != yubicoPublicID || credential.Counter != 0x13 || credential.Session != 0x11 {
+		t.Fatalf("invalid credential %+v", credential)
+	}
+
+	encoded, err := credential.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []string{encoded}
+
+	if _, err := y.Register("key", yubicoPrivateID, yubicoAESKey, yubicoOTP, data); err != ErrYubiKeyExists {
+		t.Fatalf("expected ErrYubiKeyExists, got %v", err)
+	}
+
+	// The registration OTP was already used
+	if ok, _, _ := y.VerifyUpdate(data, yubicoOTP); ok {
+		t.Fatal("registration OTP was accepted")
+	}
+
+	ok, updated, err := y.VerifyUpdate(data, yubiKeyOTP(t, 0x13, 0x12))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("next OTP of the session was rejected")
+	}
+
+	// Neither the same OTP nor older ones are accepted again
+	for _, otp := range []string{
+		yubiKeyOTP(t, 0x13, 0x12),
+		yubiKeyOTP(t, 0x13, 0x11),
+		yubiKeyOTP(t, 0x12, 0xff),
+	} {
+		if ok, _, _ := y.VerifyUpdate(updated, otp); ok {
+			t.Fatalf("replayed OTP %s was accepted", otp)
+		}
+	}
+
+	// A new session starts over with a higher counter
+	if ok, _, _ := y.VerifyUpdate(updated, " "+yubiKeyOTP(t, 0x14, 0)+"\n"); !ok {
+		t.Fatal("OTP of a new session was rejected")
+	}
+
+	// OTPs of unknown keys are rejected
+	if ok, _, _ := y.VerifyUpdate(updated, "cccccccccccc"+yubicoOTP[12:]); ok {
+		t.Fatal("OTP of an unknown key was accepted")
+	}
+}
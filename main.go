@@ -26,8 +26,23 @@ var (
 	logFormatterType = flag.String("log", "text", "Log formatter type. Either \"json\" or \"text\"")
 	forceColors      = flag.Bool("force_colors", false, "Force colored prompt?")
 	emailDomain      = flag.String("email_domain", "lavaboom.io", "Domain of the default email service")
+	trustedProxies   = flag.String("trusted_proxies", "", "Addresses or CIDR ranges of load balancers allowed to set X-Forwarded-For, split by commas")
 	// Registration settings
 	sessionDuration = flag.Int("session_duration", 72, "Session duration expressed in hours")
+	refreshDuration = flag.Int("refresh_duration", 720, "Refresh token duration expressed in hours")
+	inviteQuota     = flag.Int("invite_quota", 5, "Number of invites that beta accounts can create")
+	addressLimit    = flag.Int("address_limit", 5, "Number of addresses an account can have, including the primary one")
+	auditRetention  = flag.Int("audit_retention", 365, "Audit log retention expressed in days, 0 keeps events forever")
+	// Blob storage flags
+	blobStore     = flag.String("blob_store", "local", "Blob store backend. Either \"local\" or \"s3\"")
+	blobPath      = flag.String("blob_path", "blobs", "Directory of the local blob store")
+	s3Endpoint    = flag.String("s3_endpoint", "https://s3.amazonaws.com", "Endpoint of the S3-compatible blob store")
+	s3Region      = flag.String("s3_region", "us-east-1", "Region of the S3 bucket")
+	s3Bucket      = flag.String("s3_bucket", "lavaboom", "Name of the S3 bucket")
+	s3AccessKey   = flag.String("s3_access_key", "", "Access key of the S3 blob store")
+	s3SecretKey   = flag.String("s3_secret_key", "", "Secret key of the S3 blob store")
+	maxChunkSize  = flag.Int64("max_chunk_size", 8*1024*1024, "Maximal size of an upload chunk in bytes")
+	maxUploadSize = flag.Int64("max_upload_size", 1024*1024*1024, "Maximal size of an upload in bytes, limits the number of its chunks")
 	// Cache-related flags
 	redisAddress = flag.String("redis_address", func() string {
 		address := os.Getenv("REDIS_PORT_6379_TCP_ADDR")
@@ -38,6 +53,8 @@ var (
 	}(), "Address of the redis server")
 	redisDatabase = flag.Int("redis_db", 0, "Index of redis database to use")
 	redisPassword = flag.String("redis_password", "", "Password of the redis server")
+	cacheSize     = flag.Int("cache_size", 10000, "Maximal count of values kept in the in-memory cache")
+	cacheTTL      = flag.Int("cache_ttl", 60, "Maximal time a value is kept in the in-memory cache, in seconds")
 	// Database-related flags
 	rethinkdbAddress = flag.String("rethinkdb_address", func() string {
 		address := os.Getenv("RETHINKDB_PORT_28015_TCP_ADDR")
@@ -72,6 +89,9 @@ var (
 	// YubiCloud params
 	yubiCloudID  = flag.String("yubicloud_id", "", "YubiCloud API id")
 	yubiCloudKey = flag.String("yubicloud_key", "", "YubiCloud API key")
+	// WebAuthn-related flags
+	webAuthnRPID   = flag.String("webauthn_rp_id", "lavaboom.com", "Domain WebAuthn credentials are scoped to")
+	webAuthnOrigin = flag.String("webauthn_origin", "https://mail.lavaboom.com", "Origin of the web client using WebAuthn")
 	// etcd
 	etcdAddress  = flag.String("etcd_address", "", "etcd peer addresses split by commas")
 	etcdCAFile   = flag.String("etcd_ca_file", "", "etcd path to server cert's ca")
@@ -102,12 +122,29 @@ func main() {
 		LogFormatterType: *logFormatterType,
 		ForceColors:      *forceColors,
 		EmailDomain:      *emailDomain,
+		TrustedProxies:   *trustedProxies,
 
 		SessionDuration: *sessionDuration,
+		RefreshDuration: *refreshDuration,
+		InviteQuota:     *inviteQuota,
+		AddressLimit:    *addressLimit,
+		AuditRetention:  *auditRetention,
+
+		BlobStore:     *blobStore,
+		BlobPath:      *blobPath,
+		S3Endpoint:    *s3Endpoint,
+		S3Region:      *s3Region,
+		S3Bucket:      *s3Bucket,
+		S3AccessKey:   *s3AccessKey,
+		S3SecretKey:   *s3SecretKey,
+		MaxChunkSize:  *maxChunkSize,
+		MaxUploadSize: *maxUploadSize,
 
 		RedisAddress:  *redisAddress,
 		RedisDatabase: *redisDatabase,
 		RedisPassword: *redisPassword,
+		CacheSize:     *cacheSize,
+		CacheTTL:      *cacheTTL,
 
 		RethinkDBAddress:  *rethinkdbAddress,
 		RethinkDBKey:      *rethinkdbKey,
@@ -119,6 +156,9 @@ func main() {
 		YubiCloudID:  *yubiCloudID,
 		YubiCloudKey: *yubiCloudKey,
 
+		WebAuthnRPID:   *webAuthnRPID,
+		WebAuthnOrigin: *webAuthnOrigin,
+
 		SlackURL:      *slackURL,
 		SlackLevels:   *slackLevels,
 		SlackChannel:  *slackChannel,
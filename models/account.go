@@ -86,11 +86,21 @@ func (a *Account) VerifyPassword(password string) (bool, bool, error) {
 	return true, false, nil
 }
 
-// Verify2FA verifies the 2FA token with the account settings.
+// Verify2FA verifies the 2FA token with the account settings. If the factor
+// is stateful, FactorValue is replaced with the updated data and has to be
+// stored by the caller.
 // Returns verified, challenge, error
-func (a *Account) Verify2FA(factor factor.Factor, token string) (bool, string, error) {
+func (a *Account) Verify2FA(method factor.Factor, token string) (bool, string, error) {
 	if token == "" {
-		req, err := factor.Request(a.ID)
+		var (
+			req string
+			err error
+		)
+		if requester, ok := method.(factor.DataRequester); ok {
+			req, err = requester.RequestData(a.ID, a.FactorValue)
+		} else {
+			req, err = method.Request(a.ID)
+		}
 		if err != nil {
 			return false, "", err
 		}
@@ -98,7 +108,17 @@ func (a *Account) Verify2FA(factor factor.Factor, token string) (bool, string, e
 		return false, req, nil
 	}
 
-	ok, err := factor.Verify(a.FactorValue, token)
+	if stateful, ok := method.(factor.StatefulFactor); ok {
+		ok, data, err := stateful.VerifyUpdate(a.FactorValue, token)
+		if err != nil || !ok {
+			return false, "", err
+		}
+
+		a.FactorValue = data
+		return true, "", nil
+	}
+
+	ok, err := method.Verify(a.FactorValue, token)
 	if err != nil {
 		return false, "", err
 	}
@@ -4,4 +4,24 @@ type Address struct {
 	// ID is an unique string <val>@lavaboom.com
 	// Owner is the user whose address it is
 	Resource
+
+	// StyledName is the address as it was entered, including dots
+	StyledName string `json:"styled_name" gorethink:"styled_name"`
+
+	// Default marks the address used when an email doesn't specify From
+	Default bool `json:"default" gorethink:"default"`
+
+	// Domain is the custom domain of the address, empty for the service's
+	// domain. IDs of such addresses contain the domain, eg. john@example.com.
+	Domain string `json:"domain,omitempty" gorethink:"domain,omitempty"`
+}
+
+// Email returns the address including the domain, styled as it was entered.
+// mainDomain is used for addresses without a custom domain.
+func (a *Address) Email(mainDomain string) string {
+	if a.Domain != "" {
+		return a.StyledName + "@" + a.Domain
+	}
+
+	return a.StyledName + "@" + mainDomain
 }
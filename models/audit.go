@@ -0,0 +1,42 @@
+package models
+
+import (
+	"time"
+
+	"github.com/dchest/uniuri"
+)
+
+// AuditEvent is an entry of the append-only audit log recording
+// security-relevant changes of an account.
+type AuditEvent struct {
+	ID          string    `json:"id" gorethink:"id"`
+	DateCreated time.Time `json:"date_created" gorethink:"date_created"`
+
+	// Type describes what happened, eg. "login.success" or "password.change"
+	Type string `json:"type" gorethink:"type"`
+
+	// Actor is the ID of the account that performed the action. It's empty
+	// for anonymous requests and differs from Account for admin actions.
+	Actor string `json:"actor,omitempty" gorethink:"actor"`
+
+	// Account is the ID of the account the event concerns
+	Account string `json:"account" gorethink:"account"`
+
+	IP        string `json:"ip,omitempty" gorethink:"ip"`
+	UserAgent string `json:"user_agent,omitempty" gorethink:"user_agent"`
+	RequestID string `json:"request_id,omitempty" gorethink:"request_id"`
+
+	// Details contains event-specific information
+	Details map[string]interface{} `json:"details,omitempty" gorethink:"details,omitempty"`
+}
+
+// MakeAuditEvent creates a new AuditEvent of an account.
+func MakeAuditEvent(kind string, actor string, account string) *AuditEvent {
+	return &AuditEvent{
+		ID:          uniuri.NewLen(uniuri.UUIDLen),
+		DateCreated: time.Now(),
+		Type:        kind,
+		Actor:       actor,
+		Account:     account,
+	}
+}
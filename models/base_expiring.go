@@ -11,7 +11,11 @@ type Expiring struct {
 }
 
 // Expired checks whether an object has expired. It returns true if ExpiryDate is in the past.
+// Objects with a zero ExpiryDate never expire.
 func (e *Expiring) Expired() bool {
+	if e.ExpiryDate.IsZero() {
+		return false
+	}
 	if time.Now().UTC().After(e.ExpiryDate) {
 		return true
 	}
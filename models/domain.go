@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+)
+
+// Domain is a custom domain of an account. Addresses can be created under it
+// once its ownership is verified using a TXT record.
+type Domain struct {
+	// Name is the domain name, eg. "example.com"
+	Resource
+
+	// Token is the secret part of the verification record
+	Token string `json:"token" gorethink:"token"`
+
+	// Status is either "pending" or "verified"
+	Status string `json:"status" gorethink:"status"`
+
+	DateVerified time.Time `json:"date_verified,omitempty" gorethink:"date_verified,omitempty"`
+}
+
+// RecordName returns the name of the TXT record verifying the domain
+func (d *Domain) RecordName() string {
+	return "_lavaboom." + d.Name
+}
+
+// RecordValue returns the value of the TXT record verifying the domain
+func (d *Domain) RecordValue() string {
+	return "lavaboom-verification=" + d.Token
+}
@@ -1,7 +1,19 @@
 package models
 
-// File is an encrypted file stored by Lavaboom
+// File is an encrypted file stored by Lavaboom. Its payload is kept in the blob
+// store, Data is only filled when the file is transferred.
 type File struct {
 	Encrypted
 	Resource
+
+	// Size is the length of the encrypted payload in bytes
+	Size int64 `json:"size" gorethink:"size"`
+
+	// Hash is the hex-encoded SHA256 hash of the encrypted payload
+	Hash string `json:"hash" gorethink:"hash"`
+
+	// Blob is the content address of the payload in the blob store. Files with
+	// an empty Hash were created before payloads were content-addressed and
+	// still have to be migrated.
+	Blob string `json:"-" gorethink:"blob"`
 }
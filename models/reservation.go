@@ -0,0 +1,13 @@
+package models
+
+// Reservation prevents a username from being registered. Reservations are
+// either managed by admins or held for a short time by the availability check,
+// in which case they expire.
+type Reservation struct {
+	Resource
+	Expiring
+
+	// Email is the alternative email address of the person the username
+	// is reserved for
+	Email string `json:"email,omitempty" gorethink:"email"`
+}
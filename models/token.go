@@ -1,12 +1,44 @@
 package models
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"strings"
+	"time"
+)
+
 // Token is a volatile, unique object. It can be used for user authentication, confirmations, invites, etc.
 type Token struct {
 	Expiring
 	Resource
 
-	// Type describes the token's purpose: auth, invite, confirm, upgrade.
+	// Type describes the token's purpose: auth, refresh, api, invite, confirm, upgrade.
 	Type string `json:"type" gorethink:"type"`
+
+	// Family groups auth tokens minted by a chain of refresh tokens. The whole
+	// family is revoked when a used refresh token is presented again.
+	Family string `json:"family,omitempty" gorethink:"family,omitempty"`
+
+	// DateUsed is the time of the last request authenticated with the token.
+	// It is updated at most once per minute.
+	DateUsed time.Time `json:"date_used,omitempty" gorethink:"date_used,omitempty"`
+
+	// IP is the address of the last client that used the token.
+	IP string `json:"ip,omitempty" gorethink:"ip,omitempty"`
+
+	// UserAgent is the User-Agent header of the last client that used the token.
+	UserAgent string `json:"user_agent,omitempty" gorethink:"user_agent,omitempty"`
+
+	// Scopes limit routes that an API token can access.
+	Scopes []string `json:"scopes,omitempty" gorethink:"scopes,omitempty"`
+
+	// AllowedIPs contains addresses and CIDR ranges that can use an API token.
+	// Empty list allows all addresses.
+	AllowedIPs []string `json:"allowed_ips,omitempty" gorethink:"allowed_ips,omitempty"`
+
+	// RedeemedBy is the ID of the account created using an invite.
+	RedeemedBy string `json:"redeemed_by,omitempty" gorethink:"redeemed_by,omitempty"`
 }
 
 // MakeToken creates a generic token.
@@ -19,6 +51,48 @@ func MakeToken(accountID, _type string, nHours int) Token {
 	return out
 }
 
+// SessionID returns an identifier of the token that can be shown to other
+// sessions without revealing the token itself.
+func (t *Token) SessionID() string {
+	hash := sha256.Sum256([]byte(t.ID))
+	return hex.EncodeToString(hash[:16])
+}
+
+// HasScope checks whether the token was granted the scope
+func (t *Token) HasScope(scope string) bool {
+	for _, granted := range t.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowsIP checks whether the token can be used from the address
+func (t *Token) AllowsIP(address string) bool {
+	if len(t.AllowedIPs) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+
+	for _, allowed := range t.AllowedIPs {
+		if strings.Contains(allowed, "/") {
+			if _, network, err := net.ParseCIDR(allowed); err == nil && network.Contains(ip) {
+				return true
+			}
+		} else if ip.Equal(net.ParseIP(allowed)) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Invalidate invalidates a token by adding a period (".") at the beginning of its type.
 // It also shortens its expiration time.
 func (t *Token) Invalidate() {
@@ -0,0 +1,55 @@
+package models
+
+import (
+	"strconv"
+)
+
+// Upload is a resumable upload of an encrypted file that is sent in numbered chunks.
+// Once all chunks are received it is finalized into a File with the same ID.
+type Upload struct {
+	Resource
+	Expiring
+
+	// Metadata of the resulting file
+	Encoding        string   `json:"encoding" gorethink:"encoding"`
+	PGPFingerprints []string `json:"pgp_fingerprints" gorethink:"pgp_fingerprints"`
+	VersionMajor    int      `json:"version_major" gorethink:"version_major"`
+	VersionMinor    int      `json:"version_minor" gorethink:"version_minor"`
+
+	// ChunkCount is the declared number of chunks
+	ChunkCount int `json:"chunk_count" gorethink:"chunk_count"`
+
+	// Chunks contains the numbers of already received chunks
+	Chunks []int `json:"chunks" gorethink:"chunks"`
+}
+
+// ChunkKey returns the blob store key of the n-th chunk of the upload
+func (u *Upload) ChunkKey(n int) string {
+	return "uploads/" + u.ID + "/" + strconv.Itoa(n)
+}
+
+// ChunkKeys returns blob store keys of all declared chunks. A chunk
+// could have been stored without being marked as received.
+func (u *Upload) ChunkKeys() []string {
+	keys := make([]string, u.ChunkCount)
+	for n := range keys {
+		keys[n] = u.ChunkKey(n)
+	}
+	return keys
+}
+
+// Complete checks whether all declared chunks were received
+func (u *Upload) Complete() bool {
+	received := map[int]struct{}{}
+	for _, n := range u.Chunks {
+		received[n] = struct{}{}
+	}
+
+	for n := 0; n < u.ChunkCount; n++ {
+		if _, ok := received[n]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,19 @@
+package models
+
+// KeyVotes contains the votes cast on a key's ownership. Each account can vote
+// only once per key, so an account ID is present in at most one of the lists.
+type KeyVotes struct {
+	// ID is the fingerprint of the voted key
+	ID string `json:"id" gorethink:"id"`
+
+	// For contains IDs of accounts that confirmed the key's ownership
+	For []string `json:"for" gorethink:"for"`
+
+	// Against contains IDs of accounts that disputed the key's ownership
+	Against []string `json:"against" gorethink:"against"`
+}
+
+// Reliability calculates the reliability score of the key from its votes.
+func (k *KeyVotes) Reliability() int {
+	return len(k.For) - len(k.Against)
+}
@@ -2,6 +2,8 @@ package routes
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -16,15 +18,72 @@ import (
 
 // AccountsListResponse contains the result of the AccountsList request.
 type AccountsListResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+	Success  bool               `json:"success"`
+	Message  string             `json:"message,omitempty"`
+	Accounts *[]*models.Account `json:"accounts,omitempty"`
 }
 
-// AccountsList returns a list of accounts visible to an user
-func AccountsList(w http.ResponseWriter, r *http.Request) {
-	utils.JSONResponse(w, 501, &AccountsListResponse{
-		Success: false,
-		Message: "Sorry, not implemented yet",
+// AccountsList returns accounts matching the query, status and type. It's
+// available only to superusers.
+func AccountsList(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Parse the pagination parameters
+	input, err := parseListRequest(r)
+	if err == nil && input.Page != nil {
+		err = errors.New("Cursor pagination is not supported")
+	}
+	if err != nil {
+		utils.JSONResponse(w, 400, &AccountsListResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	var (
+		query  = r.URL.Query().Get("query")
+		status = r.URL.Query().Get("status")
+		kind   = r.URL.Query().Get("type")
+	)
+
+	accounts, err := env.Accounts.List(query, status, kind, input.Sort, input.Offset, input.Limit)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to fetch accounts")
+
+		utils.JSONResponse(w, 500, &AccountsListResponse{
+			Success: false,
+			Message: "Internal error (code AC/LI/01)",
+		})
+		return
+	}
+
+	if input.Paginated {
+		count, err := env.Accounts.CountList(query, status, kind)
+		if err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("Unable to count accounts")
+
+			utils.JSONResponse(w, 500, &AccountsListResponse{
+				Success: false,
+				Message: "Internal error (code AC/LI/02)",
+			})
+			return
+		}
+
+		writeListHeaders(w, r, input, count, nil)
+	}
+
+	adminAudit(c, r, "account.list", "", map[string]interface{}{
+		"query":  query,
+		"status": status,
+		"type":   kind,
+	})
+
+	utils.JSONResponse(w, 200, &AccountsListResponse{
+		Success:  true,
+		Accounts: &accounts,
 	})
 }
 
@@ -34,6 +93,9 @@ type AccountsCreateRequest struct {
 	Password   string `json:"password,omitempty" schema:"password"`
 	AltEmail   string `json:"alt_email,omitempty" schema:"alt_email"`
 	InviteCode string `json:"invite_code,omitempty" schema:"invite_code"`
+
+	// Reservation is the ID of a hold returned by AccountsAvailability
+	Reservation string `json:"reservation,omitempty" schema:"reservation"`
 }
 
 // AccountsCreateResponse contains the output of the AccountsCreate request.
@@ -65,6 +127,7 @@ func AccountsCreate(w http.ResponseWriter, r *http.Request) {
 
 	// Accounts flow:
 	// 1) POST /accounts {username, alt_email}             => status = registered
+	//    (optionally with the reservation returned by GET /accounts/availability)
 	// 2) POST /accounts {username, invite_code}           => checks invite_code validity
 	// 3) POST /accounts {username, invite_code, password} => status = setup
 	requestType := "unknown"
@@ -116,6 +179,22 @@ func AccountsCreate(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Reserved usernames can be registered only by the holder of the reservation
+		blocked, reservation, err := reservationBlocks(utils.RemoveDots(input.Username), input.Reservation, input.AltEmail)
+		if err != nil || blocked {
+			if err != nil {
+				env.Log.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Error("Unable to lookup reservations")
+			}
+
+			utils.JSONResponse(w, 409, &AccountsCreateResponse{
+				Success: false,
+				Message: "Username already used",
+			})
+			return
+		}
+
 		// Also check that the email is unique
 		if used, err := env.Accounts.IsEmailUsed(input.AltEmail); err != nil || used {
 			if err != nil {
@@ -153,6 +232,17 @@ func AccountsCreate(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// The account holds the username from now on
+		if reservation != nil {
+			if err := env.Reservations.DeleteID(reservation.ID); err != nil {
+				env.Log.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Error("Unable to delete a reservation")
+
+				// DO NOT RETURN!
+			}
+		}
+
 		// TODO: Send emails here. Depends on @andreis work.
 
 		// Return information about the account
@@ -197,12 +287,13 @@ func AccountsCreate(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Ensure that the invite code was given to this particular user.
-		if token.Owner != account.ID {
+		// Ensure that the code is either an invite or was given to this particular user
+		if !validInviteCode(token, account) {
 			env.Log.WithFields(logrus.Fields{
 				"user_id": account.ID,
 				"owner":   token.Owner,
-			}).Warn("Not owned invitation code used by an user")
+				"type":    token.Type,
+			}).Warn("Invalid invitation code used by an user")
 
 			utils.JSONResponse(w, 400, &AccountsCreateResponse{
 				Success: false,
@@ -211,15 +302,6 @@ func AccountsCreate(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Ensure that the token's type is valid
-		if token.Type != "verify" {
-			utils.JSONResponse(w, 400, &AccountsCreateResponse{
-				Success: false,
-				Message: "Invalid invitation code",
-			})
-			return
-		}
-
 		// Check if it's expired
 		if token.Expired() {
 			utils.JSONResponse(w, 400, &AccountsCreateResponse{
@@ -280,12 +362,13 @@ func AccountsCreate(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Ensure that the invite code was given to this particular user.
-		if token.Owner != account.ID {
+		// Ensure that the code is either an invite or was given to this particular user
+		if !validInviteCode(token, account) {
 			env.Log.WithFields(logrus.Fields{
 				"user_id": account.ID,
 				"owner":   token.Owner,
-			}).Warn("Not owned invitation code used by an user")
+				"type":    token.Type,
+			}).Warn("Invalid invitation code used by an user")
 
 			utils.JSONResponse(w, 400, &AccountsCreateResponse{
 				Success: false,
@@ -294,15 +377,6 @@ func AccountsCreate(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Ensure that the token's type is valid
-		if token.Type != "verify" {
-			utils.JSONResponse(w, 400, &AccountsCreateResponse{
-				Success: false,
-				Message: "Invalid invitation code",
-			})
-			return
-		}
-
 		// Check if it's expired
 		if token.Expired() {
 			utils.JSONResponse(w, 400, &AccountsCreateResponse{
@@ -351,6 +425,33 @@ func AccountsCreate(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Invites can be redeemed only once. The invite is restored if the
+		// account can't be set up, so that it isn't burned.
+		initialized := false
+		if token.Type == "invite" {
+			consumed, err := env.Tokens.Consume(token.ID, "invite")
+			if err != nil || !consumed {
+				utils.JSONResponse(w, 400, &AccountsCreateResponse{
+					Success: false,
+					Message: "Invalid invitation code",
+				})
+				return
+			}
+
+			defer func() {
+				if initialized {
+					return
+				}
+
+				if _, err := env.Tokens.Restore(token.ID, "invite"); err != nil {
+					env.Log.WithFields(logrus.Fields{
+						"error": err.Error(),
+						"id":    token.ID,
+					}).Error("Unable to restore an invite")
+				}
+			}()
+		}
+
 		account.Status = "setup"
 
 		// Create labels
@@ -400,6 +501,7 @@ func AccountsCreate(w http.ResponseWriter, r *http.Request) {
 				DateModified: time.Now(),
 				Owner:        account.ID,
 			},
+			StyledName: account.StyledName,
 		})
 		if err != nil {
 			utils.JSONResponse(w, 500, &AccountsCreateResponse{
@@ -428,8 +530,17 @@ func AccountsCreate(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Remove the token and return a response
-		err = env.Tokens.DeleteID(input.InviteCode)
+		initialized = true
+
+		// Remove the token (or record who redeemed the invite) and return a response
+		if token.Type == "invite" {
+			token.Type = ".invite"
+			token.RedeemedBy = account.ID
+			token.DateModified = time.Now()
+			err = env.Tokens.UpdateID(token.ID, token)
+		} else {
+			err = env.Tokens.DeleteID(input.InviteCode)
+		}
 		if err != nil {
 			env.Log.WithFields(logrus.Fields{
 				"error": err.Error(),
@@ -565,7 +676,7 @@ func AccountsUpdate(c web.C, w http.ResponseWriter, r *http.Request) {
 		factor, ok := env.Factors[user.FactorType]
 		if ok {
 			// Verify the 2FA
-			verified, challenge, err := user.Verify2FA(factor, input.Token)
+			verified, challenge, err := verifyFactor(user, factor, input.Token)
 			if err != nil {
 				utils.JSONResponse(w, 500, &AccountsUpdateResponse{
 					Success: false,
@@ -579,8 +690,8 @@ func AccountsUpdate(c web.C, w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			// Token was probably empty. Return the challenge.
-			if !verified && challenge != "" {
+			// Token was empty. Return the challenge, if the factor has one.
+			if !verified && input.Token == "" {
 				utils.JSONResponse(w, 403, &AccountsUpdateResponse{
 					Success:         false,
 					Message:         "2FA token was not passed",
@@ -592,6 +703,10 @@ func AccountsUpdate(c web.C, w http.ResponseWriter, r *http.Request) {
 
 			// Token was incorrect
 			if !verified {
+				audit(c, r, "factor.failure", user.ID, user.ID, map[string]interface{}{
+					"factor": user.FactorType,
+				})
+
 				utils.JSONResponse(w, 403, &AccountsUpdateResponse{
 					Success:    false,
 					Message:    "Invalid token passed",
@@ -625,7 +740,20 @@ func AccountsUpdate(c web.C, w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Record changes of the credentials in the audit log
+	changes := map[string]map[string]interface{}{}
+	if input.NewPassword != "" {
+		changes["password.change"] = nil
+	}
+
 	if input.AltEmail != "" {
+		if input.AltEmail != user.AltEmail {
+			changes["alt_email.change"] = map[string]interface{}{
+				"old_alt_email": user.AltEmail,
+				"alt_email":     input.AltEmail,
+			}
+		}
+
 		user.AltEmail = input.AltEmail
 	}
 
@@ -662,6 +790,12 @@ func AccountsUpdate(c web.C, w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if input.PublicKey != user.PublicKey {
+			changes["public_key.change"] = map[string]interface{}{
+				"fingerprint": input.PublicKey,
+			}
+		}
+
 		user.PublicKey = input.PublicKey
 	}
 
@@ -682,6 +816,23 @@ func AccountsUpdate(c web.C, w http.ResponseWriter, r *http.Request) {
 		user.FactorValue = input.FactorValue
 	}
 
+	if input.FactorType != "" || len(input.FactorValue) > 0 {
+		changes["factor.change"] = map[string]interface{}{
+			"factor": user.FactorType,
+		}
+	}
+
+	// Authenticator secrets, WebAuthn credentials and YubiKey secrets have
+	// to be confirmed using their own endpoints
+	if (user.FactorType == authenticator().Type() || user.FactorType == webAuthn().Type() ||
+		user.FactorType == yubiKey().Type()) && (input.FactorType != "" || len(input.FactorValue) > 0) {
+		utils.JSONResponse(w, 400, &AccountsUpdateResponse{
+			Success: false,
+			Message: "This 2FA method has to be set up using its own endpoints",
+		})
+		return
+	}
+
 	user.DateModified = time.Now()
 
 	err = env.Accounts.UpdateID(session.Owner, user)
@@ -697,6 +848,13 @@ func AccountsUpdate(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	for kind, details := range changes {
+		audit(c, r, kind, user.ID, user.ID, details)
+	}
+
+	// Notify other sessions
+	publish(user.ID, "account.update", user.ID, user)
+
 	utils.JSONResponse(w, 200, &AccountsUpdateResponse{
 		Success: true,
 		Message: "Your account has been successfully updated",
@@ -706,8 +864,9 @@ func AccountsUpdate(c web.C, w http.ResponseWriter, r *http.Request) {
 
 // AccountsDeleteResponse contains the result of the AccountsDelete request.
 type AccountsDeleteResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+	Success bool           `json:"success"`
+	Message string         `json:"message"`
+	Deleted map[string]int `json:"deleted,omitempty"`
 }
 
 // AccountsDelete deletes an account and everything related to it.
@@ -737,53 +896,60 @@ func AccountsDelete(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO: Delete contacts
-
-	// TODO: Delete emails
-
-	// TODO: Delete labels
+	// Mark the account as being deleted, so that an interrupted deletion is resumed
+	if user.Status != "deleting" {
+		err = env.Accounts.UpdateID(user.ID, map[string]interface{}{
+			"status": "deleting",
+		})
+		if err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"id":    user.ID,
+				"error": err.Error(),
+			}).Error("Unable to mark an account as deleted")
 
-	// TODO: Delete threads
+			utils.JSONResponse(w, 500, &AccountsDeleteResponse{
+				Success: false,
+				Message: "Internal error (code AC/DE/01)",
+			})
+			return
+		}
+	}
 
-	// Delete tokens
-	err = env.Tokens.DeleteOwnedBy(user.ID)
+	// Remove all account's data and then the account itself
+	deleted, err := wipeAccount(user.ID, accountDeleteSteps())
 	if err != nil {
 		env.Log.WithFields(logrus.Fields{
 			"id":    user.ID,
 			"error": err.Error(),
-		}).Error("Unable to remove account's tokens")
+		}).Error("Unable to delete an account")
 
 		utils.JSONResponse(w, 500, &AccountsDeleteResponse{
 			Success: false,
-			Message: "Internal error (code AC/DE/05)",
+			Message: "Internal error (code AC/DE/02)",
+			Deleted: deleted,
 		})
 		return
 	}
 
-	// Delete account
-	err = env.Accounts.DeleteID(user.ID)
-	if err != nil {
-		env.Log.WithFields(logrus.Fields{
-			"error": err.Error(),
-		}).Error("Unable to delete an account")
+	audit(c, r, "account.delete", user.ID, user.ID, map[string]interface{}{
+		"deleted": deleted,
+	})
 
-		utils.JSONResponse(w, 500, &AccountsDeleteResponse{
-			Success: false,
-			Message: "Internal error (code AC/DE/06)",
-		})
-		return
-	}
+	// Notify other sessions
+	publish(user.ID, "account.delete", user.ID, nil)
 
 	utils.JSONResponse(w, 200, &AccountsDeleteResponse{
 		Success: true,
 		Message: "Your account has been successfully deleted",
+		Deleted: deleted,
 	})
 }
 
 // AccountsWipeDataResponse contains the result of the AccountsWipeData request.
 type AccountsWipeDataResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+	Success bool           `json:"success"`
+	Message string         `json:"message"`
+	Deleted map[string]int `json:"deleted,omitempty"`
 }
 
 // AccountsWipeData wipes all data except the actual account and billing info.
@@ -819,35 +985,136 @@ func AccountsWipeData(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO: Delete contacts
-
-	// TODO: Delete emails
-
-	// TODO: Delete labels
-
-	// TODO: Delete threads
-
-	// Delete tokens
-	err = env.Tokens.DeleteOwnedBy(user.ID)
+	// Remove the data. Tokens go last, so the request can be retried if it fails.
+	deleted, err := wipeAccount(user.ID, accountWipeDataSteps())
 	if err != nil {
 		env.Log.WithFields(logrus.Fields{
 			"id":    user.ID,
 			"error": err.Error(),
-		}).Error("Unable to remove account's tokens")
+		}).Error("Unable to wipe account's data")
 
 		utils.JSONResponse(w, 500, &AccountsWipeDataResponse{
 			Success: false,
-			Message: "Internal error (code AC/WD/05)",
+			Message: "Internal error (code AC/WD/01)",
+			Deleted: deleted,
 		})
 		return
 	}
 
+	audit(c, r, "account.wipe", user.ID, user.ID, map[string]interface{}{
+		"deleted": deleted,
+	})
+
+	// Notify other sessions
+	publish(user.ID, "account.wipe", user.ID, deleted)
+
 	utils.JSONResponse(w, 200, &AccountsWipeDataResponse{
 		Success: true,
 		Message: "Your account has been successfully wiped",
+		Deleted: deleted,
 	})
 }
 
+// ResumeAccountDeletions finishes deletions of accounts that were interrupted
+// before all of their data got removed.
+func ResumeAccountDeletions() {
+	accounts, err := env.Accounts.GetByStatus("deleting")
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to fetch accounts pending deletion")
+		return
+	}
+
+	for _, account := range accounts {
+		deleted, err := wipeAccount(account.ID, accountDeleteSteps())
+		if err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"id":    account.ID,
+				"error": err.Error(),
+			}).Error("Unable to resume an account deletion")
+			continue
+		}
+
+		env.Log.WithFields(logrus.Fields{
+			"id":      account.ID,
+			"deleted": deleted,
+		}).Info("Resumed an account deletion")
+	}
+}
+
+// accountWipeStep removes a single kind of resources owned by an account
+type accountWipeStep struct {
+	name   string
+	delete func(owner string) (int, error)
+}
+
+// wipeAccount runs the steps in order and stops on the first failure. Every step
+// is idempotent, so an interrupted wipe can be safely run again.
+func wipeAccount(owner string, steps []accountWipeStep) (map[string]int, error) {
+	deleted := map[string]int{}
+	for _, step := range steps {
+		count, err := step.delete(owner)
+		if err != nil {
+			return deleted, fmt.Errorf("unable to delete %s: %v", step.name, err)
+		}
+
+		deleted[step.name] = count
+	}
+
+	return deleted, nil
+}
+
+// accountWipeDataSteps returns steps that remove the encrypted data of an account
+func accountWipeDataSteps() []accountWipeStep {
+	return []accountWipeStep{
+		{"contacts", env.Contacts.DeleteOwnedBy},
+		{"emails", env.Emails.DeleteOwnedBy},
+		{"threads", env.Threads.DeleteOwnedBy},
+		{"uploads", env.Uploads.DeleteOwnedBy},
+		{"files", env.Files.DeleteOwnedBy},
+		{"labels", env.Labels.DeleteCustomOwnedBy},
+		{"tokens", env.Tokens.DeleteOwnedBy},
+	}
+}
+
+// accountDeleteSteps returns steps that remove an account and everything related to it
+func accountDeleteSteps() []accountWipeStep {
+	return []accountWipeStep{
+		{"contacts", env.Contacts.DeleteOwnedBy},
+		{"emails", env.Emails.DeleteOwnedBy},
+		{"threads", env.Threads.DeleteOwnedBy},
+		{"uploads", env.Uploads.DeleteOwnedBy},
+		{"files", env.Files.DeleteOwnedBy},
+		{"labels", env.Labels.DeleteOwnedBy},
+		{"cast_votes", env.Votes.DeleteCastBy},
+		{"votes", func(owner string) (int, error) {
+			keys, err := env.Keys.FindByOwner(owner)
+			if err != nil {
+				return 0, err
+			}
+
+			ids := make([]string, len(keys))
+			for i, key := range keys {
+				ids[i] = key.ID
+			}
+
+			return env.Votes.DeleteKeyVotes(ids...)
+		}},
+		{"keys", env.Keys.DeleteOwnedBy},
+		{"addresses", env.Addresses.DeleteOwnedBy},
+		{"domains", env.Domains.DeleteOwnedBy},
+		{"tokens", env.Tokens.DeleteOwnedBy},
+		{"accounts", func(owner string) (int, error) {
+			if err := env.Accounts.DeleteID(owner); err != nil {
+				return 0, err
+			}
+
+			return 1, nil
+		}},
+	}
+}
+
 type AccountsStartOnboardingResponse struct {
 	Success bool   `json:"success"`
 	Message string `json:"message"`
@@ -893,3 +1160,51 @@ func AccountsStartOnboarding(c web.C, w http.ResponseWriter, r *http.Request) {
 		Message: "Onboarding emails for your account have been initialized",
 	})
 }
+
+// AccountsLoginAttemptsResponse contains the result of the AccountsLoginAttempts request.
+type AccountsLoginAttemptsResponse struct {
+	Success  bool           `json:"success"`
+	Message  string         `json:"message,omitempty"`
+	Attempts *LoginAttempts `json:"attempts,omitempty"`
+}
+
+// AccountsLoginAttempts returns failed login attempts of the account
+func AccountsLoginAttempts(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Right now we only support "me" as the ID
+	if c.URLParams["id"] != "me" {
+		utils.JSONResponse(w, 501, &AccountsLoginAttemptsResponse{
+			Success: false,
+			Message: `Only the "me" user is implemented`,
+		})
+		return
+	}
+
+	session := c.Env["token"].(*models.Token)
+
+	user, err := env.Accounts.GetAccount(session.Owner)
+	if err != nil {
+		utils.JSONResponse(w, 500, &AccountsLoginAttemptsResponse{
+			Success: false,
+			Message: "Unable to resolve the account",
+		})
+		return
+	}
+
+	attempts, err := getLoginAttempts("account", user.Name)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to fetch failed logins")
+
+		utils.JSONResponse(w, 500, &AccountsLoginAttemptsResponse{
+			Success: false,
+			Message: "Internal error (code AC/LA/01)",
+		})
+		return
+	}
+
+	utils.JSONResponse(w, 200, &AccountsLoginAttemptsResponse{
+		Success:  true,
+		Attempts: attempts,
+	})
+}
@@ -1,7 +1,12 @@
 package routes
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"net/http"
+	"regexp"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/zenazn/goji/web"
@@ -11,10 +16,76 @@ import (
 	"github.com/lavab/api/utils"
 )
 
+// taggedLabelsLimit is the number of custom labels after which LabelTaggedEmail
+// stops creating labels for new tags
+const taggedLabelsLimit = 50
+
+var (
+	// errInvalidDomain is returned by resolveAddress for addresses of other domains
+	errInvalidDomain = errors.New("Address doesn't belong to the email domain or a verified domain")
+
+	// labelTagPattern matches tags that can become label names
+	labelTagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,31}$`)
+)
+
+// addressLimit returns how many addresses the account can have. Superusers
+// aren't limited.
+func addressLimit(account *models.Account) (int, bool) {
+	if account.Type == "superuser" {
+		return 0, true
+	}
+
+	return env.Config.AddressLimit, false
+}
+
+// resolveAddress finds the address of an email address in the service's
+// domain or in a verified custom domain, ignoring dots and the plus tag. The
+// tag is returned as well.
+func resolveAddress(email string) (*models.Address, string, error) {
+	parts := strings.SplitN(email, "@", 2)
+	if len(parts) != 2 {
+		return nil, "", errInvalidDomain
+	}
+
+	name, tag := utils.SplitAddressTag(parts[0])
+	id := utils.RemoveDots(utils.NormalizeUsername(name))
+
+	// Addresses of custom domains contain the domain in their IDs
+	if domain := strings.ToLower(parts[1]); domain != env.Config.EmailDomain {
+		if _, err := env.Domains.GetVerified(domain); err != nil {
+			return nil, "", errInvalidDomain
+		}
+
+		id += "@" + domain
+	}
+
+	address, err := env.Addresses.GetAddress(id)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return address, utils.NormalizeUsername(tag), nil
+}
+
+// defaultAddress returns the address used as From if an email doesn't set it
+func defaultAddress(account *models.Account) string {
+	addresses, err := env.Addresses.GetOwnedBy(account.ID)
+	if err == nil {
+		for _, address := range addresses {
+			if address.Default && address.StyledName != "" {
+				return address.Email(env.Config.EmailDomain)
+			}
+		}
+	}
+
+	return account.StyledName + "@" + env.Config.EmailDomain
+}
+
 type AddressesListResponse struct {
 	Success   bool              `json:"success"`
 	Message   string            `json:"message,omitempty"`
 	Addresses []*models.Address `json:"addresses,omitempty"`
+	Limit     int               `json:"limit,omitempty"`
 }
 
 func AddressesList(c web.C, w http.ResponseWriter, r *http.Request) {
@@ -32,8 +103,495 @@ func AddressesList(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	user, err := env.Accounts.GetAccount(session.Owner)
+	if err != nil {
+		utils.JSONResponse(w, 500, &AddressesListResponse{
+			Success: false,
+			Message: "Unable to resolve the account",
+		})
+		return
+	}
+
+	limit, _ := addressLimit(user)
+
 	utils.JSONResponse(w, 200, &AddressesListResponse{
 		Success:   true,
 		Addresses: addresses,
+		Limit:     limit,
+	})
+}
+
+// AddressesCreateRequest contains the input for the AddressesCreate endpoint.
+type AddressesCreateRequest struct {
+	Address string `json:"address" schema:"address"`
+	Default bool   `json:"default" schema:"default"`
+}
+
+// AddressesCreateResponse contains the result of the AddressesCreate request.
+type AddressesCreateResponse struct {
+	Success bool            `json:"success"`
+	Message string          `json:"message"`
+	Address *models.Address `json:"address,omitempty"`
+}
+
+// AddressesCreate adds an alias to the account. Aliases follow the same rules
+// as usernames. Aliases in custom domains, eg. john@example.com, can be created
+// once the account has verified the domain.
+func AddressesCreate(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Decode the request
+	var input AddressesCreateRequest
+	err := utils.ParseRequest(r, &input)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("Unable to decode a request")
+
+		utils.JSONResponse(w, 400, &AddressesCreateResponse{
+			Success: false,
+			Message: "Invalid input format",
+		})
+		return
+	}
+
+	parts := strings.SplitN(input.Address, "@", 2)
+	styled := utils.NormalizeUsername(parts[0])
+	name := utils.RemoveDots(styled)
+
+	domain := ""
+	if len(parts) == 2 && strings.ToLower(parts[1]) != env.Config.EmailDomain {
+		domain = strings.ToLower(parts[1])
+	}
+	if len(styled) < 3 || len(name) < 3 || len(styled) > 32 {
+		utils.JSONResponse(w, 400, &AddressesCreateResponse{
+			Success: false,
+			Message: "Invalid address - it has to be at least 3 and at max 32 characters long",
+		})
+		return
+	}
+
+	session := c.Env["token"].(*models.Token)
+
+	user, err := env.Accounts.GetAccount(session.Owner)
+	if err != nil {
+		utils.JSONResponse(w, 500, &AddressesCreateResponse{
+			Success: false,
+			Message: "Unable to resolve the account",
+		})
+		return
+	}
+
+	if limit, unlimited := addressLimit(user); !unlimited {
+		count, err := env.Addresses.CountOwnedBy(user.ID)
+		if err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("Unable to count addresses")
+
+			utils.JSONResponse(w, 500, &AddressesCreateResponse{
+				Success: false,
+				Message: "Internal error (code AD/CR/01)",
+			})
+			return
+		}
+
+		if count >= limit {
+			utils.JSONResponse(w, 403, &AddressesCreateResponse{
+				Success: false,
+				Message: "Address limit reached",
+			})
+			return
+		}
+	}
+
+	id := name
+	if domain != "" {
+		verified, err := env.Domains.GetVerified(domain)
+		if err != nil || verified.Owner != user.ID {
+			utils.JSONResponse(w, 403, &AddressesCreateResponse{
+				Success: false,
+				Message: "The domain isn't verified by your account",
+			})
+			return
+		}
+
+		id = name + "@" + domain
+	}
+
+	if address, err := env.Addresses.GetAddress(id); err == nil || address != nil {
+		utils.JSONResponse(w, 409, &AddressesCreateResponse{
+			Success: false,
+			Message: "Address already used",
+		})
+		return
+	}
+
+	// Aliases in the service's domain share the namespace with usernames
+	var reservations []*models.Reservation
+	if domain == "" {
+		if used, err := env.Accounts.IsUsernameUsed(name); err != nil || used {
+			utils.JSONResponse(w, 409, &AddressesCreateResponse{
+				Success: false,
+				Message: "Address already used",
+			})
+			return
+		}
+
+		// Aliases deleted by the account stay reserved for it
+		reservations, err = env.Reservations.GetByName(name)
+		if err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("Unable to lookup reservations")
+
+			utils.JSONResponse(w, 500, &AddressesCreateResponse{
+				Success: false,
+				Message: "Internal error (code AD/CR/02)",
+			})
+			return
+		}
+
+		for _, reservation := range reservations {
+			if !reservation.Expired() && reservation.Owner != user.ID {
+				utils.JSONResponse(w, 409, &AddressesCreateResponse{
+					Success: false,
+					Message: "Address already used",
+				})
+				return
+			}
+		}
+	}
+
+	address := &models.Address{
+		Resource:   models.MakeResource(user.ID, ""),
+		StyledName: styled,
+		Domain:     domain,
+	}
+	address.ID = id
+
+	created, err := env.Addresses.Create(address)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to insert an address")
+
+		utils.JSONResponse(w, 500, &AddressesCreateResponse{
+			Success: false,
+			Message: "Internal error (code AD/CR/03)",
+		})
+		return
+	}
+
+	if !created {
+		utils.JSONResponse(w, 409, &AddressesCreateResponse{
+			Success: false,
+			Message: "Address already used",
+		})
+		return
+	}
+
+	// Concurrent requests could all pass the check of the limit, so it's
+	// checked again once the address is visible to them
+	if limit, unlimited := addressLimit(user); !unlimited {
+		count, err := env.Addresses.CountOwnedBy(user.ID)
+		if err != nil || count > limit {
+			if err := env.Addresses.DeleteID(address.ID); err != nil {
+				env.Log.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Error("Unable to delete an address")
+			}
+		}
+
+		if err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("Unable to count addresses")
+
+			utils.JSONResponse(w, 500, &AddressesCreateResponse{
+				Success: false,
+				Message: "Internal error (code AD/CR/05)",
+			})
+			return
+		}
+
+		if count > limit {
+			utils.JSONResponse(w, 403, &AddressesCreateResponse{
+				Success: false,
+				Message: "Address limit reached",
+			})
+			return
+		}
+	}
+
+	if len(reservations) > 0 {
+		if _, err := env.Reservations.DeleteByName(name); err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("Unable to delete a reservation")
+
+			// DO NOT RETURN!
+		}
+	}
+
+	if input.Default {
+		if err := env.Addresses.SetDefault(user.ID, address.ID); err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("Unable to set the default address")
+
+			utils.JSONResponse(w, 500, &AddressesCreateResponse{
+				Success: false,
+				Message: "Internal error (code AD/CR/04)",
+			})
+			return
+		}
+
+		address.Default = true
+	}
+
+	audit(c, r, "address.create", user.ID, user.ID, map[string]interface{}{
+		"address": address.ID,
+	})
+
+	// Notify other sessions
+	publish(user.ID, "address.create", address.ID, address)
+
+	utils.JSONResponse(w, 201, &AddressesCreateResponse{
+		Success: true,
+		Message: "Address created",
+		Address: address,
+	})
+}
+
+// AddressesUpdateRequest contains the input for the AddressesUpdate endpoint.
+type AddressesUpdateRequest struct {
+	Default bool `json:"default" schema:"default"`
+}
+
+// AddressesUpdateResponse contains the result of the AddressesUpdate request.
+type AddressesUpdateResponse struct {
+	Success bool            `json:"success"`
+	Message string          `json:"message"`
+	Address *models.Address `json:"address,omitempty"`
+}
+
+// AddressesUpdate makes an address the default sending identity
+func AddressesUpdate(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Decode the request
+	var input AddressesUpdateRequest
+	err := utils.ParseRequest(r, &input)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("Unable to decode a request")
+
+		utils.JSONResponse(w, 400, &AddressesUpdateResponse{
+			Success: false,
+			Message: "Invalid input format",
+		})
+		return
+	}
+
+	if !input.Default {
+		utils.JSONResponse(w, 400, &AddressesUpdateResponse{
+			Success: false,
+			Message: "Make another address the default one instead",
+		})
+		return
+	}
+
+	session := c.Env["token"].(*models.Token)
+
+	address, err := env.Addresses.GetAddress(c.URLParams["id"])
+	if err != nil || address.Owner != session.Owner {
+		utils.JSONResponse(w, 404, &AddressesUpdateResponse{
+			Success: false,
+			Message: "Address not found",
+		})
+		return
+	}
+
+	if err := env.Addresses.SetDefault(session.Owner, address.ID); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to set the default address")
+
+		utils.JSONResponse(w, 500, &AddressesUpdateResponse{
+			Success: false,
+			Message: "Internal error (code AD/DF/01)",
+		})
+		return
+	}
+
+	address.Default = true
+
+	// Notify other sessions
+	publish(session.Owner, "address.update", address.ID, address)
+
+	utils.JSONResponse(w, 200, &AddressesUpdateResponse{
+		Success: true,
+		Message: "Default address changed",
+		Address: address,
+	})
+}
+
+// AddressesDeleteResponse contains the result of the AddressesDelete request.
+type AddressesDeleteResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+// AddressesDelete removes an alias. The address stays reserved for the account,
+// so that its mail can't be received by someone else.
+func AddressesDelete(c web.C, w http.ResponseWriter, r *http.Request) {
+	session := c.Env["token"].(*models.Token)
+
+	user, err := env.Accounts.GetAccount(session.Owner)
+	if err != nil {
+		utils.JSONResponse(w, 500, &AddressesDeleteResponse{
+			Success: false,
+			Message: "Unable to resolve the account",
+		})
+		return
+	}
+
+	address, err := env.Addresses.GetAddress(c.URLParams["id"])
+	if err != nil || address.Owner != user.ID {
+		utils.JSONResponse(w, 404, &AddressesDeleteResponse{
+			Success: false,
+			Message: "Address not found",
+		})
+		return
+	}
+
+	if address.ID == user.Name {
+		utils.JSONResponse(w, 409, &AddressesDeleteResponse{
+			Success: false,
+			Message: "The primary address can't be deleted",
+		})
+		return
+	}
+
+	// Custom domains are reserved by being verified
+	if address.Domain == "" {
+		if err := env.Reservations.Insert(&models.Reservation{
+			Resource: models.MakeResource(user.ID, address.ID),
+		}); err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("Unable to reserve an address")
+
+			utils.JSONResponse(w, 500, &AddressesDeleteResponse{
+				Success: false,
+				Message: "Internal error (code AD/DE/01)",
+			})
+			return
+		}
+	}
+
+	if err := env.Addresses.DeleteID(address.ID); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to delete an address")
+
+		utils.JSONResponse(w, 500, &AddressesDeleteResponse{
+			Success: false,
+			Message: "Internal error (code AD/DE/02)",
+		})
+		return
+	}
+
+	audit(c, r, "address.delete", user.ID, user.ID, map[string]interface{}{
+		"address": address.ID,
+	})
+
+	// Notify other sessions
+	publish(user.ID, "address.delete", address.ID, nil)
+
+	utils.JSONResponse(w, 200, &AddressesDeleteResponse{
+		Success: true,
+		Message: "Address deleted",
+	})
+}
+
+// tagLabelID returns the ID of the label created for the owner's tag
+func tagLabelID(owner string, tag string) string {
+	sum := sha256.Sum256([]byte(owner + "/" + tag))
+	return hex.EncodeToString(sum[:16])
+}
+
+// LabelTaggedEmail applies the label named after the tag of the plus-address
+// the email was delivered to, eg. "news" for john+news@lavaboom.com, to its
+// thread. recipient is the envelope recipient, as the headers are controlled
+// by the sender. Missing labels are created until the owner has
+// taggedLabelsLimit custom labels.
+func LabelTaggedEmail(owner string, id string, recipient string) error {
+	if recipient == "" {
+		return nil
+	}
+
+	address, tag, err := resolveAddress(recipient)
+	if err != nil || address.Owner != owner || !labelTagPattern.MatchString(tag) {
+		return nil
+	}
+
+	email, err := env.Emails.GetEmail(id)
+	if err != nil {
+		return err
+	}
+
+	label, err := env.Labels.GetLabelByNameAndOwner(owner, tag)
+	if err != nil {
+		labels, err := env.Labels.GetOwnedBy(owner)
+		if err != nil {
+			return err
+		}
+
+		custom := 0
+		for _, label := range labels {
+			if !label.Builtin {
+				custom++
+			}
+		}
+
+		if custom >= taggedLabelsLimit {
+			return nil
+		}
+
+		// Emails delivered at once create the same label
+		label = &models.Label{
+			Resource: models.MakeResource(owner, tag),
+		}
+		label.ID = tagLabelID(owner, tag)
+
+		created, err := env.Labels.Create(label)
+		if err != nil {
+			return err
+		}
+
+		if created {
+			publish(owner, "label.create", label.ID, label)
+		} else if label, err = env.Labels.GetLabel(label.ID); err != nil {
+			return err
+		}
+	}
+
+	// Senders can't move emails into the system's labels
+	if label.Builtin {
+		return nil
+	}
+
+	thread, err := env.Threads.GetThread(email.Thread)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range thread.Labels {
+		if id == label.ID {
+			return nil
+		}
+	}
+
+	return env.Threads.UpdateID(thread.ID, map[string]interface{}{
+		"labels": append(thread.Labels, label.ID),
 	})
 }
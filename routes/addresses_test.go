@@ -0,0 +1,240 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dchest/uniuri"
+	"github.com/zenazn/goji/web"
+
+	"github.com/lavab/api/cache"
+	"github.com/lavab/api/db"
+	"github.com/lavab/api/env"
+	"github.com/lavab/api/events"
+	"github.com/lavab/api/models"
+)
+
+// setupAddresses prepares the tables used by addresses and returns a new
+// beta account
+func setupAddresses(t *testing.T) *models.Account {
+	session := connectRethink(t, "accounts", "addresses", "reservations", "labels", "threads", "emails")
+
+	env.Config = &env.Flags{
+		EmailDomain:  "lavaboom.com",
+		AddressLimit: 3,
+	}
+	env.Log = logrus.New()
+	env.Cache = cache.NewMemoryCache(&cache.MemoryCacheOpts{})
+	env.Events = events.NewBus()
+
+	env.Accounts = &db.AccountsTable{
+		RethinkCRUD: db.NewCRUDTable(session, "test", "accounts"),
+	}
+	env.Addresses = &db.AddressesTable{
+		RethinkCRUD: db.NewCRUDTable(session, "test", "addresses"),
+	}
+	env.Reservations = &db.ReservationsTable{
+		RethinkCRUD: db.NewCRUDTable(session, "test", "reservations"),
+	}
+	env.Audit = &db.AuditTable{
+		RethinkCRUD: db.NewCRUDTable(session, "test", "audit"),
+	}
+	env.Emails = &db.EmailsTable{
+		RethinkCRUD: db.NewCRUDTable(session, "test", "emails"),
+	}
+	env.Threads = &db.ThreadsTable{
+		RethinkCRUD: db.NewCRUDTable(session, "test", "threads"),
+		Emails:      env.Emails,
+	}
+	env.Labels = &db.LabelsTable{
+		RethinkCRUD: db.NewCRUDTable(session, "test", "labels"),
+		Emails:      env.Emails,
+		Threads:     env.Threads,
+		Cache:       env.Cache,
+	}
+	env.Threads.Labels = env.Labels
+
+	account := &models.Account{
+		Resource: models.MakeResource("", strings.ToLower(uniuri.New())),
+		Type:     "beta",
+	}
+	account.Owner = account.ID
+	if err := env.Accounts.Insert(account); err != nil {
+		t.Fatal(err)
+	}
+
+	return account
+}
+
+// createAddress calls AddressesCreate on behalf of the account
+func createAddress(account *models.Account, address string) (int, *AddressesCreateResponse, error) {
+	r, err := http.NewRequest("POST", "/addresses", strings.NewReader(`{"address":"`+address+`"}`))
+	if err != nil {
+		return 0, nil, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	c := web.C{
+		Env: map[string]interface{}{
+			"token": &models.Token{Resource: models.Resource{Owner: account.ID}},
+		},
+	}
+
+	w := httptest.NewRecorder()
+	AddressesCreate(c, w, r)
+
+	var response AddressesCreateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		return 0, nil, err
+	}
+
+	return w.Code, &response, nil
+}
+
+func TestAddressesCreateConcurrent(t *testing.T) {
+	account := setupAddresses(t)
+
+	// Only one of the requests creates the same address
+	name := strings.ToLower(uniuri.NewLen(12))
+	codes := make([]int, 5)
+
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			code, _, err := createAddress(account, name)
+			if err != nil {
+				t.Error(err)
+			}
+			codes[i] = code
+		}(i)
+	}
+	wg.Wait()
+
+	created := 0
+	for _, code := range codes {
+		if code == 201 {
+			created++
+		} else if code != 409 {
+			t.Fatalf("unexpected response %d", code)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("address was created %d times", created)
+	}
+
+	// Concurrent requests can't exceed the limit
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if _, _, err := createAddress(account, strings.ToLower(uniuri.NewLen(12))); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if count, err := env.Addresses.CountOwnedBy(account.ID); err != nil || count > env.Config.AddressLimit {
+		t.Fatalf("account has %d addresses (%v)", count, err)
+	}
+}
+
+func TestLabelTaggedEmailConcurrent(t *testing.T) {
+	account := setupAddresses(t)
+
+	address := &models.Address{
+		Resource:   models.MakeResource(account.ID, ""),
+		StyledName: account.Name,
+	}
+	address.ID = account.Name
+	if err := env.Addresses.Insert(address); err != nil {
+		t.Fatal(err)
+	}
+
+	var emails []*models.Email
+	for i := 0; i < 5; i++ {
+		thread := &models.Thread{
+			Resource: models.MakeResource(account.ID, "Hello"),
+			Labels:   []string{},
+		}
+		if err := env.Threads.Insert(thread); err != nil {
+			t.Fatal(err)
+		}
+
+		email := &models.Email{
+			Resource: models.MakeResource(account.ID, "Hello"),
+			Thread:   thread.ID,
+		}
+		if err := env.Emails.Insert(email); err != nil {
+			t.Fatal(err)
+		}
+
+		emails = append(emails, email)
+	}
+
+	var wg sync.WaitGroup
+	for _, email := range emails {
+		wg.Add(1)
+		go func(email *models.Email) {
+			defer wg.Done()
+
+			if err := LabelTaggedEmail(account.ID, email.ID, account.Name+"+news@lavaboom.com"); err != nil {
+				t.Error(err)
+			}
+		}(email)
+	}
+	wg.Wait()
+
+	labels, err := env.Labels.GetOwnedBy(account.ID)
+	if err != nil || len(labels) != 1 || labels[0].Name != "news" {
+		t.Fatalf("invalid labels %+v (%v)", labels, err)
+	}
+
+	for _, email := range emails {
+		thread, err := env.Threads.GetThread(email.Thread)
+		if err != nil || len(thread.Labels) != 1 || thread.Labels[0] != labels[0].ID {
+			t.Fatalf("thread wasn't labeled: %+v (%v)", thread, err)
+		}
+	}
+}
+
+func TestLabelTagPattern(t *testing.T) {
+	cases := []struct {
+		tag   string
+		valid bool
+	}{
+		{"news", true},
+		{"news.2015", true},
+		{"mailing-list_1", true},
+		{strings.Repeat("a", 32), true},
+		{"", false},
+		{strings.Repeat("a", 33), false},
+		{".hidden", false},
+		{"-news", false},
+		{"News", false},
+		{"news letters", false},
+		{"news/letters", false},
+		{"<script>", false},
+		{"nеws", false},
+	}
+
+	for _, test := range cases {
+		if labelTagPattern.MatchString(test.tag) != test.valid {
+			t.Fatalf("%q: valid %v, expected %v", test.tag, !test.valid, test.valid)
+		}
+	}
+
+	// Tags are lowercased by resolveAddress
+	if !labelTagPattern.MatchString(strings.ToLower("News")) {
+		t.Fatal("lowercased tag was rejected")
+	}
+}
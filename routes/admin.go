@@ -0,0 +1,415 @@
+package routes
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/zenazn/goji/web"
+
+	"github.com/lavab/api/env"
+	"github.com/lavab/api/models"
+	"github.com/lavab/api/utils"
+)
+
+// adminStatuses lists statuses that admins can set
+var adminStatuses = map[string]struct{}{
+	"registered": struct{}{},
+	"setup":      struct{}{},
+	"suspended":  struct{}{},
+}
+
+// accountTypes lists valid values of Account.Type
+var accountTypes = map[string]struct{}{
+	"beta":      struct{}{},
+	"std":       struct{}{},
+	"premium":   struct{}{},
+	"superuser": struct{}{},
+}
+
+// AdminMiddleware allows only superusers to access the admin routes. It has
+// to be used after AuthMiddleware.
+func AdminMiddleware(c *web.C, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := c.Env["token"].(*models.Token)
+
+		// API tokens can't be used to administer the service
+		if session.Type != "auth" {
+			utils.JSONResponse(w, 403, &AuthMiddlewareResponse{
+				Success: false,
+				Message: "Admin routes require an auth token",
+			})
+			return
+		}
+
+		user, err := env.Accounts.GetAccount(session.Owner)
+		if err != nil || user.Type != "superuser" {
+			utils.JSONResponse(w, 403, &AuthMiddlewareResponse{
+				Success: false,
+				Message: "Only superusers can access admin routes",
+			})
+			return
+		}
+
+		c.Env["admin"] = user
+		h.ServeHTTP(w, r)
+	})
+}
+
+// adminAudit records an admin action in the audit log
+func adminAudit(c web.C, r *http.Request, kind string, account string, details map[string]interface{}) {
+	audit(c, r, "admin."+kind, c.Env["admin"].(*models.Account).ID, account, details)
+}
+
+// AdminAccountsUpdateRequest contains the input for the AdminAccountsUpdate endpoint.
+type AdminAccountsUpdateRequest struct {
+	Status string `json:"status" schema:"status"`
+	Type   string `json:"type" schema:"type"`
+}
+
+// AdminAccountsUpdateResponse contains the result of the AdminAccountsUpdate request.
+type AdminAccountsUpdateResponse struct {
+	Success bool            `json:"success"`
+	Message string          `json:"message"`
+	Account *models.Account `json:"account,omitempty"`
+}
+
+// AdminAccountsUpdate changes status or type of an account. Suspending an
+// account logs out all of its sessions.
+func AdminAccountsUpdate(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Decode the request
+	var input AdminAccountsUpdateRequest
+	err := utils.ParseRequest(r, &input)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("Unable to decode a request")
+
+		utils.JSONResponse(w, 400, &AdminAccountsUpdateResponse{
+			Success: false,
+			Message: "Invalid input format",
+		})
+		return
+	}
+
+	if _, ok := adminStatuses[input.Status]; input.Status != "" && !ok {
+		utils.JSONResponse(w, 400, &AdminAccountsUpdateResponse{
+			Success: false,
+			Message: "Invalid status",
+		})
+		return
+	}
+
+	if _, ok := accountTypes[input.Type]; input.Type != "" && !ok {
+		utils.JSONResponse(w, 400, &AdminAccountsUpdateResponse{
+			Success: false,
+			Message: "Invalid type",
+		})
+		return
+	}
+
+	account, err := env.Accounts.GetAccount(c.URLParams["id"])
+	if err != nil {
+		utils.JSONResponse(w, 404, &AdminAccountsUpdateResponse{
+			Success: false,
+			Message: "Account not found",
+		})
+		return
+	}
+
+	if account.Status == "deleting" {
+		utils.JSONResponse(w, 409, &AdminAccountsUpdateResponse{
+			Success: false,
+			Message: "Account is being deleted",
+		})
+		return
+	}
+
+	details := map[string]interface{}{}
+	if input.Status != "" && input.Status != account.Status {
+		details["old_status"] = account.Status
+		details["status"] = input.Status
+		account.Status = input.Status
+	}
+	if input.Type != "" && input.Type != account.Type {
+		details["old_type"] = account.Type
+		details["type"] = input.Type
+		account.Type = input.Type
+	}
+	account.DateModified = time.Now()
+
+	if err := env.Accounts.UpdateID(account.ID, account); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to update an account")
+
+		utils.JSONResponse(w, 500, &AdminAccountsUpdateResponse{
+			Success: false,
+			Message: "Internal error (code AD/UP/01)",
+		})
+		return
+	}
+
+	if account.Status == "suspended" {
+		if _, err := env.Tokens.DeleteSessions(account.ID); err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("Unable to delete sessions")
+
+			utils.JSONResponse(w, 500, &AdminAccountsUpdateResponse{
+				Success: false,
+				Message: "Internal error (code AD/UP/02)",
+			})
+			return
+		}
+	}
+
+	adminAudit(c, r, "account.update", account.ID, details)
+
+	utils.JSONResponse(w, 200, &AdminAccountsUpdateResponse{
+		Success: true,
+		Message: "Account updated",
+		Account: account,
+	})
+}
+
+// AdminAccountsLogoutResponse contains the result of the AdminAccountsLogout request.
+type AdminAccountsLogoutResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+	Deleted int    `json:"deleted"`
+}
+
+// AdminAccountsLogout deletes all auth, refresh and API tokens of an account
+func AdminAccountsLogout(c web.C, w http.ResponseWriter, r *http.Request) {
+	account, err := env.Accounts.GetAccount(c.URLParams["id"])
+	if err != nil {
+		utils.JSONResponse(w, 404, &AdminAccountsLogoutResponse{
+			Success: false,
+			Message: "Account not found",
+		})
+		return
+	}
+
+	deleted, err := env.Tokens.DeleteSessions(account.ID)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to delete sessions")
+
+		utils.JSONResponse(w, 500, &AdminAccountsLogoutResponse{
+			Success: false,
+			Message: "Internal error (code AD/LO/01)",
+		})
+		return
+	}
+
+	adminAudit(c, r, "account.logout", account.ID, map[string]interface{}{
+		"deleted": deleted,
+	})
+
+	utils.JSONResponse(w, 200, &AdminAccountsLogoutResponse{
+		Success: true,
+		Message: "Account was logged out",
+		Deleted: deleted,
+	})
+}
+
+// AdminAccountsUsageResponse contains the result of the AdminAccountsUsage request.
+type AdminAccountsUsageResponse struct {
+	Success   bool   `json:"success"`
+	Message   string `json:"message,omitempty"`
+	Emails    int    `json:"emails"`
+	Threads   int    `json:"threads"`
+	Contacts  int    `json:"contacts"`
+	Files     int    `json:"files"`
+	FilesSize int64  `json:"files_size"`
+}
+
+// AdminAccountsUsage returns storage used by an account
+func AdminAccountsUsage(c web.C, w http.ResponseWriter, r *http.Request) {
+	account, err := env.Accounts.GetAccount(c.URLParams["id"])
+	if err != nil {
+		utils.JSONResponse(w, 404, &AdminAccountsUsageResponse{
+			Success: false,
+			Message: "Account not found",
+		})
+		return
+	}
+
+	resp := &AdminAccountsUsageResponse{
+		Success: true,
+	}
+
+	if resp.Emails, err = env.Emails.CountOwnedBy(account.ID); err == nil {
+		if resp.Threads, err = env.Threads.CountOwnedBy(account.ID); err == nil {
+			if resp.Contacts, err = env.Contacts.CountOwnedBy(account.ID); err == nil {
+				if resp.Files, err = env.Files.CountList(account.ID, nil, ""); err == nil {
+					resp.FilesSize, err = env.Files.SizeOwnedBy(account.ID)
+				}
+			}
+		}
+	}
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to calculate storage usage")
+
+		utils.JSONResponse(w, 500, &AdminAccountsUsageResponse{
+			Success: false,
+			Message: "Internal error (code AD/US/01)",
+		})
+		return
+	}
+
+	adminAudit(c, r, "account.usage", account.ID, nil)
+
+	utils.JSONResponse(w, 200, resp)
+}
+
+// AdminReservationsListResponse contains the result of the AdminReservationsList request.
+type AdminReservationsListResponse struct {
+	Success      bool                  `json:"success"`
+	Message      string                `json:"message,omitempty"`
+	Reservations []*models.Reservation `json:"reservations,omitempty"`
+}
+
+// AdminReservationsList returns all reserved usernames
+func AdminReservationsList(c web.C, w http.ResponseWriter, r *http.Request) {
+	reservations, err := env.Reservations.List()
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to fetch reservations")
+
+		utils.JSONResponse(w, 500, &AdminReservationsListResponse{
+			Success: false,
+			Message: "Internal error (code AD/RL/01)",
+		})
+		return
+	}
+
+	adminAudit(c, r, "reservation.list", "", nil)
+
+	utils.JSONResponse(w, 200, &AdminReservationsListResponse{
+		Success:      true,
+		Reservations: reservations,
+	})
+}
+
+// AdminReservationsCreateRequest contains the input for the AdminReservationsCreate endpoint.
+type AdminReservationsCreateRequest struct {
+	Username string `json:"username" schema:"username"`
+	Email    string `json:"email" schema:"email"`
+}
+
+// AdminReservationsCreateResponse contains the result of the AdminReservationsCreate request.
+type AdminReservationsCreateResponse struct {
+	Success     bool                `json:"success"`
+	Message     string              `json:"message"`
+	Reservation *models.Reservation `json:"reservation,omitempty"`
+}
+
+// AdminReservationsCreate reserves a username
+func AdminReservationsCreate(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Decode the request
+	var input AdminReservationsCreateRequest
+	err := utils.ParseRequest(r, &input)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("Unable to decode a request")
+
+		utils.JSONResponse(w, 400, &AdminReservationsCreateResponse{
+			Success: false,
+			Message: "Invalid input format",
+		})
+		return
+	}
+
+	name := utils.RemoveDots(utils.NormalizeUsername(input.Username))
+	if name == "" {
+		utils.JSONResponse(w, 400, &AdminReservationsCreateResponse{
+			Success: false,
+			Message: "Invalid username",
+		})
+		return
+	}
+
+	if used, err := env.Reservations.IsUsernameUsed(name); err != nil || used {
+		utils.JSONResponse(w, 409, &AdminReservationsCreateResponse{
+			Success: false,
+			Message: "Username is already reserved",
+		})
+		return
+	}
+
+	admin := c.Env["admin"].(*models.Account)
+	reservation := &models.Reservation{
+		Resource: models.MakeResource(admin.ID, name),
+		Email:    input.Email,
+	}
+
+	if err := env.Reservations.Insert(reservation); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to insert a reservation")
+
+		utils.JSONResponse(w, 500, &AdminReservationsCreateResponse{
+			Success: false,
+			Message: "Internal error (code AD/RC/01)",
+		})
+		return
+	}
+
+	adminAudit(c, r, "reservation.create", "", map[string]interface{}{
+		"username": name,
+	})
+
+	utils.JSONResponse(w, 201, &AdminReservationsCreateResponse{
+		Success:     true,
+		Message:     "Username reserved",
+		Reservation: reservation,
+	})
+}
+
+// AdminReservationsDeleteResponse contains the result of the AdminReservationsDelete request.
+type AdminReservationsDeleteResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+// AdminReservationsDelete releases a username
+func AdminReservationsDelete(c web.C, w http.ResponseWriter, r *http.Request) {
+	name := utils.RemoveDots(utils.NormalizeUsername(c.URLParams["name"]))
+
+	deleted, err := env.Reservations.DeleteByName(name)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to delete a reservation")
+
+		utils.JSONResponse(w, 500, &AdminReservationsDeleteResponse{
+			Success: false,
+			Message: "Internal error (code AD/RD/01)",
+		})
+		return
+	}
+
+	if deleted == 0 {
+		utils.JSONResponse(w, 404, &AdminReservationsDeleteResponse{
+			Success: false,
+			Message: "Reservation not found",
+		})
+		return
+	}
+
+	adminAudit(c, r, "reservation.delete", "", map[string]interface{}{
+		"username": name,
+	})
+
+	utils.JSONResponse(w, 200, &AdminReservationsDeleteResponse{
+		Success: true,
+		Message: "Username released",
+	})
+}
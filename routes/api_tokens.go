@@ -0,0 +1,264 @@
+package routes
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/zenazn/goji/web"
+
+	"github.com/lavab/api/env"
+	"github.com/lavab/api/models"
+	"github.com/lavab/api/utils"
+)
+
+// APIToken describes an API token without revealing it
+type APIToken struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Scopes      []string  `json:"scopes"`
+	AllowedIPs  []string  `json:"allowed_ips,omitempty"`
+	DateCreated time.Time `json:"date_created"`
+	DateUsed    time.Time `json:"date_used,omitempty"`
+	ExpiryDate  time.Time `json:"expiry_date,omitempty"`
+	IP          string    `json:"ip,omitempty"`
+}
+
+// makeAPIToken converts a token into an APIToken
+func makeAPIToken(token *models.Token) *APIToken {
+	return &APIToken{
+		ID:          token.SessionID(),
+		Name:        token.Name,
+		Scopes:      token.Scopes,
+		AllowedIPs:  token.AllowedIPs,
+		DateCreated: token.DateCreated,
+		DateUsed:    token.DateUsed,
+		ExpiryDate:  token.ExpiryDate,
+		IP:          token.IP,
+	}
+}
+
+// APITokensListResponse contains the result of the APITokensList request.
+type APITokensListResponse struct {
+	Success bool        `json:"success"`
+	Message string      `json:"message,omitempty"`
+	Tokens  []*APIToken `json:"tokens,omitempty"`
+}
+
+// APITokensList returns API tokens of the current user
+func APITokensList(c web.C, w http.ResponseWriter, r *http.Request) {
+	session := c.Env["token"].(*models.Token)
+
+	tokens, err := env.Tokens.GetOwnedBy(session.Owner, "api")
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+			"owner": session.Owner,
+		}).Error("Unable to list API tokens")
+
+		utils.JSONResponse(w, 500, &APITokensListResponse{
+			Success: false,
+			Message: "Internal error (code AT/LI/01)",
+		})
+		return
+	}
+
+	result := []*APIToken{}
+	for _, token := range tokens {
+		if !token.Expired() {
+			result = append(result, makeAPIToken(token))
+		}
+	}
+
+	utils.JSONResponse(w, 200, &APITokensListResponse{
+		Success: true,
+		Tokens:  result,
+	})
+}
+
+// APITokensCreateRequest contains the input for the APITokensCreate endpoint.
+type APITokensCreateRequest struct {
+	Name       string   `json:"name" schema:"name"`
+	Scopes     []string `json:"scopes" schema:"scopes"`
+	AllowedIPs []string `json:"allowed_ips" schema:"allowed_ips"`
+
+	// ExpiresIn is the token's lifetime in hours. Tokens without it never expire.
+	ExpiresIn int `json:"expires_in" schema:"expires_in"`
+}
+
+// APITokensCreateResponse contains the result of the APITokensCreate request.
+type APITokensCreateResponse struct {
+	Success bool      `json:"success"`
+	Message string    `json:"message"`
+	Token   string    `json:"token,omitempty"`
+	Info    *APIToken `json:"info,omitempty"`
+}
+
+// APITokensCreate creates a new API token. The token itself is returned only
+// in this response.
+func APITokensCreate(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Decode the request
+	var input APITokensCreateRequest
+	err := utils.ParseRequest(r, &input)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("Unable to decode a request")
+
+		utils.JSONResponse(w, 400, &APITokensCreateResponse{
+			Success: false,
+			Message: "Invalid input format",
+		})
+		return
+	}
+
+	if input.Name == "" {
+		utils.JSONResponse(w, 400, &APITokensCreateResponse{
+			Success: false,
+			Message: "Token name is required",
+		})
+		return
+	}
+
+	if len(input.Scopes) == 0 {
+		utils.JSONResponse(w, 400, &APITokensCreateResponse{
+			Success: false,
+			Message: "At least one scope is required",
+		})
+		return
+	}
+
+	for _, scope := range input.Scopes {
+		if !validScope(scope) {
+			utils.JSONResponse(w, 400, &APITokensCreateResponse{
+				Success: false,
+				Message: "Invalid scope: " + scope,
+			})
+			return
+		}
+	}
+
+	for _, address := range input.AllowedIPs {
+		valid := net.ParseIP(address) != nil
+		if strings.Contains(address, "/") {
+			_, _, err := net.ParseCIDR(address)
+			valid = err == nil
+		}
+
+		if !valid {
+			utils.JSONResponse(w, 400, &APITokensCreateResponse{
+				Success: false,
+				Message: "Invalid address: " + address,
+			})
+			return
+		}
+	}
+
+	if input.ExpiresIn < 0 {
+		utils.JSONResponse(w, 400, &APITokensCreateResponse{
+			Success: false,
+			Message: "Invalid expiry time",
+		})
+		return
+	}
+
+	session := c.Env["token"].(*models.Token)
+
+	token := &models.Token{
+		Resource:   models.MakeResource(session.Owner, input.Name),
+		Type:       "api",
+		Scopes:     input.Scopes,
+		AllowedIPs: input.AllowedIPs,
+	}
+	if input.ExpiresIn > 0 {
+		token.ExpireAfterNHours(input.ExpiresIn)
+	}
+
+	if err := env.Tokens.Insert(token); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to insert an API token")
+
+		utils.JSONResponse(w, 500, &APITokensCreateResponse{
+			Success: false,
+			Message: "Internal error (code AT/CR/01)",
+		})
+		return
+	}
+
+	audit(c, r, "api_token.create", session.Owner, session.Owner, map[string]interface{}{
+		"token":  token.SessionID(),
+		"scopes": token.Scopes,
+	})
+
+	utils.JSONResponse(w, 201, &APITokensCreateResponse{
+		Success: true,
+		Message: "A new API token was created",
+		Token:   token.ID,
+		Info:    makeAPIToken(token),
+	})
+}
+
+// APITokensDeleteResponse contains the result of the APITokensDelete request.
+type APITokensDeleteResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+// APITokensDelete revokes an API token
+func APITokensDelete(c web.C, w http.ResponseWriter, r *http.Request) {
+	session := c.Env["token"].(*models.Token)
+
+	tokens, err := env.Tokens.GetOwnedBy(session.Owner, "api")
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+			"owner": session.Owner,
+		}).Error("Unable to list API tokens")
+
+		utils.JSONResponse(w, 500, &APITokensDeleteResponse{
+			Success: false,
+			Message: "Internal error (code AT/DE/01)",
+		})
+		return
+	}
+
+	var token *models.Token
+	for _, item := range tokens {
+		if item.SessionID() == c.URLParams["id"] {
+			token = item
+			break
+		}
+	}
+
+	if token == nil {
+		utils.JSONResponse(w, 404, &APITokensDeleteResponse{
+			Success: false,
+			Message: "API token not found",
+		})
+		return
+	}
+
+	if err := env.Tokens.DeleteID(token.ID); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to delete an API token")
+
+		utils.JSONResponse(w, 500, &APITokensDeleteResponse{
+			Success: false,
+			Message: "Internal error (code AT/DE/02)",
+		})
+		return
+	}
+
+	audit(c, r, "api_token.delete", session.Owner, session.Owner, map[string]interface{}{
+		"token": token.SessionID(),
+	})
+
+	utils.JSONResponse(w, 200, &APITokensDeleteResponse{
+		Success: true,
+		Message: "API token revoked",
+	})
+}
@@ -0,0 +1,187 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+
+	"github.com/lavab/api/db"
+	"github.com/lavab/api/env"
+	"github.com/lavab/api/models"
+	"github.com/lavab/api/utils"
+)
+
+// auditPruneInterval is how often events older than the retention period are removed
+const auditPruneInterval = time.Hour
+
+// audit appends an event to the audit log. actor is the account performing
+// the action, empty for anonymous requests. Failures are only logged, so that
+// they don't break the request.
+func audit(c web.C, r *http.Request, kind string, actor string, account string, details map[string]interface{}) {
+	event := models.MakeAuditEvent(kind, actor, account)
+	event.IP = utils.RemoteIP(r)
+	event.UserAgent = r.UserAgent()
+	event.RequestID = middleware.GetReqID(c)
+	event.Details = details
+
+	if err := env.Audit.Insert(event); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error":   err.Error(),
+			"type":    kind,
+			"account": account,
+		}).Error("Unable to insert an audit event")
+	}
+}
+
+// PruneAuditLog periodically removes events older than retention
+func PruneAuditLog(retention time.Duration) {
+	for {
+		deleted, err := env.Audit.DeleteBefore(time.Now().Add(-retention))
+		if err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("Unable to prune the audit log")
+		} else if deleted > 0 {
+			env.Log.WithFields(logrus.Fields{
+				"count": deleted,
+			}).Info("Pruned the audit log")
+		}
+
+		time.Sleep(auditPruneInterval)
+	}
+}
+
+// parseAuditRequest parses pagination and filters of audit log listings
+func parseAuditRequest(r *http.Request) (*listRequest, *db.AuditQuery, error) {
+	input, err := parseListRequest(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if input.Page != nil {
+		return nil, nil, errors.New("Cursor pagination is not supported")
+	}
+
+	// The log can be long, don't return all of it at once
+	if input.Limit == 0 || input.Limit > maxPageLimit {
+		input.Limit = defaultPageLimit
+	}
+
+	params := r.URL.Query()
+	query := &db.AuditQuery{
+		Type: params.Get("type"),
+	}
+
+	if since := params.Get("since"); since != "" {
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return nil, nil, errors.New("Invalid since date")
+		}
+	}
+
+	if until := params.Get("until"); until != "" {
+		if query.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return nil, nil, errors.New("Invalid until date")
+		}
+	}
+
+	return input, query, nil
+}
+
+// AuditListResponse contains the result of audit log listings.
+type AuditListResponse struct {
+	Success bool                  `json:"success"`
+	Message string                `json:"message,omitempty"`
+	Events  *[]*models.AuditEvent `json:"events,omitempty"`
+}
+
+// listAudit writes events matching the query. It returns false if an error
+// was written instead.
+func listAudit(w http.ResponseWriter, r *http.Request, input *listRequest, query *db.AuditQuery, code string) bool {
+	events, err := env.Audit.List(query, input.Offset, input.Limit)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to fetch audit events")
+
+		utils.JSONResponse(w, 500, &AuditListResponse{
+			Success: false,
+			Message: "Internal error (code " + code + "/01)",
+		})
+		return false
+	}
+
+	count, err := env.Audit.CountList(query)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to count audit events")
+
+		utils.JSONResponse(w, 500, &AuditListResponse{
+			Success: false,
+			Message: "Internal error (code " + code + "/02)",
+		})
+		return false
+	}
+
+	writeListHeaders(w, r, input, count, nil)
+
+	utils.JSONResponse(w, 200, &AuditListResponse{
+		Success: true,
+		Events:  &events,
+	})
+	return true
+}
+
+// AccountsAudit returns the audit log of the current account, newest first.
+// It can be filtered by type, since and until.
+func AccountsAudit(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Right now we only support "me" as the ID
+	if c.URLParams["id"] != "me" {
+		utils.JSONResponse(w, 501, &AuditListResponse{
+			Success: false,
+			Message: `Only the "me" user is implemented`,
+		})
+		return
+	}
+
+	input, query, err := parseAuditRequest(r)
+	if err != nil {
+		utils.JSONResponse(w, 400, &AuditListResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	session := c.Env["token"].(*models.Token)
+	query.Account = session.Owner
+
+	listAudit(w, r, input, query, "AC/AU")
+}
+
+// AdminAuditList queries the audit log of all accounts. Apart from the
+// filters of AccountsAudit, it accepts account and actor.
+func AdminAuditList(c web.C, w http.ResponseWriter, r *http.Request) {
+	input, query, err := parseAuditRequest(r)
+	if err != nil {
+		utils.JSONResponse(w, 400, &AuditListResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	query.Account = r.URL.Query().Get("account")
+	query.Actor = r.URL.Query().Get("actor")
+
+	if listAudit(w, r, input, query, "AD/AU") {
+		adminAudit(c, r, "audit.list", query.Account, map[string]interface{}{
+			"actor": query.Actor,
+			"type":  query.Type,
+		})
+	}
+}
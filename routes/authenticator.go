@@ -0,0 +1,532 @@
+package routes
+
+import (
+	"encoding/base64"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/zenazn/goji/web"
+
+	"github.com/lavab/api/env"
+	"github.com/lavab/api/factor"
+	"github.com/lavab/api/models"
+	"github.com/lavab/api/utils"
+)
+
+const (
+	// authenticatorEnrollmentTTL is the time the user has to confirm a new secret
+	authenticatorEnrollmentTTL = 10 * time.Minute
+
+	// recoveryCodesCount is the count of recovery codes generated on enrollment
+	recoveryCodesCount = 10
+)
+
+// authenticator returns the TOTP factor
+func authenticator() *factor.Authenticator {
+	return env.Factors["authenticator"].(*factor.Authenticator)
+}
+
+// verifyFactor verifies the 2FA token and stores the updated data of stateful
+// factors, so that the token can't be used again.
+// Returns verified, challenge, error
+func verifyFactor(user *models.Account, method factor.Factor, token string) (bool, string, error) {
+	old := user.FactorValue
+
+	verified, challenge, err := user.Verify2FA(method, token)
+	if err != nil || !verified {
+		return verified, challenge, err
+	}
+
+	if _, ok := method.(factor.StatefulFactor); !ok {
+		return true, "", nil
+	}
+
+	// Another request might have used the same code in the meantime
+	stored, err := env.Accounts.UpdateFactorValue(user.ID, old, user.FactorValue)
+	if err != nil {
+		return false, "", err
+	}
+
+	return stored, "", nil
+}
+
+// AuthenticatorEnrollRequest contains the input for the AuthenticatorEnroll endpoint.
+type AuthenticatorEnrollRequest struct {
+	Password string `json:"password" schema:"password"`
+}
+
+// AuthenticatorEnrollResponse contains the result of the AuthenticatorEnroll request.
+type AuthenticatorEnrollResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message,omitempty"`
+	Secret  string `json:"secret,omitempty"`
+	URI     string `json:"uri,omitempty"`
+	QR      string `json:"qr,omitempty"`
+}
+
+// AuthenticatorEnroll generates a new TOTP secret. It has to be confirmed using
+// AuthenticatorConfirm before it's enabled.
+func AuthenticatorEnroll(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Decode the request
+	var input AuthenticatorEnrollRequest
+	err := utils.ParseRequest(r, &input)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("Unable to decode a request")
+
+		utils.JSONResponse(w, 400, &AuthenticatorEnrollResponse{
+			Success: false,
+			Message: "Invalid input format",
+		})
+		return
+	}
+
+	// Right now we only support "me" as the ID
+	if c.URLParams["id"] != "me" {
+		utils.JSONResponse(w, 501, &AuthenticatorEnrollResponse{
+			Success: false,
+			Message: `Only the "me" user is implemented`,
+		})
+		return
+	}
+
+	session := c.Env["token"].(*models.Token)
+
+	user, err := env.Accounts.GetAccount(session.Owner)
+	if err != nil {
+		utils.JSONResponse(w, 500, &AuthenticatorEnrollResponse{
+			Success: false,
+			Message: "Unable to resolve the account",
+		})
+		return
+	}
+
+	if valid, _, err := user.VerifyPassword(input.Password); err != nil || !valid {
+		utils.JSONResponse(w, 403, &AuthenticatorEnrollResponse{
+			Success: false,
+			Message: "Invalid password",
+		})
+		return
+	}
+
+	if user.FactorType != "" {
+		utils.JSONResponse(w, 409, &AuthenticatorEnrollResponse{
+			Success: false,
+			Message: "2FA is already enabled",
+		})
+		return
+	}
+
+	secret, err := authenticator().NewSecret()
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to generate an authenticator secret")
+
+		utils.JSONResponse(w, 500, &AuthenticatorEnrollResponse{
+			Success: false,
+			Message: "Internal error (code AU/EN/01)",
+		})
+		return
+	}
+
+	qr, err := authenticator().QR(secret, user.Name)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to encode a QR code")
+
+		utils.JSONResponse(w, 500, &AuthenticatorEnrollResponse{
+			Success: false,
+			Message: "Internal error (code AU/EN/02)",
+		})
+		return
+	}
+
+	// Keep the secret until it's confirmed
+	if err := env.Cache.Set("authenticator:"+user.ID, secret, authenticatorEnrollmentTTL); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to store an authenticator secret")
+
+		utils.JSONResponse(w, 500, &AuthenticatorEnrollResponse{
+			Success: false,
+			Message: "Internal error (code AU/EN/03)",
+		})
+		return
+	}
+
+	utils.JSONResponse(w, 201, &AuthenticatorEnrollResponse{
+		Success: true,
+		Message: "Confirm the secret with a code from your app",
+		Secret:  secret,
+		URI:     authenticator().URI(secret, user.Name),
+		QR:      "data:image/png;base64," + base64.StdEncoding.EncodeToString(qr),
+	})
+}
+
+// AuthenticatorConfirmRequest contains the input for the AuthenticatorConfirm endpoint.
+type AuthenticatorConfirmRequest struct {
+	Code string `json:"code" schema:"code"`
+}
+
+// AuthenticatorConfirmResponse contains the result of the AuthenticatorConfirm request.
+type AuthenticatorConfirmResponse struct {
+	Success       bool     `json:"success"`
+	Message       string   `json:"message,omitempty"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+// AuthenticatorConfirm enables the authenticator factor after checking the first
+// code generated by the app. Recovery codes are returned only once.
+func AuthenticatorConfirm(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Decode the request
+	var input AuthenticatorConfirmRequest
+	err := utils.ParseRequest(r, &input)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("Unable to decode a request")
+
+		utils.JSONResponse(w, 400, &AuthenticatorConfirmResponse{
+			Success: false,
+			Message: "Invalid input format",
+		})
+		return
+	}
+
+	// Right now we only support "me" as the ID
+	if c.URLParams["id"] != "me" {
+		utils.JSONResponse(w, 501, &AuthenticatorConfirmResponse{
+			Success: false,
+			Message: `Only the "me" user is implemented`,
+		})
+		return
+	}
+
+	session := c.Env["token"].(*models.Token)
+
+	user, err := env.Accounts.GetAccount(session.Owner)
+	if err != nil {
+		utils.JSONResponse(w, 500, &AuthenticatorConfirmResponse{
+			Success: false,
+			Message: "Unable to resolve the account",
+		})
+		return
+	}
+
+	if user.FactorType != "" {
+		utils.JSONResponse(w, 409, &AuthenticatorConfirmResponse{
+			Success: false,
+			Message: "2FA is already enabled",
+		})
+		return
+	}
+
+	var secret string
+	if err := env.Cache.Get("authenticator:"+user.ID, &secret); err != nil {
+		utils.JSONResponse(w, 404, &AuthenticatorConfirmResponse{
+			Success: false,
+			Message: "Authenticator enrollment not found or expired",
+		})
+		return
+	}
+
+	step, ok, err := authenticator().Check(secret, input.Code, 0)
+	if err != nil || !ok {
+		utils.JSONResponse(w, 403, &AuthenticatorConfirmResponse{
+			Success: false,
+			Message: "Invalid code",
+		})
+		return
+	}
+
+	codes, hashes, err := factor.NewRecoveryCodes(recoveryCodesCount)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to generate recovery codes")
+
+		utils.JSONResponse(w, 500, &AuthenticatorConfirmResponse{
+			Success: false,
+			Message: "Internal error (code AU/CO/01)",
+		})
+		return
+	}
+
+	user.FactorType = authenticator().Type()
+	user.FactorValue = authenticator().Data(secret, step, hashes)
+	user.DateModified = time.Now()
+
+	if err := env.Accounts.UpdateID(user.ID, user); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to update an account")
+
+		utils.JSONResponse(w, 500, &AuthenticatorConfirmResponse{
+			Success: false,
+			Message: "Internal error (code AU/CO/02)",
+		})
+		return
+	}
+
+	env.Cache.Delete("authenticator:" + user.ID)
+
+	audit(c, r, "factor.enable", user.ID, user.ID, map[string]interface{}{
+		"factor": authenticator().Type(),
+	})
+
+	// Notify other sessions
+	publish(user.ID, "account.update", user.ID, user)
+
+	utils.JSONResponse(w, 200, &AuthenticatorConfirmResponse{
+		Success:       true,
+		Message:       "Authenticator enabled",
+		RecoveryCodes: codes,
+	})
+}
+
+// AuthenticatorDisableRequest contains the input for the AuthenticatorDisable endpoint.
+type AuthenticatorDisableRequest struct {
+	Password string `json:"password" schema:"password"`
+	Token    string `json:"token" schema:"token"`
+}
+
+// AuthenticatorDisableResponse contains the result of the AuthenticatorDisable request.
+type AuthenticatorDisableResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+// AuthenticatorDisable turns off the authenticator factor. Both the password
+// and a code (or a recovery code) are required.
+func AuthenticatorDisable(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Decode the request
+	var input AuthenticatorDisableRequest
+	err := utils.ParseRequest(r, &input)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("Unable to decode a request")
+
+		utils.JSONResponse(w, 400, &AuthenticatorDisableResponse{
+			Success: false,
+			Message: "Invalid input format",
+		})
+		return
+	}
+
+	// Right now we only support "me" as the ID
+	if c.URLParams["id"] != "me" {
+		utils.JSONResponse(w, 501, &AuthenticatorDisableResponse{
+			Success: false,
+			Message: `Only the "me" user is implemented`,
+		})
+		return
+	}
+
+	session := c.Env["token"].(*models.Token)
+
+	user, err := env.Accounts.GetAccount(session.Owner)
+	if err != nil {
+		utils.JSONResponse(w, 500, &AuthenticatorDisableResponse{
+			Success: false,
+			Message: "Unable to resolve the account",
+		})
+		return
+	}
+
+	if user.FactorType != authenticator().Type() {
+		utils.JSONResponse(w, 404, &AuthenticatorDisableResponse{
+			Success: false,
+			Message: "Authenticator is not enabled",
+		})
+		return
+	}
+
+	if valid, _, err := user.VerifyPassword(input.Password); err != nil || !valid {
+		utils.JSONResponse(w, 403, &AuthenticatorDisableResponse{
+			Success: false,
+			Message: "Invalid password",
+		})
+		return
+	}
+
+	verified, _, err := verifyFactor(user, authenticator(), input.Token)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error":  err.Error(),
+			"factor": user.FactorType,
+		}).Warn("2FA authentication error")
+
+		utils.JSONResponse(w, 500, &AuthenticatorDisableResponse{
+			Success: false,
+			Message: "Internal 2FA error",
+		})
+		return
+	}
+
+	if !verified {
+		utils.JSONResponse(w, 403, &AuthenticatorDisableResponse{
+			Success: false,
+			Message: "Invalid token passed",
+		})
+		return
+	}
+
+	user.FactorType = ""
+	user.FactorValue = []string{}
+	user.DateModified = time.Now()
+
+	if err := env.Accounts.UpdateID(user.ID, user); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to update an account")
+
+		utils.JSONResponse(w, 500, &AuthenticatorDisableResponse{
+			Success: false,
+			Message: "Internal error (code AU/DE/01)",
+		})
+		return
+	}
+
+	audit(c, r, "factor.disable", user.ID, user.ID, map[string]interface{}{
+		"factor": authenticator().Type(),
+	})
+
+	// Notify other sessions
+	publish(user.ID, "account.update", user.ID, user)
+
+	utils.JSONResponse(w, 200, &AuthenticatorDisableResponse{
+		Success: true,
+		Message: "Authenticator disabled",
+	})
+}
+
+// AuthenticatorRecoveryCodesRequest contains the input for the AuthenticatorRecoveryCodes endpoint.
+type AuthenticatorRecoveryCodesRequest struct {
+	Token string `json:"token" schema:"token"`
+}
+
+// AuthenticatorRecoveryCodesResponse contains the result of the AuthenticatorRecoveryCodes request.
+type AuthenticatorRecoveryCodesResponse struct {
+	Success       bool     `json:"success"`
+	Message       string   `json:"message,omitempty"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+// AuthenticatorRecoveryCodes replaces all recovery codes with new ones
+func AuthenticatorRecoveryCodes(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Decode the request
+	var input AuthenticatorRecoveryCodesRequest
+	err := utils.ParseRequest(r, &input)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("Unable to decode a request")
+
+		utils.JSONResponse(w, 400, &AuthenticatorRecoveryCodesResponse{
+			Success: false,
+			Message: "Invalid input format",
+		})
+		return
+	}
+
+	// Right now we only support "me" as the ID
+	if c.URLParams["id"] != "me" {
+		utils.JSONResponse(w, 501, &AuthenticatorRecoveryCodesResponse{
+			Success: false,
+			Message: `Only the "me" user is implemented`,
+		})
+		return
+	}
+
+	session := c.Env["token"].(*models.Token)
+
+	user, err := env.Accounts.GetAccount(session.Owner)
+	if err != nil {
+		utils.JSONResponse(w, 500, &AuthenticatorRecoveryCodesResponse{
+			Success: false,
+			Message: "Unable to resolve the account",
+		})
+		return
+	}
+
+	if user.FactorType != authenticator().Type() {
+		utils.JSONResponse(w, 404, &AuthenticatorRecoveryCodesResponse{
+			Success: false,
+			Message: "Authenticator is not enabled",
+		})
+		return
+	}
+
+	verified, _, err := verifyFactor(user, authenticator(), input.Token)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error":  err.Error(),
+			"factor": user.FactorType,
+		}).Warn("2FA authentication error")
+
+		utils.JSONResponse(w, 500, &AuthenticatorRecoveryCodesResponse{
+			Success: false,
+			Message: "Internal 2FA error",
+		})
+		return
+	}
+
+	if !verified {
+		utils.JSONResponse(w, 403, &AuthenticatorRecoveryCodesResponse{
+			Success: false,
+			Message: "Invalid token passed",
+		})
+		return
+	}
+
+	codes, hashes, err := factor.NewRecoveryCodes(recoveryCodesCount)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to generate recovery codes")
+
+		utils.JSONResponse(w, 500, &AuthenticatorRecoveryCodesResponse{
+			Success: false,
+			Message: "Internal error (code AU/RC/01)",
+		})
+		return
+	}
+
+	stored, err := env.Accounts.UpdateFactorValue(
+		user.ID,
+		user.FactorValue,
+		authenticator().WithRecoveryCodes(user.FactorValue, hashes),
+	)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to update an account")
+
+		utils.JSONResponse(w, 500, &AuthenticatorRecoveryCodesResponse{
+			Success: false,
+			Message: "Internal error (code AU/RC/02)",
+		})
+		return
+	}
+
+	if !stored {
+		utils.JSONResponse(w, 409, &AuthenticatorRecoveryCodesResponse{
+			Success: false,
+			Message: "2FA settings were modified by another request",
+		})
+		return
+	}
+
+	audit(c, r, "factor.recovery_codes", user.ID, user.ID, nil)
+
+	utils.JSONResponse(w, 200, &AuthenticatorRecoveryCodesResponse{
+		Success:       true,
+		Message:       "Recovery codes replaced",
+		RecoveryCodes: codes,
+	})
+}
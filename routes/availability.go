@@ -0,0 +1,236 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/zenazn/goji/web"
+
+	"github.com/lavab/api/db"
+	"github.com/lavab/api/env"
+	"github.com/lavab/api/models"
+	"github.com/lavab/api/utils"
+)
+
+const (
+	// availabilityLimit is how many usernames an address can check per window
+	availabilityLimit = 30
+
+	// availabilityWindow is the rate limiting window of availability checks
+	availabilityWindow = time.Minute
+
+	// reservationHoldDuration is how long an available username stays
+	// reserved for the client that checked it
+	reservationHoldDuration = 15 * time.Minute
+
+	// availabilityHolds is how many new holds an address can create during
+	// reservationHoldDuration
+	availabilityHolds = 3
+)
+
+// reservationBlocks checks whether a reservation of the username prevents
+// registering it. Holds can be redeemed by passing their ID, reservations made
+// by admins by registering with the reserved alternative email address. The
+// redeemed reservation is returned if there is one.
+func reservationBlocks(name string, hold string, email string) (bool, *models.Reservation, error) {
+	reservations, err := env.Reservations.GetByName(name)
+	if err != nil {
+		return false, nil, err
+	}
+
+	var redeemed *models.Reservation
+	for _, reservation := range reservations {
+		if reservation.Expired() {
+			continue
+		}
+
+		if (hold != "" && reservation.ID == hold) || (email != "" && reservation.Email == email) {
+			redeemed = reservation
+			continue
+		}
+
+		return true, nil, nil
+	}
+
+	return false, redeemed, nil
+}
+
+// AccountsAvailabilityResponse contains the result of the AccountsAvailability request.
+type AccountsAvailabilityResponse struct {
+	Success     bool      `json:"success"`
+	Message     string    `json:"message,omitempty"`
+	Username    string    `json:"username,omitempty"`
+	Available   bool      `json:"available"`
+	Reservation string    `json:"reservation,omitempty"`
+	ExpiryDate  time.Time `json:"expiry_date,omitempty"`
+	RetryAfter  int       `json:"retry_after,omitempty"`
+}
+
+// AccountsAvailability checks whether a username can be registered. A few
+// available usernames are held for the client for a short time - passing the returned
+// reservation ID to the register step of AccountsCreate redeems the hold and
+// passing it to this endpoint again renews it.
+func AccountsAvailability(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Don't let clients enumerate the usernames
+	ip := utils.RemoteIP(r)
+	delay, err := rateLimit("availability:"+ip, availabilityLimit, availabilityWindow)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to rate limit a request")
+
+		utils.JSONResponse(w, 500, &AccountsAvailabilityResponse{
+			Success: false,
+			Message: "Internal error (code AC/AV/01)",
+		})
+		return
+	}
+
+	if delay > 0 {
+		seconds := int(delay/time.Second) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		utils.JSONResponse(w, 429, &AccountsAvailabilityResponse{
+			Success:    false,
+			Message:    "Too many requests, try again later",
+			RetryAfter: seconds,
+		})
+		return
+	}
+
+	username := utils.NormalizeUsername(r.URL.Query().Get("username"))
+	name := utils.RemoveDots(username)
+
+	// Same rules as in AccountsCreate
+	if len(username) < 3 || len(name) < 3 || len(username) > 32 {
+		utils.JSONResponse(w, 400, &AccountsAvailabilityResponse{
+			Success: false,
+			Message: "Invalid username - it has to be at least 3 and at max 32 characters long",
+		})
+		return
+	}
+
+	response := &AccountsAvailabilityResponse{
+		Success:  true,
+		Username: name,
+	}
+
+	// Check the addresses, accounts and then the reservations
+	address, err := env.Addresses.GetAddress(name)
+	if err != nil && !db.IsNotFound(err) {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to lookup an address")
+
+		utils.JSONResponse(w, 500, &AccountsAvailabilityResponse{
+			Success: false,
+			Message: "Internal error (code AC/AV/03)",
+		})
+		return
+	}
+
+	if address != nil {
+		utils.JSONResponse(w, 200, response)
+		return
+	}
+
+	used, err := env.Accounts.IsUsernameUsed(name)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to lookup an account")
+
+		utils.JSONResponse(w, 500, &AccountsAvailabilityResponse{
+			Success: false,
+			Message: "Internal error (code AC/AV/04)",
+		})
+		return
+	}
+
+	if used {
+		utils.JSONResponse(w, 200, response)
+		return
+	}
+
+	blocked, reservation, err := reservationBlocks(name, r.URL.Query().Get("reservation"), "")
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to lookup reservations")
+
+		utils.JSONResponse(w, 500, &AccountsAvailabilityResponse{
+			Success: false,
+			Message: "Internal error (code AC/AV/05)",
+		})
+		return
+	}
+
+	if blocked {
+		utils.JSONResponse(w, 200, response)
+		return
+	}
+
+	response.Available = true
+
+	expiryDate := time.Now().UTC().Add(reservationHoldDuration)
+	if reservation != nil {
+		// Renew the hold
+		reservation.ExpiryDate = expiryDate
+		err = env.Reservations.UpdateID(reservation.ID, reservation)
+	} else {
+		// Anonymous clients can't hold every name they check
+		var holds int64
+		holds, err = env.Cache.Increment("availability_holds:"+ip, 1, reservationHoldDuration)
+		if err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("Unable to count reservation holds")
+
+			utils.JSONResponse(w, 500, &AccountsAvailabilityResponse{
+				Success: false,
+				Message: "Internal error (code AC/AV/06)",
+			})
+			return
+		}
+
+		if holds > availabilityHolds {
+			response.Message = "Too many usernames are held for you, this one was not reserved"
+			utils.JSONResponse(w, 200, response)
+			return
+		}
+
+		// Clean up old holds before adding a new one
+		if _, err := env.Reservations.DeleteExpired(); err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("Unable to delete expired reservations")
+
+			// DO NOT RETURN!
+		}
+
+		reservation = &models.Reservation{
+			Resource: models.MakeResource("", name),
+			Expiring: models.Expiring{
+				ExpiryDate: expiryDate,
+			},
+		}
+		err = env.Reservations.Insert(reservation)
+	}
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to store a reservation")
+
+		utils.JSONResponse(w, 500, &AccountsAvailabilityResponse{
+			Success: false,
+			Message: "Internal error (code AC/AV/02)",
+		})
+		return
+	}
+
+	response.Reservation = reservation.ID
+	response.ExpiryDate = reservation.ExpiryDate
+
+	utils.JSONResponse(w, 200, response)
+}
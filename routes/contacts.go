@@ -6,6 +6,7 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/zenazn/goji/web"
 
+	"github.com/lavab/api/db"
 	"github.com/lavab/api/env"
 	"github.com/lavab/api/models"
 	"github.com/lavab/api/utils"
@@ -13,18 +14,37 @@ import (
 
 // ContactsListResponse contains the result of the ContactsList request.
 type ContactsListResponse struct {
-	Success  bool               `json:"success"`
-	Message  string             `json:"message,omitempty"`
-	Contacts *[]*models.Contact `json:"contacts,omitempty"`
+	Success    bool               `json:"success"`
+	Message    string             `json:"message,omitempty"`
+	Contacts   *[]*models.Contact `json:"contacts,omitempty"`
+	NextCursor string             `json:"next_cursor,omitempty"`
 }
 
-// ContactsList does *something* - TODO
+// ContactsList returns a list of the user's contacts
 func ContactsList(c web.C, w http.ResponseWriter, r *http.Request) {
 	// Fetch the current session from the database
 	session := c.Env["token"].(*models.Token)
 
+	// Parse the pagination parameters
+	input, err := parseListRequest(r)
+	if err != nil {
+		utils.JSONResponse(w, 400, &ContactsListResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
 	// Get contacts from the database
-	contacts, err := env.Contacts.GetOwnedBy(session.Owner)
+	var (
+		contacts []*models.Contact
+		next     *db.Cursor
+	)
+	if input.Page != nil {
+		contacts, next, err = env.Contacts.ListPage(session.Owner, input.Page)
+	} else {
+		contacts, err = env.Contacts.List(session.Owner, input.Sort, input.Offset, input.Limit)
+	}
 	if err != nil {
 		env.Log.WithFields(logrus.Fields{
 			"error": err.Error(),
@@ -37,10 +57,32 @@ func ContactsList(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	utils.JSONResponse(w, 200, &ContactsListResponse{
+	if input.Paginated || input.Page != nil {
+		count, err := env.Contacts.CountOwnedBy(session.Owner)
+		if err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("Unable to count contacts")
+
+			utils.JSONResponse(w, 500, &ContactsListResponse{
+				Success: false,
+				Message: "Internal error (code CO/LI/02)",
+			})
+			return
+		}
+
+		writeListHeaders(w, r, input, count, next)
+	}
+
+	resp := &ContactsListResponse{
 		Success:  true,
 		Contacts: &contacts,
-	})
+	}
+	if next != nil {
+		resp.NextCursor = next.Encode()
+	}
+
+	utils.JSONResponse(w, 200, resp)
 }
 
 // ContactsCreateRequest is the payload that user should pass to POST /contacts
@@ -116,6 +158,9 @@ func ContactsCreate(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Notify other sessions
+	publish(session.Owner, "contact.create", contact.ID, contact)
+
 	utils.JSONResponse(w, 201, &ContactsCreateResponse{
 		Success: true,
 		Message: "A new contact was successfully created",
@@ -256,6 +301,9 @@ func ContactsUpdate(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Notify other sessions
+	publish(session.Owner, "contact.update", contact.ID, contact)
+
 	// Write the contact to the response
 	utils.JSONResponse(w, 200, &ContactsUpdateResponse{
 		Success: true,
@@ -308,6 +356,9 @@ func ContactsDelete(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Notify other sessions
+	publish(session.Owner, "contact.delete", contact.ID, nil)
+
 	// Write the contact to the response
 	utils.JSONResponse(w, 200, &ContactsDeleteResponse{
 		Success: true,
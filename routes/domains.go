@@ -0,0 +1,379 @@
+package routes
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dchest/uniuri"
+	"github.com/zenazn/goji/web"
+
+	"github.com/lavab/api/env"
+	"github.com/lavab/api/models"
+	"github.com/lavab/api/utils"
+)
+
+// domainPattern matches lowercase domain names with at least two labels
+var domainPattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+
+// canUseDomains checks whether the account can add custom domains
+func canUseDomains(account *models.Account) bool {
+	return account.Type == "premium" || account.Type == "superuser"
+}
+
+// DomainsListResponse contains the result of the DomainsList request.
+type DomainsListResponse struct {
+	Success bool             `json:"success"`
+	Message string           `json:"message,omitempty"`
+	Domains []*models.Domain `json:"domains,omitempty"`
+}
+
+// DomainsList returns all custom domains of the account
+func DomainsList(c web.C, w http.ResponseWriter, r *http.Request) {
+	session := c.Env["token"].(*models.Token)
+
+	domains, err := env.Domains.GetOwnedBy(session.Owner)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to fetch domains")
+
+		utils.JSONResponse(w, 500, &DomainsListResponse{
+			Success: false,
+			Message: "Internal error (code DO/LI/01)",
+		})
+		return
+	}
+
+	utils.JSONResponse(w, 200, &DomainsListResponse{
+		Success: true,
+		Domains: domains,
+	})
+}
+
+// DomainsCreateRequest contains the input for the DomainsCreate endpoint.
+type DomainsCreateRequest struct {
+	Domain string `json:"domain" schema:"domain"`
+}
+
+// DomainsCreateResponse contains the result of the DomainsCreate request.
+type DomainsCreateResponse struct {
+	Success     bool           `json:"success"`
+	Message     string         `json:"message"`
+	Domain      *models.Domain `json:"domain,omitempty"`
+	RecordName  string         `json:"record_name,omitempty"`
+	RecordValue string         `json:"record_value,omitempty"`
+}
+
+// DomainsCreate adds a custom domain to the account. The domain has to be
+// verified by publishing the returned TXT record before addresses can be
+// created under it.
+func DomainsCreate(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Decode the request
+	var input DomainsCreateRequest
+	err := utils.ParseRequest(r, &input)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("Unable to decode a request")
+
+		utils.JSONResponse(w, 400, &DomainsCreateResponse{
+			Success: false,
+			Message: "Invalid input format",
+		})
+		return
+	}
+
+	name := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(input.Domain)), ".")
+	if len(name) > 253 || !domainPattern.MatchString(name) {
+		utils.JSONResponse(w, 400, &DomainsCreateResponse{
+			Success: false,
+			Message: "Invalid domain",
+		})
+		return
+	}
+
+	// The service's domain can't be claimed
+	if name == env.Config.EmailDomain || strings.HasSuffix(name, "."+env.Config.EmailDomain) {
+		utils.JSONResponse(w, 409, &DomainsCreateResponse{
+			Success: false,
+			Message: "Domain already used",
+		})
+		return
+	}
+
+	session := c.Env["token"].(*models.Token)
+
+	user, err := env.Accounts.GetAccount(session.Owner)
+	if err != nil {
+		utils.JSONResponse(w, 500, &DomainsCreateResponse{
+			Success: false,
+			Message: "Unable to resolve the account",
+		})
+		return
+	}
+
+	if !canUseDomains(user) {
+		utils.JSONResponse(w, 403, &DomainsCreateResponse{
+			Success: false,
+			Message: "Custom domains are available only to premium accounts",
+		})
+		return
+	}
+
+	if verified, err := env.Domains.GetVerified(name); err == nil || verified != nil {
+		utils.JSONResponse(w, 409, &DomainsCreateResponse{
+			Success: false,
+			Message: "Domain already used",
+		})
+		return
+	}
+
+	domains, err := env.Domains.GetOwnedBy(user.ID)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to fetch domains")
+
+		utils.JSONResponse(w, 500, &DomainsCreateResponse{
+			Success: false,
+			Message: "Internal error (code DO/CR/01)",
+		})
+		return
+	}
+
+	for _, domain := range domains {
+		if domain.Name == name {
+			utils.JSONResponse(w, 409, &DomainsCreateResponse{
+				Success: false,
+				Message: "Domain already added",
+			})
+			return
+		}
+	}
+
+	domain := &models.Domain{
+		Resource: models.MakeResource(user.ID, name),
+		Token:    uniuri.NewLen(32),
+		Status:   "pending",
+	}
+
+	if err := env.Domains.Insert(domain); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to insert a domain")
+
+		utils.JSONResponse(w, 500, &DomainsCreateResponse{
+			Success: false,
+			Message: "Internal error (code DO/CR/02)",
+		})
+		return
+	}
+
+	audit(c, r, "domain.create", user.ID, user.ID, map[string]interface{}{
+		"domain": domain.Name,
+	})
+
+	// Notify other sessions
+	publish(user.ID, "domain.create", domain.ID, domain)
+
+	utils.JSONResponse(w, 201, &DomainsCreateResponse{
+		Success:     true,
+		Message:     "Domain added, publish the TXT record to verify it",
+		Domain:      domain,
+		RecordName:  domain.RecordName(),
+		RecordValue: domain.RecordValue(),
+	})
+}
+
+// DomainsGetResponse contains the result of the DomainsGet request.
+type DomainsGetResponse struct {
+	Success     bool           `json:"success"`
+	Message     string         `json:"message,omitempty"`
+	Domain      *models.Domain `json:"domain,omitempty"`
+	RecordName  string         `json:"record_name,omitempty"`
+	RecordValue string         `json:"record_value,omitempty"`
+}
+
+// DomainsGet returns a domain and the TXT record verifying it
+func DomainsGet(c web.C, w http.ResponseWriter, r *http.Request) {
+	session := c.Env["token"].(*models.Token)
+
+	domain, err := env.Domains.GetDomain(c.URLParams["id"])
+	if err != nil || domain.Owner != session.Owner {
+		utils.JSONResponse(w, 404, &DomainsGetResponse{
+			Success: false,
+			Message: "Domain not found",
+		})
+		return
+	}
+
+	utils.JSONResponse(w, 200, &DomainsGetResponse{
+		Success:     true,
+		Domain:      domain,
+		RecordName:  domain.RecordName(),
+		RecordValue: domain.RecordValue(),
+	})
+}
+
+// DomainsVerifyResponse contains the result of the DomainsVerify request.
+type DomainsVerifyResponse struct {
+	Success bool           `json:"success"`
+	Message string         `json:"message"`
+	Domain  *models.Domain `json:"domain,omitempty"`
+}
+
+// DomainsVerify looks up the domain's TXT record and marks the domain as
+// verified if it contains the token.
+func DomainsVerify(c web.C, w http.ResponseWriter, r *http.Request) {
+	session := c.Env["token"].(*models.Token)
+
+	domain, err := env.Domains.GetDomain(c.URLParams["id"])
+	if err != nil || domain.Owner != session.Owner {
+		utils.JSONResponse(w, 404, &DomainsVerifyResponse{
+			Success: false,
+			Message: "Domain not found",
+		})
+		return
+	}
+
+	if domain.Status == "verified" {
+		utils.JSONResponse(w, 200, &DomainsVerifyResponse{
+			Success: true,
+			Message: "Domain already verified",
+			Domain:  domain,
+		})
+		return
+	}
+
+	// Someone else might have verified the domain in the meantime
+	if verified, err := env.Domains.GetVerified(domain.Name); err == nil || verified != nil {
+		utils.JSONResponse(w, 409, &DomainsVerifyResponse{
+			Success: false,
+			Message: "Domain already used",
+		})
+		return
+	}
+
+	records, err := env.Resolver.LookupTXT(domain.RecordName())
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error":  err.Error(),
+			"domain": domain.Name,
+		}).Warn("Unable to look up a verification record")
+
+		// Missing records are reported the same way as invalid ones
+	}
+
+	found := false
+	for _, record := range records {
+		if strings.TrimSpace(record) == domain.RecordValue() {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		utils.JSONResponse(w, 409, &DomainsVerifyResponse{
+			Success: false,
+			Message: "Verification record not found",
+			Domain:  domain,
+		})
+		return
+	}
+
+	// The name is claimed atomically, concurrent verifications can't both win
+	verified, err := env.Domains.Verify(domain)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to update a domain")
+
+		utils.JSONResponse(w, 500, &DomainsVerifyResponse{
+			Success: false,
+			Message: "Internal error (code DO/VE/01)",
+		})
+		return
+	}
+
+	if !verified {
+		utils.JSONResponse(w, 409, &DomainsVerifyResponse{
+			Success: false,
+			Message: "Domain already used",
+		})
+		return
+	}
+
+	audit(c, r, "domain.verify", session.Owner, session.Owner, map[string]interface{}{
+		"domain": domain.Name,
+	})
+
+	// Notify other sessions
+	publish(session.Owner, "domain.update", domain.ID, domain)
+
+	utils.JSONResponse(w, 200, &DomainsVerifyResponse{
+		Success: true,
+		Message: "Domain verified",
+		Domain:  domain,
+	})
+}
+
+// DomainsDeleteResponse contains the result of the DomainsDelete request.
+type DomainsDeleteResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+// DomainsDelete removes a domain together with its addresses
+func DomainsDelete(c web.C, w http.ResponseWriter, r *http.Request) {
+	session := c.Env["token"].(*models.Token)
+
+	domain, err := env.Domains.GetDomain(c.URLParams["id"])
+	if err != nil || domain.Owner != session.Owner {
+		utils.JSONResponse(w, 404, &DomainsDeleteResponse{
+			Success: false,
+			Message: "Domain not found",
+		})
+		return
+	}
+
+	// Only the owner of the verified domain has addresses in it
+	if domain.Status == "verified" {
+		if _, err := env.Addresses.DeleteByDomain(domain.Name); err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("Unable to delete domain's addresses")
+
+			utils.JSONResponse(w, 500, &DomainsDeleteResponse{
+				Success: false,
+				Message: "Internal error (code DO/DE/01)",
+			})
+			return
+		}
+	}
+
+	if err := env.Domains.DeleteDomain(domain); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to delete a domain")
+
+		utils.JSONResponse(w, 500, &DomainsDeleteResponse{
+			Success: false,
+			Message: "Internal error (code DO/DE/02)",
+		})
+		return
+	}
+
+	audit(c, r, "domain.delete", session.Owner, session.Owner, map[string]interface{}{
+		"domain": domain.Name,
+	})
+
+	// Notify other sessions
+	publish(session.Owner, "domain.delete", domain.ID, nil)
+
+	utils.JSONResponse(w, 200, &DomainsDeleteResponse{
+		Success: true,
+		Message: "Domain deleted",
+	})
+}
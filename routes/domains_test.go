@@ -0,0 +1,243 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dchest/uniuri"
+	"github.com/zenazn/goji/web"
+
+	"github.com/lavab/api/cache"
+	"github.com/lavab/api/db"
+	"github.com/lavab/api/dns"
+	"github.com/lavab/api/env"
+	"github.com/lavab/api/events"
+	"github.com/lavab/api/models"
+)
+
+// setupDomains prepares the tables used by domain verification and returns
+// the resolver serving verification records
+func setupDomains(t *testing.T) *dns.FakeResolver {
+	session := connectRethink(t, "accounts", "addresses", "domains", "domain_claims", "keys")
+
+	env.Config = &env.Flags{
+		EmailDomain: "lavaboom.com",
+	}
+	env.Log = logrus.New()
+	env.Cache = cache.NewMemoryCache(&cache.MemoryCacheOpts{})
+	env.Events = events.NewBus()
+
+	resolver := dns.NewFakeResolver()
+	env.Resolver = resolver
+
+	env.Accounts = &db.AccountsTable{
+		RethinkCRUD: db.NewCRUDTable(session, "test", "accounts"),
+	}
+	env.Addresses = &db.AddressesTable{
+		RethinkCRUD: db.NewCRUDTable(session, "test", "addresses"),
+	}
+	env.Domains = &db.DomainsTable{
+		RethinkCRUD: db.NewCRUDTable(session, "test", "domains"),
+		Claims:      db.NewCRUDTable(session, "test", "domain_claims"),
+	}
+	env.Votes = &db.VotesTable{
+		RethinkCRUD: db.NewCRUDTable(session, "test", "votes"),
+	}
+	env.Keys = &db.KeysTable{
+		RethinkCRUD: db.NewCRUDTable(session, "test", "keys"),
+		Votes:       env.Votes,
+	}
+	env.Audit = &db.AuditTable{
+		RethinkCRUD: db.NewCRUDTable(session, "test", "audit"),
+	}
+
+	return resolver
+}
+
+// insertDomain adds a domain with a random name unless name is set
+func insertDomain(t *testing.T, owner string, name string, status string) *models.Domain {
+	if name == "" {
+		name = strings.ToLower(uniuri.New()) + ".example.com"
+	}
+
+	domain := &models.Domain{
+		Resource: models.MakeResource(owner, name),
+		Token:    uniuri.NewLen(32),
+		Status:   status,
+	}
+	if err := env.Domains.Insert(domain); err != nil {
+		t.Fatal(err)
+	}
+
+	return domain
+}
+
+// verifyDomain calls DomainsVerify on behalf of the domain's owner
+func verifyDomain(t *testing.T, domain *models.Domain) (int, *DomainsVerifyResponse) {
+	r, err := http.NewRequest("POST", "/domains/"+domain.ID+"/verify", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := web.C{
+		URLParams: map[string]string{"id": domain.ID},
+		Env: map[string]interface{}{
+			"token": &models.Token{Resource: models.Resource{Owner: domain.Owner}},
+		},
+	}
+
+	w := httptest.NewRecorder()
+	DomainsVerify(c, w, r)
+
+	var response DomainsVerifyResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	return w.Code, &response
+}
+
+func TestDomainsVerify(t *testing.T) {
+	resolver := setupDomains(t)
+
+	owner := uniuri.New()
+	domain := insertDomain(t, owner, "", "pending")
+
+	// Pending domains without the record stay pending
+	if code, response := verifyDomain(t, domain); code != 409 || response.Message != "Verification record not found" {
+		t.Fatalf("missing record: %d %s", code, response.Message)
+	}
+
+	resolver.SetTXT(domain.RecordName(), "lavaboom-verification="+uniuri.NewLen(32))
+	if code, response := verifyDomain(t, domain); code != 409 || response.Message != "Verification record not found" {
+		t.Fatalf("wrong token: %d %s", code, response.Message)
+	}
+
+	if stored, err := env.Domains.GetDomain(domain.ID); err != nil || stored.Status != "pending" {
+		t.Fatalf("domain was verified with a wrong token: %+v (%v)", stored, err)
+	}
+
+	resolver.SetTXT(domain.RecordName(), "v=spf1 -all", " "+domain.RecordValue()+" ")
+	code, response := verifyDomain(t, domain)
+	if code != 200 || !response.Success || response.Domain.Status != "verified" {
+		t.Fatalf("valid record: %d %s", code, response.Message)
+	}
+
+	stored, err := env.Domains.GetDomain(domain.ID)
+	if err != nil || stored.Status != "verified" || stored.DateVerified.IsZero() {
+		t.Fatalf("domain wasn't stored as verified: %+v (%v)", stored, err)
+	}
+
+	if code, response := verifyDomain(t, stored); code != 200 || response.Message != "Domain already verified" {
+		t.Fatalf("repeated verification: %d %s", code, response.Message)
+	}
+
+	// Another account can't verify the name, even with its own record
+	other := insertDomain(t, uniuri.New(), domain.Name, "pending")
+	resolver.SetTXT(domain.RecordName(), domain.RecordValue(), other.RecordValue())
+
+	if code, response := verifyDomain(t, other); code != 409 || response.Message != "Domain already used" {
+		t.Fatalf("domain verified by another account: %d %s", code, response.Message)
+	}
+
+	// The claim holds even if the check before the lookup is raced
+	if verified, err := env.Domains.Verify(other); err != nil || verified {
+		t.Fatalf("claimed name was verified again: %v (%v)", verified, err)
+	}
+	if stored, err := env.Domains.GetDomain(other.ID); err != nil || stored.Status != "pending" {
+		t.Fatalf("domain of another account was verified: %+v (%v)", stored, err)
+	}
+
+	// Deleting the verified domain releases the name
+	if err := env.Domains.DeleteDomain(stored); err != nil {
+		t.Fatal(err)
+	}
+	if code, response := verifyDomain(t, other); code != 200 || !response.Success {
+		t.Fatalf("released name wasn't verified: %d %s", code, response.Message)
+	}
+}
+
+func TestResolveAddressDomains(t *testing.T) {
+	setupDomains(t)
+
+	owner := uniuri.New()
+	verified := insertDomain(t, owner, "", "verified")
+	pending := insertDomain(t, owner, "", "pending")
+
+	account := &models.Account{
+		Resource:  models.MakeResource(owner, "john"),
+		PublicKey: strings.ToLower(uniuri.NewLen(40)),
+	}
+	account.ID = owner
+	if err := env.Accounts.Insert(account); err != nil {
+		t.Fatal(err)
+	}
+
+	key := &models.Key{
+		Resource: models.MakeResource(owner, ""),
+		Key:      "-----BEGIN PGP PUBLIC KEY BLOCK-----",
+	}
+	key.ID = account.PublicKey
+	if err := env.Keys.Insert(key); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, domain := range []*models.Domain{verified, pending} {
+		address := &models.Address{
+			Resource:   models.MakeResource(owner, "John.Doe"),
+			StyledName: "John.Doe",
+			Domain:     domain.Name,
+		}
+		address.ID = "johndoe@" + domain.Name
+		if err := env.Addresses.Insert(address); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	address, tag, err := resolveAddress("John.Doe+News@" + strings.ToUpper(verified.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address.ID != "johndoe@"+verified.Name || tag != "news" {
+		t.Fatalf("invalid address %s with tag %s", address.ID, tag)
+	}
+
+	// Addresses of pending and unknown domains don't exist for senders
+	for _, email := range []string{
+		"johndoe@" + pending.Name,
+		"johndoe@unknown." + verified.Name,
+	} {
+		if _, _, err := resolveAddress(email); err == nil {
+			t.Fatalf("%s was resolved", email)
+		}
+	}
+
+	keysGet := func(id string) (int, *KeysGetResponse) {
+		r, err := http.NewRequest("GET", "/keys/"+id, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		KeysGet(web.C{URLParams: map[string]string{"id": id}}, w, r)
+
+		var response KeysGetResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+
+		return w.Code, &response
+	}
+
+	if code, response := keysGet("john.doe@" + verified.Name); code != 200 || response.Key == nil || response.Key.ID != account.PublicKey {
+		t.Fatalf("key of the custom domain address: %d %s", code, response.Message)
+	}
+
+	if code, _ := keysGet("john.doe@" + pending.Name); code != 404 {
+		t.Fatalf("key of the pending domain address: %d", code)
+	}
+}
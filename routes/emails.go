@@ -8,8 +8,6 @@ import (
 	"net/http"
 	"net/mail"
 	"regexp"
-	"strconv"
-	"strings"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/zenazn/goji/web"
@@ -17,6 +15,7 @@ import (
 	//"golang.org/x/crypto/openpgp/armor"
 	_ "golang.org/x/crypto/ripemd160"
 
+	"github.com/lavab/api/db"
 	"github.com/lavab/api/env"
 	"github.com/lavab/api/models"
 	"github.com/lavab/api/utils"
@@ -26,9 +25,10 @@ var prefixesRegex = regexp.MustCompile(`([\[\(] *)?(RE?S?|FYI|RIF|I|FS|VB|RV|ENC
 
 // EmailsListResponse contains the result of the EmailsList request.
 type EmailsListResponse struct {
-	Success bool             `json:"success"`
-	Message string           `json:"message,omitempty"`
-	Emails  *[]*models.Email `json:"emails,omitempty"`
+	Success    bool             `json:"success"`
+	Message    string           `json:"message,omitempty"`
+	Emails     *[]*models.Email `json:"emails,omitempty"`
+	NextCursor string           `json:"next_cursor,omitempty"`
 }
 
 // EmailsList sends a list of the emails in the inbox.
@@ -37,94 +37,130 @@ func EmailsList(c web.C, w http.ResponseWriter, r *http.Request) {
 	session := c.Env["token"].(*models.Token)
 
 	// Parse the query
+	input, err := parseListRequest(r)
+	if err != nil {
+		utils.JSONResponse(w, 400, &EmailsListResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	thread := r.URL.Query().Get("thread")
+
+	// Get emails from the database
 	var (
-		query     = r.URL.Query()
-		sortRaw   = query.Get("sort")
-		offsetRaw = query.Get("offset")
-		limitRaw  = query.Get("limit")
-		thread    = query.Get("thread")
-		sort      []string
-		offset    int
-		limit     int
+		emails []*models.Email
+		next   *db.Cursor
 	)
+	if input.Page != nil {
+		emails, next, err = env.Emails.ListPage(session.Owner, thread, input.Page)
+	} else {
+		emails, err = env.Emails.List(session.Owner, input.Sort, input.Offset, input.Limit, thread)
+	}
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to fetch emails")
 
-	if offsetRaw != "" {
-		o, err := strconv.Atoi(offsetRaw)
-		if err != nil {
-			env.Log.WithFields(logrus.Fields{
-				"error":  err,
-				"offset": offset,
-			}).Error("Invalid offset")
-
-			utils.JSONResponse(w, 400, &EmailsListResponse{
-				Success: false,
-				Message: "Invalid offset",
-			})
-			return
-		}
-		offset = o
+		utils.JSONResponse(w, 500, &EmailsListResponse{
+			Success: false,
+			Message: "Internal error (code EM/LI/01)",
+		})
+		return
 	}
 
-	if limitRaw != "" {
-		l, err := strconv.Atoi(limitRaw)
+	if input.Paginated || input.Page != nil {
+		count, err := env.Emails.CountList(session.Owner, thread)
 		if err != nil {
 			env.Log.WithFields(logrus.Fields{
 				"error": err.Error(),
-				"limit": limit,
-			}).Error("Invalid limit")
+			}).Error("Unable to count emails")
 
-			utils.JSONResponse(w, 400, &EmailsListResponse{
+			utils.JSONResponse(w, 500, &EmailsListResponse{
 				Success: false,
-				Message: "Invalid limit",
+				Message: "Internal error (code EM/LI/02)",
 			})
 			return
 		}
-		limit = l
+
+		writeListHeaders(w, r, input, count, next)
+	}
+
+	resp := &EmailsListResponse{
+		Success: true,
+		Emails:  &emails,
+	}
+	if next != nil {
+		resp.NextCursor = next.Encode()
 	}
 
-	if sortRaw != "" {
-		sort = strings.Split(sortRaw, ",")
+	utils.JSONResponse(w, 200, resp)
+
+	// GET parameters:
+	//   sort - split by commas, prefixes: - is desc, + is asc
+	//   offset, limit - for pagination
+	//   cursor - for cursor pagination, see parseListRequest
+	//   thread - ID of the thread
+	// Pagination ADDS X-Total-Count and Link to the response!
+}
+
+// EmailsSearchResponse contains the result of the EmailsSearch request.
+type EmailsSearchResponse struct {
+	Success bool             `json:"success"`
+	Message string           `json:"message,omitempty"`
+	Emails  *[]*models.Email `json:"emails,omitempty"`
+}
+
+// EmailsSearch returns emails matching a search query over the unencrypted metadata.
+func EmailsSearch(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Fetch the current session from the middleware
+	session := c.Env["token"].(*models.Token)
+
+	// Parse the query
+	input, err := parseSearchRequest(r)
+	if err != nil {
+		utils.JSONResponse(w, 400, &EmailsSearchResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
 	}
 
-	// Get contacts from the database
-	emails, err := env.Emails.List(session.Owner, sort, offset, limit, thread)
+	query, ok, err := resolveSearchLabels(session.Owner, input.Query)
 	if err != nil {
 		env.Log.WithFields(logrus.Fields{
 			"error": err.Error(),
-		}).Error("Unable to fetch emails")
+		}).Error("Unable to fetch labels")
 
-		utils.JSONResponse(w, 500, &EmailsListResponse{
+		utils.JSONResponse(w, 500, &EmailsSearchResponse{
 			Success: false,
-			Message: "Internal error (code EM/LI/01)",
+			Message: "Internal error (code EM/SE/01)",
 		})
 		return
 	}
 
-	if offsetRaw != "" || limitRaw != "" {
-		count, err := env.Emails.CountOwnedBy(session.Owner)
+	// Nothing can match a label that doesn't exist
+	emails := []*models.Email{}
+	if ok {
+		emails, err = env.Emails.Search(session.Owner, query, input.Sort, input.Offset, input.Limit)
 		if err != nil {
 			env.Log.WithFields(logrus.Fields{
 				"error": err.Error(),
-			}).Error("Unable to count emails")
+			}).Error("Unable to search emails")
 
-			utils.JSONResponse(w, 500, &EmailsListResponse{
+			utils.JSONResponse(w, 500, &EmailsSearchResponse{
 				Success: false,
-				Message: "Internal error (code EM/LI/02)",
+				Message: "Internal error (code EM/SE/02)",
 			})
 			return
 		}
-		w.Header().Set("X-Total-Count", strconv.Itoa(count))
 	}
 
-	utils.JSONResponse(w, 200, &EmailsListResponse{
+	utils.JSONResponse(w, 200, &EmailsSearchResponse{
 		Success: true,
 		Emails:  &emails,
 	})
-
-	// GET parameters:
-	//   sort - split by commas, prefixes: - is desc, + is asc
-	//   offset, limit - for pagination
-	// Pagination ADDS X-Total-Count to the response!
 }
 
 type EmailsCreateRequest struct {
@@ -243,12 +279,7 @@ func EmailsCreate(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get the "Sent" label's ID
-	var label *models.Label
-	err = env.Labels.WhereAndFetchOne(map[string]interface{}{
-		"name":    "Sent",
-		"builtin": true,
-		"owner":   account.ID,
-	}, &label)
+	label, err := env.Labels.GetBuiltin(account.ID, "Sent")
 	if err != nil {
 		env.Log.WithFields(logrus.Fields{
 			"id":    account.ID,
@@ -273,11 +304,10 @@ func EmailsCreate(c web.C, w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// We have a specified address
+		// We have a specified address. Aliases and plus-addresses are accepted.
 		if from.Address != "" {
-			parts := strings.SplitN(from.Address, "@", 2)
-
-			if parts[1] != env.Config.EmailDomain {
+			address, _, err := resolveAddress(from.Address)
+			if err == errInvalidDomain {
 				utils.JSONResponse(w, 400, &EmailsCreateResponse{
 					Success: false,
 					Message: "Invalid email.From (invalid domain)",
@@ -285,7 +315,6 @@ func EmailsCreate(c web.C, w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			address, err := env.Addresses.GetAddress(parts[0])
 			if err != nil {
 				utils.JSONResponse(w, 400, &EmailsCreateResponse{
 					Success: false,
@@ -315,7 +344,7 @@ func EmailsCreate(c web.C, w http.ResponseWriter, r *http.Request) {
 
 		addr := &mail.Address{
 			Name:    displayName,
-			Address: account.StyledName + "@" + env.Config.EmailDomain,
+			Address: defaultAddress(account),
 		}
 
 		input.From = addr.String()
@@ -356,6 +385,9 @@ func EmailsCreate(c web.C, w http.ResponseWriter, r *http.Request) {
 				})
 				return
 			}
+
+			thread.Secure = "some"
+			publish(account.ID, "thread.update", thread.ID, thread)
 		}
 	} else {
 		secure := "all"
@@ -387,6 +419,9 @@ func EmailsCreate(c web.C, w http.ResponseWriter, r *http.Request) {
 		}
 
 		input.Thread = thread.ID
+
+		publish(account.ID, "thread.create", thread.ID, thread)
+		go PublishLabelCounts(account.ID, thread.Labels...)
 	}
 
 	// Calculate the message ID
@@ -456,6 +491,19 @@ func EmailsCreate(c web.C, w http.ResponseWriter, r *http.Request) {
 		}
 	}*/
 
+	// The mailer reads attachments from the files table
+	if err := env.Files.InlinePayloads(email.Files...); err != nil {
+		utils.JSONResponse(w, 500, &EmailsCreateResponse{
+			Success: false,
+			Message: "internal server error - EM/CR/04",
+		})
+
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Could not inline attachments of an email")
+		return
+	}
+
 	// Add a send request to the queue
 	err = env.Producer.Publish("send_email", []byte(`"`+email.ID+`"`))
 	if err != nil {
@@ -470,6 +518,9 @@ func EmailsCreate(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Notify other sessions
+	publish(account.ID, "email.create", email.ID, email)
+
 	utils.JSONResponse(w, 201, &EmailsCreateResponse{
 		Success: true,
 		Created: []string{email.ID},
@@ -559,6 +610,9 @@ func EmailsDelete(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Notify other sessions
+	publish(session.Owner, "email.delete", email.ID, nil)
+
 	// Write the email to the response
 	utils.JSONResponse(w, 200, &EmailsDeleteResponse{
 		Success: true,
@@ -676,12 +730,7 @@ func EmailsDelete(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get the "Inbox" label's ID
-	var inbox *models.Label
-	err = env.Labels.WhereAndFetchOne(map[string]interface{}{
-		"name":    "Inbox",
-		"builtin": true,
-		"owner":   recipient.ID,
-	}, &inbox)
+	inbox, err := env.Labels.GetBuiltin(recipient.ID, "Inbox")
 	if err != nil {
 		env.Log.WithFields(logrus.Fields{
 			"id":    recipient.ID,
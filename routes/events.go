@@ -0,0 +1,47 @@
+package routes
+
+import (
+	"github.com/Sirupsen/logrus"
+
+	"github.com/lavab/api/env"
+	"github.com/lavab/api/events"
+)
+
+// publish notifies owner's subscribed sessions about a change of a resource.
+// kind consists of the resource and the action, eg. "thread.update".
+func publish(owner string, kind string, id string, data interface{}) {
+	env.Events.Publish(owner, &events.Event{
+		Type: kind,
+		ID:   id,
+		Data: data,
+	})
+}
+
+// PublishLabelCounts sends labels with recalculated thread counts to owner's
+// subscribed sessions. It's meant to be run in a goroutine after threads change.
+func PublishLabelCounts(owner string, ids ...string) {
+	if !env.Events.Subscribed(owner) {
+		return
+	}
+
+	// Counts are cached until owner's threads change
+	labels, err := env.Labels.GetOwnedByWithCounts(owner)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+			"owner": owner,
+		}).Error("Unable to count labels' threads")
+		return
+	}
+
+	changed := map[string]struct{}{}
+	for _, id := range ids {
+		changed[id] = struct{}{}
+	}
+
+	for _, label := range labels {
+		if _, ok := changed[label.ID]; ok {
+			publish(owner, "label.update", label.ID, label)
+		}
+	}
+}
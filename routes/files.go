@@ -1,38 +1,74 @@
 package routes
 
 import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/zenazn/goji/web"
 
+	"github.com/lavab/api/db"
 	"github.com/lavab/api/env"
 	"github.com/lavab/api/models"
 	"github.com/lavab/api/utils"
 )
 
 type FilesListResponse struct {
-	Success bool            `json:"success"`
-	Message string          `json:"message,omitempty"`
-	Files   *[]*models.File `json:"files,omitempty"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message,omitempty"`
+	Files      *[]*models.File `json:"files,omitempty"`
+	NextCursor string          `json:"next_cursor,omitempty"`
 }
 
+// FilesList returns metadata of the user's files. The list can be narrowed
+// down to an email's attachments using the email GET parameter and to files
+// with a specific name using the name parameter.
 func FilesList(c web.C, w http.ResponseWriter, r *http.Request) {
 	session := c.Env["token"].(*models.Token)
 
-	query := r.URL.Query()
-	email := query.Get("email")
-	name := query.Get("name")
-
-	if email == "" || name == "" {
+	input, err := parseListRequest(r)
+	if err != nil {
 		utils.JSONResponse(w, 400, &FilesListResponse{
 			Success: false,
-			Message: "No email or name in get params",
+			Message: err.Error(),
 		})
 		return
 	}
 
-	files, err := env.Files.GetInEmail(session.Owner, email, name)
+	var (
+		query = r.URL.Query()
+		name  = query.Get("name")
+		ids   []string
+	)
+
+	if id := query.Get("email"); id != "" {
+		email, err := env.Emails.GetEmail(id)
+		if err != nil || email.Owner != session.Owner {
+			utils.JSONResponse(w, 404, &FilesListResponse{
+				Success: false,
+				Message: "Email not found",
+			})
+			return
+		}
+
+		ids = email.Files
+		if ids == nil {
+			ids = []string{}
+		}
+	}
+
+	var (
+		files []*models.File
+		next  *db.Cursor
+	)
+	if input.Page != nil {
+		files, next, err = env.Files.ListPage(session.Owner, ids, name, input.Page)
+	} else {
+		files, err = env.Files.List(session.Owner, ids, name, input.Sort, input.Offset, input.Limit)
+	}
 	if err != nil {
 		env.Log.WithFields(logrus.Fields{
 			"error": err.Error(),
@@ -45,10 +81,32 @@ func FilesList(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	utils.JSONResponse(w, 200, &FilesListResponse{
+	if input.Paginated || input.Page != nil {
+		count, err := env.Files.CountList(session.Owner, ids, name)
+		if err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("Unable to count files")
+
+			utils.JSONResponse(w, 500, &FilesListResponse{
+				Success: false,
+				Message: "Internal error (code FI/LI/02)",
+			})
+			return
+		}
+
+		writeListHeaders(w, r, input, count, next)
+	}
+
+	resp := &FilesListResponse{
 		Success: true,
 		Files:   &files,
-	})
+	}
+	if next != nil {
+		resp.NextCursor = next.Encode()
+	}
+
+	utils.JSONResponse(w, 200, resp)
 }
 
 type FilesCreateRequest struct {
@@ -108,6 +166,21 @@ func FilesCreate(c web.C, w http.ResponseWriter, r *http.Request) {
 		Resource: models.MakeResource(session.Owner, input.Name),
 	}
 
+	// Move the payload into the blob store
+	if err := env.Files.StorePayload(file, func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader(input.Data)), nil
+	}); err != nil {
+		utils.JSONResponse(w, 500, &FilesCreateResponse{
+			Success: false,
+			Message: "internal server error - FI/CR/02",
+		})
+
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Could not store file's payload")
+		return
+	}
+
 	// Insert the file into the database
 	if err := env.Files.Insert(file); err != nil {
 		utils.JSONResponse(w, 500, &FilesCreateResponse{
@@ -121,6 +194,9 @@ func FilesCreate(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Notify other sessions
+	publish(session.Owner, "file.create", file.ID, file)
+
 	utils.JSONResponse(w, 201, &FilesCreateResponse{
 		Success: true,
 		Message: "A new file was successfully created",
@@ -159,11 +235,52 @@ func FilesGet(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Open the payload before anything is written
+	payload, err := env.Files.OpenPayload(file)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+			"id":    file.ID,
+		}).Error("Unable to open file's payload")
+
+		utils.JSONResponse(w, 500, &FilesGetResponse{
+			Success: false,
+			Message: "Internal error (code FI/GE/01)",
+		})
+		return
+	}
+	defer payload.Close()
+
+	// Marshal the metadata, data is spliced into it while streaming
+	metadata, err := json.Marshal(file)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+			"id":    file.ID,
+		}).Error("Unable to marshal file's metadata")
+
+		utils.JSONResponse(w, 500, &FilesGetResponse{
+			Success: false,
+			Message: "Internal error (code FI/GE/02)",
+		})
+		return
+	}
+
 	// Write the file to the response
-	utils.JSONResponse(w, 200, &FilesGetResponse{
-		Success: true,
-		File:    file,
-	})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(200)
+	io.WriteString(w, `{"success":true,"file":`)
+	w.Write(metadata[:len(metadata)-1])
+	io.WriteString(w, `,"data":`)
+	if err := utils.WriteJSONString(w, payload); err != nil {
+		// Headers are already sent, so all we can do is to cut the response short
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+			"id":    file.ID,
+		}).Error("Unable to stream file's payload")
+		return
+	}
+	io.WriteString(w, `}}`)
 }
 
 // FilesUpdateRequest is the payload passed to PUT /files/:id
@@ -222,32 +339,62 @@ func FilesUpdate(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Only the changed fields are written, the file was fetched without its
+	// inline payload
+	changes := map[string]interface{}{}
+
+	// New payload replaces the one in the blob store
+	oldBlob := ""
 	if input.Data != "" {
-		file.Data = input.Data
+		oldBlob = file.Blob
+
+		if err := env.Files.StorePayload(file, func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader(input.Data)), nil
+		}); err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+				"id":    c.URLParams["id"],
+			}).Error("Unable to store file's payload")
+
+			utils.JSONResponse(w, 500, &FilesUpdateResponse{
+				Success: false,
+				Message: "Internal error (code FI/UP/02)",
+			})
+			return
+		}
+
+		changes["hash"] = file.Hash
+		changes["size"] = file.Size
+		changes["blob"] = file.Blob
 	}
 
 	if input.Name != "" {
 		file.Name = input.Name
+		changes["name"] = file.Name
 	}
 
 	if input.Encoding != "" {
 		file.Encoding = input.Encoding
+		changes["encoding"] = file.Encoding
 	}
 
 	if input.VersionMajor != nil {
 		file.VersionMajor = *input.VersionMajor
+		changes["version_major"] = file.VersionMajor
 	}
 
 	if input.VersionMinor != nil {
 		file.VersionMinor = *input.VersionMinor
+		changes["version_minor"] = file.VersionMinor
 	}
 
 	if input.PGPFingerprints != nil {
 		file.PGPFingerprints = input.PGPFingerprints
+		changes["pgp_fingerprints"] = file.PGPFingerprints
 	}
 
 	// Perform the update
-	err = env.Files.UpdateID(c.URLParams["id"], file)
+	err = env.Files.UpdateID(c.URLParams["id"], changes)
 	if err != nil {
 		env.Log.WithFields(logrus.Fields{
 			"error": err.Error(),
@@ -261,6 +408,18 @@ func FilesUpdate(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if oldBlob != "" && oldBlob != file.Blob {
+		if err := env.Files.ReleasePayload(oldBlob); err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+				"id":    c.URLParams["id"],
+			}).Error("Unable to delete file's old payload")
+		}
+	}
+
+	// Notify other sessions
+	publish(session.Owner, "file.update", file.ID, file)
+
 	// Write the file to the response
 	utils.JSONResponse(w, 200, &FilesUpdateResponse{
 		Success: true,
@@ -313,6 +472,9 @@ func FilesDelete(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Notify other sessions
+	publish(session.Owner, "file.delete", file.ID, nil)
+
 	// Write the file to the response
 	utils.JSONResponse(w, 200, &FilesDeleteResponse{
 		Success: true,
@@ -0,0 +1,373 @@
+package routes
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/zenazn/goji/web"
+
+	"github.com/lavab/api/env"
+	"github.com/lavab/api/models"
+	"github.com/lavab/api/utils"
+)
+
+const (
+	// maxInvitesPerRequest limits how many invites can be created at once
+	maxInvitesPerRequest = 50
+
+	// inviteReservationTTL is how long invites being created are reserved if
+	// the reservation isn't released, eg. when the API crashes
+	inviteReservationTTL = time.Minute
+)
+
+// validInviteCode checks whether the token can be used to set up the account.
+// Invites can be redeemed by anyone but their creator, verification codes only
+// by the account they were created for.
+func validInviteCode(token *models.Token, account *models.Account) bool {
+	switch token.Type {
+	case "invite":
+		return token.Owner != account.ID
+	case "verify":
+		return token.Owner == account.ID
+	}
+
+	return false
+}
+
+// inviteQuota returns how many more invites the account can create. Superusers
+// aren't limited.
+func inviteQuota(account *models.Account) (remaining int, unlimited bool, err error) {
+	switch account.Type {
+	case "superuser":
+		return 0, true, nil
+	case "beta":
+	default:
+		return 0, false, nil
+	}
+
+	outstanding, err := env.Tokens.GetOwnedBy(account.ID, "invite")
+	if err != nil {
+		return 0, false, err
+	}
+
+	redeemed, err := env.Tokens.GetOwnedBy(account.ID, ".invite")
+	if err != nil {
+		return 0, false, err
+	}
+
+	// Expired invites don't count towards the quota
+	used := len(redeemed)
+	for _, invite := range outstanding {
+		if !invite.Expired() {
+			used++
+		}
+	}
+
+	if used >= env.Config.InviteQuota {
+		return 0, false, nil
+	}
+
+	return env.Config.InviteQuota - used, false, nil
+}
+
+func inviteReservationKey(id string) string {
+	return "invites:reserved:" + id
+}
+
+// reserveInvites atomically reserves count invites of the account's quota.
+// Reservations are counted in the cache until releaseInvites is called, so
+// concurrent requests can't create more invites than the quota allows.
+func reserveInvites(account *models.Account, count int) (bool, error) {
+	reserved, err := env.Cache.Increment(inviteReservationKey(account.ID), int64(count), inviteReservationTTL)
+	if err != nil {
+		return false, err
+	}
+
+	// Invites created by others are counted after they were reserved, so
+	// the quota can only be overestimated
+	remaining, unlimited, err := inviteQuota(account)
+	if err != nil || (!unlimited && reserved > int64(remaining)) {
+		if err := releaseInvites(account, count); err != nil {
+			return false, err
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+// releaseInvites releases a reservation made by reserveInvites
+func releaseInvites(account *models.Account, count int) error {
+	_, err := env.Cache.Increment(inviteReservationKey(account.ID), -int64(count), inviteReservationTTL)
+	return err
+}
+
+// Invite is an invite code created by the account
+type Invite struct {
+	ID          string    `json:"id"`
+	Status      string    `json:"status"`
+	RedeemedBy  string    `json:"redeemed_by,omitempty"`
+	DateCreated time.Time `json:"date_created"`
+	ExpiryDate  time.Time `json:"expiry_date"`
+}
+
+// makeInvite converts a token into an Invite
+func makeInvite(token *models.Token) *Invite {
+	invite := &Invite{
+		ID:          token.ID,
+		Status:      "outstanding",
+		RedeemedBy:  token.RedeemedBy,
+		DateCreated: token.DateCreated,
+		ExpiryDate:  token.ExpiryDate,
+	}
+
+	if token.Type == ".invite" {
+		invite.Status = "redeemed"
+	} else if token.Expired() {
+		invite.Status = "expired"
+	}
+
+	return invite
+}
+
+// InvitesListResponse contains the result of the InvitesList request.
+type InvitesListResponse struct {
+	Success   bool      `json:"success"`
+	Message   string    `json:"message,omitempty"`
+	Invites   []*Invite `json:"invites,omitempty"`
+	Remaining int       `json:"remaining"`
+	Unlimited bool      `json:"unlimited,omitempty"`
+}
+
+// InvitesList returns invites created by the current user
+func InvitesList(c web.C, w http.ResponseWriter, r *http.Request) {
+	session := c.Env["token"].(*models.Token)
+
+	user, err := env.Accounts.GetAccount(session.Owner)
+	if err != nil {
+		utils.JSONResponse(w, 500, &InvitesListResponse{
+			Success: false,
+			Message: "Unable to resolve the account",
+		})
+		return
+	}
+
+	remaining, unlimited, err := inviteQuota(user)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to count invites")
+
+		utils.JSONResponse(w, 500, &InvitesListResponse{
+			Success: false,
+			Message: "Internal error (code IN/LI/01)",
+		})
+		return
+	}
+
+	invites := []*Invite{}
+	for _, kind := range []string{"invite", ".invite"} {
+		tokens, err := env.Tokens.GetOwnedBy(user.ID, kind)
+		if err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("Unable to list invites")
+
+			utils.JSONResponse(w, 500, &InvitesListResponse{
+				Success: false,
+				Message: "Internal error (code IN/LI/02)",
+			})
+			return
+		}
+
+		for _, token := range tokens {
+			invites = append(invites, makeInvite(token))
+		}
+	}
+
+	utils.JSONResponse(w, 200, &InvitesListResponse{
+		Success:   true,
+		Invites:   invites,
+		Remaining: remaining,
+		Unlimited: unlimited,
+	})
+}
+
+// InvitesCreateRequest contains the input for the InvitesCreate endpoint.
+type InvitesCreateRequest struct {
+	Count int `json:"count" schema:"count"`
+
+	// ExpiresIn is invites' lifetime in hours
+	ExpiresIn int `json:"expires_in" schema:"expires_in"`
+}
+
+// InvitesCreateResponse contains the result of the InvitesCreate request.
+type InvitesCreateResponse struct {
+	Success bool      `json:"success"`
+	Message string    `json:"message"`
+	Invites []*Invite `json:"invites,omitempty"`
+}
+
+// InvitesCreate creates invite codes. Only superuser and beta accounts can
+// invite other users.
+func InvitesCreate(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Decode the request
+	var input InvitesCreateRequest
+	err := utils.ParseRequest(r, &input)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("Unable to decode a request")
+
+		utils.JSONResponse(w, 400, &InvitesCreateResponse{
+			Success: false,
+			Message: "Invalid input format",
+		})
+		return
+	}
+
+	if input.Count == 0 {
+		input.Count = 1
+	}
+
+	if input.Count < 0 || input.Count > maxInvitesPerRequest || input.ExpiresIn < 0 {
+		utils.JSONResponse(w, 400, &InvitesCreateResponse{
+			Success: false,
+			Message: "Invalid invite count or expiry time",
+		})
+		return
+	}
+
+	session := c.Env["token"].(*models.Token)
+
+	user, err := env.Accounts.GetAccount(session.Owner)
+	if err != nil {
+		utils.JSONResponse(w, 500, &InvitesCreateResponse{
+			Success: false,
+			Message: "Unable to resolve the account",
+		})
+		return
+	}
+
+	if user.Type != "superuser" && user.Type != "beta" {
+		utils.JSONResponse(w, 403, &InvitesCreateResponse{
+			Success: false,
+			Message: "Your account can't invite other users",
+		})
+		return
+	}
+
+	reserved, err := reserveInvites(user, input.Count)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to count invites")
+
+		utils.JSONResponse(w, 500, &InvitesCreateResponse{
+			Success: false,
+			Message: "Internal error (code IN/CR/01)",
+		})
+		return
+	}
+
+	if !reserved {
+		utils.JSONResponse(w, 403, &InvitesCreateResponse{
+			Success: false,
+			Message: "Invite quota exceeded",
+		})
+		return
+	}
+
+	defer func() {
+		if err := releaseInvites(user, input.Count); err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("Unable to release reserved invites")
+		}
+	}()
+
+	invites := []*Invite{}
+	for i := 0; i < input.Count; i++ {
+		token := models.MakeInviteToken(user.ID)
+		if input.ExpiresIn > 0 {
+			token.ExpireAfterNHours(input.ExpiresIn)
+		}
+
+		if err := env.Tokens.Insert(&token); err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("Unable to insert an invite")
+
+			// Invites are created all at once or not at all
+			for _, invite := range invites {
+				if err := env.Tokens.DeleteID(invite.ID); err != nil {
+					env.Log.WithFields(logrus.Fields{
+						"error": err.Error(),
+						"id":    invite.ID,
+					}).Error("Unable to delete an invite")
+				}
+			}
+
+			utils.JSONResponse(w, 500, &InvitesCreateResponse{
+				Success: false,
+				Message: "Internal error (code IN/CR/02)",
+			})
+			return
+		}
+
+		invites = append(invites, makeInvite(&token))
+	}
+
+	utils.JSONResponse(w, 201, &InvitesCreateResponse{
+		Success: true,
+		Message: "Invites created",
+		Invites: invites,
+	})
+}
+
+// InvitesDeleteResponse contains the result of the InvitesDelete request.
+type InvitesDeleteResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+// InvitesDelete revokes an outstanding invite
+func InvitesDelete(c web.C, w http.ResponseWriter, r *http.Request) {
+	session := c.Env["token"].(*models.Token)
+
+	token, err := env.Tokens.GetToken(c.URLParams["id"])
+	if err != nil || token.Owner != session.Owner || (token.Type != "invite" && token.Type != ".invite") {
+		utils.JSONResponse(w, 404, &InvitesDeleteResponse{
+			Success: false,
+			Message: "Invite not found",
+		})
+		return
+	}
+
+	if token.Type == ".invite" {
+		utils.JSONResponse(w, 409, &InvitesDeleteResponse{
+			Success: false,
+			Message: "Invite has already been redeemed",
+		})
+		return
+	}
+
+	if err := env.Tokens.DeleteID(token.ID); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to delete an invite")
+
+		utils.JSONResponse(w, 500, &InvitesDeleteResponse{
+			Success: false,
+			Message: "Internal error (code IN/DE/01)",
+		})
+		return
+	}
+
+	utils.JSONResponse(w, 200, &InvitesDeleteResponse{
+		Success: true,
+		Message: "Invite revoked",
+	})
+}
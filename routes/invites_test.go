@@ -0,0 +1,113 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/zenazn/goji/web"
+
+	"github.com/lavab/api/cache"
+	"github.com/lavab/api/db"
+	"github.com/lavab/api/env"
+	"github.com/lavab/api/models"
+)
+
+// createInvites calls InvitesCreate on behalf of the account
+func createInvites(t *testing.T, account *models.Account, count int) (int, *InvitesCreateResponse) {
+	r, err := http.NewRequest("POST", "/invites", strings.NewReader(`{"count":`+strconv.Itoa(count)+`}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	c := web.C{
+		Env: map[string]interface{}{
+			"token": &models.Token{Resource: models.Resource{Owner: account.ID}},
+		},
+	}
+
+	w := httptest.NewRecorder()
+	InvitesCreate(c, w, r)
+
+	var response InvitesCreateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	return w.Code, &response
+}
+
+func TestInvitesCreateQuota(t *testing.T) {
+	session := connectRethink(t, "accounts", "tokens")
+
+	env.Config = &env.Flags{
+		InviteQuota: 5,
+	}
+	env.Log = logrus.New()
+	env.Cache = cache.NewMemoryCache(&cache.MemoryCacheOpts{})
+
+	env.Tokens = &db.TokensTable{
+		RethinkCRUD: db.NewCRUDTable(session, "test", "tokens"),
+		Cache:       env.Cache,
+	}
+	env.Accounts = &db.AccountsTable{
+		RethinkCRUD: db.NewCRUDTable(session, "test", "accounts"),
+		Tokens:      env.Tokens,
+	}
+
+	account := &models.Account{
+		Resource: models.MakeResource("", "inviter"),
+		Type:     "beta",
+	}
+	account.Owner = account.ID
+	if err := env.Accounts.Insert(account); err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent requests can't exceed the quota together
+	var (
+		wg      sync.WaitGroup
+		lock    sync.Mutex
+		created int
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			code, response := createInvites(t, account, 2)
+			if code == 201 {
+				lock.Lock()
+				created += len(response.Invites)
+				lock.Unlock()
+			} else if code != 403 {
+				t.Errorf("unexpected response: %d %s", code, response.Message)
+			}
+		}()
+	}
+	wg.Wait()
+
+	invites, err := env.Tokens.GetOwnedBy(account.ID, "invite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created > env.Config.InviteQuota || len(invites) != created {
+		t.Fatalf("%d invites were created, %d stored", created, len(invites))
+	}
+
+	// Reservations are released once the invites are created
+	if remaining := env.Config.InviteQuota - created; remaining > 0 {
+		if code, response := createInvites(t, account, remaining); code != 201 {
+			t.Fatalf("remaining invites weren't created: %d %s", code, response.Message)
+		}
+	}
+	if code, _ := createInvites(t, account, 1); code != 403 {
+		t.Fatalf("invite over the quota: %d", code)
+	}
+}
@@ -35,9 +35,12 @@ func KeysList(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user = utils.RemoveDots(utils.NormalizeUsername(user))
+	// Usernames without a domain belong to the service's domain
+	if !strings.Contains(user, "@") {
+		user += "@" + env.Config.EmailDomain
+	}
 
-	address, err := env.Addresses.GetAddress(user)
+	address, _, err := resolveAddress(user)
 	if err != nil {
 		utils.JSONResponse(w, 409, &KeysListResponse{
 			Success: false,
@@ -172,6 +175,11 @@ func KeysCreate(c web.C, w http.ResponseWriter, r *http.Request) {
 	// Update id as we can't do it directly during allocation
 	key.ID = id
 
+	// Restore the score if the key was voted on before
+	if votes, err := env.Votes.GetKeyVotes(id); err == nil {
+		key.Reliability = votes.Reliability()
+	}
+
 	// Try to insert it into the database
 	if err := env.Keys.Insert(key); err != nil {
 		utils.JSONResponse(w, 500, &KeysCreateResponse{
@@ -185,6 +193,13 @@ func KeysCreate(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	audit(c, r, "key.create", session.Owner, session.Owner, map[string]interface{}{
+		"fingerprint": key.ID,
+	})
+
+	// Notify other sessions
+	publish(session.Owner, "key.create", key.ID, key)
+
 	// Return the inserted key
 	utils.JSONResponse(w, 201, &KeysCreateResponse{
 		Success: true,
@@ -213,17 +228,12 @@ func KeysGet(c web.C, w http.ResponseWriter, r *http.Request) {
 	// Check if ID is an email or a fingerprint.
 	// Fingerprints can't contain @, right?
 	if strings.Contains(id, "@") {
-		// Who cares about the second part? I don't!
-		username := strings.Split(id, "@")[0]
-
-		username = utils.RemoveDots(utils.NormalizeUsername(username))
-
-		// Resolve address
-		address, err := env.Addresses.GetAddress(username)
+		// Resolve address, custom domains included
+		address, _, err := resolveAddress(id)
 		if err != nil {
 			env.Log.WithFields(logrus.Fields{
 				"error": err.Error(),
-				"name":  username,
+				"name":  id,
 			}).Warn("Unable to fetch the requested address from the database")
 
 			utils.JSONResponse(w, 404, &KeysGetResponse{
@@ -238,7 +248,7 @@ func KeysGet(c web.C, w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			env.Log.WithFields(logrus.Fields{
 				"error": err.Error(),
-				"name":  username,
+				"name":  id,
 			}).Warn("Unable to fetch the requested account from the database")
 
 			utils.JSONResponse(w, 404, &KeysGetResponse{
@@ -316,16 +326,91 @@ func KeysGet(c web.C, w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// KeysVoteRequest contains the input for the KeysVote endpoint.
+type KeysVoteRequest struct {
+	// Vote is 1 if the key belongs to its owner, -1 if it doesn't and 0 to retract the vote
+	Vote int `json:"vote" schema:"vote"`
+}
+
 // KeysVoteResponse contains the result of the KeysVote request.
 type KeysVoteResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+	Success     bool   `json:"success"`
+	Message     string `json:"message"`
+	Reliability int    `json:"reliability"`
 }
 
-// KeysVote does *something* - TODO
-func KeysVote(w http.ResponseWriter, r *http.Request) {
-	utils.JSONResponse(w, 501, &KeysVoteResponse{
-		Success: false,
-		Message: "Sorry, not implemented yet",
+// KeysVote casts a vote for or against the key being owned by its account
+func KeysVote(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Decode the request
+	var input KeysVoteRequest
+	err := utils.ParseRequest(r, &input)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("Unable to decode a request")
+
+		utils.JSONResponse(w, 400, &KeysVoteResponse{
+			Success: false,
+			Message: "Invalid input format",
+		})
+		return
+	}
+
+	// Ensure that the vote is valid
+	if input.Vote < -1 || input.Vote > 1 {
+		utils.JSONResponse(w, 400, &KeysVoteResponse{
+			Success: false,
+			Message: "Invalid vote",
+		})
+		return
+	}
+
+	// Get the session
+	session := c.Env["token"].(*models.Token)
+
+	// Fetch the requested key from the database
+	key, err := env.Keys.FindByFingerprint(c.URLParams["id"])
+	if err != nil {
+		utils.JSONResponse(w, 404, &KeysVoteResponse{
+			Success: false,
+			Message: "Requested key does not exist on our server",
+		})
+		return
+	}
+
+	// Owners can't vote on their own keys
+	if key.Owner == session.Owner {
+		utils.JSONResponse(w, 403, &KeysVoteResponse{
+			Success: false,
+			Message: "You can't vote on your own key",
+		})
+		return
+	}
+
+	// Replace account's vote
+	votes, err := env.Votes.Vote(key.ID, session.Owner, input.Vote)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+			"key":   key.ID,
+		}).Error("Unable to cast a vote")
+
+		utils.JSONResponse(w, 500, &KeysVoteResponse{
+			Success: false,
+			Message: "Internal server error - KE/VO/01",
+		})
+		return
+	}
+
+	// Reliability is derived from the stored votes whenever keys are read
+	key.Reliability = votes.Reliability()
+
+	// Notify the key's owner
+	publish(key.Owner, "key.update", key.ID, key)
+
+	utils.JSONResponse(w, 200, &KeysVoteResponse{
+		Success:     true,
+		Message:     "Your vote has been saved",
+		Reliability: key.Reliability,
 	})
 }
@@ -0,0 +1,284 @@
+package routes
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/zenazn/goji/web"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+
+	"github.com/lavab/api/env"
+	"github.com/lavab/api/models"
+	"github.com/lavab/api/utils"
+)
+
+// errInvalidSearch is returned by hkpSearch for searches it can't handle
+var errInvalidSearch = errors.New("Invalid search")
+
+// addressKeys returns the keys published for an address. If the owner has set
+// a default key, it's the only one returned.
+func addressKeys(address *models.Address) ([]*models.Key, error) {
+	account, err := env.Accounts.GetAccount(address.Owner)
+	if err != nil {
+		return nil, err
+	}
+
+	if account.PublicKey != "" {
+		if key, err := env.Keys.FindByFingerprint(account.PublicKey); err == nil {
+			return []*models.Key{key}, nil
+		}
+	}
+
+	return env.Keys.FindByOwner(account.ID)
+}
+
+// hkpSearch finds keys matching an HKP search, which is either a hex key ID,
+// a fingerprint or an email address. Usernames without a domain belong to the
+// service's domain.
+func hkpSearch(search string) ([]*models.Key, error) {
+	search = strings.TrimSpace(search)
+
+	if strings.HasPrefix(search, "0x") || strings.HasPrefix(search, "0X") {
+		id := strings.ToUpper(search[2:])
+		switch len(id) {
+		case 8:
+			return env.Keys.FindByKeyIDShort(id)
+		case 16:
+			return env.Keys.FindByKeyID(id)
+		case 40:
+			key, err := env.Keys.FindByFingerprint(strings.ToLower(id))
+			if err != nil {
+				return nil, err
+			}
+
+			return []*models.Key{key}, nil
+		}
+
+		return nil, errInvalidSearch
+	}
+
+	// Accept "Name <user@domain>" as well
+	if start := strings.Index(search, "<"); start != -1 {
+		if end := strings.LastIndex(search, ">"); end > start {
+			search = search[start+1 : end]
+		}
+	}
+
+	if search == "" {
+		return nil, errInvalidSearch
+	}
+
+	if !strings.Contains(search, "@") {
+		search += "@" + env.Config.EmailDomain
+	}
+
+	address, _, err := resolveAddress(search)
+	if err != nil {
+		return nil, err
+	}
+
+	return addressKeys(address)
+}
+
+// hkpEscape escapes a string for the machine-readable HKP output
+func hkpEscape(input string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(input); i++ {
+		if ch := input[i]; ch < 0x20 || ch > 0x7e || ch == ':' || ch == '%' {
+			fmt.Fprintf(&buf, "%%%02X", ch)
+		} else {
+			buf.WriteByte(ch)
+		}
+	}
+
+	return buf.String()
+}
+
+// hkpIndex writes the machine-readable HKP index of the keys
+func hkpIndex(w io.Writer, keys []*models.Key) {
+	var entities []*openpgp.Entity
+	for _, key := range keys {
+		list, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key.Key))
+		if err != nil || len(list) == 0 {
+			continue
+		}
+
+		entities = append(entities, list[0])
+	}
+
+	fmt.Fprintf(w, "info:1:%d\n", len(entities))
+
+	now := time.Now()
+	for _, entity := range entities {
+		var (
+			primary = entity.PrimaryKey
+			expiry  string
+			flags   string
+			names   []string
+		)
+
+		for name, identity := range entity.Identities {
+			names = append(names, name)
+
+			// Key lifetime is counted from the creation of the key
+			if sig := identity.SelfSignature; sig != nil && sig.KeyLifetimeSecs != nil && *sig.KeyLifetimeSecs > 0 {
+				date := primary.CreationTime.Add(time.Duration(*sig.KeyLifetimeSecs) * time.Second)
+				expiry = fmt.Sprintf("%d", date.Unix())
+				if now.After(date) {
+					flags = "e"
+				}
+			}
+		}
+
+		if len(entity.Revocations) > 0 {
+			flags = "r"
+		}
+
+		bitLength, _ := primary.BitLength()
+		fmt.Fprintf(
+			w,
+			"pub:%X:%d:%d:%d:%s:%s\n",
+			primary.Fingerprint[:],
+			primary.PubKeyAlgo,
+			bitLength,
+			primary.CreationTime.Unix(),
+			expiry,
+			flags,
+		)
+
+		sort.Strings(names)
+		for _, name := range names {
+			created := ""
+			if sig := entity.Identities[name].SelfSignature; sig != nil {
+				created = fmt.Sprintf("%d", sig.CreationTime.Unix())
+			}
+
+			fmt.Fprintf(w, "uid:%s:%s::\n", hkpEscape(name), created)
+		}
+	}
+}
+
+// PKSLookup implements the lookup of the HKP keyserver protocol, so that
+// OpenPGP clients can fetch keys from the API. Indexes are always returned in
+// the machine-readable format.
+func PKSLookup(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	op := query.Get("op")
+	if op != "get" && op != "index" && op != "vindex" {
+		http.Error(w, "Unsupported operation", 501)
+		return
+	}
+
+	keys, err := hkpSearch(query.Get("search"))
+	if err == errInvalidSearch {
+		http.Error(w, "Invalid search", 400)
+		return
+	}
+
+	if err != nil || len(keys) == 0 {
+		http.Error(w, "No keys found", 404)
+		return
+	}
+
+	if op == "get" {
+		w.Header().Set("Content-Type", "application/pgp-keys")
+		for _, key := range keys {
+			io.WriteString(w, key.Key)
+			if !strings.HasSuffix(key.Key, "\n") {
+				io.WriteString(w, "\n")
+			}
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	hkpIndex(w, keys)
+}
+
+// WKDLookup serves keys over the Web Key Directory. The advanced method passes
+// the domain in the URL, the direct one in the Host header - requests sent to
+// hosts that aren't a verified domain, eg. the API's, are handled as ones for
+// the service's domain. Hashes can't be reversed, so the local part has to be
+// passed in the "l" parameter.
+func WKDLookup(c web.C, w http.ResponseWriter, r *http.Request) {
+	domain := strings.ToLower(c.URLParams["domain"])
+	if domain == "" {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+
+		domain = strings.ToLower(host)
+		if _, err := env.Domains.GetVerified(domain); err != nil {
+			domain = env.Config.EmailDomain
+		}
+	}
+
+	local := r.URL.Query().Get("l")
+	if local == "" || utils.WKDHash(local) != c.URLParams["hash"] {
+		http.Error(w, "Key not found", 404)
+		return
+	}
+
+	address, _, err := resolveAddress(local + "@" + domain)
+	if err != nil {
+		http.Error(w, "Key not found", 404)
+		return
+	}
+
+	keys, err := addressKeys(address)
+	if err != nil || len(keys) == 0 {
+		http.Error(w, "Key not found", 404)
+		return
+	}
+
+	// WKD serves the binary form of the keys
+	var buf bytes.Buffer
+	for _, key := range keys {
+		block, err := armor.Decode(strings.NewReader(key.Key))
+		if err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+				"key":   key.ID,
+			}).Warn("Unable to decode an armored key")
+			continue
+		}
+
+		body, err := ioutil.ReadAll(block.Body)
+		if err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+				"key":   key.ID,
+			}).Warn("Unable to decode an armored key")
+			continue
+		}
+
+		buf.Write(body)
+	}
+
+	if buf.Len() == 0 {
+		http.Error(w, "Key not found", 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(buf.Bytes())
+}
+
+// WKDPolicy serves the Web Key Directory policy file, which marks the
+// directory as available. The API has no special policies, so it's empty.
+func WKDPolicy(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(nil)
+}
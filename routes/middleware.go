@@ -3,6 +3,7 @@ package routes
 import (
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/zenazn/goji/web"
@@ -11,6 +12,9 @@ import (
 	"github.com/lavab/api/utils"
 )
 
+// sessionTouchInterval limits how often the last use of a token is saved
+const sessionTouchInterval = time.Minute
+
 // AuthMiddlewareResponse is the response sent by the middleware if user is not logged in
 type AuthMiddlewareResponse struct {
 	Success bool   `json:"success"`
@@ -42,6 +46,14 @@ func AuthMiddleware(c *web.C, h http.Handler) http.Handler {
 
 		// Get the token from the database
 		token, err := env.Tokens.GetToken(headerParts[1])
+		if err == nil && token.Type != "auth" && token.Type != "api" {
+			// Refresh and invite tokens can't be used to authenticate
+			utils.JSONResponse(w, 401, &AuthMiddlewareResponse{
+				Success: false,
+				Message: "Invalid authorization token",
+			})
+			return
+		}
 		if err != nil {
 			env.Log.WithFields(logrus.Fields{
 				"error": err.Error(),
@@ -64,6 +76,42 @@ func AuthMiddleware(c *web.C, h http.Handler) http.Handler {
 			return
 		}
 
+		// API tokens are limited to their scopes and addresses
+		if token.Type == "api" {
+			if !token.AllowsIP(utils.RemoteIP(r)) {
+				utils.JSONResponse(w, 403, &AuthMiddlewareResponse{
+					Success: false,
+					Message: "Token can't be used from this address",
+				})
+				return
+			}
+
+			scope, ok := Scopes.Match(r)
+			if !ok {
+				utils.JSONResponse(w, 403, &AuthMiddlewareResponse{
+					Success: false,
+					Message: "This route can't be accessed using API tokens",
+				})
+				return
+			}
+
+			if !token.HasScope(scope) {
+				utils.JSONResponse(w, 403, &AuthMiddlewareResponse{
+					Success: false,
+					Message: "Token is missing the " + scope + " scope",
+				})
+				return
+			}
+		}
+
+		// Record the last use of the session
+		if err := env.Tokens.Touch(token, utils.RemoteIP(r), r.UserAgent(), sessionTouchInterval); err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+				"id":    token.ID,
+			}).Warn("Unable to update the last use of a token")
+		}
+
 		// Continue to the next middleware/route
 		c.Env["token"] = token
 		h.ServeHTTP(w, r)
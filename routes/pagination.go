@@ -0,0 +1,148 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lavab/api/db"
+)
+
+const (
+	// defaultPageLimit is the page size used by cursor pagination if no limit was passed
+	defaultPageLimit = 50
+
+	// maxPageLimit is the largest page that can be requested using a cursor
+	maxPageLimit = 1000
+)
+
+// listRequest contains the pagination GET parameters of list endpoints:
+//
+//	sort - split by commas, prefixes: - is desc, + is asc
+//	offset, limit - for pagination
+//	cursor - switches to cursor pagination, empty on the first page and
+//	         next_cursor of the previous page later on
+type listRequest struct {
+	Sort   []string
+	Offset int
+	Limit  int
+
+	// Paginated is true if offset or limit was passed
+	Paginated bool
+
+	// Page is set if cursor pagination was requested
+	Page *db.PageOpts
+}
+
+// parseListRequest parses the pagination parameters of a list request
+func parseListRequest(r *http.Request) (*listRequest, error) {
+	var (
+		query  = r.URL.Query()
+		result = &listRequest{}
+		err    error
+	)
+
+	if offset := query.Get("offset"); offset != "" {
+		result.Offset, err = strconv.Atoi(offset)
+		if err != nil || result.Offset < 0 {
+			return nil, errors.New("Invalid offset")
+		}
+		result.Paginated = true
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		result.Limit, err = strconv.Atoi(limit)
+		if err != nil || result.Limit < 0 {
+			return nil, errors.New("Invalid limit")
+		}
+		result.Paginated = true
+	}
+
+	if sort := query.Get("sort"); sort != "" {
+		for _, field := range strings.Split(sort, ",") {
+			if field != "" {
+				result.Sort = append(result.Sort, field)
+			}
+		}
+	}
+
+	if _, ok := query["cursor"]; !ok {
+		return result, nil
+	}
+
+	// Cursor pagination
+	if result.Offset != 0 {
+		return nil, errors.New("Offset can't be used together with a cursor")
+	}
+
+	page := &db.PageOpts{
+		Field: "date_created",
+		Desc:  true,
+		Limit: result.Limit,
+	}
+
+	if page.Limit == 0 {
+		page.Limit = defaultPageLimit
+	}
+	if page.Limit > maxPageLimit {
+		page.Limit = maxPageLimit
+	}
+
+	if len(result.Sort) > 1 {
+		return nil, errors.New("Cursor pagination supports sorting by only one field")
+	}
+
+	if len(result.Sort) == 1 {
+		field := result.Sort[0]
+		page.Desc = field[0] == '-'
+		page.Field = strings.TrimLeft(field, "-+ ")
+
+		if !db.IsPageField(page.Field) {
+			return nil, errors.New("Cursor pagination supports sorting only by date_created or date_modified")
+		}
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		page.Cursor, err = db.DecodeCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+
+		// Order is stored in the cursor, so sort may be omitted on the next pages
+		if len(result.Sort) == 0 {
+			page.Field = page.Cursor.Field
+			page.Desc = page.Cursor.Desc
+		} else if page.Field != page.Cursor.Field || page.Desc != page.Cursor.Desc {
+			return nil, errors.New("Sort doesn't match the cursor")
+		}
+	}
+
+	result.Page = page
+	return result, nil
+}
+
+// writeListHeaders sets the X-Total-Count header and a Link header pointing
+// at the next page, if there is one
+func writeListHeaders(w http.ResponseWriter, r *http.Request, input *listRequest, count int, next *db.Cursor) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(count))
+
+	query := r.URL.Query()
+	if input.Page != nil {
+		if next == nil {
+			return
+		}
+
+		query.Set("cursor", next.Encode())
+	} else {
+		if input.Limit == 0 || input.Offset+input.Limit >= count {
+			return
+		}
+
+		query.Set("offset", strconv.Itoa(input.Offset+input.Limit))
+	}
+
+	link := *r.URL
+	link.RawQuery = query.Encode()
+	w.Header().Set("Link", "<"+link.RequestURI()+`>; rel="next"`)
+}
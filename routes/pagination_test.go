@@ -0,0 +1,171 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lavab/api/db"
+)
+
+func listRequestFor(t *testing.T, query string) *http.Request {
+	r, err := http.NewRequest("GET", "/emails?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+func TestParseListRequest(t *testing.T) {
+	cursor := &db.Cursor{
+		Field: "date_modified",
+		Desc:  false,
+		Date:  time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC),
+		ID:    "item",
+	}
+	encoded := url.QueryEscape(cursor.Encode())
+
+	cases := []struct {
+		query     string
+		sort      []string
+		offset    int
+		limit     int
+		paginated bool
+		page      *db.PageOpts
+	}{
+		{"", nil, 0, 0, false, nil},
+		{"sort=-date_created,,name", []string{"-date_created", "name"}, 0, 0, false, nil},
+		{"offset=20&limit=10", nil, 20, 10, true, nil},
+		{"limit=0", nil, 0, 0, true, nil},
+		{
+			"cursor=", nil, 0, 0, false,
+			&db.PageOpts{Field: "date_created", Desc: true, Limit: defaultPageLimit},
+		},
+		{
+			"cursor=&limit=10&sort=%2Bdate_modified", []string{"+date_modified"}, 0, 10, true,
+			&db.PageOpts{Field: "date_modified", Desc: false, Limit: 10},
+		},
+		{
+			"cursor=&limit=100000&sort=-date_created", []string{"-date_created"}, 0, 100000, true,
+			&db.PageOpts{Field: "date_created", Desc: true, Limit: maxPageLimit},
+		},
+		{
+			"cursor=&offset=0", nil, 0, 0, true,
+			&db.PageOpts{Field: "date_created", Desc: true, Limit: defaultPageLimit},
+		},
+		{
+			// Order of the next pages is stored in the cursor
+			"cursor=" + encoded, nil, 0, 0, false,
+			&db.PageOpts{Field: "date_modified", Desc: false, Limit: defaultPageLimit, Cursor: cursor},
+		},
+		{
+			"cursor=" + encoded + "&sort=date_modified", []string{"date_modified"}, 0, 0, false,
+			&db.PageOpts{Field: "date_modified", Desc: false, Limit: defaultPageLimit, Cursor: cursor},
+		},
+	}
+
+	for _, test := range cases {
+		input, err := parseListRequest(listRequestFor(t, test.query))
+		if err != nil {
+			t.Fatalf("%q: %v", test.query, err)
+		}
+
+		if !reflect.DeepEqual(input.Sort, test.sort) || input.Offset != test.offset ||
+			input.Limit != test.limit || input.Paginated != test.paginated {
+			t.Fatalf("%q: invalid request %+v", test.query, input)
+		}
+
+		if test.page == nil {
+			if input.Page != nil {
+				t.Fatalf("%q: unexpected page %+v", test.query, input.Page)
+			}
+			continue
+		}
+
+		if input.Page == nil || input.Page.Field != test.page.Field || input.Page.Desc != test.page.Desc ||
+			input.Page.Limit != test.page.Limit || (input.Page.Cursor == nil) != (test.page.Cursor == nil) {
+			t.Fatalf("%q: page %+v, expected %+v", test.query, input.Page, test.page)
+		}
+		if test.page.Cursor != nil && input.Page.Cursor.ID != test.page.Cursor.ID {
+			t.Fatalf("%q: invalid cursor %+v", test.query, input.Page.Cursor)
+		}
+	}
+
+	for _, query := range []string{
+		"offset=-1",
+		"offset=a",
+		"limit=-1",
+		"limit=1.5",
+		"cursor=&offset=10",
+		"cursor=&sort=name",
+		"cursor=&sort=date_created,date_modified",
+		"cursor=garbage",
+		"cursor=" + encoded + "&sort=-date_modified",
+		"cursor=" + encoded + "&sort=date_created",
+	} {
+		if input, err := parseListRequest(listRequestFor(t, query)); err == nil {
+			t.Fatalf("%q: invalid request was parsed into %+v", query, input)
+		}
+	}
+}
+
+func TestWriteListHeaders(t *testing.T) {
+	next := &db.Cursor{
+		Field: "date_created",
+		Desc:  true,
+		Date:  time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC),
+		ID:    "item",
+	}
+
+	cases := []struct {
+		query string
+		count int
+		next  *db.Cursor
+		link  url.Values
+	}{
+		// Unpaginated and last offset pages don't link anywhere
+		{"sort=name", 10, nil, nil},
+		{"offset=5&limit=5", 10, nil, nil},
+		{"offset=8&limit=5", 10, nil, nil},
+		{"offset=0&limit=5&sort=name", 10, nil, url.Values{"offset": {"5"}, "limit": {"5"}, "sort": {"name"}}},
+		{"limit=3", 10, nil, url.Values{"offset": {"3"}, "limit": {"3"}}},
+
+		// Cursor pages link only if the page wasn't the last one
+		{"cursor=&limit=5", 10, nil, nil},
+		{"cursor=&limit=5", 10, next, url.Values{"cursor": {next.Encode()}, "limit": {"5"}}},
+	}
+
+	for _, test := range cases {
+		r := listRequestFor(t, test.query)
+
+		input, err := parseListRequest(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		writeListHeaders(w, r, input, test.count, test.next)
+
+		if count := w.Header().Get("X-Total-Count"); count != strconv.Itoa(test.count) {
+			t.Fatalf("%q: invalid count %s", test.query, count)
+		}
+
+		link := w.Header().Get("Link")
+		if test.link == nil {
+			if link != "" {
+				t.Fatalf("%q: unexpected link %s", test.query, link)
+			}
+			continue
+		}
+
+		expected := "</emails?" + test.link.Encode() + `>; rel="next"`
+		if link != expected {
+			t.Fatalf("%q: link %s, expected %s", test.query, link, expected)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/zenazn/goji/web"
+
+	"github.com/lavab/api/env"
+	"github.com/lavab/api/models"
+	"github.com/lavab/api/utils"
+)
+
+const (
+	// recoveryTokenDuration is the lifetime of password reset tokens in hours
+	recoveryTokenDuration = 1
+
+	// recoveryInterval limits how often a reset email can be sent to an account
+	recoveryInterval = 5 * time.Minute
+
+	// recoveryFactorAttempts is the number of invalid 2FA tokens that burn a
+	// recovery token
+	recoveryFactorAttempts = 5
+)
+
+// AccountsRecoverRequest contains the input for the AccountsRecover endpoint.
+type AccountsRecoverRequest struct {
+	Username string `json:"username" schema:"username"`
+}
+
+// AccountsRecoverResponse contains the result of the AccountsRecover request.
+type AccountsRecoverResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+// AccountsRecover sends a password reset token to the alternative email
+// address of the account. The response is the same whether the account exists
+// or not.
+func AccountsRecover(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Decode the request
+	var input AccountsRecoverRequest
+	err := utils.ParseRequest(r, &input)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("Unable to decode a request")
+
+		utils.JSONResponse(w, 400, &AccountsRecoverResponse{
+			Success: false,
+			Message: "Invalid input format",
+		})
+		return
+	}
+
+	input.Username = utils.RemoveDots(
+		utils.NormalizeUsername(input.Username),
+	)
+
+	response := &AccountsRecoverResponse{
+		Success: true,
+		Message: "If the account has an alternative email address, a reset link was sent to it",
+	}
+
+	user, err := env.Accounts.FindAccountByName(input.Username)
+	if err != nil || user.AltEmail == "" || user.Status == "registered" ||
+		user.Status == "deleting" || user.Status == "suspended" {
+		utils.JSONResponse(w, 200, response)
+		return
+	}
+
+	// Don't flood the inbox
+	key := "recover:" + user.ID
+	if sent, err := env.Cache.Exists(key); err != nil || sent {
+		utils.JSONResponse(w, 200, response)
+		return
+	}
+
+	token := models.MakeToken(user.ID, "recover", recoveryTokenDuration)
+	if err := env.Tokens.Insert(&token); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to insert a recovery token")
+
+		utils.JSONResponse(w, 500, &AccountsRecoverResponse{
+			Success: false,
+			Message: "Internal error (code AC/RE/01)",
+		})
+		return
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"account":     user.ID,
+		"alt_email":   user.AltEmail,
+		"token":       token.ID,
+		"expiry_date": token.ExpiryDate,
+	})
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to encode a recovery message")
+
+		utils.JSONResponse(w, 500, &AccountsRecoverResponse{
+			Success: false,
+			Message: "Internal error (code AC/RE/02)",
+		})
+		return
+	}
+
+	if err := env.Producer.Publish("hook_recover", data); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to publish a recovery message")
+
+		utils.JSONResponse(w, 500, &AccountsRecoverResponse{
+			Success: false,
+			Message: "Internal error (code AC/RE/03)",
+		})
+		return
+	}
+
+	if err := env.Cache.Set(key, true, recoveryInterval); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to cache a recovery request")
+
+		// DO NOT RETURN!
+	}
+
+	audit(c, r, "password.reset_request", "", user.ID, nil)
+
+	utils.JSONResponse(w, 200, response)
+}
+
+// AccountsRecoverConfirmRequest contains the input for the AccountsRecoverConfirm endpoint.
+type AccountsRecoverConfirmRequest struct {
+	Token       string `json:"token" schema:"token"`
+	NewPassword string `json:"new_password" schema:"new_password"`
+	FactorToken string `json:"factor_token" schema:"factor_token"`
+}
+
+// AccountsRecoverConfirmResponse contains the result of the AccountsRecoverConfirm request.
+type AccountsRecoverConfirmResponse struct {
+	Success         bool   `json:"success"`
+	Message         string `json:"message"`
+	ReimportKeys    bool   `json:"reimport_keys,omitempty"`
+	FactorType      string `json:"factor_type,omitempty"`
+	FactorChallenge string `json:"factor_challenge,omitempty"`
+	RetryAfter      int    `json:"retry_after,omitempty"`
+}
+
+// AccountsRecoverConfirm sets a new password using a token sent by
+// AccountsRecover and logs out all sessions. Private keys are encrypted with
+// the old password on the client, so they have to be imported again.
+func AccountsRecoverConfirm(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Decode the request
+	var input AccountsRecoverConfirmRequest
+	err := utils.ParseRequest(r, &input)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("Unable to decode a request")
+
+		utils.JSONResponse(w, 400, &AccountsRecoverConfirmResponse{
+			Success: false,
+			Message: "Invalid input format",
+		})
+		return
+	}
+
+	token, err := env.Tokens.GetToken(input.Token)
+	if err != nil || token.Type != "recover" || token.Expired() {
+		utils.JSONResponse(w, 403, &AccountsRecoverConfirmResponse{
+			Success: false,
+			Message: "Invalid or expired recovery token",
+		})
+		return
+	}
+
+	user, err := env.Accounts.GetAccount(token.Owner)
+	if err != nil {
+		utils.JSONResponse(w, 403, &AccountsRecoverConfirmResponse{
+			Success: false,
+			Message: "Invalid or expired recovery token",
+		})
+		return
+	}
+
+	if input.NewPassword == "" || env.PasswordBF.TestString(input.NewPassword) {
+		utils.JSONResponse(w, 400, &AccountsRecoverConfirmResponse{
+			Success: false,
+			Message: "Weak new password",
+		})
+		return
+	}
+
+	// The alternative email address doesn't replace the second factor
+	var attempt *loginAttempt
+	if user.FactorType != "" {
+		factor, ok := env.Factors[user.FactorType]
+		if ok {
+			// 2FA tokens are throttled the same way as when logging in
+			if input.FactorToken != "" {
+				var delay time.Duration
+				attempt, delay, err = countLoginAttempt(user.Name, utils.RemoteIP(r))
+				if err != nil {
+					env.Log.WithFields(logrus.Fields{
+						"error": err.Error(),
+					}).Error("Unable to check failed logins")
+
+					utils.JSONResponse(w, 500, &AccountsRecoverConfirmResponse{
+						Success: false,
+						Message: "Internal error (code AC/RC/05)",
+					})
+					return
+				}
+
+				if delay > 0 {
+					seconds := int(delay/time.Second) + 1
+					w.Header().Set("Retry-After", strconv.Itoa(seconds))
+					utils.JSONResponse(w, 429, &AccountsRecoverConfirmResponse{
+						Success:    false,
+						Message:    "Too many failed attempts, try again later",
+						RetryAfter: seconds,
+					})
+					return
+				}
+			}
+
+			verified, challenge, err := verifyFactor(user, factor, input.FactorToken)
+			if err != nil {
+				env.Log.WithFields(logrus.Fields{
+					"error":  err.Error(),
+					"factor": user.FactorType,
+				}).Warn("2FA authentication error")
+
+				utils.JSONResponse(w, 500, &AccountsRecoverConfirmResponse{
+					Success: false,
+					Message: "Internal 2FA error",
+				})
+				return
+			}
+
+			if !verified {
+				message := "Invalid token passed"
+				if input.FactorToken == "" {
+					message = "2FA token was not passed"
+				} else {
+					recordLoginFailure(c, r, "factor.failure", user.Name, user, attempt)
+
+					if burnRecoveryToken(token) {
+						message = "Too many invalid tokens passed, request a new recovery email"
+					}
+				}
+
+				utils.JSONResponse(w, 403, &AccountsRecoverConfirmResponse{
+					Success:         false,
+					Message:         message,
+					FactorType:      user.FactorType,
+					FactorChallenge: challenge,
+				})
+				return
+			}
+		}
+	}
+
+	// Tokens are single-use
+	consumed, err := env.Tokens.Consume(token.ID, "recover")
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to consume a recovery token")
+
+		utils.JSONResponse(w, 500, &AccountsRecoverConfirmResponse{
+			Success: false,
+			Message: "Internal error (code AC/RC/01)",
+		})
+		return
+	}
+
+	if !consumed {
+		utils.JSONResponse(w, 403, &AccountsRecoverConfirmResponse{
+			Success: false,
+			Message: "Invalid or expired recovery token",
+		})
+		return
+	}
+
+	if err := user.SetPassword(input.NewPassword); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to hash a password")
+
+		utils.JSONResponse(w, 500, &AccountsRecoverConfirmResponse{
+			Success: false,
+			Message: "Internal error (code AC/RC/02)",
+		})
+		return
+	}
+
+	user.DateModified = time.Now()
+	if err := env.Accounts.UpdateID(user.ID, user); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to update an account")
+
+		utils.JSONResponse(w, 500, &AccountsRecoverConfirmResponse{
+			Success: false,
+			Message: "Internal error (code AC/RC/03)",
+		})
+		return
+	}
+
+	// Whoever knew the old password must not stay logged in
+	if _, err := env.Tokens.DeleteSessions(user.ID); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to delete sessions")
+
+		utils.JSONResponse(w, 500, &AccountsRecoverConfirmResponse{
+			Success: false,
+			Message: "Internal error (code AC/RC/04)",
+		})
+		return
+	}
+
+	if err := loginSucceeded(user.Name, utils.RemoteIP(r), attempt); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to reset failed logins")
+
+		// DO NOT RETURN!
+	}
+
+	audit(c, r, "password.reset", "", user.ID, nil)
+
+	utils.JSONResponse(w, 200, &AccountsRecoverConfirmResponse{
+		Success:      true,
+		Message:      "Your password has been reset and all sessions were logged out. Your private keys were encrypted with the old password - import them again to read your emails.",
+		ReimportKeys: true,
+	})
+}
+
+// burnRecoveryToken counts an invalid 2FA token passed with the recovery
+// token. It returns true once the recovery token can't be used anymore.
+func burnRecoveryToken(token *models.Token) bool {
+	failures, err := env.Cache.Increment("recover_failures:"+token.ID, 1, token.ExpiryDate.Sub(time.Now()))
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to count invalid 2FA tokens")
+		return false
+	}
+
+	if failures < recoveryFactorAttempts {
+		return false
+	}
+
+	if _, err := env.Tokens.Consume(token.ID, "recover"); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to burn a recovery token")
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,129 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/dchest/uniuri"
+	"github.com/zenazn/goji/web"
+
+	"github.com/lavab/api/cache"
+	"github.com/lavab/api/db"
+	"github.com/lavab/api/env"
+	"github.com/lavab/api/events"
+	"github.com/lavab/api/models"
+)
+
+// refreshSession calls tokensRefresh with the refresh token
+func refreshSession(t *testing.T, id string) (int, *TokensCreateResponse) {
+	r, err := http.NewRequest("POST", "/tokens", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	tokensRefresh(web.C{Env: map[string]interface{}{}}, w, r, &TokensCreateRequest{
+		Type:         "auth",
+		RefreshToken: id,
+	})
+
+	var response TokensCreateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	return w.Code, &response
+}
+
+func TestTokensRefresh(t *testing.T) {
+	session := connectRethink(t, "accounts", "tokens", "audit")
+
+	env.Config = &env.Flags{
+		SessionDuration: 72,
+		RefreshDuration: 720,
+	}
+	env.Log = logrus.New()
+	env.Cache = cache.NewMemoryCache(&cache.MemoryCacheOpts{})
+	env.Events = events.NewBus()
+
+	env.Tokens = &db.TokensTable{
+		RethinkCRUD: db.NewCRUDTable(session, "test", "tokens"),
+		Cache:       env.Cache,
+	}
+	env.Accounts = &db.AccountsTable{
+		RethinkCRUD: db.NewCRUDTable(session, "test", "accounts"),
+		Tokens:      env.Tokens,
+	}
+	env.Audit = &db.AuditTable{
+		RethinkCRUD: db.NewCRUDTable(session, "test", "audit"),
+	}
+
+	account := &models.Account{
+		Resource: models.MakeResource("", "refresh"),
+	}
+	account.Owner = account.ID
+	if err := env.Accounts.Insert(account); err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest("POST", "/tokens", nil)
+	family := uniuri.New()
+	auth, refresh := makeSessionTokens(r, account.ID, family)
+	auth.Name = "Laptop"
+	for _, token := range []*models.Token{auth, refresh} {
+		if err := env.Tokens.Insert(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Refresh tokens are rotated
+	code, response := refreshSession(t, refresh.ID)
+	if code != 201 || response.Token == nil || response.RefreshToken == nil {
+		t.Fatalf("refresh: %d %s", code, response.Message)
+	}
+	if response.Token.Family != family || response.RefreshToken.Family != family ||
+		response.RefreshToken.ID == refresh.ID || response.Token.Name != auth.Name {
+		t.Fatalf("invalid tokens %+v, %+v", response.Token, response.RefreshToken)
+	}
+	next := response.RefreshToken
+
+	// The previous auth token expires shortly
+	previous, err := env.Tokens.GetToken(auth.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if previous.ExpiryDate.After(time.Now().Add(5 * time.Minute)) {
+		t.Fatalf("previous auth token expires at %s", previous.ExpiryDate)
+	}
+
+	// Presenting the used token again revokes the whole family
+	code, response = refreshSession(t, refresh.ID)
+	if code != 403 || response.Token != nil {
+		t.Fatalf("reused refresh token: %d %s", code, response.Message)
+	}
+
+	tokens, err := env.Tokens.GetFamily(family)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 0 {
+		t.Fatalf("%d tokens of the family weren't revoked", len(tokens))
+	}
+
+	if code, _ := refreshSession(t, next.ID); code != 403 {
+		t.Fatalf("refresh token of a revoked family: %d", code)
+	}
+
+	// Auth tokens can't be used to refresh
+	other, _ := makeSessionTokens(r, account.ID, uniuri.New())
+	if err := env.Tokens.Insert(other); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := refreshSession(t, other.ID); code != 403 {
+		t.Fatalf("auth token was accepted as a refresh token: %d", code)
+	}
+}
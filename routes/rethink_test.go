@@ -0,0 +1,42 @@
+package routes
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dancannon/gorethink"
+
+	"github.com/lavab/api/db"
+)
+
+// connectRethink connects to the test database, creating its tables. The test
+// is skipped if RethinkDB isn't available.
+func connectRethink(t *testing.T, tables ...string) *gorethink.Session {
+	address := os.Getenv("RETHINKDB_ADDRESS")
+	if address == "" {
+		address = "127.0.0.1:28015"
+	}
+
+	opts := gorethink.ConnectOpts{
+		Address:  address,
+		Database: "test",
+		Timeout:  time.Second,
+	}
+
+	session, err := gorethink.Connect(opts)
+	if err != nil {
+		t.Skipf("rethinkdb is not available at %s: %v", address, err)
+	}
+
+	if err := db.Setup(opts); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		if err := gorethink.DB("test").Table(table).IndexWait().Exec(session); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return session
+}
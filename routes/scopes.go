@@ -0,0 +1,76 @@
+package routes
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/zenazn/goji/web"
+)
+
+// APITokenScopes lists scopes that can be granted to API tokens
+var APITokenScopes = []string{
+	"account:read",
+	"emails:read",
+	"emails:write",
+	"emails:send",
+	"contacts:read",
+	"contacts:write",
+	"keys:write",
+	"files:read",
+	"files:write",
+}
+
+// scopedRoute is a route that can be accessed using API tokens
+type scopedRoute struct {
+	method  string
+	pattern web.Pattern
+	scope   string
+}
+
+// ScopeTable maps routes to scopes required from API tokens. Routes that
+// aren't in the table can only be accessed using auth tokens.
+type ScopeTable struct {
+	sync.RWMutex
+	routes []scopedRoute
+}
+
+// Scopes is used by AuthMiddleware to authorize API tokens
+var Scopes = &ScopeTable{}
+
+// Add registers the scope required to access the route
+func (s *ScopeTable) Add(method string, pattern string, scope string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.routes = append(s.routes, scopedRoute{
+		method:  method,
+		pattern: web.ParsePattern(pattern),
+		scope:   scope,
+	})
+}
+
+// Match returns the scope required to access the request's route
+func (s *ScopeTable) Match(r *http.Request) (string, bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var c web.C
+	for _, route := range s.routes {
+		if route.method == r.Method && route.pattern.Match(r, &c) {
+			return route.scope, true
+		}
+	}
+
+	return "", false
+}
+
+// validScope checks whether the scope can be granted to API tokens
+func validScope(scope string) bool {
+	for _, valid := range APITokenScopes {
+		if valid == scope {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,146 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/zenazn/goji/web"
+	"github.com/zenazn/goji/web/middleware"
+
+	"github.com/lavab/api/cache"
+	"github.com/lavab/api/db"
+	"github.com/lavab/api/env"
+	"github.com/lavab/api/models"
+)
+
+func TestScopeTableMatch(t *testing.T) {
+	scopes := &ScopeTable{}
+	scopes.Add("GET", "/emails", "emails:read")
+	scopes.Add("POST", "/emails", "emails:send")
+	scopes.Add("GET", "/emails/:id", "emails:read")
+	scopes.Add("DELETE", "/emails/:id", "emails:write")
+
+	cases := []struct {
+		method string
+		path   string
+		scope  string
+		ok     bool
+	}{
+		{"GET", "/emails", "emails:read", true},
+		{"POST", "/emails", "emails:send", true},
+		{"GET", "/emails/123", "emails:read", true},
+		{"DELETE", "/emails/123", "emails:write", true},
+		{"PUT", "/emails/123", "", false},
+		{"DELETE", "/emails", "", false},
+		{"GET", "/emails/123/files", "", false},
+		{"GET", "/accounts/me", "", false},
+		{"GET", "/", "", false},
+	}
+
+	for _, test := range cases {
+		r, err := http.NewRequest(test.method, test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if scope, ok := scopes.Match(r); scope != test.scope || ok != test.ok {
+			t.Fatalf("%s %s: scope %q (%v), expected %q (%v)", test.method, test.path, scope, ok, test.scope, test.ok)
+		}
+	}
+}
+
+func TestValidScope(t *testing.T) {
+	for _, scope := range APITokenScopes {
+		if !validScope(scope) {
+			t.Fatalf("%s is invalid", scope)
+		}
+	}
+
+	for _, scope := range []string{"", "admin", "account:write", "emails:*", "EMAILS:READ"} {
+		if validScope(scope) {
+			t.Fatalf("%q was accepted", scope)
+		}
+	}
+}
+
+func TestAuthMiddlewareScopes(t *testing.T) {
+	env.Log = logrus.New()
+	env.Cache = cache.NewMemoryCache(&cache.MemoryCacheOpts{})
+	env.Tokens = &db.TokensTable{
+		RethinkCRUD: db.NewCRUDTable(nil, "test", "tokens"),
+		Cache:       env.Cache,
+	}
+
+	scopes := Scopes
+	defer func() {
+		Scopes = scopes
+	}()
+
+	Scopes = &ScopeTable{}
+	Scopes.Add("GET", "/emails", "emails:read")
+	Scopes.Add("POST", "/emails", "emails:send")
+
+	// Tokens are served by the cache, recent uses aren't written
+	token := func(kind string, scopes ...string) string {
+		token := models.MakeToken("owner", kind, 1)
+		token.Scopes = scopes
+
+		if err := env.Cache.Set("tokens:"+token.ID, &token, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := env.Cache.Set("tokens:used:"+token.ID, true, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		return token.ID
+	}
+
+	var (
+		api     = token("api", "emails:read")
+		auth    = token("auth")
+		refresh = token("refresh")
+		reached bool
+		mux     = web.New()
+		handler = func(c web.C, w http.ResponseWriter, r *http.Request) {
+			reached = true
+		}
+	)
+	mux.Use(middleware.EnvInit)
+	mux.Use(AuthMiddleware)
+	mux.Get("/emails", handler)
+	mux.Post("/emails", handler)
+	mux.Get("/accounts/me", handler)
+
+	cases := []struct {
+		method  string
+		path    string
+		token   string
+		allowed bool
+	}{
+		{"GET", "/emails", api, true},
+		{"POST", "/emails", api, false},
+		{"GET", "/accounts/me", api, false},
+		{"GET", "/emails", auth, true},
+		{"POST", "/emails", auth, true},
+		{"GET", "/accounts/me", auth, true},
+		{"GET", "/emails", refresh, false},
+	}
+
+	for _, test := range cases {
+		r, err := http.NewRequest(test.method, test.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Authorization", "Bearer "+test.token)
+
+		reached = false
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+
+		if reached != test.allowed {
+			t.Fatalf("%s %s with %s: allowed %v (%d %s)", test.method, test.path, test.token, reached, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/lavab/api/db"
+	"github.com/lavab/api/env"
+)
+
+// searchRequest contains the parsed GET parameters of the search endpoints
+type searchRequest struct {
+	*listRequest
+	Query db.SearchQuery
+}
+
+// parseSearchRequest parses the GET parameters of the search endpoints. q is
+// the search query, see db.ParseSearchQuery. Pagination parameters are the same
+// as in the list endpoints, except for cursors.
+func parseSearchRequest(r *http.Request) (*searchRequest, error) {
+	list, err := parseListRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if list.Page != nil {
+		return nil, errors.New("Search doesn't support cursor pagination")
+	}
+
+	query, err := db.ParseSearchQuery(r.URL.Query().Get("q"))
+	if err != nil {
+		return nil, errors.New("Invalid search query: " + err.Error())
+	}
+
+	return &searchRequest{
+		listRequest: list,
+		Query:       query,
+	}, nil
+}
+
+// resolveSearchLabels replaces label names in the query with owner's label IDs.
+// Returns false if the query requires a label that doesn't exist, so nothing
+// can match it.
+func resolveSearchLabels(owner string, query db.SearchQuery) (db.SearchQuery, bool, error) {
+	if !query.Has("label") {
+		return query, true, nil
+	}
+
+	labels, err := env.Labels.GetOwnedBy(owner)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ids := map[string]string{}
+	for _, label := range labels {
+		ids[strings.ToLower(label.Name)] = label.ID
+	}
+
+	resolved := db.SearchQuery{}
+	for _, term := range query {
+		if term.Key == "label" {
+			id, ok := ids[strings.ToLower(term.Value)]
+			if !ok {
+				if term.Negated {
+					// No thread has a label that doesn't exist
+					continue
+				}
+
+				return nil, false, nil
+			}
+
+			term = &db.SearchTerm{
+				Key:     term.Key,
+				Value:   id,
+				Negated: term.Negated,
+			}
+		}
+
+		resolved = append(resolved, term)
+	}
+
+	return resolved, true, nil
+}
@@ -3,12 +3,12 @@ package routes
 import (
 	"net/http"
 	"reflect"
-	"strconv"
 	"strings"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/zenazn/goji/web"
 
+	"github.com/lavab/api/db"
 	"github.com/lavab/api/env"
 	"github.com/lavab/api/models"
 	"github.com/lavab/api/utils"
@@ -16,99 +16,132 @@ import (
 
 // ThreadsListResponse contains the result of the ThreadsList request.
 type ThreadsListResponse struct {
-	Success bool              `json:"success"`
-	Message string            `json:"message,omitempty"`
-	Threads *[]*models.Thread `json:"threads,omitempty"`
+	Success    bool              `json:"success"`
+	Message    string            `json:"message,omitempty"`
+	Threads    *[]*models.Thread `json:"threads,omitempty"`
+	NextCursor string            `json:"next_cursor,omitempty"`
 }
 
 // ThreadsList shows all threads
 func ThreadsList(c web.C, w http.ResponseWriter, r *http.Request) {
 	session := c.Env["token"].(*models.Token)
 
+	input, err := parseListRequest(r)
+	if err != nil {
+		utils.JSONResponse(w, 400, &ThreadsListResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	var labels []string
+	if labelsRaw := r.URL.Query().Get("label"); labelsRaw != "" {
+		labels = strings.Split(labelsRaw, ",")
+	}
+
 	var (
-		query     = r.URL.Query()
-		sortRaw   = query.Get("sort")
-		offsetRaw = query.Get("offset")
-		limitRaw  = query.Get("limit")
-		labelsRaw = query.Get("label")
-		labels    []string
-		sort      []string
-		offset    int
-		limit     int
+		threads []*models.Thread
+		next    *db.Cursor
 	)
+	if input.Page != nil {
+		threads, next, err = env.Threads.ListPage(session.Owner, labels, input.Page)
+	} else {
+		threads, err = env.Threads.List(session.Owner, input.Sort, input.Offset, input.Limit, labels)
+	}
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to fetch threads")
 
-	if offsetRaw != "" {
-		o, err := strconv.Atoi(offsetRaw)
-		if err != nil {
-			env.Log.WithFields(logrus.Fields{
-				"error":  err,
-				"offset": offset,
-			}).Error("Invalid offset")
-
-			utils.JSONResponse(w, 400, &ThreadsListResponse{
-				Success: false,
-				Message: "Invalid offset",
-			})
-			return
-		}
-		offset = o
+		utils.JSONResponse(w, 500, &ThreadsListResponse{
+			Success: false,
+			Message: "Internal error (code TH/LI/01)",
+		})
+		return
 	}
 
-	if limitRaw != "" {
-		l, err := strconv.Atoi(limitRaw)
+	if input.Paginated || input.Page != nil {
+		count, err := env.Threads.CountList(session.Owner, labels)
 		if err != nil {
 			env.Log.WithFields(logrus.Fields{
 				"error": err.Error(),
-				"limit": limit,
-			}).Error("Invalid limit")
+			}).Error("Unable to count threads")
 
-			utils.JSONResponse(w, 400, &ThreadsListResponse{
+			utils.JSONResponse(w, 500, &ThreadsListResponse{
 				Success: false,
-				Message: "Invalid limit",
+				Message: "Internal error (code TH/LI/02)",
 			})
 			return
 		}
-		limit = l
+
+		writeListHeaders(w, r, input, count, next)
 	}
 
-	if sortRaw != "" {
-		sort = strings.Split(sortRaw, ",")
+	resp := &ThreadsListResponse{
+		Success: true,
+		Threads: &threads,
+	}
+	if next != nil {
+		resp.NextCursor = next.Encode()
 	}
 
-	if labelsRaw != "" {
-		labels = strings.Split(labelsRaw, ",")
+	utils.JSONResponse(w, 200, resp)
+}
+
+// ThreadsSearchResponse contains the result of the ThreadsSearch request.
+type ThreadsSearchResponse struct {
+	Success bool              `json:"success"`
+	Message string            `json:"message,omitempty"`
+	Threads *[]*models.Thread `json:"threads,omitempty"`
+}
+
+// ThreadsSearch returns threads matching a search query over the unencrypted metadata.
+func ThreadsSearch(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Fetch the current session from the middleware
+	session := c.Env["token"].(*models.Token)
+
+	// Parse the query
+	input, err := parseSearchRequest(r)
+	if err != nil {
+		utils.JSONResponse(w, 400, &ThreadsSearchResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
 	}
 
-	threads, err := env.Threads.List(session.Owner, sort, offset, limit, labels)
+	query, ok, err := resolveSearchLabels(session.Owner, input.Query)
 	if err != nil {
 		env.Log.WithFields(logrus.Fields{
 			"error": err.Error(),
-		}).Error("Unable to fetch threads")
+		}).Error("Unable to fetch labels")
 
-		utils.JSONResponse(w, 500, &ThreadsListResponse{
+		utils.JSONResponse(w, 500, &ThreadsSearchResponse{
 			Success: false,
-			Message: "Internal error (code TH/LI/01)",
+			Message: "Internal error (code TH/SE/01)",
 		})
 		return
 	}
 
-	if offsetRaw != "" || limitRaw != "" {
-		count, err := env.Threads.CountOwnedBy(session.Owner)
+	// Nothing can match a label that doesn't exist
+	threads := []*models.Thread{}
+	if ok {
+		threads, err = env.Threads.Search(session.Owner, query, input.Sort, input.Offset, input.Limit)
 		if err != nil {
 			env.Log.WithFields(logrus.Fields{
 				"error": err.Error(),
-			}).Error("Unable to count threads")
+			}).Error("Unable to search threads")
 
-			utils.JSONResponse(w, 500, &ThreadsListResponse{
+			utils.JSONResponse(w, 500, &ThreadsSearchResponse{
 				Success: false,
-				Message: "Internal error (code TH/LI/02)",
+				Message: "Internal error (code TH/SE/02)",
 			})
 			return
 		}
-		w.Header().Set("X-Total-Count", strconv.Itoa(count))
 	}
 
-	utils.JSONResponse(w, 200, &ThreadsListResponse{
+	utils.JSONResponse(w, 200, &ThreadsSearchResponse{
 		Success: true,
 		Threads: &threads,
 	})
@@ -227,8 +260,12 @@ func ThreadsUpdate(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Counts of both old and new labels change
+	labels := thread.Labels
+
 	if input.Labels != nil && !reflect.DeepEqual(thread.Labels, input.Labels) {
 		thread.Labels = input.Labels
+		labels = append(labels, input.Labels...)
 	}
 
 	if input.LastRead != nil && *input.LastRead != thread.LastRead {
@@ -256,6 +293,10 @@ func ThreadsUpdate(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Notify other sessions
+	publish(session.Owner, "thread.update", thread.ID, thread)
+	go PublishLabelCounts(session.Owner, labels...)
+
 	// Write the thread to the response
 	utils.JSONResponse(w, 200, &ThreadsUpdateResponse{
 		Success: true,
@@ -323,6 +364,10 @@ func ThreadsDelete(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Notify other sessions
+	publish(session.Owner, "thread.delete", thread.ID, nil)
+	go PublishLabelCounts(session.Owner, thread.Labels...)
+
 	// Write the thread to the response
 	utils.JSONResponse(w, 200, &ThreadsDeleteResponse{
 		Success: true,
@@ -0,0 +1,320 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/zenazn/goji/web"
+
+	"github.com/lavab/api/cache"
+	"github.com/lavab/api/env"
+	"github.com/lavab/api/models"
+	"github.com/lavab/api/utils"
+)
+
+const (
+	// loginFreeAttempts is the number of failures allowed before the backoff starts
+	loginFreeAttempts = 3
+
+	// loginMaxDelay caps the exponential backoff
+	loginMaxDelay = 15 * time.Minute
+
+	// loginLockoutAttempts is the number of consecutive failures that lock an account
+	loginLockoutAttempts = 10
+
+	// loginLockoutDuration is how long a locked account refuses logins
+	loginLockoutDuration = 30 * time.Minute
+
+	// loginAttemptsTTL is how long failed attempts are remembered
+	loginAttemptsTTL = 24 * time.Hour
+)
+
+// LoginAttempts contains failed login attempts of an account or an address
+type LoginAttempts struct {
+	// Failures counts consecutive failures and drives the backoff. It's reset
+	// after a successful login.
+	Failures int `json:"failures"`
+
+	// Total counts all failures during the last 24 hours
+	Total int `json:"total"`
+
+	LastFailure time.Time `json:"last_failure,omitempty"`
+	LastIP      string    `json:"last_ip,omitempty"`
+	LockedUntil time.Time `json:"locked_until,omitempty"`
+}
+
+// loginAttempt contains numbers of a login attempt counted by countLoginAttempt
+type loginAttempt struct {
+	Account int64
+	IP      int64
+}
+
+// loginBackoff returns how long the attempt blocks the following ones
+func loginBackoff(attempt int64) time.Duration {
+	delay := loginMaxDelay
+	if shift := uint(attempt - loginFreeAttempts); shift < 20 {
+		if backoff := time.Second << shift; backoff < delay {
+			delay = backoff
+		}
+	}
+
+	return delay
+}
+
+// loginAttemptsKey returns the cache key of an account's or an address' attempts
+func loginAttemptsKey(kind string, id string) string {
+	return "login_attempts:" + kind + ":" + id
+}
+
+// loginCounterKey returns the cache key of the counter of consecutive attempts
+func loginCounterKey(kind string, id string) string {
+	return "login_counter:" + kind + ":" + id
+}
+
+// loginSlotKey returns the cache key held for the backoff of the last attempt
+func loginSlotKey(kind string, id string) string {
+	return "login_slot:" + kind + ":" + id
+}
+
+// loginLockoutKey returns the cache key holding the end of an account's lockout
+func loginLockoutKey(id string) string {
+	return "login_lockout:" + id
+}
+
+// getLoginAttempts loads attempts from the cache
+func getLoginAttempts(kind string, id string) (*LoginAttempts, error) {
+	var attempts LoginAttempts
+	if err := env.Cache.Get(loginAttemptsKey(kind, id), &attempts); err != nil && err != cache.ErrNotFound {
+		return nil, err
+	}
+
+	return &attempts, nil
+}
+
+// startLoginAttempt atomically counts an attempt of the account or the address
+// before the credentials are checked. The attempt stays counted as a failure
+// until loginSucceeded resets the counter. Once the free attempts are used,
+// every attempt has to take a slot that is held for its backoff, so only one
+// of concurrent guesses gets through. It returns the number of the attempt or
+// how long the caller has to wait.
+func startLoginAttempt(kind string, id string) (int64, time.Duration, error) {
+	if kind == "account" {
+		var lockedUntil time.Time
+		if err := env.Cache.Get(loginLockoutKey(id), &lockedUntil); err != nil && err != cache.ErrNotFound {
+			return 0, 0, err
+		}
+
+		if wait := lockedUntil.Sub(time.Now()); wait > 0 {
+			return 0, wait, nil
+		}
+	}
+
+	attempt, err := env.Cache.Increment(loginCounterKey(kind, id), 1, loginAttemptsTTL)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if attempt < loginFreeAttempts {
+		return attempt, 0, nil
+	}
+
+	slot, err := env.Cache.Increment(loginSlotKey(kind, id), 1, loginBackoff(attempt))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if slot == 1 {
+		return attempt, 0, nil
+	}
+
+	// Attempts that have to wait aren't failures
+	if err := cancelLoginAttempt(kind, id); err != nil {
+		return 0, 0, err
+	}
+
+	return 0, loginBackoff(attempt - 1), nil
+}
+
+// cancelLoginAttempt stops counting an attempt that wasn't made
+func cancelLoginAttempt(kind string, id string) error {
+	_, err := env.Cache.Increment(loginCounterKey(kind, id), -1, loginAttemptsTTL)
+	return err
+}
+
+// countLoginAttempt counts an attempt against the username and the address.
+// It returns how long the caller has to wait if either of them is throttled.
+func countLoginAttempt(username string, ip string) (*loginAttempt, time.Duration, error) {
+	account, delay, err := startLoginAttempt("account", username)
+	if err != nil || delay > 0 {
+		return nil, delay, err
+	}
+
+	address, delay, err := startLoginAttempt("ip", ip)
+	if err != nil || delay > 0 {
+		if err := cancelLoginAttempt("account", username); err != nil {
+			return nil, 0, err
+		}
+
+		return nil, delay, err
+	}
+
+	return &loginAttempt{
+		Account: account,
+		IP:      address,
+	}, 0, nil
+}
+
+// loginFailed records a failed attempt in the history. It returns true if the
+// attempt locked the account.
+func loginFailed(kind string, id string, ip string, attempt int64) (bool, *LoginAttempts, error) {
+	attempts, err := getLoginAttempts(kind, id)
+	if err != nil {
+		return false, nil, err
+	}
+
+	attempts.Failures = int(attempt)
+	attempts.Total++
+	attempts.LastFailure = time.Now()
+	attempts.LastIP = ip
+
+	// Attempt numbers are unique, so only one request locks the account
+	locked := false
+	if kind == "account" && attempt%loginLockoutAttempts == 0 {
+		attempts.LockedUntil = attempts.LastFailure.Add(loginLockoutDuration)
+		locked = true
+
+		if err := env.Cache.Set(loginLockoutKey(id), attempts.LockedUntil, loginLockoutDuration); err != nil {
+			return false, nil, err
+		}
+	}
+
+	return locked, attempts, env.Cache.Set(loginAttemptsKey(kind, id), attempts, loginAttemptsTTL)
+}
+
+// loginSucceeded resets the backoff of an account, keeping the history. The
+// attempt counted against the address is cancelled, so that successful logins
+// don't throttle other users behind the same address. attempt is nil if no
+// attempt was counted.
+func loginSucceeded(id string, ip string, attempt *loginAttempt) error {
+	if err := env.Cache.DeleteMulti(
+		loginCounterKey("account", id),
+		loginSlotKey("account", id),
+		loginLockoutKey(id),
+	); err != nil {
+		return err
+	}
+
+	if attempt != nil {
+		if err := cancelLoginAttempt("ip", ip); err != nil {
+			return err
+		}
+
+		// Only one attempt holds the slot of a throttled address
+		if attempt.IP >= loginFreeAttempts {
+			if err := env.Cache.Delete(loginSlotKey("ip", ip)); err != nil {
+				return err
+			}
+		}
+	}
+
+	attempts, err := getLoginAttempts("account", id)
+	if err != nil || attempts.Total == 0 {
+		return err
+	}
+
+	attempts.Failures = 0
+	attempts.LockedUntil = time.Time{}
+
+	return env.Cache.Set(loginAttemptsKey("account", id), attempts, loginAttemptsTTL)
+}
+
+// recordLoginFailure records a failed attempt counted by countLoginAttempt in
+// the history of the username and the address and in the audit log as kind.
+// The owner of an account that gets locked is notified on their alternative
+// email address. user is nil for unknown usernames.
+func recordLoginFailure(c web.C, r *http.Request, kind string, username string, user *models.Account, attempt *loginAttempt) {
+	ip := utils.RemoteIP(r)
+	if user != nil {
+		audit(c, r, kind, "", user.ID, nil)
+	}
+
+	if _, _, err := loginFailed("ip", ip, ip, attempt.IP); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+			"ip":    ip,
+		}).Error("Unable to record a failed login")
+	}
+
+	locked, attempts, err := loginFailed("account", username, ip, attempt.Account)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error":    err.Error(),
+			"username": username,
+		}).Error("Unable to record a failed login")
+		return
+	}
+
+	if !locked || user == nil {
+		return
+	}
+
+	env.Log.WithFields(logrus.Fields{
+		"account":  user.ID,
+		"failures": attempts.Failures,
+		"ip":       ip,
+	}).Warn("Account locked after failed logins")
+
+	audit(c, r, "account.lockout", "", user.ID, map[string]interface{}{
+		"failures":     attempts.Failures,
+		"locked_until": attempts.LockedUntil,
+	})
+
+	if user.AltEmail == "" {
+		return
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"account":      user.ID,
+		"alt_email":    user.AltEmail,
+		"ip":           ip,
+		"failures":     attempts.Failures,
+		"locked_until": attempts.LockedUntil,
+	})
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"account": user.ID,
+			"error":   err.Error(),
+		}).Error("Unable to encode a lockout notification")
+		return
+	}
+
+	if err := env.Producer.Publish("hook_lockout", data); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"account": user.ID,
+			"error":   err.Error(),
+		}).Error("Unable to publish a lockout notification")
+	}
+}
+
+// rateLimit counts a request against the key and returns how long the caller
+// has to wait if more than limit requests were made during the window. Windows
+// are fixed, so that all requests of a window share one counter.
+func rateLimit(key string, limit int, window time.Duration) (time.Duration, error) {
+	now := time.Now()
+	start := now.Truncate(window)
+	reset := start.Add(window)
+
+	count, err := env.Cache.Increment("rate:"+key+":"+strconv.FormatInt(start.Unix(), 10), 1, reset.Sub(now))
+	if err != nil {
+		return 0, err
+	}
+
+	if count > int64(limit) {
+		return reset.Sub(now), nil
+	}
+
+	return 0, nil
+}
@@ -0,0 +1,152 @@
+package routes
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lavab/api/cache"
+	"github.com/lavab/api/env"
+)
+
+func TestCountLoginAttemptConcurrent(t *testing.T) {
+	env.Cache = cache.NewMemoryCache(&cache.MemoryCacheOpts{})
+
+	var (
+		wg      sync.WaitGroup
+		lock    sync.Mutex
+		allowed []*loginAttempt
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			attempt, delay, err := countLoginAttempt("user", "203.0.113.7")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if delay == 0 {
+				lock.Lock()
+				allowed = append(allowed, attempt)
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Only the free attempts and the first one holding a slot get through
+	if len(allowed) != loginFreeAttempts {
+		t.Fatalf("%d concurrent attempts were allowed", len(allowed))
+	}
+
+	seen := map[int64]bool{}
+	for _, attempt := range allowed {
+		seen[attempt.Account] = true
+	}
+	if len(seen) != loginFreeAttempts {
+		t.Fatalf("attempt numbers aren't unique: %v", seen)
+	}
+
+	// Rejected attempts aren't counted
+	if count, _ := env.Cache.Increment(loginCounterKey("account", "user"), 0, 0); count != loginFreeAttempts {
+		t.Fatalf("invalid count %d", count)
+	}
+
+	// Another address is throttled by the username
+	if _, delay, _ := countLoginAttempt("user", "198.51.100.1"); delay == 0 {
+		t.Fatal("attempt from another address wasn't throttled")
+	}
+
+	// A successful login resets the backoff
+	if err := loginSucceeded("user", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	attempt, delay, err := countLoginAttempt("user", "198.51.100.1")
+	if err != nil || delay != 0 || attempt.Account != 1 {
+		t.Fatalf("attempt after a successful login: %+v, %s (%v)", attempt, delay, err)
+	}
+}
+
+func TestLoginSucceededAddress(t *testing.T) {
+	env.Cache = cache.NewMemoryCache(&cache.MemoryCacheOpts{})
+
+	// Users behind the same address log in one after another
+	for i := 0; i < loginFreeAttempts*3; i++ {
+		username := "user" + strconv.Itoa(i)
+		attempt, delay, err := countLoginAttempt(username, "203.0.113.7")
+		if err != nil || delay != 0 {
+			t.Fatalf("login %d was throttled: %s (%v)", i, delay, err)
+		}
+
+		if err := loginSucceeded(username, "203.0.113.7", attempt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if count, _ := env.Cache.Increment(loginCounterKey("ip", "203.0.113.7"), 0, 0); count != 0 {
+		t.Fatalf("successful logins were counted: %d", count)
+	}
+
+	// A login that holds the slot releases it
+	for i := 1; i < loginFreeAttempts; i++ {
+		if _, _, err := countLoginAttempt("guess", "203.0.113.7"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	attempt, delay, err := countLoginAttempt("user", "203.0.113.7")
+	if err != nil || delay != 0 {
+		t.Fatalf("login after failures wasn't allowed: %s (%v)", delay, err)
+	}
+	if err := loginSucceeded("user", "203.0.113.7", attempt); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, delay, _ := countLoginAttempt("other", "203.0.113.7"); delay != 0 {
+		t.Fatalf("slot wasn't released after a successful login: %s", delay)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	env.Cache = cache.NewMemoryCache(&cache.MemoryCacheOpts{})
+
+	locked, attempts, err := loginFailed("account", "user", "203.0.113.7", loginLockoutAttempts-1)
+	if err != nil || locked {
+		t.Fatalf("account was locked too early: %v", err)
+	}
+
+	locked, attempts, err = loginFailed("account", "user", "203.0.113.7", loginLockoutAttempts)
+	if err != nil || !locked || attempts.Total != 2 {
+		t.Fatalf("account wasn't locked: %+v (%v)", attempts, err)
+	}
+
+	_, delay, err := startLoginAttempt("account", "user")
+	if err != nil || delay <= loginLockoutDuration-time.Minute {
+		t.Fatalf("locked account was allowed to log in: %s (%v)", delay, err)
+	}
+
+	if err := loginSucceeded("user", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, delay, _ := startLoginAttempt("account", "user"); delay != 0 {
+		t.Fatal("lockout wasn't reset")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	env.Cache = cache.NewMemoryCache(&cache.MemoryCacheOpts{})
+
+	for i := 0; i < 5; i++ {
+		if delay, err := rateLimit("test", 5, time.Hour); err != nil || delay != 0 {
+			t.Fatalf("request %d was limited: %s (%v)", i, delay, err)
+		}
+	}
+
+	if delay, err := rateLimit("test", 5, time.Hour); err != nil || delay == 0 || delay > time.Hour {
+		t.Fatalf("request over the limit: %s (%v)", delay, err)
+	}
+}
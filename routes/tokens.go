@@ -2,9 +2,11 @@ package routes
 
 import (
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/dchest/uniuri"
 	"github.com/zenazn/goji/web"
 
 	"github.com/lavab/api/env"
@@ -12,46 +14,135 @@ import (
 	"github.com/lavab/api/utils"
 )
 
+// TokenSession describes an auth token without revealing it
+type TokenSession struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	DateCreated time.Time `json:"date_created"`
+	DateUsed    time.Time `json:"date_used,omitempty"`
+	ExpiryDate  time.Time `json:"expiry_date"`
+	IP          string    `json:"ip,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	Current     bool      `json:"current"`
+}
+
+// makeSession converts a token into a TokenSession
+func makeSession(token *models.Token, current *models.Token) *TokenSession {
+	return &TokenSession{
+		ID:          token.SessionID(),
+		Name:        token.Name,
+		DateCreated: token.DateCreated,
+		DateUsed:    token.DateUsed,
+		ExpiryDate:  token.ExpiryDate,
+		IP:          token.IP,
+		UserAgent:   token.UserAgent,
+		Current:     token.ID == current.ID,
+	}
+}
+
+// findSession returns an auth token of the current user. id can be either the
+// token itself or its session ID. Empty id and "current" mean the current token.
+func findSession(current *models.Token, id string) *models.Token {
+	if id == "" || id == "current" {
+		return current
+	}
+
+	if token, err := env.Tokens.GetToken(id); err == nil {
+		if token.Owner == current.Owner && token.Type == "auth" {
+			return token
+		}
+
+		return nil
+	}
+
+	tokens, err := env.Tokens.GetOwnedBy(current.Owner, "auth")
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+			"owner": current.Owner,
+		}).Error("Unable to list tokens")
+		return nil
+	}
+
+	for _, token := range tokens {
+		if token.SessionID() == id {
+			return token
+		}
+	}
+
+	return nil
+}
+
+// TokensListResponse contains the result of the TokensList request.
+type TokensListResponse struct {
+	Success  bool            `json:"success"`
+	Message  string          `json:"message,omitempty"`
+	Sessions []*TokenSession `json:"sessions,omitempty"`
+}
+
+// TokensList returns active sessions of the current user.
+func TokensList(c web.C, w http.ResponseWriter, r *http.Request) {
+	session := c.Env["token"].(*models.Token)
+
+	tokens, err := env.Tokens.GetOwnedBy(session.Owner, "auth")
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+			"owner": session.Owner,
+		}).Error("Unable to list tokens")
+
+		utils.JSONResponse(w, 500, &TokensListResponse{
+			Success: false,
+			Message: "Internal error (code TO/LI/01)",
+		})
+		return
+	}
+
+	sessions := []*TokenSession{}
+	for _, token := range tokens {
+		if !token.Expired() {
+			sessions = append(sessions, makeSession(token, session))
+		}
+	}
+
+	utils.JSONResponse(w, 200, &TokensListResponse{
+		Success:  true,
+		Sessions: sessions,
+	})
+}
+
 // TokensGetResponse contains the result of the TokensGet request.
 type TokensGetResponse struct {
 	Success bool          `json:"success"`
 	Message string        `json:"message,omitempty"`
 	Token   *models.Token `json:"token,omitempty"`
+	Session *TokenSession `json:"session,omitempty"`
 }
 
-// TokensGet returns information about the current token.
+// TokensGet returns information about the current token or one of the other
+// sessions of its owner.
 func TokensGet(c web.C, w http.ResponseWriter, r *http.Request) {
-	// Initialize
-	var (
-		token *models.Token
-		err   error
-	)
+	session := c.Env["token"].(*models.Token)
 
-	id, ok := c.URLParams["id"]
-	if !ok || id == "" {
-		// Get the token from the middleware
-		token = c.Env["token"].(*models.Token)
-	} else {
-		token, err = env.Tokens.GetToken(id)
-		if err != nil {
-			env.Log.WithFields(logrus.Fields{
-				"error": err.Error(),
-				"id":    id,
-			}).Warn("Unable to find the token")
-
-			utils.JSONResponse(w, 404, &TokensGetResponse{
-				Success: false,
-				Message: "Invalid token ID",
-			})
-			return
-		}
+	token := findSession(session, c.URLParams["id"])
+	if token == nil {
+		utils.JSONResponse(w, 404, &TokensGetResponse{
+			Success: false,
+			Message: "Invalid token ID",
+		})
+		return
 	}
 
-	// Respond with the token information
-	utils.JSONResponse(w, 200, &TokensGetResponse{
+	// Only the current token is returned as is
+	response := &TokensGetResponse{
 		Success: true,
-		Token:   token,
-	})
+		Session: makeSession(token, session),
+	}
+	if token.ID == session.ID {
+		response.Token = token
+	}
+
+	utils.JSONResponse(w, 200, response)
 }
 
 // TokensCreateRequest contains the input for the TokensCreate endpoint.
@@ -60,6 +151,9 @@ type TokensCreateRequest struct {
 	Password string `json:"password" schema:"password"`
 	Type     string `json:"type" schema:"type"`
 	Token    string `json:"token" schema:"token"`
+
+	// RefreshToken replaces the credentials when renewing a session
+	RefreshToken string `json:"refresh_token" schema:"refresh_token"`
 }
 
 // TokensCreateResponse contains the result of the TokensCreate request.
@@ -67,12 +161,39 @@ type TokensCreateResponse struct {
 	Success         bool          `json:"success"`
 	Message         string        `json:"message,omitempty"`
 	Token           *models.Token `json:"token,omitempty"`
+	RefreshToken    *models.Token `json:"refresh_token,omitempty"`
 	FactorType      string        `json:"factor_type,omitempty"`
 	FactorChallenge string        `json:"factor_challenge,omitempty"`
+	RetryAfter      int           `json:"retry_after,omitempty"`
+}
+
+// makeSessionTokens creates an auth token and a refresh token of the family
+func makeSessionTokens(r *http.Request, owner string, family string) (*models.Token, *models.Token) {
+	expDate := time.Now().Add(time.Hour * time.Duration(env.Config.SessionDuration))
+	token := &models.Token{
+		Expiring:  models.Expiring{ExpiryDate: expDate},
+		Resource:  models.MakeResource(owner, "Auth token expiring on "+expDate.Format(time.RFC3339)),
+		Type:      "auth",
+		Family:    family,
+		IP:        utils.RemoteIP(r),
+		UserAgent: r.UserAgent(),
+	}
+	token.DateUsed = token.DateCreated
+
+	refresh := &models.Token{
+		Expiring: models.Expiring{
+			ExpiryDate: time.Now().Add(time.Hour * time.Duration(env.Config.RefreshDuration)),
+		},
+		Resource: models.MakeResource(owner, ""),
+		Type:     "refresh",
+		Family:   family,
+	}
+
+	return token, refresh
 }
 
 // TokensCreate allows logging in to an account.
-func TokensCreate(w http.ResponseWriter, r *http.Request) {
+func TokensCreate(c web.C, w http.ResponseWriter, r *http.Request) {
 	// Decode the request
 	var input TokensCreateRequest
 	err := utils.ParseRequest(r, &input)
@@ -88,6 +209,12 @@ func TokensCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Renew the session using a refresh token
+	if input.RefreshToken != "" {
+		tokensRefresh(c, w, r, &input)
+		return
+	}
+
 	// We can only create "auth" tokens now
 	if input.Type != "auth" {
 		utils.JSONResponse(w, 409, &TokensCreateResponse{
@@ -101,9 +228,38 @@ func TokensCreate(w http.ResponseWriter, r *http.Request) {
 		utils.NormalizeUsername(input.Username),
 	)
 
+	// Throttle attempts per username and per address before doing any work.
+	// The attempt is counted right away, so concurrent guesses can't all pass.
+	ip := utils.RemoteIP(r)
+	attempt, delay, err := countLoginAttempt(input.Username, ip)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to check failed logins")
+
+		utils.JSONResponse(w, 500, &TokensCreateResponse{
+			Success: false,
+			Message: "Internal error (code TO/CR/03)",
+		})
+		return
+	}
+
+	if delay > 0 {
+		seconds := int(delay/time.Second) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		utils.JSONResponse(w, 429, &TokensCreateResponse{
+			Success:    false,
+			Message:    "Too many failed login attempts, try again later",
+			RetryAfter: seconds,
+		})
+		return
+	}
+
 	// Check if account exists
 	user, err := env.Accounts.FindAccountByName(input.Username)
 	if err != nil {
+		recordLoginFailure(c, r, "login.failure", input.Username, nil, attempt)
+
 		utils.JSONResponse(w, 403, &TokensCreateResponse{
 			Success: false,
 			Message: "Wrong username or password",
@@ -120,9 +276,29 @@ func TokensCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Accounts that are being deleted can't log in
+	if user.Status == "deleting" {
+		utils.JSONResponse(w, 403, &TokensCreateResponse{
+			Success: false,
+			Message: "Your account is being deleted",
+		})
+		return
+	}
+
+	// Suspended accounts can't log in either
+	if user.Status == "suspended" {
+		utils.JSONResponse(w, 403, &TokensCreateResponse{
+			Success: false,
+			Message: "Your account has been suspended",
+		})
+		return
+	}
+
 	// Verify the password
 	valid, updated, err := user.VerifyPassword(input.Password)
 	if err != nil || !valid {
+		recordLoginFailure(c, r, "login.failure", input.Username, user, attempt)
+
 		utils.JSONResponse(w, 403, &TokensCreateResponse{
 			Success: false,
 			Message: "Wrong username or password",
@@ -149,7 +325,7 @@ func TokensCreate(w http.ResponseWriter, r *http.Request) {
 		factor, ok := env.Factors[user.FactorType]
 		if ok {
 			// Verify the 2FA
-			verified, challenge, err := user.Verify2FA(factor, input.Token)
+			verified, challenge, err := verifyFactor(user, factor, input.Token)
 			if err != nil {
 				utils.JSONResponse(w, 500, &TokensCreateResponse{
 					Success: false,
@@ -163,8 +339,8 @@ func TokensCreate(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			// Token was probably empty. Return the challenge.
-			if !verified && challenge != "" {
+			// Token was empty. Return the challenge, if the factor has one.
+			if !verified && input.Token == "" {
 				utils.JSONResponse(w, 403, &TokensCreateResponse{
 					Success:         false,
 					Message:         "2FA token was not passed",
@@ -176,6 +352,8 @@ func TokensCreate(w http.ResponseWriter, r *http.Request) {
 
 			// Token was incorrect
 			if !verified {
+				recordLoginFailure(c, r, "factor.failure", input.Username, user, attempt)
+
 				utils.JSONResponse(w, 403, &TokensCreateResponse{
 					Success:    false,
 					Message:    "Invalid token passed",
@@ -186,63 +364,296 @@ func TokensCreate(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Calculate the expiry date
-	expDate := time.Now().Add(time.Hour * time.Duration(env.Config.SessionDuration))
+	if err := loginSucceeded(input.Username, ip, attempt); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to reset failed logins")
 
-	// Create a new token
-	token := &models.Token{
-		Expiring: models.Expiring{ExpiryDate: expDate},
-		Resource: models.MakeResource(user.ID, "Auth token expiring on "+expDate.Format(time.RFC3339)),
-		Type:     input.Type,
+		// DO NOT RETURN!
+	}
+
+	// Create a new token and a refresh token that can renew it
+	token, refresh := makeSessionTokens(r, user.ID, uniuri.NewLen(uniuri.UUIDLen))
+
+	// Insert them into the database
+	if err := env.Tokens.Insert(token); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to insert a token")
+
+		utils.JSONResponse(w, 500, &TokensCreateResponse{
+			Success: false,
+			Message: "Internal error (code TO/CR/01)",
+		})
+		return
 	}
 
-	// Insert int into the database
-	env.Tokens.Insert(token)
+	if err := env.Tokens.Insert(refresh); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to insert a refresh token")
+
+		utils.JSONResponse(w, 500, &TokensCreateResponse{
+			Success: false,
+			Message: "Internal error (code TO/CR/02)",
+		})
+		return
+	}
+
+	audit(c, r, "login.success", user.ID, user.ID, map[string]interface{}{
+		"session": token.SessionID(),
+	})
 
 	// Respond with the freshly created token
 	utils.JSONResponse(w, 201, &TokensCreateResponse{
-		Success: true,
-		Message: "Authentication successful",
-		Token:   token,
+		Success:      true,
+		Message:      "Authentication successful",
+		Token:        token,
+		RefreshToken: refresh,
 	})
 }
 
-// TokensDeleteResponse contains the result of the TokensDelete request.
-type TokensDeleteResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
-}
+// tokensRefresh exchanges a refresh token for a new auth token and a new
+// refresh token. Refresh tokens are single-use - presenting a used one again
+// means that it has leaked, so the whole session is revoked.
+func tokensRefresh(c web.C, w http.ResponseWriter, r *http.Request, input *TokensCreateRequest) {
+	if input.Type != "auth" {
+		utils.JSONResponse(w, 409, &TokensCreateResponse{
+			Success: false,
+			Message: "Only auth tokens are implemented",
+		})
+		return
+	}
 
-// TokensDelete destroys either the current auth token or the one passed as an URL param
-func TokensDelete(c web.C, w http.ResponseWriter, r *http.Request) {
-	// Initialize
-	var (
-		token *models.Token
-		err   error
-	)
+	refresh, err := env.Tokens.GetToken(input.RefreshToken)
+	if err != nil || (refresh.Type != "refresh" && refresh.Type != ".refresh") {
+		utils.JSONResponse(w, 403, &TokensCreateResponse{
+			Success: false,
+			Message: "Invalid refresh token",
+		})
+		return
+	}
 
-	id, ok := c.URLParams["id"]
-	if !ok || id == "" {
-		// Get the token from the middleware
-		token = c.Env["token"].(*models.Token)
-	} else {
-		token, err = env.Tokens.GetToken(id)
+	if refresh.Expired() {
+		utils.JSONResponse(w, 419, &TokensCreateResponse{
+			Success: false,
+			Message: "Refresh token has expired",
+		})
+		env.Tokens.DeleteID(refresh.ID)
+		return
+	}
+
+	// Mark the token as used. It fails for tokens that have already been used.
+	consumed := false
+	if refresh.Type == "refresh" {
+		consumed, err = env.Tokens.Consume(refresh.ID, "refresh")
 		if err != nil {
 			env.Log.WithFields(logrus.Fields{
 				"error": err.Error(),
-				"id":    id,
-			}).Warn("Unable to find the token")
+			}).Error("Unable to consume a refresh token")
 
-			utils.JSONResponse(w, 404, &TokensDeleteResponse{
+			utils.JSONResponse(w, 500, &TokensCreateResponse{
 				Success: false,
-				Message: "Invalid token ID",
+				Message: "Internal error (code TO/RE/01)",
 			})
 			return
 		}
 	}
 
-	// Delete it from the database
-	if err := env.Tokens.DeleteID(token.ID); err != nil {
+	if !consumed {
+		env.Log.WithFields(logrus.Fields{
+			"owner":  refresh.Owner,
+			"family": refresh.Family,
+		}).Warn("Refresh token reuse detected")
+
+		if _, err := env.Tokens.DeleteFamily(refresh.Family); err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("Unable to revoke a token family")
+
+			utils.JSONResponse(w, 500, &TokensCreateResponse{
+				Success: false,
+				Message: "Internal error (code TO/RE/02)",
+			})
+			return
+		}
+
+		audit(c, r, "session.reuse", "", refresh.Owner, map[string]interface{}{
+			"session": refresh.SessionID(),
+		})
+
+		utils.JSONResponse(w, 403, &TokensCreateResponse{
+			Success: false,
+			Message: "Refresh token has already been used, the session was revoked",
+		})
+		return
+	}
+
+	user, err := env.Accounts.GetAccount(refresh.Owner)
+	if err != nil || user.Status == "deleting" || user.Status == "suspended" {
+		utils.JSONResponse(w, 403, &TokensCreateResponse{
+			Success: false,
+			Message: "Invalid refresh token",
+		})
+		return
+	}
+
+	token, next := makeSessionTokens(r, user.ID, refresh.Family)
+
+	// Previous auth tokens of the session expire shortly, leaving some time
+	// for requests that are still in flight
+	family, err := env.Tokens.GetFamily(refresh.Family)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to fetch a token family")
+
+		utils.JSONResponse(w, 500, &TokensCreateResponse{
+			Success: false,
+			Message: "Internal error (code TO/RE/03)",
+		})
+		return
+	}
+
+	for _, previous := range family {
+		if previous.Type != "auth" || previous.Expired() {
+			continue
+		}
+
+		// Keep the name given to the session
+		token.Name = previous.Name
+
+		previous.ExpireSoon()
+		if err := env.Tokens.UpdateID(previous.ID, previous); err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("Unable to expire a token")
+
+			// DO NOT RETURN!
+		}
+	}
+
+	if err := env.Tokens.Insert(token); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to insert a token")
+
+		utils.JSONResponse(w, 500, &TokensCreateResponse{
+			Success: false,
+			Message: "Internal error (code TO/RE/04)",
+		})
+		return
+	}
+
+	if err := env.Tokens.Insert(next); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to insert a refresh token")
+
+		utils.JSONResponse(w, 500, &TokensCreateResponse{
+			Success: false,
+			Message: "Internal error (code TO/RE/05)",
+		})
+		return
+	}
+
+	utils.JSONResponse(w, 201, &TokensCreateResponse{
+		Success:      true,
+		Message:      "Session renewed",
+		Token:        token,
+		RefreshToken: next,
+	})
+}
+
+// TokensUpdateRequest contains the input for the TokensUpdate endpoint.
+type TokensUpdateRequest struct {
+	Name string `json:"name" schema:"name"`
+}
+
+// TokensUpdateResponse contains the result of the TokensUpdate request.
+type TokensUpdateResponse struct {
+	Success bool          `json:"success"`
+	Message string        `json:"message,omitempty"`
+	Session *TokenSession `json:"session,omitempty"`
+}
+
+// TokensUpdate renames a session
+func TokensUpdate(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Decode the request
+	var input TokensUpdateRequest
+	err := utils.ParseRequest(r, &input)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("Unable to decode a request")
+
+		utils.JSONResponse(w, 400, &TokensUpdateResponse{
+			Success: false,
+			Message: "Invalid input format",
+		})
+		return
+	}
+
+	session := c.Env["token"].(*models.Token)
+
+	token := findSession(session, c.URLParams["id"])
+	if token == nil {
+		utils.JSONResponse(w, 404, &TokensUpdateResponse{
+			Success: false,
+			Message: "Invalid token ID",
+		})
+		return
+	}
+
+	token.Name = input.Name
+	token.DateModified = time.Now()
+
+	if err := env.Tokens.UpdateID(token.ID, token); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to update a token")
+
+		utils.JSONResponse(w, 500, &TokensUpdateResponse{
+			Success: false,
+			Message: "Internal error (code TO/UP/01)",
+		})
+		return
+	}
+
+	utils.JSONResponse(w, 200, &TokensUpdateResponse{
+		Success: true,
+		Session: makeSession(token, session),
+	})
+}
+
+// TokensDeleteResponse contains the result of the TokensDelete request.
+type TokensDeleteResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+// TokensDelete destroys either the current auth token or one of the sessions
+// passed as an URL param
+func TokensDelete(c web.C, w http.ResponseWriter, r *http.Request) {
+	session := c.Env["token"].(*models.Token)
+
+	var err error
+	token := findSession(session, c.URLParams["id"])
+	if token == nil {
+		utils.JSONResponse(w, 404, &TokensDeleteResponse{
+			Success: false,
+			Message: "Invalid token ID",
+		})
+		return
+	}
+
+	// Delete it from the database, along with the refresh tokens of the session
+	if token.Family != "" {
+		_, err = env.Tokens.DeleteFamily(token.Family)
+	} else {
+		err = env.Tokens.DeleteID(token.ID)
+	}
+	if err != nil {
 		env.Log.WithFields(logrus.Fields{
 			"error": err.Error(),
 		}).Error("Unable to delete a token")
@@ -254,8 +665,17 @@ func TokensDelete(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	message := "Successfully logged out"
+	if token.ID != session.ID {
+		message = "Session revoked"
+	}
+
+	audit(c, r, "session.delete", session.Owner, session.Owner, map[string]interface{}{
+		"session": token.SessionID(),
+	})
+
 	utils.JSONResponse(w, 200, &TokensDeleteResponse{
 		Success: true,
-		Message: "Successfully logged out",
+		Message: message,
 	})
 }
@@ -0,0 +1,479 @@
+package routes
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/zenazn/goji/web"
+
+	"github.com/lavab/api/env"
+	"github.com/lavab/api/models"
+	"github.com/lavab/api/storage"
+	"github.com/lavab/api/utils"
+)
+
+// uploadPruneInterval is how often expired uploads are removed
+const uploadPruneInterval = time.Hour
+
+// PruneUploads periodically removes abandoned uploads and their chunks
+func PruneUploads() {
+	for {
+		deleted, err := env.Uploads.DeleteExpired()
+		if err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("Unable to remove expired uploads")
+		}
+
+		if deleted > 0 {
+			env.Log.WithFields(logrus.Fields{
+				"count": deleted,
+			}).Info("Removed expired uploads")
+		}
+
+		time.Sleep(uploadPruneInterval)
+	}
+}
+
+// maxUploadChunks returns the number of chunks needed to upload a file of the
+// maximal size
+func maxUploadChunks() int {
+	return int((env.Config.MaxUploadSize + env.Config.MaxChunkSize - 1) / env.Config.MaxChunkSize)
+}
+
+// UploadsCreateRequest contains the input for the UploadsCreate endpoint.
+type UploadsCreateRequest struct {
+	Name            string   `json:"name" schema:"name"`
+	Encoding        string   `json:"encoding" schema:"encoding"`
+	VersionMajor    int      `json:"version_major" schema:"version_major"`
+	VersionMinor    int      `json:"version_minor" schema:"version_minor"`
+	PGPFingerprints []string `json:"pgp_fingerprints" schema:"pgp_fingerprints"`
+	ChunkCount      int      `json:"chunk_count" schema:"chunk_count"`
+}
+
+// UploadsCreateResponse contains the result of the UploadsCreate request.
+type UploadsCreateResponse struct {
+	Success bool           `json:"success"`
+	Message string         `json:"message"`
+	Upload  *models.Upload `json:"upload,omitempty"`
+}
+
+// UploadsCreate starts a new chunked upload of a file
+func UploadsCreate(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Decode the request
+	var input UploadsCreateRequest
+	err := utils.ParseRequest(r, &input)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("Unable to decode a request")
+
+		utils.JSONResponse(w, 400, &UploadsCreateResponse{
+			Success: false,
+			Message: "Invalid input format",
+		})
+		return
+	}
+
+	// Fetch the current session from the middleware
+	session := c.Env["token"].(*models.Token)
+
+	// Ensure that the input data isn't empty
+	if input.Name == "" || input.Encoding == "" || input.ChunkCount < 1 {
+		utils.JSONResponse(w, 400, &UploadsCreateResponse{
+			Success: false,
+			Message: "Invalid request",
+		})
+		return
+	}
+
+	// Chunks are allocated by their declared count, so it's limited by the
+	// maximal size of the file
+	if maxChunks := maxUploadChunks(); input.ChunkCount > maxChunks {
+		utils.JSONResponse(w, 400, &UploadsCreateResponse{
+			Success: false,
+			Message: "Upload can have at most " + strconv.Itoa(maxChunks) + " chunks of " +
+				strconv.FormatInt(env.Config.MaxChunkSize, 10) + " bytes",
+		})
+		return
+	}
+
+	// Create a new upload struct
+	upload := &models.Upload{
+		Resource:        models.MakeResource(session.Owner, input.Name),
+		Encoding:        input.Encoding,
+		PGPFingerprints: input.PGPFingerprints,
+		VersionMajor:    input.VersionMajor,
+		VersionMinor:    input.VersionMinor,
+		ChunkCount:      input.ChunkCount,
+		Chunks:          []int{},
+	}
+	upload.ExpireAfterNHours(24)
+
+	// Insert the upload into the database
+	if err := env.Uploads.Insert(upload); err != nil {
+		utils.JSONResponse(w, 500, &UploadsCreateResponse{
+			Success: false,
+			Message: "Internal server error - UP/CR/01",
+		})
+
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Could not insert an upload into the database")
+		return
+	}
+
+	// Notify other sessions
+	publish(session.Owner, "upload.create", upload.ID, upload)
+
+	utils.JSONResponse(w, 201, &UploadsCreateResponse{
+		Success: true,
+		Message: "A new upload was successfully created",
+		Upload:  upload,
+	})
+}
+
+// UploadsGetResponse contains the result of the UploadsGet request.
+type UploadsGetResponse struct {
+	Success bool           `json:"success"`
+	Message string         `json:"message,omitempty"`
+	Upload  *models.Upload `json:"upload,omitempty"`
+}
+
+// UploadsGet returns the upload's state, so that clients can resume it
+func UploadsGet(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Get the upload from the database
+	upload, err := env.Uploads.GetUpload(c.URLParams["id"])
+	if err != nil {
+		utils.JSONResponse(w, 404, &UploadsGetResponse{
+			Success: false,
+			Message: "Upload not found",
+		})
+		return
+	}
+
+	// Fetch the current session from the middleware
+	session := c.Env["token"].(*models.Token)
+
+	// Check for ownership
+	if upload.Owner != session.Owner {
+		utils.JSONResponse(w, 404, &UploadsGetResponse{
+			Success: false,
+			Message: "Upload not found",
+		})
+		return
+	}
+
+	utils.JSONResponse(w, 200, &UploadsGetResponse{
+		Success: true,
+		Upload:  upload,
+	})
+}
+
+// UploadsPutChunkResponse contains the result of the UploadsPutChunk request.
+type UploadsPutChunkResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+	Chunk   int    `json:"chunk"`
+	Size    int64  `json:"size"`
+}
+
+// UploadsPutChunk stores a single chunk of an upload. The chunk is either the raw
+// request body or the "chunk" field of a multipart form.
+func UploadsPutChunk(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Parse the chunk number
+	n, err := strconv.Atoi(c.URLParams["n"])
+	if err != nil {
+		utils.JSONResponse(w, 400, &UploadsPutChunkResponse{
+			Success: false,
+			Message: "Invalid chunk number",
+		})
+		return
+	}
+
+	// Get the upload from the database
+	upload, err := env.Uploads.GetUpload(c.URLParams["id"])
+	if err != nil {
+		utils.JSONResponse(w, 404, &UploadsPutChunkResponse{
+			Success: false,
+			Message: "Upload not found",
+		})
+		return
+	}
+
+	// Fetch the current session from the middleware
+	session := c.Env["token"].(*models.Token)
+
+	// Check for ownership
+	if upload.Owner != session.Owner {
+		utils.JSONResponse(w, 404, &UploadsPutChunkResponse{
+			Success: false,
+			Message: "Upload not found",
+		})
+		return
+	}
+
+	// Check if it's expired
+	if upload.Expired() {
+		utils.JSONResponse(w, 410, &UploadsPutChunkResponse{
+			Success: false,
+			Message: "Upload has expired",
+		})
+		env.Uploads.DeleteID(upload.ID)
+		return
+	}
+
+	// Ensure that the chunk was declared
+	if n < 0 || n >= upload.ChunkCount {
+		utils.JSONResponse(w, 400, &UploadsPutChunkResponse{
+			Success: false,
+			Message: "Invalid chunk number",
+		})
+		return
+	}
+
+	// Leave some space for the multipart encoding
+	r.Body = http.MaxBytesReader(w, r.Body, env.Config.MaxChunkSize+4096)
+
+	// Get the chunk's reader
+	var chunk io.Reader = r.Body
+	if strings.Contains(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("chunk")
+		if err != nil {
+			utils.JSONResponse(w, 400, &UploadsPutChunkResponse{
+				Success: false,
+				Message: "Invalid chunk",
+			})
+			return
+		}
+		defer file.Close()
+
+		chunk = file
+	}
+
+	// Write it into the blob store, reading at most one byte over the limit
+	size, err := env.Blobs.Put(upload.ChunkKey(n), io.LimitReader(chunk, env.Config.MaxChunkSize+1))
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+			"id":    upload.ID,
+			"chunk": n,
+		}).Error("Unable to store a chunk")
+
+		utils.JSONResponse(w, 500, &UploadsPutChunkResponse{
+			Success: false,
+			Message: "Internal error (code UP/PC/01)",
+		})
+		return
+	}
+
+	if size > env.Config.MaxChunkSize || size == 0 {
+		env.Blobs.Delete(upload.ChunkKey(n))
+
+		utils.JSONResponse(w, 400, &UploadsPutChunkResponse{
+			Success: false,
+			Message: "Chunk has to be between 1 and " + strconv.FormatInt(env.Config.MaxChunkSize, 10) + " bytes long",
+		})
+		return
+	}
+
+	// Mark it as received
+	if err := env.Uploads.AddChunk(upload.ID, n); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+			"id":    upload.ID,
+			"chunk": n,
+		}).Error("Unable to update an upload")
+
+		utils.JSONResponse(w, 500, &UploadsPutChunkResponse{
+			Success: false,
+			Message: "Internal error (code UP/PC/02)",
+		})
+		return
+	}
+
+	// Notify other sessions
+	publish(session.Owner, "upload.chunk", upload.ID, map[string]interface{}{
+		"chunk": n,
+		"size":  size,
+	})
+
+	utils.JSONResponse(w, 200, &UploadsPutChunkResponse{
+		Success: true,
+		Message: "Chunk successfully stored",
+		Chunk:   n,
+		Size:    size,
+	})
+}
+
+// UploadsFinalizeResponse contains the result of the UploadsFinalize request.
+type UploadsFinalizeResponse struct {
+	Success bool           `json:"success"`
+	Message string         `json:"message"`
+	File    *models.File   `json:"file,omitempty"`
+	Upload  *models.Upload `json:"upload,omitempty"`
+}
+
+// UploadsFinalize joins the received chunks into a new file
+func UploadsFinalize(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Get the upload from the database
+	upload, err := env.Uploads.GetUpload(c.URLParams["id"])
+	if err != nil {
+		utils.JSONResponse(w, 404, &UploadsFinalizeResponse{
+			Success: false,
+			Message: "Upload not found",
+		})
+		return
+	}
+
+	// Fetch the current session from the middleware
+	session := c.Env["token"].(*models.Token)
+
+	// Check for ownership
+	if upload.Owner != session.Owner {
+		utils.JSONResponse(w, 404, &UploadsFinalizeResponse{
+			Success: false,
+			Message: "Upload not found",
+		})
+		return
+	}
+
+	// Check if it's expired
+	if upload.Expired() {
+		utils.JSONResponse(w, 410, &UploadsFinalizeResponse{
+			Success: false,
+			Message: "Upload has expired",
+		})
+		env.Uploads.DeleteID(upload.ID)
+		return
+	}
+
+	// Ensure that we have all the chunks
+	if !upload.Complete() {
+		utils.JSONResponse(w, 409, &UploadsFinalizeResponse{
+			Success: false,
+			Message: "Upload is incomplete",
+			Upload:  upload,
+		})
+		return
+	}
+
+	// Create a new file struct. It reuses upload's ID, so finalizing twice fails on insert.
+	file := &models.File{
+		Encrypted: models.Encrypted{
+			Encoding:        upload.Encoding,
+			Schema:          "file",
+			VersionMajor:    upload.VersionMajor,
+			VersionMinor:    upload.VersionMinor,
+			PGPFingerprints: upload.PGPFingerprints,
+		},
+		Resource: models.MakeResource(session.Owner, upload.Name),
+	}
+	file.ID = upload.ID
+
+	// Concatenate the chunks in order
+	err = env.Files.StorePayload(file, func() (io.ReadCloser, error) {
+		return storage.NewMultiReader(env.Blobs, upload.ChunkKeys()...), nil
+	})
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+			"id":    upload.ID,
+		}).Error("Unable to join upload's chunks")
+
+		utils.JSONResponse(w, 500, &UploadsFinalizeResponse{
+			Success: false,
+			Message: "Internal error (code UP/FI/01)",
+		})
+		return
+	}
+
+	// Insert the file into the database
+	if err := env.Files.Insert(file); err != nil {
+		utils.JSONResponse(w, 500, &UploadsFinalizeResponse{
+			Success: false,
+			Message: "Internal error (code UP/FI/02)",
+		})
+
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Could not insert a file into the database")
+		return
+	}
+
+	// Remove the upload, the file is already safe
+	if err := env.Uploads.DeleteID(upload.ID); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+			"id":    upload.ID,
+		}).Error("Unable to remove a finalized upload")
+	}
+
+	// Notify other sessions
+	publish(session.Owner, "upload.delete", upload.ID, nil)
+	publish(session.Owner, "file.create", file.ID, file)
+
+	utils.JSONResponse(w, 201, &UploadsFinalizeResponse{
+		Success: true,
+		Message: "A new file was successfully created",
+		File:    file,
+	})
+}
+
+// UploadsDeleteResponse contains the result of the UploadsDelete request.
+type UploadsDeleteResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+// UploadsDelete aborts an upload and removes its chunks
+func UploadsDelete(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Get the upload from the database
+	upload, err := env.Uploads.GetUpload(c.URLParams["id"])
+	if err != nil {
+		utils.JSONResponse(w, 404, &UploadsDeleteResponse{
+			Success: false,
+			Message: "Upload not found",
+		})
+		return
+	}
+
+	// Fetch the current session from the middleware
+	session := c.Env["token"].(*models.Token)
+
+	// Check for ownership
+	if upload.Owner != session.Owner {
+		utils.JSONResponse(w, 404, &UploadsDeleteResponse{
+			Success: false,
+			Message: "Upload not found",
+		})
+		return
+	}
+
+	// Perform the deletion
+	err = env.Uploads.DeleteID(upload.ID)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+			"id":    upload.ID,
+		}).Error("Unable to delete an upload")
+
+		utils.JSONResponse(w, 500, &UploadsDeleteResponse{
+			Success: false,
+			Message: "Internal error (code UP/DE/01)",
+		})
+		return
+	}
+
+	// Notify other sessions
+	publish(session.Owner, "upload.delete", upload.ID, nil)
+
+	utils.JSONResponse(w, 200, &UploadsDeleteResponse{
+		Success: true,
+		Message: "Upload successfully removed",
+	})
+}
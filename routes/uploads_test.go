@@ -0,0 +1,48 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/zenazn/goji/web"
+
+	"github.com/lavab/api/env"
+	"github.com/lavab/api/models"
+)
+
+func TestUploadsCreateChunkCount(t *testing.T) {
+	env.Config = &env.Flags{
+		MaxChunkSize:  8 * 1024 * 1024,
+		MaxUploadSize: 1024*1024*1024 + 1,
+	}
+
+	if chunks := maxUploadChunks(); chunks != 129 {
+		t.Fatalf("invalid chunk limit %d", chunks)
+	}
+
+	for _, count := range []int{0, -1, 130, 1 << 40} {
+		r, err := http.NewRequest("POST", "/uploads", strings.NewReader(
+			`{"name":"file","encoding":"json","chunk_count":`+strconv.Itoa(count)+`}`,
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "application/json")
+
+		c := web.C{
+			Env: map[string]interface{}{
+				"token": &models.Token{Resource: models.Resource{Owner: "owner"}},
+			},
+		}
+
+		w := httptest.NewRecorder()
+		UploadsCreate(c, w, r)
+
+		if w.Code != 400 {
+			t.Fatalf("upload of %d chunks: %d %s", count, w.Code, w.Body.String())
+		}
+	}
+}
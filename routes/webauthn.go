@@ -0,0 +1,473 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/zenazn/goji/web"
+
+	"github.com/lavab/api/env"
+	"github.com/lavab/api/factor"
+	"github.com/lavab/api/models"
+	"github.com/lavab/api/utils"
+)
+
+// webAuthn returns the WebAuthn factor
+func webAuthn() *factor.WebAuthn {
+	return env.Factors["webauthn"].(*factor.WebAuthn)
+}
+
+// WebAuthnListResponse contains the result of the WebAuthnList request.
+type WebAuthnListResponse struct {
+	Success     bool                         `json:"success"`
+	Message     string                       `json:"message,omitempty"`
+	Credentials []*factor.WebAuthnCredential `json:"credentials,omitempty"`
+}
+
+// WebAuthnList returns authenticators registered to the account
+func WebAuthnList(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Right now we only support "me" as the ID
+	if c.URLParams["id"] != "me" {
+		utils.JSONResponse(w, 501, &WebAuthnListResponse{
+			Success: false,
+			Message: `Only the "me" user is implemented`,
+		})
+		return
+	}
+
+	session := c.Env["token"].(*models.Token)
+
+	user, err := env.Accounts.GetAccount(session.Owner)
+	if err != nil {
+		utils.JSONResponse(w, 500, &WebAuthnListResponse{
+			Success: false,
+			Message: "Unable to resolve the account",
+		})
+		return
+	}
+
+	credentials := []*factor.WebAuthnCredential{}
+	if user.FactorType == webAuthn().Type() {
+		credentials, err = webAuthn().Credentials(user.FactorValue)
+		if err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error":   err.Error(),
+				"account": user.ID,
+			}).Error("Unable to decode WebAuthn credentials")
+
+			utils.JSONResponse(w, 500, &WebAuthnListResponse{
+				Success: false,
+				Message: "Internal error (code WA/LI/01)",
+			})
+			return
+		}
+	}
+
+	utils.JSONResponse(w, 200, &WebAuthnListResponse{
+		Success:     true,
+		Credentials: credentials,
+	})
+}
+
+// WebAuthnRegisterRequest contains the input for the WebAuthnRegister endpoint.
+type WebAuthnRegisterRequest struct {
+	Password string `json:"password" schema:"password"`
+	Token    string `json:"token" schema:"token"`
+}
+
+// WebAuthnRegisterResponse contains the result of the WebAuthnRegister request.
+type WebAuthnRegisterResponse struct {
+	Success bool            `json:"success"`
+	Message string          `json:"message,omitempty"`
+	Options json.RawMessage `json:"options,omitempty"`
+}
+
+// WebAuthnRegister starts a registration of a new authenticator. The returned
+// options have to be passed to navigator.credentials.create. Adding another
+// authenticator requires an assertion from an already registered one.
+func WebAuthnRegister(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Decode the request
+	var input WebAuthnRegisterRequest
+	err := utils.ParseRequest(r, &input)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("Unable to decode a request")
+
+		utils.JSONResponse(w, 400, &WebAuthnRegisterResponse{
+			Success: false,
+			Message: "Invalid input format",
+		})
+		return
+	}
+
+	// Right now we only support "me" as the ID
+	if c.URLParams["id"] != "me" {
+		utils.JSONResponse(w, 501, &WebAuthnRegisterResponse{
+			Success: false,
+			Message: `Only the "me" user is implemented`,
+		})
+		return
+	}
+
+	session := c.Env["token"].(*models.Token)
+
+	user, err := env.Accounts.GetAccount(session.Owner)
+	if err != nil {
+		utils.JSONResponse(w, 500, &WebAuthnRegisterResponse{
+			Success: false,
+			Message: "Unable to resolve the account",
+		})
+		return
+	}
+
+	if valid, _, err := user.VerifyPassword(input.Password); err != nil || !valid {
+		utils.JSONResponse(w, 403, &WebAuthnRegisterResponse{
+			Success: false,
+			Message: "Invalid password",
+		})
+		return
+	}
+
+	var existing []string
+	switch user.FactorType {
+	case "":
+	case webAuthn().Type():
+		verified, challenge, err := verifyFactor(user, webAuthn(), input.Token)
+		if err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error":  err.Error(),
+				"factor": user.FactorType,
+			}).Warn("2FA authentication error")
+
+			utils.JSONResponse(w, 500, &WebAuthnRegisterResponse{
+				Success: false,
+				Message: "Internal 2FA error",
+			})
+			return
+		}
+
+		if !verified && input.Token == "" {
+			utils.JSONResponse(w, 403, &WebAuthnRegisterResponse{
+				Success: false,
+				Message: "2FA token was not passed",
+				Options: json.RawMessage(challenge),
+			})
+			return
+		}
+
+		if !verified {
+			utils.JSONResponse(w, 403, &WebAuthnRegisterResponse{
+				Success: false,
+				Message: "Invalid token passed",
+			})
+			return
+		}
+
+		existing = user.FactorValue
+	default:
+		utils.JSONResponse(w, 409, &WebAuthnRegisterResponse{
+			Success: false,
+			Message: "Another 2FA method is enabled",
+		})
+		return
+	}
+
+	options, err := webAuthn().BeginRegistration(user.ID, user.Name, existing)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to start a WebAuthn registration")
+
+		utils.JSONResponse(w, 500, &WebAuthnRegisterResponse{
+			Success: false,
+			Message: "Internal error (code WA/RE/01)",
+		})
+		return
+	}
+
+	utils.JSONResponse(w, 201, &WebAuthnRegisterResponse{
+		Success: true,
+		Options: json.RawMessage(options),
+	})
+}
+
+// WebAuthnConfirmRequest contains the input for the WebAuthnConfirm endpoint.
+type WebAuthnConfirmRequest struct {
+	Name       string `json:"name" schema:"name"`
+	Credential string `json:"credential" schema:"credential"`
+}
+
+// WebAuthnConfirmResponse contains the result of the WebAuthnConfirm request.
+type WebAuthnConfirmResponse struct {
+	Success    bool                       `json:"success"`
+	Message    string                     `json:"message,omitempty"`
+	Credential *factor.WebAuthnCredential `json:"credential,omitempty"`
+}
+
+// WebAuthnConfirm verifies the JSON-encoded result of navigator.credentials.create
+// and enables the WebAuthn factor
+func WebAuthnConfirm(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Decode the request
+	var input WebAuthnConfirmRequest
+	err := utils.ParseRequest(r, &input)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("Unable to decode a request")
+
+		utils.JSONResponse(w, 400, &WebAuthnConfirmResponse{
+			Success: false,
+			Message: "Invalid input format",
+		})
+		return
+	}
+
+	// Right now we only support "me" as the ID
+	if c.URLParams["id"] != "me" {
+		utils.JSONResponse(w, 501, &WebAuthnConfirmResponse{
+			Success: false,
+			Message: `Only the "me" user is implemented`,
+		})
+		return
+	}
+
+	if input.Name == "" {
+		input.Name = "Security key"
+	}
+
+	session := c.Env["token"].(*models.Token)
+
+	user, err := env.Accounts.GetAccount(session.Owner)
+	if err != nil {
+		utils.JSONResponse(w, 500, &WebAuthnConfirmResponse{
+			Success: false,
+			Message: "Unable to resolve the account",
+		})
+		return
+	}
+
+	if user.FactorType != "" && user.FactorType != webAuthn().Type() {
+		utils.JSONResponse(w, 409, &WebAuthnConfirmResponse{
+			Success: false,
+			Message: "Another 2FA method is enabled",
+		})
+		return
+	}
+
+	var existing []string
+	if user.FactorType == webAuthn().Type() {
+		existing = user.FactorValue
+	}
+
+	credential, err := webAuthn().FinishRegistration(user.ID, input.Name, existing, input.Credential)
+	if err == factor.ErrInvalidCredential || err == factor.ErrCredentialExists {
+		utils.JSONResponse(w, 400, &WebAuthnConfirmResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to finish a WebAuthn registration")
+
+		utils.JSONResponse(w, 500, &WebAuthnConfirmResponse{
+			Success: false,
+			Message: "Internal error (code WA/CO/01)",
+		})
+		return
+	}
+
+	encoded, err := credential.Encode()
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to encode a WebAuthn credential")
+
+		utils.JSONResponse(w, 500, &WebAuthnConfirmResponse{
+			Success: false,
+			Message: "Internal error (code WA/CO/02)",
+		})
+		return
+	}
+
+	user.FactorType = webAuthn().Type()
+	user.FactorValue = append(existing, encoded)
+	user.DateModified = time.Now()
+
+	if err := env.Accounts.UpdateID(user.ID, user); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to update an account")
+
+		utils.JSONResponse(w, 500, &WebAuthnConfirmResponse{
+			Success: false,
+			Message: "Internal error (code WA/CO/03)",
+		})
+		return
+	}
+
+	audit(c, r, "factor.enable", user.ID, user.ID, map[string]interface{}{
+		"factor": webAuthn().Type(),
+	})
+
+	// Notify other sessions
+	publish(user.ID, "account.update", user.ID, user)
+
+	utils.JSONResponse(w, 201, &WebAuthnConfirmResponse{
+		Success:    true,
+		Message:    "Authenticator registered",
+		Credential: credential,
+	})
+}
+
+// WebAuthnDeleteRequest contains the input for the WebAuthnDelete endpoint.
+type WebAuthnDeleteRequest struct {
+	Password string `json:"password" schema:"password"`
+	Token    string `json:"token" schema:"token"`
+}
+
+// WebAuthnDeleteResponse contains the result of the WebAuthnDelete request.
+type WebAuthnDeleteResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+// WebAuthnDelete removes an authenticator. Removing the last one disables the factor.
+func WebAuthnDelete(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Decode the request
+	var input WebAuthnDeleteRequest
+	err := utils.ParseRequest(r, &input)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("Unable to decode a request")
+
+		utils.JSONResponse(w, 400, &WebAuthnDeleteResponse{
+			Success: false,
+			Message: "Invalid input format",
+		})
+		return
+	}
+
+	// Right now we only support "me" as the ID
+	if c.URLParams["id"] != "me" {
+		utils.JSONResponse(w, 501, &WebAuthnDeleteResponse{
+			Success: false,
+			Message: `Only the "me" user is implemented`,
+		})
+		return
+	}
+
+	session := c.Env["token"].(*models.Token)
+
+	user, err := env.Accounts.GetAccount(session.Owner)
+	if err != nil {
+		utils.JSONResponse(w, 500, &WebAuthnDeleteResponse{
+			Success: false,
+			Message: "Unable to resolve the account",
+		})
+		return
+	}
+
+	if user.FactorType != webAuthn().Type() {
+		utils.JSONResponse(w, 404, &WebAuthnDeleteResponse{
+			Success: false,
+			Message: "Authenticator not found",
+		})
+		return
+	}
+
+	if valid, _, err := user.VerifyPassword(input.Password); err != nil || !valid {
+		utils.JSONResponse(w, 403, &WebAuthnDeleteResponse{
+			Success: false,
+			Message: "Invalid password",
+		})
+		return
+	}
+
+	verified, _, err := verifyFactor(user, webAuthn(), input.Token)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error":  err.Error(),
+			"factor": user.FactorType,
+		}).Warn("2FA authentication error")
+
+		utils.JSONResponse(w, 500, &WebAuthnDeleteResponse{
+			Success: false,
+			Message: "Internal 2FA error",
+		})
+		return
+	}
+
+	if !verified {
+		utils.JSONResponse(w, 403, &WebAuthnDeleteResponse{
+			Success: false,
+			Message: "Invalid token passed",
+		})
+		return
+	}
+
+	credentials, err := webAuthn().Credentials(user.FactorValue)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error":   err.Error(),
+			"account": user.ID,
+		}).Error("Unable to decode WebAuthn credentials")
+
+		utils.JSONResponse(w, 500, &WebAuthnDeleteResponse{
+			Success: false,
+			Message: "Internal error (code WA/DE/01)",
+		})
+		return
+	}
+
+	remaining := []string{}
+	for i, credential := range credentials {
+		if credential.ID != c.URLParams["credential"] {
+			remaining = append(remaining, user.FactorValue[i])
+		}
+	}
+
+	if len(remaining) == len(credentials) {
+		utils.JSONResponse(w, 404, &WebAuthnDeleteResponse{
+			Success: false,
+			Message: "Authenticator not found",
+		})
+		return
+	}
+
+	user.FactorValue = remaining
+	if len(remaining) == 0 {
+		user.FactorType = ""
+	}
+	user.DateModified = time.Now()
+
+	if err := env.Accounts.UpdateID(user.ID, user); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to update an account")
+
+		utils.JSONResponse(w, 500, &WebAuthnDeleteResponse{
+			Success: false,
+			Message: "Internal error (code WA/DE/02)",
+		})
+		return
+	}
+
+	audit(c, r, "factor.disable", user.ID, user.ID, map[string]interface{}{
+		"factor": webAuthn().Type(),
+	})
+
+	// Notify other sessions
+	publish(user.ID, "account.update", user.ID, user)
+
+	utils.JSONResponse(w, 200, &WebAuthnDeleteResponse{
+		Success: true,
+		Message: "Authenticator removed",
+	})
+}
@@ -0,0 +1,394 @@
+package routes
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/zenazn/goji/web"
+
+	"github.com/lavab/api/env"
+	"github.com/lavab/api/factor"
+	"github.com/lavab/api/models"
+	"github.com/lavab/api/utils"
+)
+
+// yubiKey returns the local YubiKey OTP factor
+func yubiKey() *factor.YubiKey {
+	return env.Factors["yubikey"].(*factor.YubiKey)
+}
+
+// withoutSecrets removes secrets of keys before they are sent to the client
+func withoutSecrets(credentials []*factor.YubiKeyCredential) []*factor.YubiKeyCredential {
+	for _, credential := range credentials {
+		credential.PrivateID = ""
+		credential.AESKey = ""
+	}
+
+	return credentials
+}
+
+// YubiKeysListResponse contains the result of the YubiKeysList request.
+type YubiKeysListResponse struct {
+	Success  bool                        `json:"success"`
+	Message  string                      `json:"message,omitempty"`
+	YubiKeys []*factor.YubiKeyCredential `json:"yubikeys,omitempty"`
+}
+
+// YubiKeysList returns YubiKeys registered for local OTP validation
+func YubiKeysList(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Right now we only support "me" as the ID
+	if c.URLParams["id"] != "me" {
+		utils.JSONResponse(w, 501, &YubiKeysListResponse{
+			Success: false,
+			Message: `Only the "me" user is implemented`,
+		})
+		return
+	}
+
+	session := c.Env["token"].(*models.Token)
+
+	user, err := env.Accounts.GetAccount(session.Owner)
+	if err != nil {
+		utils.JSONResponse(w, 500, &YubiKeysListResponse{
+			Success: false,
+			Message: "Unable to resolve the account",
+		})
+		return
+	}
+
+	keys := []*factor.YubiKeyCredential{}
+	if user.FactorType == yubiKey().Type() {
+		keys, err = yubiKey().Credentials(user.FactorValue)
+		if err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error":   err.Error(),
+				"account": user.ID,
+			}).Error("Unable to decode YubiKeys")
+
+			utils.JSONResponse(w, 500, &YubiKeysListResponse{
+				Success: false,
+				Message: "Internal error (code YK/LI/01)",
+			})
+			return
+		}
+	}
+
+	utils.JSONResponse(w, 200, &YubiKeysListResponse{
+		Success:  true,
+		YubiKeys: withoutSecrets(keys),
+	})
+}
+
+// YubiKeysCreateRequest contains the input for the YubiKeysCreate endpoint.
+type YubiKeysCreateRequest struct {
+	Password  string `json:"password" schema:"password"`
+	Token     string `json:"token" schema:"token"`
+	Name      string `json:"name" schema:"name"`
+	PrivateID string `json:"private_id" schema:"private_id"`
+	AESKey    string `json:"aes_key" schema:"aes_key"`
+	OTP       string `json:"otp" schema:"otp"`
+}
+
+// YubiKeysCreateResponse contains the result of the YubiKeysCreate request.
+type YubiKeysCreateResponse struct {
+	Success bool                      `json:"success"`
+	Message string                    `json:"message"`
+	YubiKey *factor.YubiKeyCredential `json:"yubikey,omitempty"`
+}
+
+// YubiKeysCreate registers a YubiKey programmed with a known AES key. The OTP
+// proves that the secrets match the key. Adding another key requires an OTP
+// from an already registered one.
+func YubiKeysCreate(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Decode the request
+	var input YubiKeysCreateRequest
+	err := utils.ParseRequest(r, &input)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("Unable to decode a request")
+
+		utils.JSONResponse(w, 400, &YubiKeysCreateResponse{
+			Success: false,
+			Message: "Invalid input format",
+		})
+		return
+	}
+
+	// Right now we only support "me" as the ID
+	if c.URLParams["id"] != "me" {
+		utils.JSONResponse(w, 501, &YubiKeysCreateResponse{
+			Success: false,
+			Message: `Only the "me" user is implemented`,
+		})
+		return
+	}
+
+	if input.Name == "" {
+		input.Name = "YubiKey"
+	}
+
+	session := c.Env["token"].(*models.Token)
+
+	user, err := env.Accounts.GetAccount(session.Owner)
+	if err != nil {
+		utils.JSONResponse(w, 500, &YubiKeysCreateResponse{
+			Success: false,
+			Message: "Unable to resolve the account",
+		})
+		return
+	}
+
+	if valid, _, err := user.VerifyPassword(input.Password); err != nil || !valid {
+		utils.JSONResponse(w, 403, &YubiKeysCreateResponse{
+			Success: false,
+			Message: "Invalid password",
+		})
+		return
+	}
+
+	var existing []string
+	switch user.FactorType {
+	case "":
+	case yubiKey().Type():
+		verified, _, err := verifyFactor(user, yubiKey(), input.Token)
+		if err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error":  err.Error(),
+				"factor": user.FactorType,
+			}).Warn("2FA authentication error")
+
+			utils.JSONResponse(w, 500, &YubiKeysCreateResponse{
+				Success: false,
+				Message: "Internal 2FA error",
+			})
+			return
+		}
+
+		if !verified {
+			utils.JSONResponse(w, 403, &YubiKeysCreateResponse{
+				Success: false,
+				Message: "Invalid token passed",
+			})
+			return
+		}
+
+		existing = user.FactorValue
+	default:
+		utils.JSONResponse(w, 409, &YubiKeysCreateResponse{
+			Success: false,
+			Message: "Another 2FA method is enabled",
+		})
+		return
+	}
+
+	key, err := yubiKey().Register(input.Name, input.PrivateID, input.AESKey, input.OTP, existing)
+	if err == factor.ErrInvalidOTP || err == factor.ErrYubiKeyExists {
+		utils.JSONResponse(w, 400, &YubiKeysCreateResponse{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to register a YubiKey")
+
+		utils.JSONResponse(w, 500, &YubiKeysCreateResponse{
+			Success: false,
+			Message: "Internal error (code YK/CR/01)",
+		})
+		return
+	}
+
+	encoded, err := key.Encode()
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to encode a YubiKey")
+
+		utils.JSONResponse(w, 500, &YubiKeysCreateResponse{
+			Success: false,
+			Message: "Internal error (code YK/CR/02)",
+		})
+		return
+	}
+
+	user.FactorType = yubiKey().Type()
+	user.FactorValue = append(existing, encoded)
+	user.DateModified = time.Now()
+
+	if err := env.Accounts.UpdateID(user.ID, user); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to update an account")
+
+		utils.JSONResponse(w, 500, &YubiKeysCreateResponse{
+			Success: false,
+			Message: "Internal error (code YK/CR/03)",
+		})
+		return
+	}
+
+	audit(c, r, "factor.enable", user.ID, user.ID, map[string]interface{}{
+		"factor": yubiKey().Type(),
+	})
+
+	// Notify other sessions
+	publish(user.ID, "account.update", user.ID, user)
+
+	utils.JSONResponse(w, 201, &YubiKeysCreateResponse{
+		Success: true,
+		Message: "YubiKey registered",
+		YubiKey: withoutSecrets([]*factor.YubiKeyCredential{key})[0],
+	})
+}
+
+// YubiKeysDeleteRequest contains the input for the YubiKeysDelete endpoint.
+type YubiKeysDeleteRequest struct {
+	Password string `json:"password" schema:"password"`
+	Token    string `json:"token" schema:"token"`
+}
+
+// YubiKeysDeleteResponse contains the result of the YubiKeysDelete request.
+type YubiKeysDeleteResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+// YubiKeysDelete removes a YubiKey. Removing the last one disables the factor.
+func YubiKeysDelete(c web.C, w http.ResponseWriter, r *http.Request) {
+	// Decode the request
+	var input YubiKeysDeleteRequest
+	err := utils.ParseRequest(r, &input)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("Unable to decode a request")
+
+		utils.JSONResponse(w, 400, &YubiKeysDeleteResponse{
+			Success: false,
+			Message: "Invalid input format",
+		})
+		return
+	}
+
+	// Right now we only support "me" as the ID
+	if c.URLParams["id"] != "me" {
+		utils.JSONResponse(w, 501, &YubiKeysDeleteResponse{
+			Success: false,
+			Message: `Only the "me" user is implemented`,
+		})
+		return
+	}
+
+	session := c.Env["token"].(*models.Token)
+
+	user, err := env.Accounts.GetAccount(session.Owner)
+	if err != nil {
+		utils.JSONResponse(w, 500, &YubiKeysDeleteResponse{
+			Success: false,
+			Message: "Unable to resolve the account",
+		})
+		return
+	}
+
+	if user.FactorType != yubiKey().Type() {
+		utils.JSONResponse(w, 404, &YubiKeysDeleteResponse{
+			Success: false,
+			Message: "YubiKey not found",
+		})
+		return
+	}
+
+	if valid, _, err := user.VerifyPassword(input.Password); err != nil || !valid {
+		utils.JSONResponse(w, 403, &YubiKeysDeleteResponse{
+			Success: false,
+			Message: "Invalid password",
+		})
+		return
+	}
+
+	verified, _, err := verifyFactor(user, yubiKey(), input.Token)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error":  err.Error(),
+			"factor": user.FactorType,
+		}).Warn("2FA authentication error")
+
+		utils.JSONResponse(w, 500, &YubiKeysDeleteResponse{
+			Success: false,
+			Message: "Internal 2FA error",
+		})
+		return
+	}
+
+	if !verified {
+		utils.JSONResponse(w, 403, &YubiKeysDeleteResponse{
+			Success: false,
+			Message: "Invalid token passed",
+		})
+		return
+	}
+
+	keys, err := yubiKey().Credentials(user.FactorValue)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error":   err.Error(),
+			"account": user.ID,
+		}).Error("Unable to decode YubiKeys")
+
+		utils.JSONResponse(w, 500, &YubiKeysDeleteResponse{
+			Success: false,
+			Message: "Internal error (code YK/DE/01)",
+		})
+		return
+	}
+
+	remaining := []string{}
+	for i, key := range keys {
+		if key.PublicID != c.URLParams["public_id"] {
+			remaining = append(remaining, user.FactorValue[i])
+		}
+	}
+
+	if len(remaining) == len(keys) {
+		utils.JSONResponse(w, 404, &YubiKeysDeleteResponse{
+			Success: false,
+			Message: "YubiKey not found",
+		})
+		return
+	}
+
+	user.FactorValue = remaining
+	if len(remaining) == 0 {
+		user.FactorType = ""
+	}
+	user.DateModified = time.Now()
+
+	if err := env.Accounts.UpdateID(user.ID, user); err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Unable to update an account")
+
+		utils.JSONResponse(w, 500, &YubiKeysDeleteResponse{
+			Success: false,
+			Message: "Internal error (code YK/DE/02)",
+		})
+		return
+	}
+
+	audit(c, r, "factor.disable", user.ID, user.ID, map[string]interface{}{
+		"factor": yubiKey().Type(),
+	})
+
+	// Notify other sessions
+	publish(user.ID, "account.update", user.ID, user)
+
+	utils.JSONResponse(w, 200, &YubiKeysDeleteResponse{
+		Success: true,
+		Message: "YubiKey removed",
+	})
+}
@@ -0,0 +1,88 @@
+package setup
+
+import (
+	"github.com/Sirupsen/logrus"
+
+	"github.com/lavab/api/env"
+	"github.com/lavab/api/events"
+	"github.com/lavab/api/models"
+)
+
+// deliveryMessage is the body of messages in the email_delivery topic
+type deliveryMessage struct {
+	ID    string `json:"id"`
+	Owner string `json:"owner"`
+}
+
+// routeDelivery notifies owner's sessions about a delivered email. All
+// instances share the consumer channel, so the message might be handled by a
+// node that doesn't hold the sessions - the bus passes the notification on.
+// resolve is only called if anyone listens. The returned thread is nil if
+// nobody does.
+func routeDelivery(
+	bus *events.Bus,
+	msg *deliveryMessage,
+	resolve func(id string) (*models.Email, *models.Thread, error),
+) (*models.Thread, error) {
+	// Check if anyone is handling owner's session
+	if !bus.Subscribed(msg.Owner) {
+		return nil, nil
+	}
+
+	email, thread, err := resolve(msg.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Send notifications to subscribers
+	bus.Send(msg.Owner, map[string]interface{}{
+		"type":   "delivery",
+		"id":     msg.ID,
+		"name":   email.Name,
+		"thread": email.Thread,
+		"labels": thread.Labels,
+	})
+
+	return thread, nil
+}
+
+// releaseAttachments removes inline copies of the payloads of a sent email's
+// attachments, which were made by routes.EmailsCreate for the mailer
+func releaseAttachments(id string) error {
+	email, err := env.Emails.GetEmail(id)
+	if err != nil {
+		return err
+	}
+
+	if email.Status == "queued" || len(email.Files) == 0 {
+		return nil
+	}
+
+	return env.Files.ReleaseInlinePayloads(email.Files...)
+}
+
+// resolveDelivery looks up the email of a delivery notification and its thread
+func resolveDelivery(id string) (*models.Email, *models.Thread, error) {
+	// Resolve the email
+	email, err := env.Emails.GetEmail(id)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+			"id":    id,
+		}).Error("Unable to resolve an email from queue")
+		return nil, nil, err
+	}
+
+	// Resolve the thread
+	thread, err := env.Threads.GetThread(email.Thread)
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error":  err.Error(),
+			"id":     id,
+			"thread": email.Thread,
+		}).Error("Unable to resolve a thread from queue")
+		return nil, nil, err
+	}
+
+	return email, thread, nil
+}
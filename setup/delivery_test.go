@@ -0,0 +1,149 @@
+package setup
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dchest/uniuri"
+
+	"github.com/lavab/api/events"
+	"github.com/lavab/api/models"
+)
+
+type testSession struct {
+	id       string
+	messages chan string
+}
+
+func (t *testSession) ID() string {
+	return t.id
+}
+
+func (t *testSession) Send(message string) error {
+	t.messages <- message
+	return nil
+}
+
+func newTestSession() *testSession {
+	return &testSession{
+		id:       uniuri.New(),
+		messages: make(chan string, 10),
+	}
+}
+
+// newInstance creates the event bus of a separate API instance
+func newInstance(t *testing.T, prefix string) (*events.Bus, *events.RedisTransport) {
+	address := os.Getenv("REDIS_ADDRESS")
+	if address == "" {
+		address = "127.0.0.1:6379"
+	}
+
+	transport, err := events.NewRedisTransport(&events.RedisTransportOpts{
+		Address: address,
+		Prefix:  prefix,
+	})
+	if err != nil {
+		t.Skipf("redis is not available at %s: %v", address, err)
+	}
+
+	bus := events.NewBus()
+	bus.SetTransport(transport)
+
+	return bus, transport
+}
+
+func TestRouteDelivery(t *testing.T) {
+	prefix := "delivery_test:" + uniuri.New() + ":"
+
+	first, firstTransport := newInstance(t, prefix)
+	defer firstTransport.Close(nil)
+	second, secondTransport := newInstance(t, prefix)
+	defer secondTransport.Close(nil)
+
+	// Wait for both listeners to subscribe
+	time.Sleep(500 * time.Millisecond)
+
+	var (
+		owner   = uniuri.New()
+		other   = uniuri.New()
+		session = newTestSession()
+		bystand = newTestSession()
+	)
+
+	// The recipient is connected to the first instance, someone else to the second
+	first.Subscribe(owner, session)
+	second.Subscribe(other, bystand)
+
+	resolved := 0
+	resolve := func(id string) (*models.Email, *models.Thread, error) {
+		resolved++
+
+		return &models.Email{
+			Resource: models.Resource{ID: id, Name: "subject"},
+			Thread:   "thread-id",
+		}, &models.Thread{
+			Labels: []string{"label-id"},
+		}, nil
+	}
+
+	// The message was consumed by the second instance
+	thread, err := routeDelivery(second, &deliveryMessage{
+		ID:    "email-id",
+		Owner: owner,
+	}, resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thread == nil || resolved != 1 {
+		t.Fatal("delivery wasn't routed to a subscribed owner")
+	}
+
+	select {
+	case message := <-session.messages:
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(message), &event); err != nil {
+			t.Fatal(err)
+		}
+
+		if event["type"] != "delivery" || event["id"] != "email-id" || event["thread"] != "thread-id" {
+			t.Fatalf("unexpected message %s", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery was not routed to the instance holding the session")
+	}
+
+	// Only the node holding the session gets the notification
+	select {
+	case message := <-bystand.messages:
+		t.Fatalf("notification reached another owner's session: %s", message)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Nobody listens to this owner, so the email isn't even resolved
+	thread, err = routeDelivery(first, &deliveryMessage{
+		ID:    "email-id",
+		Owner: uniuri.New(),
+	}, resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thread != nil || resolved != 1 {
+		t.Fatal("delivery was routed to an owner without sessions")
+	}
+
+	// After the session leaves, the second instance stops routing the owner's deliveries
+	first.Unsubscribe(owner, session)
+
+	thread, err = routeDelivery(second, &deliveryMessage{
+		ID:    "email-id",
+		Owner: owner,
+	}, resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thread != nil {
+		t.Fatal("delivery was routed after the session left")
+	}
+}
@@ -10,7 +10,6 @@ import (
 	"os"
 	"regexp"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -26,18 +25,15 @@ import (
 
 	"github.com/lavab/api/cache"
 	"github.com/lavab/api/db"
+	"github.com/lavab/api/dns"
 	"github.com/lavab/api/env"
+	"github.com/lavab/api/events"
 	"github.com/lavab/api/factor"
 	"github.com/lavab/api/routes"
+	"github.com/lavab/api/storage"
 	"github.com/lavab/api/utils"
 )
 
-// sessions contains all "subscribing" WebSockets sessions
-var (
-	sessions     = map[string][]sockjs.Session{}
-	sessionsLock sync.Mutex
-)
-
 type nopCloser struct {
 	io.Reader
 }
@@ -106,6 +102,15 @@ func PrepareMux(flags *env.Flags) *web.Mux {
 	// Pass it to the environment package
 	env.Log = log
 
+	// Only load balancers can tell the address of the client
+	trustedProxies, err := utils.ParseNetworks(flags.TrustedProxies)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Fatal("Unable to parse the trusted proxies")
+	}
+	env.TrustedProxies = trustedProxies
+
 	// Load the bloom filter
 	bf := bloom.NewWithEstimates(flags.BloomCount, 0.001)
 	bff, err := os.Open(flags.BloomFilter)
@@ -134,7 +139,44 @@ func PrepareMux(flags *env.Flags) *web.Mux {
 		}).Fatal("Unable to connect to the redis server")
 	}
 
-	env.Cache = redis
+	// Keep hot values in memory in front of redis
+	tiered := cache.NewTieredCache(redis, &cache.TieredCacheOpts{
+		MaxEntries: flags.CacheSize,
+		LocalTTL:   time.Duration(flags.CacheTTL) * time.Second,
+	})
+	tiered.OnError = func(err error) {
+		log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("Lost the connection to the cache invalidation channel")
+	}
+
+	env.Cache = tiered
+
+	// Initialize the blob store
+	var blobs storage.BlobStore
+	switch flags.BlobStore {
+	case "s3":
+		blobs, err = storage.NewS3Store(&storage.S3StoreOpts{
+			Endpoint:  flags.S3Endpoint,
+			Region:    flags.S3Region,
+			Bucket:    flags.S3Bucket,
+			AccessKey: flags.S3AccessKey,
+			SecretKey: flags.S3SecretKey,
+		})
+	case "local":
+		blobs, err = storage.NewLocalStore(&storage.LocalStoreOpts{
+			Path: flags.BlobPath,
+		})
+	default:
+		err = fmt.Errorf("unknown blob store %q", flags.BlobStore)
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Fatal("Unable to set up the blob store")
+	}
+
+	env.Blobs = blobs
 
 	// Set up the database
 	rethinkOpts := gorethink.ConnectOpts{
@@ -162,6 +204,9 @@ func PrepareMux(flags *env.Flags) *web.Mux {
 	// Put the RethinkDB session into the environment package
 	env.Rethink = rethinkSession
 
+	// Custom domains are verified using the system's resolver
+	env.Resolver = dns.NewNetResolver()
+
 	// Initialize factors
 	env.Factors = make(map[string]factor.Factor)
 	if flags.YubiCloudID != "" {
@@ -177,6 +222,17 @@ func PrepareMux(flags *env.Flags) *web.Mux {
 	authenticator := factor.NewAuthenticator(6)
 	env.Factors[authenticator.Type()] = authenticator
 
+	webAuthn := factor.NewWebAuthn(&factor.WebAuthnOpts{
+		RPID:   flags.WebAuthnRPID,
+		Origin: flags.WebAuthnOrigin,
+		Cache:  env.Cache,
+	})
+	env.Factors[webAuthn.Type()] = webAuthn
+
+	// Local OTP validation doesn't depend on YubiCloud
+	yubiKey := factor.NewYubiKey()
+	env.Factors[yubiKey.Type()] = yubiKey
+
 	// Initialize the tables
 	env.Tokens = &db.TokensTable{
 		RethinkCRUD: db.NewCRUDTable(
@@ -184,7 +240,7 @@ func PrepareMux(flags *env.Flags) *web.Mux {
 			rethinkOpts.Database,
 			"tokens",
 		),
-		Cache: redis,
+		Cache: env.Cache,
 	}
 	env.Accounts = &db.AccountsTable{
 		RethinkCRUD: db.NewCRUDTable(
@@ -222,6 +278,18 @@ func PrepareMux(flags *env.Flags) *web.Mux {
 			"reservations",
 		),
 	}
+	env.Domains = &db.DomainsTable{
+		RethinkCRUD: db.NewCRUDTable(
+			rethinkSession,
+			rethinkOpts.Database,
+			"domains",
+		),
+		Claims: db.NewCRUDTable(
+			rethinkSession,
+			rethinkOpts.Database,
+			"domain_claims",
+		),
+	}
 	env.Emails = &db.EmailsTable{
 		RethinkCRUD: db.NewCRUDTable(
 			rethinkSession,
@@ -235,6 +303,7 @@ func PrepareMux(flags *env.Flags) *web.Mux {
 			rethinkOpts.Database,
 			"threads",
 		),
+		Emails: env.Emails,
 	}
 	env.Labels = &db.LabelsTable{
 		RethinkCRUD: db.NewCRUDTable(
@@ -242,9 +311,11 @@ func PrepareMux(flags *env.Flags) *web.Mux {
 			rethinkOpts.Database,
 			"labels",
 		),
-		Emails: env.Emails,
-		//Cache:  redis,
+		Emails:  env.Emails,
+		Threads: env.Threads,
+		Cache:   env.Cache,
 	}
+	env.Threads.Labels = env.Labels
 	env.Files = &db.FilesTable{
 		Emails: env.Emails,
 		RethinkCRUD: db.NewCRUDTable(
@@ -252,8 +323,91 @@ func PrepareMux(flags *env.Flags) *web.Mux {
 			rethinkOpts.Database,
 			"files",
 		),
+		Blobs: blobs,
+	}
+	env.Uploads = &db.UploadsTable{
+		RethinkCRUD: db.NewCRUDTable(
+			rethinkSession,
+			rethinkOpts.Database,
+			"uploads",
+		),
+		Blobs: blobs,
+	}
+	env.Audit = &db.AuditTable{
+		RethinkCRUD: db.NewCRUDTable(
+			rethinkSession,
+			rethinkOpts.Database,
+			"audit",
+		),
+	}
+	env.Votes = &db.VotesTable{
+		RethinkCRUD: db.NewCRUDTable(
+			rethinkSession,
+			rethinkOpts.Database,
+			"votes",
+		),
+	}
+	env.Keys.Votes = env.Votes
+
+	// Finish account deletions interrupted by a crash
+	go routes.ResumeAccountDeletions()
+
+	// Remove abandoned uploads together with their chunks
+	go routes.PruneUploads()
+
+	// Remove audit events older than the retention period
+	if flags.AuditRetention > 0 {
+		go routes.PruneAuditLog(time.Duration(flags.AuditRetention) * 24 * time.Hour)
 	}
 
+	// Move file payloads stored before content addressing into the blob store
+	go func() {
+		migrated, err := env.Files.MigratePayloads()
+		if err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("Unable to migrate file payloads")
+		}
+
+		if migrated > 0 {
+			env.Log.WithFields(logrus.Fields{
+				"count": migrated,
+			}).Info("Migrated file payloads")
+		}
+	}()
+
+	// Set up the event bus used to notify the WebSocket sessions
+	env.Events = events.NewBus()
+	env.Events.OnError = func(session events.Session, err error) {
+		fields := logrus.Fields{
+			"error": err.Error(),
+		}
+		if session != nil {
+			fields["id"] = session.ID()
+		}
+
+		env.Log.WithFields(fields).Warn("Error while writing to a WebSocket")
+	}
+
+	// Share the subscriptions with other API instances
+	transport, err := events.NewRedisTransport(&events.RedisTransportOpts{
+		Address:  flags.RedisAddress,
+		Database: flags.RedisDatabase,
+		Password: flags.RedisPassword,
+	})
+	if err != nil {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Fatal("Unable to connect to the redis server")
+	}
+	transport.OnError = func(err error) {
+		env.Log.WithFields(logrus.Fields{
+			"error": err.Error(),
+			"node":  transport.Node(),
+		}).Warn("Lost the connection to the events channel")
+	}
+	env.Events.SetTransport(transport)
+
 	// Create a producer
 	producer, err := nsq.NewProducer(flags.NSQdAddress, nsq.NewConfig())
 	if err != nil {
@@ -268,16 +422,12 @@ func PrepareMux(flags *env.Flags) *web.Mux {
 
 	env.Producer = producer
 
-	// Get the hostname
-	hostname, err := os.Hostname()
-	if err != nil {
-		env.Log.WithFields(logrus.Fields{
-			"error": err.Error(),
-		}).Fatal("Unable to get the hostname")
-	}
+	// All instances share the consumer channels, so that every message is handled
+	// once. Events are routed to the instance holding the session by the bus.
+	const channel = "api"
 
 	// Create a delivery consumer
-	deliveryConsumer, err := nsq.NewConsumer("email_delivery", hostname, nsq.NewConfig())
+	deliveryConsumer, err := nsq.NewConsumer("email_delivery", channel, nsq.NewConfig())
 	if err != nil {
 		env.Log.WithFields(logrus.Fields{
 			"error": err.Error(),
@@ -311,62 +461,34 @@ func PrepareMux(flags *env.Flags) *web.Mux {
 			rc.Capture(packet, nil)
 		}()
 
-		var msg *struct {
-			ID    string `json:"id"`
-			Owner string `json:"owner"`
-		}
-
+		var msg *deliveryMessage
 		if err := json.Unmarshal(m.Body, &msg); err != nil {
 			return err
 		}
 
-		// Check if we are handling owner's session
-		if _, ok := sessions[msg.Owner]; !ok {
-			return nil
-		}
-
-		if len(sessions[msg.Owner]) == 0 {
-			return nil
+		// Threads were modified by another service, so the cached counts are stale
+		if err := env.Labels.InvalidateCounts(msg.Owner); err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+				"owner": msg.Owner,
+			}).Error("Unable to invalidate label counts")
 		}
 
-		// Resolve the email
-		email, err := env.Emails.GetEmail(msg.ID)
-		if err != nil {
+		// The mailer doesn't need the attachments anymore
+		if err := releaseAttachments(msg.ID); err != nil {
 			env.Log.WithFields(logrus.Fields{
 				"error": err.Error(),
 				"id":    msg.ID,
-			}).Error("Unable to resolve an email from queue")
-			return nil
+			}).Error("Unable to release attachments of a sent email")
 		}
 
-		// Resolve the thread
-		thread, err := env.Threads.GetThread(email.Thread)
-		if err != nil {
-			env.Log.WithFields(logrus.Fields{
-				"error":  err.Error(),
-				"id":     msg.ID,
-				"thread": email.Thread,
-			}).Error("Unable to resolve a thread from queue")
+		// Resolution errors are logged by resolveDelivery
+		thread, err := routeDelivery(env.Events, msg, resolveDelivery)
+		if err != nil || thread == nil {
 			return nil
 		}
 
-		// Send notifications to subscribers
-		for _, session := range sessions[msg.Owner] {
-			result, _ := json.Marshal(map[string]interface{}{
-				"type":   "delivery",
-				"id":     msg.ID,
-				"name":   email.Name,
-				"thread": email.Thread,
-				"labels": thread.Labels,
-			})
-			err = session.Send(string(result))
-			if err != nil {
-				env.Log.WithFields(logrus.Fields{
-					"id":    session.ID(),
-					"error": err.Error(),
-				}).Warn("Error while writing to a WebSocket")
-			}
-		}
+		go routes.PublishLabelCounts(msg.Owner, thread.Labels...)
 
 		return nil
 	}), 10)
@@ -378,7 +500,7 @@ func PrepareMux(flags *env.Flags) *web.Mux {
 	}
 
 	// Create a receipt consumer
-	receiptConsumer, err := nsq.NewConsumer("email_receipt", hostname, nsq.NewConfig())
+	receiptConsumer, err := nsq.NewConsumer("email_receipt", channel, nsq.NewConfig())
 	if err != nil {
 		env.Log.WithFields(logrus.Fields{
 			"error": err.Error(),
@@ -415,18 +537,33 @@ func PrepareMux(flags *env.Flags) *web.Mux {
 		var msg *struct {
 			ID    string `json:"id"`
 			Owner string `json:"owner"`
+
+			// Recipient is the envelope recipient the email was delivered to
+			Recipient string `json:"recipient"`
 		}
 
 		if err := json.Unmarshal(m.Body, &msg); err != nil {
 			return err
 		}
 
-		// Check if we are handling owner's session
-		if _, ok := sessions[msg.Owner]; !ok {
-			return nil
+		// Threads were modified by another service, so the cached counts are stale
+		if err := env.Labels.InvalidateCounts(msg.Owner); err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+				"owner": msg.Owner,
+			}).Error("Unable to invalidate label counts")
 		}
 
-		if len(sessions[msg.Owner]) == 0 {
+		// Label emails sent to plus-addresses with their tags
+		if err := routes.LabelTaggedEmail(msg.Owner, msg.ID, msg.Recipient); err != nil {
+			env.Log.WithFields(logrus.Fields{
+				"error": err.Error(),
+				"id":    msg.ID,
+			}).Error("Unable to label a tagged email")
+		}
+
+		// Check if we are handling owner's session
+		if !env.Events.Subscribed(msg.Owner) {
 			return nil
 		}
 
@@ -452,22 +589,14 @@ func PrepareMux(flags *env.Flags) *web.Mux {
 		}
 
 		// Send notifications to subscribers
-		for _, session := range sessions[msg.Owner] {
-			result, _ := json.Marshal(map[string]interface{}{
-				"type":   "receipt",
-				"id":     msg.ID,
-				"name":   email.Name,
-				"thread": email.Thread,
-				"labels": thread.Labels,
-			})
-			err = session.Send(string(result))
-			if err != nil {
-				env.Log.WithFields(logrus.Fields{
-					"id":    session.ID(),
-					"error": err.Error(),
-				}).Warn("Error while writing to a WebSocket")
-			}
-		}
+		env.Events.Send(msg.Owner, map[string]interface{}{
+			"type":   "receipt",
+			"id":     msg.ID,
+			"name":   email.Name,
+			"thread": email.Thread,
+			"labels": thread.Labels,
+		})
+		go routes.PublishLabelCounts(msg.Owner, thread.Labels...)
 
 		return nil
 	}), 10)
@@ -547,77 +676,170 @@ func PrepareMux(flags *env.Flags) *web.Mux {
 	auth := web.New()
 	auth.Use(routes.AuthMiddleware)
 
+	// scoped registers a route that can also be accessed using API tokens
+	// granted the scope
+	scoped := func(method string, pattern string, scope string, handler interface{}) {
+		routes.Scopes.Add(method, pattern, scope)
+
+		switch method {
+		case "GET":
+			auth.Get(pattern, handler)
+		case "POST":
+			auth.Post(pattern, handler)
+		case "PUT":
+			auth.Put(pattern, handler)
+		case "DELETE":
+			auth.Delete(pattern, handler)
+		}
+	}
+
+	// Set up an admin mux
+	admin := web.New()
+	admin.Use(routes.AuthMiddleware)
+	admin.Use(routes.AdminMiddleware)
+
 	// Index route
 	mux.Get("/", routes.Hello)
 
 	// Accounts
-	auth.Get("/accounts", routes.AccountsList)
 	mux.Post("/accounts", routes.AccountsCreate)
-	auth.Get("/accounts/:id", routes.AccountsGet)
+	mux.Get("/accounts/availability", routes.AccountsAvailability)
+	mux.Post("/accounts/recover", routes.AccountsRecover)
+	mux.Post("/accounts/recover/confirm", routes.AccountsRecoverConfirm)
+	scoped("GET", "/accounts/:id", "account:read", routes.AccountsGet)
 	auth.Put("/accounts/:id", routes.AccountsUpdate)
 	auth.Delete("/accounts/:id", routes.AccountsDelete)
 	auth.Post("/accounts/:id/wipe-data", routes.AccountsWipeData)
 	auth.Post("/accounts/:id/start-onboarding", routes.AccountsStartOnboarding)
+	auth.Get("/accounts/:id/login-attempts", routes.AccountsLoginAttempts)
+	auth.Get("/accounts/:id/audit", routes.AccountsAudit)
+	auth.Post("/accounts/:id/authenticator", routes.AuthenticatorEnroll)
+	auth.Put("/accounts/:id/authenticator", routes.AuthenticatorConfirm)
+	auth.Delete("/accounts/:id/authenticator", routes.AuthenticatorDisable)
+	auth.Post("/accounts/:id/authenticator/recovery-codes", routes.AuthenticatorRecoveryCodes)
+	auth.Get("/accounts/:id/webauthn", routes.WebAuthnList)
+	auth.Post("/accounts/:id/webauthn", routes.WebAuthnRegister)
+	auth.Put("/accounts/:id/webauthn", routes.WebAuthnConfirm)
+	auth.Delete("/accounts/:id/webauthn/:credential", routes.WebAuthnDelete)
+	auth.Get("/accounts/:id/yubikeys", routes.YubiKeysList)
+	auth.Post("/accounts/:id/yubikeys", routes.YubiKeysCreate)
+	auth.Delete("/accounts/:id/yubikeys/:public_id", routes.YubiKeysDelete)
 
 	// Addresses
-	auth.Get("/addresses", routes.AddressesList)
+	scoped("GET", "/addresses", "account:read", routes.AddressesList)
+	auth.Post("/addresses", routes.AddressesCreate)
+	auth.Put("/addresses/:id", routes.AddressesUpdate)
+	auth.Delete("/addresses/:id", routes.AddressesDelete)
+
+	// Domains
+	auth.Get("/domains", routes.DomainsList)
+	auth.Post("/domains", routes.DomainsCreate)
+	auth.Get("/domains/:id", routes.DomainsGet)
+	auth.Post("/domains/:id/verify", routes.DomainsVerify)
+	auth.Delete("/domains/:id", routes.DomainsDelete)
 
 	// Avatars
 	mux.Get(regexp.MustCompile(`/avatars/(?P<hash>[\S\s]*?)\.(?P<ext>svg|png)(?:[\S\s]*?)$`), routes.Avatars)
 	//mux.Get("/avatars/:hash.:ext", routes.Avatars)
 
 	// Files
-	auth.Get("/files", routes.FilesList)
-	auth.Post("/files", routes.FilesCreate)
-	auth.Get("/files/:id", routes.FilesGet)
-	auth.Put("/files/:id", routes.FilesUpdate)
-	auth.Delete("/files/:id", routes.FilesDelete)
+	scoped("GET", "/files", "files:read", routes.FilesList)
+	scoped("POST", "/files", "files:write", routes.FilesCreate)
+	scoped("GET", "/files/:id", "files:read", routes.FilesGet)
+	scoped("PUT", "/files/:id", "files:write", routes.FilesUpdate)
+	scoped("DELETE", "/files/:id", "files:write", routes.FilesDelete)
+
+	// Uploads
+	scoped("POST", "/uploads", "files:write", routes.UploadsCreate)
+	scoped("GET", "/uploads/:id", "files:write", routes.UploadsGet)
+	scoped("PUT", "/uploads/:id/chunks/:n", "files:write", routes.UploadsPutChunk)
+	scoped("POST", "/uploads/:id/finalize", "files:write", routes.UploadsFinalize)
+	scoped("DELETE", "/uploads/:id", "files:write", routes.UploadsDelete)
 
 	// Tokens
-	auth.Get("/tokens", routes.TokensGet)
+	auth.Get("/tokens", routes.TokensList)
 	auth.Get("/tokens/:id", routes.TokensGet)
+	auth.Put("/tokens/:id", routes.TokensUpdate)
 	mux.Post("/tokens", routes.TokensCreate)
 	auth.Delete("/tokens", routes.TokensDelete)
 	auth.Delete("/tokens/:id", routes.TokensDelete)
 
+	// Invites
+	auth.Get("/invites", routes.InvitesList)
+	auth.Post("/invites", routes.InvitesCreate)
+	auth.Delete("/invites/:id", routes.InvitesDelete)
+
+	// API tokens
+	auth.Get("/api-tokens", routes.APITokensList)
+	auth.Post("/api-tokens", routes.APITokensCreate)
+	auth.Delete("/api-tokens/:id", routes.APITokensDelete)
+
 	// Threads
-	auth.Get("/threads", routes.ThreadsList)
-	auth.Get("/threads/:id", routes.ThreadsGet)
-	auth.Put("/threads/:id", routes.ThreadsUpdate)
-	auth.Delete("/threads/:id", routes.ThreadsDelete)
+	scoped("GET", "/threads", "emails:read", routes.ThreadsList)
+	scoped("GET", "/threads/search", "emails:read", routes.ThreadsSearch)
+	scoped("GET", "/threads/:id", "emails:read", routes.ThreadsGet)
+	scoped("PUT", "/threads/:id", "emails:write", routes.ThreadsUpdate)
+	scoped("DELETE", "/threads/:id", "emails:write", routes.ThreadsDelete)
 
 	// Emails
-	auth.Get("/emails", routes.EmailsList)
-	auth.Post("/emails", routes.EmailsCreate)
-	auth.Get("/emails/:id", routes.EmailsGet)
-	auth.Delete("/emails/:id", routes.EmailsDelete)
+	scoped("GET", "/emails", "emails:read", routes.EmailsList)
+	scoped("POST", "/emails", "emails:send", routes.EmailsCreate)
+	scoped("GET", "/emails/search", "emails:read", routes.EmailsSearch)
+	scoped("GET", "/emails/:id", "emails:read", routes.EmailsGet)
+	scoped("DELETE", "/emails/:id", "emails:write", routes.EmailsDelete)
 
 	// Labels
-	auth.Get("/labels", routes.LabelsList)
-	auth.Post("/labels", routes.LabelsCreate)
-	auth.Get("/labels/:id", routes.LabelsGet)
-	auth.Put("/labels/:id", routes.LabelsUpdate)
-	auth.Delete("/labels/:id", routes.LabelsDelete)
+	scoped("GET", "/labels", "emails:read", routes.LabelsList)
+	scoped("POST", "/labels", "emails:write", routes.LabelsCreate)
+	scoped("GET", "/labels/:id", "emails:read", routes.LabelsGet)
+	scoped("PUT", "/labels/:id", "emails:write", routes.LabelsUpdate)
+	scoped("DELETE", "/labels/:id", "emails:write", routes.LabelsDelete)
 
 	// Contacts
-	auth.Get("/contacts", routes.ContactsList)
-	auth.Post("/contacts", routes.ContactsCreate)
-	auth.Get("/contacts/:id", routes.ContactsGet)
-	auth.Put("/contacts/:id", routes.ContactsUpdate)
-	auth.Delete("/contacts/:id", routes.ContactsDelete)
+	scoped("GET", "/contacts", "contacts:read", routes.ContactsList)
+	scoped("POST", "/contacts", "contacts:write", routes.ContactsCreate)
+	scoped("GET", "/contacts/:id", "contacts:read", routes.ContactsGet)
+	scoped("PUT", "/contacts/:id", "contacts:write", routes.ContactsUpdate)
+	scoped("DELETE", "/contacts/:id", "contacts:write", routes.ContactsDelete)
 
 	// Keys
 	mux.Get("/keys", routes.KeysList)
-	auth.Post("/keys", routes.KeysCreate)
+	scoped("POST", "/keys", "keys:write", routes.KeysCreate)
 	mux.Get("/keys/:id", routes.KeysGet)
-	auth.Post("/keys/:id/vote", routes.KeysVote)
+	scoped("POST", "/keys/:id/vote", "keys:write", routes.KeysVote)
+
+	// Keyservers
+	mux.Get("/pks/lookup", routes.PKSLookup)
+	mux.Get("/.well-known/openpgpkey/policy", routes.WKDPolicy)
+	mux.Get("/.well-known/openpgpkey/hu/:hash", routes.WKDLookup)
+	mux.Get("/.well-known/openpgpkey/:domain/policy", routes.WKDPolicy)
+	mux.Get("/.well-known/openpgpkey/:domain/hu/:hash", routes.WKDLookup)
+
+	// Admin
+	admin.Get("/admin/accounts", routes.AccountsList)
+	admin.Put("/admin/accounts/:id", routes.AdminAccountsUpdate)
+	admin.Post("/admin/accounts/:id/logout", routes.AdminAccountsLogout)
+	admin.Get("/admin/accounts/:id/usage", routes.AdminAccountsUsage)
+	admin.Get("/admin/audit", routes.AdminAuditList)
+	admin.Get("/admin/reservations", routes.AdminReservationsList)
+	admin.Post("/admin/reservations", routes.AdminReservationsCreate)
+	admin.Delete("/admin/reservations/:name", routes.AdminReservationsDelete)
 
 	// Headers proxy
 	mux.Get("/headers", func(w http.ResponseWriter, r *http.Request) {
 		utils.JSONResponse(w, 200, r.Header)
 	})
 
-	mux.Handle("/ws/*", sockjs.NewHandler("/ws", sockjs.DefaultOptions, func(session sockjs.Session) {
+	sessions := newSessionAddresses("/ws")
+	mux.Handle("/ws/*", sessions.Handler(sockjs.NewHandler("/ws", sockjs.DefaultOptions, func(session sockjs.Session) {
+		defer sessions.Delete(session.ID())
+
+		// Tunneled requests couldn't be attributed to a client without its address
+		if sessions.Open(session.ID()) == "" {
+			session.Close(3000, "Unable to determine the client's address")
+			return
+		}
+
 		var subscribed string
 
 		// A new goroutine seems to be spawned for each new session
@@ -686,7 +908,7 @@ func PrepareMux(flags *env.Flags) *web.Mux {
 
 				// Check the token in database
 				token, err := env.Tokens.GetToken(input.Token)
-				if err != nil {
+				if err != nil || token.Type != "auth" || token.Expired() {
 					// Return an error response
 					resp, _ := json.Marshal(map[string]interface{}{
 						"type":  "error",
@@ -704,19 +926,11 @@ func PrepareMux(flags *env.Flags) *web.Mux {
 				}
 
 				// Do the actual subscription
-				subscribed = token.Owner
-				sessionsLock.Lock()
-
-				// Sessions map already contains this owner
-				if _, ok := sessions[token.Owner]; ok {
-					sessions[token.Owner] = append(sessions[token.Owner], session)
-				} else {
-					// We have to allocate a new slice
-					sessions[token.Owner] = []sockjs.Session{session}
+				if subscribed != "" {
+					env.Events.Unsubscribe(subscribed, session)
 				}
-
-				// Unlock the map write
-				sessionsLock.Unlock()
+				subscribed = token.Owner
+				env.Events.Subscribe(subscribed, session)
 
 				// Return a response
 				resp, _ := json.Marshal(map[string]interface{}{
@@ -744,86 +958,11 @@ func PrepareMux(flags *env.Flags) *web.Mux {
 						}).Warn("Error while writing to a WebSocket")
 						break
 					}
-				}
-
-				sessionsLock.Lock()
-
-				if _, ok := sessions[subscribed]; !ok {
-					// Return a response
-					resp, _ := json.Marshal(map[string]interface{}{
-						"type": "unsubscribed",
-					})
-					err := session.Send(string(resp))
-					if err != nil {
-						env.Log.WithFields(logrus.Fields{
-							"id":    session.ID(),
-							"error": err.Error(),
-						}).Warn("Error while writing to a WebSocket")
-						sessionsLock.Unlock()
-						subscribed = ""
-						break
-					}
-					sessionsLock.Unlock()
-					subscribed = ""
-					continue
-				}
-
-				if len(sessions[subscribed]) == 1 {
-					delete(sessions, subscribed)
-
-					// Return a response
-					resp, _ := json.Marshal(map[string]interface{}{
-						"type": "unsubscribed",
-					})
-					err := session.Send(string(resp))
-					if err != nil {
-						env.Log.WithFields(logrus.Fields{
-							"id":    session.ID(),
-							"error": err.Error(),
-						}).Warn("Error while writing to a WebSocket")
-						sessionsLock.Unlock()
-						subscribed = ""
-						break
-					}
-					sessionsLock.Unlock()
-					subscribed = ""
-					continue
-				}
-
-				// Find the session
-				index := -1
-				for i, session2 := range sessions[subscribed] {
-					if session == session2 {
-						index = i
-						break
-					}
-				}
-
-				// We didn't find anything
-				if index == -1 {
-					// Return a response
-					resp, _ := json.Marshal(map[string]interface{}{
-						"type": "unsubscribed",
-					})
-					err := session.Send(string(resp))
-					if err != nil {
-						env.Log.WithFields(logrus.Fields{
-							"id":    session.ID(),
-							"error": err.Error(),
-						}).Warn("Error while writing to a WebSocket")
-						sessionsLock.Unlock()
-						subscribed = ""
-						break
-					}
-					sessionsLock.Unlock()
-					subscribed = ""
 					continue
 				}
 
-				// We found it, so we are supposed to slice it
-				sessions[subscribed][index] = sessions[subscribed][len(sessions[subscribed])-1]
-				sessions[subscribed][len(sessions[subscribed])-1] = nil
-				sessions[subscribed] = sessions[subscribed][:len(sessions[subscribed])-1]
+				env.Events.Unsubscribe(subscribed, session)
+				subscribed = ""
 
 				// Return a response
 				resp, _ := json.Marshal(map[string]interface{}{
@@ -835,12 +974,8 @@ func PrepareMux(flags *env.Flags) *web.Mux {
 						"id":    session.ID(),
 						"error": err.Error(),
 					}).Warn("Error while writing to a WebSocket")
-					sessionsLock.Unlock()
-					subscribed = ""
 					break
 				}
-				sessionsLock.Unlock()
-				subscribed = ""
 			} else if input.Type == "request" {
 				// Perform the request
 				w := httptest.NewRecorder()
@@ -875,6 +1010,10 @@ func PrepareMux(flags *env.Flags) *web.Mux {
 					r.Header.Set(key, value)
 				}
 
+				// The request comes from the session's client, not from a proxy
+				r.Header.Del("X-Forwarded-For")
+				r.RemoteAddr = sessions.Get(session.ID())
+
 				mux.ServeHTTP(w, r)
 
 				// Return the final response
@@ -896,49 +1035,14 @@ func PrepareMux(flags *env.Flags) *web.Mux {
 			}
 		}
 
-		// We have to clear the subscription here too. TODO: make the code shorter
-		if subscribed == "" {
-			return
-		}
-
-		sessionsLock.Lock()
-
-		if _, ok := sessions[subscribed]; !ok {
-			sessionsLock.Unlock()
-			return
-		}
-
-		if len(sessions[subscribed]) == 1 {
-			delete(sessions, subscribed)
-			sessionsLock.Unlock()
-			return
-		}
-
-		// Find the session
-		index := -1
-		for i, session2 := range sessions[subscribed] {
-			if session == session2 {
-				index = i
-				break
-			}
-		}
-
-		// We didn't find anything
-		if index == -1 {
-			sessionsLock.Unlock()
-			return
+		// We have to clear the subscription here too
+		if subscribed != "" {
+			env.Events.Unsubscribe(subscribed, session)
 		}
-
-		// We found it, so we are supposed to slice it
-		sessions[subscribed][index] = sessions[subscribed][len(sessions[subscribed])-1]
-		sessions[subscribed][len(sessions[subscribed])-1] = nil
-		sessions[subscribed] = sessions[subscribed][:len(sessions[subscribed])-1]
-
-		// Unlock the mutex
-		sessionsLock.Unlock()
-	}))
+	})))
 
 	// Merge the muxes
+	mux.Handle("/admin/*", admin)
 	mux.Handle("/*", auth)
 
 	// Compile the routes
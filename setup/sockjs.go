@@ -0,0 +1,154 @@
+package setup
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lavab/api/utils"
+)
+
+const (
+	// sessionOpenTimeout is how long an address is kept for a session that
+	// the SockJS handler didn't open, eg. because the request was invalid
+	sessionOpenTimeout = time.Minute
+
+	// maxPendingSessions limits the number of addresses of unopened sessions
+	maxPendingSessions = 10000
+)
+
+// sessionTransports lists SockJS transports that open sessions and their methods
+var sessionTransports = map[string]string{
+	"xhr":           "POST",
+	"xhr_streaming": "POST",
+	"eventsource":   "GET",
+	"htmlfile":      "GET",
+	"jsonp":         "GET",
+	"websocket":     "GET",
+}
+
+// sessionAddress is the address of a session's client
+type sessionAddress struct {
+	address string
+	opened  bool
+	created time.Time
+}
+
+// sessionAddresses remembers the address of the client that opened each
+// SockJS session. Requests tunneled through a session are attributed to it,
+// as headers of the messages are controlled by the client.
+type sessionAddresses struct {
+	sync.Mutex
+	prefix    string
+	addresses map[string]*sessionAddress
+	pending   int
+	pruned    time.Time
+}
+
+func newSessionAddresses(prefix string) *sessionAddresses {
+	return &sessionAddresses{
+		prefix:    prefix,
+		addresses: map[string]*sessionAddress{},
+	}
+}
+
+// Handler records addresses of requests passed to the SockJS handler. The
+// address is recorded before the request is handled, so that it's known once
+// the session is opened.
+func (s *sessionAddresses) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Session URLs are /prefix/server/session/transport
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, s.prefix+"/"), "/")
+		if len(parts) == 3 && parts[0] != "" && parts[1] != "" &&
+			!strings.Contains(parts[0]+parts[1], ".") &&
+			sessionTransports[parts[2]] == r.Method {
+			s.record(parts[1], utils.RemoteIP(r))
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// record stores the address of a session that isn't known yet
+func (s *sessionAddresses) record(id string, address string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.addresses[id]; ok {
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(s.pruned) > sessionOpenTimeout || s.pending >= maxPendingSessions {
+		s.prune(now)
+	}
+
+	// Sessions without an address are closed when they're opened
+	if s.pending >= maxPendingSessions {
+		return
+	}
+
+	s.addresses[id] = &sessionAddress{
+		address: address,
+		created: now,
+	}
+	s.pending++
+}
+
+// prune removes addresses of sessions that weren't opened in time
+func (s *sessionAddresses) prune(now time.Time) {
+	for id, session := range s.addresses {
+		if !session.opened && now.Sub(session.created) > sessionOpenTimeout {
+			delete(s.addresses, id)
+			s.pending--
+		}
+	}
+
+	s.pruned = now
+}
+
+// Open marks the session as opened and returns its address. The address is
+// empty if it wasn't recorded.
+func (s *sessionAddresses) Open(id string) string {
+	s.Lock()
+	defer s.Unlock()
+
+	session, ok := s.addresses[id]
+	if !ok {
+		return ""
+	}
+
+	if !session.opened {
+		session.opened = true
+		s.pending--
+	}
+
+	return session.address
+}
+
+// Get returns the address of the session's client
+func (s *sessionAddresses) Get(id string) string {
+	s.Lock()
+	defer s.Unlock()
+
+	if session, ok := s.addresses[id]; ok {
+		return session.address
+	}
+
+	return ""
+}
+
+// Delete forgets the session once it's closed
+func (s *sessionAddresses) Delete(id string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if session, ok := s.addresses[id]; ok {
+		if !session.opened {
+			s.pending--
+		}
+
+		delete(s.addresses, id)
+	}
+}
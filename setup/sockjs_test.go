@@ -0,0 +1,114 @@
+package setup
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSessionAddresses(t *testing.T) {
+	sessions := newSessionAddresses("/ws")
+	handler := sessions.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func(path string, remote string, forwarded string) {
+		method := "POST"
+		if strings.HasSuffix(path, "/websocket") {
+			method = "GET"
+		}
+
+		r, err := http.NewRequest(method, "http://api.lavaboom.io"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RemoteAddr = remote
+		r.Header.Set("X-Forwarded-For", forwarded)
+
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	// Forwarded addresses of untrusted clients are ignored
+	request("/ws/000/session/xhr", "203.0.113.7:4321", "198.51.100.1")
+	if address := sessions.Get("session"); address != "203.0.113.7" {
+		t.Fatalf("invalid address %s", address)
+	}
+
+	// Later requests can't change the address of an open session
+	request("/ws/000/session/xhr", "198.51.100.2:4321", "")
+	request("/ws/000/other/xhr_send", "198.51.100.2:4321", "")
+	request("/ws/info", "198.51.100.2:4321", "")
+	if address := sessions.Get("session"); address != "203.0.113.7" {
+		t.Fatalf("invalid address %s", address)
+	}
+	if address := sessions.Get("other"); address != "" {
+		t.Fatalf("sending transport created address %s", address)
+	}
+
+	// Paths that can't open a session aren't recorded
+	for _, path := range []string{
+		"/ws/000/invalid/unknown",
+		"/ws/000/invalid.id/xhr",
+		"/ws/000//xhr",
+		"/ws/000/invalid/xhr/more",
+		"/ws/websocket",
+	} {
+		request(path, "203.0.113.7:4321", "")
+	}
+	if len(sessions.addresses) != 1 || sessions.pending != 1 {
+		t.Fatalf("invalid sessions were recorded: %v", sessions.addresses)
+	}
+
+	if address := sessions.Open("session"); address != "203.0.113.7" {
+		t.Fatalf("opened session has address %s", address)
+	}
+	if address := sessions.Open("unknown"); address != "" {
+		t.Fatalf("unknown session has address %s", address)
+	}
+	if sessions.pending != 0 {
+		t.Fatalf("%d sessions are pending", sessions.pending)
+	}
+
+	request("/ws/000/websocket/websocket", "198.51.100.3:4321", "")
+	if address := sessions.Get("websocket"); address != "198.51.100.3" {
+		t.Fatalf("invalid address %s", address)
+	}
+
+	sessions.Delete("session")
+	sessions.Delete("websocket")
+	if address := sessions.Get("session"); address != "" {
+		t.Fatalf("address %s wasn't deleted", address)
+	}
+	if len(sessions.addresses) != 0 || sessions.pending != 0 {
+		t.Fatalf("sessions weren't deleted: %v (%d pending)", sessions.addresses, sessions.pending)
+	}
+}
+
+func TestSessionAddressesPrune(t *testing.T) {
+	sessions := newSessionAddresses("/ws")
+
+	for i := 0; i < maxPendingSessions; i++ {
+		sessions.record(strconv.Itoa(i), "203.0.113.7")
+	}
+
+	// Unopened sessions are limited
+	sessions.record("full", "203.0.113.7")
+	if address := sessions.Get("full"); address != "" {
+		t.Fatalf("session over the limit has address %s", address)
+	}
+	sessions.Open("0")
+
+	// Stale unopened sessions are removed, opened ones stay
+	for _, session := range sessions.addresses {
+		session.created = session.created.Add(-2 * sessionOpenTimeout)
+	}
+	sessions.pruned = sessions.pruned.Add(-2 * sessionOpenTimeout)
+
+	sessions.record("new", "198.51.100.1")
+	if len(sessions.addresses) != 2 || sessions.pending != 1 {
+		t.Fatalf("stale sessions weren't pruned: %d left, %d pending", len(sessions.addresses), sessions.pending)
+	}
+	if sessions.Get("0") != "203.0.113.7" || sessions.Get("new") != "198.51.100.1" {
+		t.Fatalf("invalid sessions were pruned: %v", sessions.addresses)
+	}
+}
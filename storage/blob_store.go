@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrNotFound is returned by Get if the requested blob does not exist
+var ErrNotFound = errors.New("Blob not found")
+
+// BlobStore is the basic interface for binary payload storage implementations
+type BlobStore interface {
+	Put(key string, data io.Reader) (int64, error)
+	Get(key string) (io.ReadCloser, error)
+	Delete(keys ...string) error
+	Exists(key string) (bool, error)
+}
+
+// multiReader reads blobs one after another, opening each of them only when
+// the previous one was fully read
+type multiReader struct {
+	store   BlobStore
+	keys    []string
+	current io.ReadCloser
+}
+
+// NewMultiReader returns a reader that concatenates blobs stored under keys
+func NewMultiReader(store BlobStore, keys ...string) io.ReadCloser {
+	return &multiReader{
+		store: store,
+		keys:  keys,
+	}
+}
+
+func (m *multiReader) Read(p []byte) (int, error) {
+	for {
+		// Open the next blob
+		if m.current == nil {
+			if len(m.keys) == 0 {
+				return 0, io.EOF
+			}
+
+			blob, err := m.store.Get(m.keys[0])
+			if err != nil {
+				return 0, err
+			}
+
+			m.current = blob
+			m.keys = m.keys[1:]
+		}
+
+		n, err := m.current.Read(p)
+		if err == io.EOF {
+			m.current.Close()
+			m.current = nil
+
+			if n == 0 {
+				continue
+			}
+
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+func (m *multiReader) Close() error {
+	if m.current == nil {
+		return nil
+	}
+
+	err := m.current.Close()
+	m.current = nil
+	return err
+}
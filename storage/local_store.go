@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrInvalidKey is returned if a key would escape the store's directory
+var ErrInvalidKey = errors.New("Invalid blob key")
+
+// LocalStore is an implementation of BlobStore that keeps blobs on a local disk
+type LocalStore struct {
+	path string
+}
+
+// LocalStoreOpts is used to pass options to NewLocalStore
+type LocalStoreOpts struct {
+	Path string
+}
+
+// NewLocalStore creates a new blob store in the passed directory
+func NewLocalStore(options *LocalStoreOpts) (*LocalStore, error) {
+	path, err := filepath.Abs(options.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+
+	return &LocalStore{
+		path: path,
+	}, nil
+}
+
+// filename converts a slash-separated key into a path inside the store
+func (l *LocalStore) filename(key string) (string, error) {
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", ErrInvalidKey
+		}
+	}
+
+	return filepath.Join(l.path, filepath.FromSlash(key)), nil
+}
+
+// Put writes data into a temporary file and then atomically moves it to key's path
+func (l *LocalStore) Put(key string, data io.Reader) (int64, error) {
+	name, err := l.filename(key)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return 0, err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := io.Copy(file, data)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return 0, err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return 0, err
+	}
+
+	if err := os.Rename(file.Name(), name); err != nil {
+		os.Remove(file.Name())
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// Get opens the blob for reading
+func (l *LocalStore) Get(key string) (io.ReadCloser, error) {
+	name, err := l.filename(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// Delete removes blobs, ignoring the ones that don't exist
+func (l *LocalStore) Delete(keys ...string) error {
+	for _, key := range keys {
+		name, err := l.filename(key)
+		if err != nil {
+			return err
+		}
+
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Exists performs a check whether a blob exists
+func (l *LocalStore) Exists(key string) (bool, error) {
+	name, err := l.filename(key)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := os.Stat(name); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
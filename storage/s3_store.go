@@ -0,0 +1,285 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Store is an implementation of BlobStore that uses an S3-compatible object
+// storage as a backend. Buckets are addressed using path-style URLs, so it works
+// with self-hosted services like MinIO too.
+type S3Store struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// S3StoreOpts is used to pass options to NewS3Store
+type S3StoreOpts struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+}
+
+// NewS3Store creates a new blob store with an S3 backend
+func NewS3Store(options *S3StoreOpts) (*S3Store, error) {
+	// Default values
+	if options.Endpoint == "" {
+		options.Endpoint = "https://s3.amazonaws.com"
+	}
+	if options.Region == "" {
+		options.Region = "us-east-1"
+	}
+	if options.Client == nil {
+		options.Client = &http.Client{
+			Timeout: 5 * time.Minute,
+		}
+	}
+
+	endpoint, err := url.Parse(options.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &S3Store{
+		endpoint:  endpoint,
+		region:    options.Region,
+		bucket:    options.Bucket,
+		accessKey: options.AccessKey,
+		secretKey: options.SecretKey,
+		client:    options.Client,
+	}
+
+	// Test the connection
+	resp, err := store.do("HEAD", "", nil, 0, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Unable to access bucket %s: %s", options.Bucket, resp.Status)
+	}
+
+	return store, nil
+}
+
+// Put spools data into a temporary file to calculate its length and hash and then uploads it
+func (s *S3Store) Put(key string, data io.Reader) (int64, error) {
+	file, err := ioutil.TempFile("", "s3-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), data)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := file.Seek(0, 0); err != nil {
+		return 0, err
+	}
+
+	resp, err := s.do("PUT", key, file, size, hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return 0, s.error(resp)
+	}
+
+	return size, nil
+}
+
+// Get opens the object for reading
+func (s *S3Store) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", key, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == 404 {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+
+	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
+		return nil, s.error(resp)
+	}
+
+	return resp.Body, nil
+}
+
+// Delete removes objects, ignoring the ones that don't exist
+func (s *S3Store) Delete(keys ...string) error {
+	for _, key := range keys {
+		resp, err := s.do("DELETE", key, nil, 0, emptyPayloadHash)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != 204 && resp.StatusCode != 200 && resp.StatusCode != 404 {
+			return s.error(resp)
+		}
+	}
+
+	return nil
+}
+
+// Exists performs a check whether an object exists
+func (s *S3Store) Exists(key string) (bool, error) {
+	resp, err := s.do("HEAD", key, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+		return true, nil
+	case 404:
+		return false, nil
+	default:
+		return false, s.error(resp)
+	}
+}
+
+// emptyPayloadHash is the SHA256 hash of an empty request body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// do performs a request signed using AWS Signature Version 4
+func (s *S3Store) do(method string, key string, body io.Reader, length int64, payloadHash string) (*http.Response, error) {
+	// Build the path-style URL
+	target := *s.endpoint
+	target.Path = strings.TrimRight(target.Path, "/") + "/" + s.bucket
+	if key != "" {
+		target.Path += "/" + key
+	}
+
+	req, err := http.NewRequest(method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = length
+
+	// Send the path escaped the same way as it's signed
+	req.URL.Opaque = "//" + req.URL.Host + s3EscapePath(req.URL.Path)
+
+	now := time.Now().UTC()
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	s.sign(req, now, payloadHash)
+
+	return s.client.Do(req)
+}
+
+// sign adds the Authorization header to the request
+func (s *S3Store) sign(req *http.Request, now time.Time, payloadHash string) {
+	date := now.Format("20060102")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+
+	// Canonical headers have to be sorted
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           req.Header.Get("X-Amz-Date"),
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		req.Header.Get("X-Amz-Date"),
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	// Derive the signing key
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey,
+		scope,
+		signedHeaders,
+		signature,
+	))
+}
+
+// error converts an unexpected response into an error
+func (s *S3Store) error(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("S3 request failed: %s - %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// s3EscapePath URI-encodes everything in the path but unreserved characters
+// and slashes, as required by the canonical request
+func s3EscapePath(path string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+
+	return buf.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -20,3 +20,14 @@ func NormalizeUsername(input string) string {
 func RemoveDots(input string) string {
 	return strings.Replace(input, ".", "", -1)
 }
+
+// SplitAddressTag splits a plus-addressed local part, eg. "john+news", into
+// the address and the tag. The tag is empty if there isn't one.
+func SplitAddressTag(input string) (string, string) {
+	parts := strings.SplitN(input, "+", 2)
+	if len(parts) == 1 {
+		return input, ""
+	}
+
+	return parts[0], parts[1]
+}
@@ -1,6 +1,15 @@
 package utils
 
-import "golang.org/x/crypto/openpgp/packet"
+import (
+	"crypto/sha1"
+	"encoding/base32"
+	"strings"
+
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// zbase32 is the encoding of Web Key Directory hashes
+var zbase32 = base32.NewEncoding("ybndrfg8ejkmcpqxot1uwisza345h769")
 
 // GetAlgorithmName returns algorithm's name depending on its ID
 func GetAlgorithmName(id packet.PublicKeyAlgorithm) string {
@@ -19,3 +28,11 @@ func GetAlgorithmName(id packet.PublicKeyAlgorithm) string {
 		return "unknown"
 	}
 }
+
+// WKDHash returns the Web Key Directory hash of an address' local part, ie.
+// the z-base-32 encoded SHA-1 of its lowercase version
+func WKDHash(local string) string {
+	sum := sha1.Sum([]byte(strings.ToLower(local)))
+	// z-base-32 has no padding, SHA-1 sums don't need any either way
+	return strings.TrimRight(zbase32.EncodeToString(sum[:]), "=")
+}
@@ -0,0 +1,24 @@
+package utils_test
+
+import (
+	"testing"
+
+	"github.com/lavab/api/utils"
+)
+
+func TestWKDHash(t *testing.T) {
+	cases := []struct {
+		local    string
+		expected string
+	}{
+		// The example of draft-koch-openpgp-webkey-service
+		{"joe.doe", "iy9q119eutrkn8s1mk4r39qejnbu3n5q"},
+		{"Joe.Doe", "iy9q119eutrkn8s1mk4r39qejnbu3n5q"},
+	}
+
+	for _, test := range cases {
+		if hash := utils.WKDHash(test.local); hash != test.expected {
+			t.Fatalf("%s: hash %s, expected %s", test.local, hash, test.expected)
+		}
+	}
+}
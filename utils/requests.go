@@ -3,9 +3,12 @@ package utils
 import (
 	"encoding/json"
 	"errors"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/schema"
@@ -88,3 +91,166 @@ func ParseRequest(r *http.Request, data interface{}) error {
 
 	return ErrInvalidContentType
 }
+
+// RemoteIP returns the address of the client. X-Forwarded-For is used only if
+// the request came from a trusted proxy, in which case the right-most address
+// not belonging to one is the client, as anything to the left of it could have
+// been sent by the client itself.
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !trustedProxy(host) {
+		return host
+	}
+
+	var addresses []string
+	for _, header := range r.Header["X-Forwarded-For"] {
+		addresses = append(addresses, strings.Split(header, ",")...)
+	}
+
+	for i := len(addresses) - 1; i >= 0; i-- {
+		address := strings.TrimSpace(addresses[i])
+
+		// Garbage can only come from a client, the last proxy is the best guess
+		if net.ParseIP(address) == nil {
+			return host
+		}
+
+		host = address
+		if !trustedProxy(host) {
+			return host
+		}
+	}
+
+	// All addresses belong to proxies, so the left-most one is the client
+	return host
+}
+
+// trustedProxy checks if the address belongs to one of env.TrustedProxies
+func trustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range env.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseNetworks parses a comma-separated list of IP addresses and CIDR ranges
+func ParseNetworks(input string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range strings.Split(input, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		// Single addresses are networks with a full mask
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, errors.New("Invalid IP address " + item)
+			}
+
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+
+			networks = append(networks, &net.IPNet{
+				IP:   ip,
+				Mask: net.CIDRMask(len(ip)*8, len(ip)*8),
+			})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// WriteJSONString streams r into w as a quoted JSON string without buffering
+// the whole input. Invalid UTF-8 is replaced with U+FFFD, like encoding/json does.
+func WriteJSONString(w io.Writer, r io.Reader) error {
+	const hex = "0123456789abcdef"
+
+	if _, err := io.WriteString(w, `"`); err != nil {
+		return err
+	}
+
+	var (
+		input   = make([]byte, 32*1024+utf8.UTFMax)
+		output  = make([]byte, 0, 6*len(input))
+		pending = 0
+	)
+	for {
+		// Bytes of a rune split between reads are carried over
+		n, err := r.Read(input[pending : len(input)-utf8.UTFMax+pending])
+		n += pending
+		pending = 0
+
+		output = output[:0]
+		for i := 0; i < n; {
+			c := input[i]
+			if c >= utf8.RuneSelf {
+				if err == nil && !utf8.FullRune(input[i:n]) {
+					pending = copy(input, input[i:n])
+					break
+				}
+
+				r, size := utf8.DecodeRune(input[i:n])
+				if r == utf8.RuneError && size == 1 {
+					output = append(output, `\ufffd`...)
+				} else {
+					output = append(output, input[i:i+size]...)
+				}
+				i += size
+				continue
+			}
+
+			switch {
+			case c == '"' || c == '\\':
+				output = append(output, '\\', c)
+			case c == '\n':
+				output = append(output, '\\', 'n')
+			case c == '\r':
+				output = append(output, '\\', 'r')
+			case c == '\t':
+				output = append(output, '\\', 't')
+			case c < 0x20:
+				output = append(output, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xF])
+			default:
+				output = append(output, c)
+			}
+			i++
+		}
+
+		if _, werr := w.Write(output); werr != nil {
+			return werr
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := io.WriteString(w, `"`)
+	return err
+}
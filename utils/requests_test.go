@@ -0,0 +1,120 @@
+package utils_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"unicode/utf8"
+
+	"github.com/lavab/api/env"
+	"github.com/lavab/api/utils"
+)
+
+func TestWriteJSONString(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		{"", ""},
+		{"plain text", "plain text"},
+		{"\"quoted\"\\\n\r\t\x00\x1f", "\"quoted\"\\\n\r\t\x00\x1f"},
+		{"zażółć gęślą jaźń ☃", "zażółć gęślą jaźń ☃"},
+		{"\x80\xff binary \xc3", "�� binary �"},
+		{"\xe2\x98 cut", "�� cut"},
+	}
+
+	for _, c := range cases {
+		// Reading a byte at a time splits runes between reads
+		for _, source := range []io.Reader{
+			strings.NewReader(c.input),
+			iotest.OneByteReader(strings.NewReader(c.input)),
+		} {
+			var buf bytes.Buffer
+			if err := utils.WriteJSONString(&buf, source); err != nil {
+				t.Fatal(err)
+			}
+
+			if !utf8.Valid(buf.Bytes()) {
+				t.Fatalf("invalid UTF-8 %q for %q", buf.String(), c.input)
+			}
+
+			var output string
+			if err := json.Unmarshal(buf.Bytes(), &output); err != nil {
+				t.Fatalf("invalid JSON %q for %q: %v", buf.String(), c.input, err)
+			}
+			if output != c.expected {
+				t.Fatalf("invalid output %q for %q, expected %q", output, c.input, c.expected)
+			}
+		}
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	proxies, err := utils.ParseNetworks("10.0.0.0/8, 192.0.2.1,2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env.TrustedProxies = proxies
+	defer func() {
+		env.TrustedProxies = nil
+	}()
+
+	cases := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		expected  string
+	}{
+		{"direct", "203.0.113.7:4321", nil, "203.0.113.7"},
+		{"direct with a header", "203.0.113.7:4321", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"without a port", "203.0.113.7", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"proxy", "10.1.2.3:80", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"single proxy address", "192.0.2.1:80", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"IPv6 proxy", "[2001:db8::1]:80", []string{"2001:db8:ffff::1"}, "2001:db8:ffff::1"},
+		{"forged by the client", "10.1.2.3:80", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"chained proxies", "10.1.2.3:80", []string{"1.2.3.4, 198.51.100.1, 192.0.2.1", "10.0.0.1"}, "198.51.100.1"},
+		{"only proxies", "10.1.2.3:80", []string{"10.0.0.2, 10.0.0.1"}, "10.0.0.2"},
+		{"garbage", "10.1.2.3:80", []string{"198.51.100.1, nonsense"}, "10.1.2.3"},
+		{"proxy without a header", "10.1.2.3:80", nil, "10.1.2.3"},
+	}
+
+	for _, test := range cases {
+		r := &http.Request{
+			RemoteAddr: test.remote,
+			Header:     http.Header{},
+		}
+		for _, header := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", header)
+		}
+
+		if ip := utils.RemoteIP(r); ip != test.expected {
+			t.Fatalf("%s: got %s, expected %s", test.name, ip, test.expected)
+		}
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := utils.ParseNetworks("")
+	if err != nil || len(networks) != 0 {
+		t.Fatalf("empty list parsed into %v (%v)", networks, err)
+	}
+
+	networks, err = utils.ParseNetworks("192.0.2.1, 10.0.0.0/8,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(networks) != 3 || networks[0].String() != "192.0.2.1/32" || networks[1].String() != "10.0.0.0/8" || networks[2].String() != "::1/128" {
+		t.Fatalf("invalid networks %v", networks)
+	}
+
+	for _, input := range []string{"192.0.2", "10.0.0.0/33", "proxy.local"} {
+		if _, err := utils.ParseNetworks(input); err == nil {
+			t.Fatalf("%s was parsed", input)
+		}
+	}
+}